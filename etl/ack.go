@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// Delivery Acknowledgments
+//////////////////////////////////////////////////
+
+// AckConfig keeps the IDs of the batches each sink acknowledged in the
+// state store, so a batch delivered once isn't sent again when it comes
+// back, such as a spill replayed after the original flush got through or
+// a dead letter replayed twice.
+type AckConfig struct {
+	Enabled bool     `yaml:"enabled" json:"enabled"`
+	TTL     Duration `yaml:"ttl" json:"ttl"` // how long acknowledgments are kept
+}
+
+func defaultAckConfig() AckConfig {
+	return AckConfig{
+		Enabled: true,
+		TTL:     Duration(7 * 24 * time.Hour),
+	}
+}
+
+func (a *AckConfig) validate() []error {
+	if a.Enabled && a.TTL <= 0 {
+		return []error{errors.New("load.acks.ttl must be > 0")}
+	}
+	return nil
+}
+
+// ackKey is the state store key of a batch acknowledged by a sink. Batch
+// IDs are content hashes, so the same batch has the same key in every run.
+func ackKey(sink, batchID string) string {
+	return "ack/" + sink + "/" + batchID
+}
+
+// acknowledged reports whether the sink already acknowledged the batch.
+func acknowledged(sink, batchID string) bool {
+	return cfg.Load.Acks.Enabled && state != nil && state.HasKey(ackKey(sink, batchID))
+}
+
+// acknowledge records that the sink took the whole batch. A failure to
+// record it only costs a possible duplicate, so it is logged and ignored.
+func acknowledge(sink, batchID string) {
+	if !cfg.Load.Acks.Enabled || state == nil {
+		return
+	}
+	if err := state.RememberKeys([]string{ackKey(sink, batchID)}); err != nil {
+		slog.Error("Failed to record batch acknowledgment", "component", "acks", "sink", sink, "batch_id", batchID, "error", err)
+	}
+}
+
+// pruneAcks drops acknowledgments older than load.acks.ttl before a run.
+func pruneAcks() {
+	if !cfg.Load.Acks.Enabled {
+		return
+	}
+	removed, err := state.ForgetKeysBefore(time.Now().Add(-cfg.Load.Acks.TTL.Std()))
+	if err != nil {
+		slog.Error("Error pruning batch acknowledgments", "component", "acks", "error", err)
+		return
+	}
+	if removed > 0 {
+		slog.Info("Pruned batch acknowledgments", "component", "acks", "removed", removed)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+//////////////////////////////////////////////////
+// Windowed Aggregation
+//////////////////////////////////////////////////
+
+type AggregateConfig struct {
+	Enabled bool     `yaml:"enabled" json:"enabled"`
+	Window  Duration `yaml:"window" json:"window"`
+	// Functions are applied to every indicator; each yields an indicator
+	// named <indicator>_<function>.
+	Functions []string `yaml:"functions" json:"functions"`
+}
+
+var aggregateFunctions = []string{"min", "max", "avg", "sum", "count", "last"}
+
+func defaultAggregateConfig() AggregateConfig {
+	return AggregateConfig{
+		Window:    Duration(5 * time.Minute),
+		Functions: []string{"min", "max", "avg"},
+	}
+}
+
+func (a *AggregateConfig) validate() []error {
+	if !a.Enabled {
+		return nil
+	}
+	var errs []error
+	if a.Window < Duration(time.Second) || a.Window.Std()%time.Second != 0 {
+		errs = append(errs, fmt.Errorf("aggregate.window must be a whole number of seconds >= 1s, got %s", a.Window.Std()))
+	}
+	if len(a.Functions) == 0 {
+		errs = append(errs, errors.New("aggregate.functions must not be empty"))
+	}
+	for _, fn := range a.Functions {
+		if !slices.Contains(aggregateFunctions, fn) {
+			errs = append(errs, fmt.Errorf("aggregate.functions: unknown function %q (available: %v)", fn, aggregateFunctions))
+		}
+	}
+	return errs
+}
+
+type aggKey struct {
+	name   string
+	metric string
+	device string
+	cpu    string
+	start  uint64
+}
+
+// aggBucket accumulates the records of one (name, cpu, window).
+type aggBucket struct {
+	appliance   string
+	spanContext trace.SpanContext
+	labels      map[string]string
+	order       []string
+	stats       map[string]*aggStats
+}
+
+type aggStats struct {
+	n                   int
+	min, max, sum, last float64
+}
+
+// Aggregator buckets records by name, metric, device, CPU and time window,
+// and turns each finished window into one record of min/max/avg/...
+// indicators. It sits between transform and load. In daemon mode it lives
+// across runs, so a window collects the polls of every run that falls into
+// it.
+type Aggregator struct {
+	window    uint64
+	functions []string
+	keepNames bool // indicators aren't suffixed with the function; see newRollup
+
+	mu      sync.Mutex
+	buckets map[aggKey]*aggBucket
+}
+
+// aggregator is nil unless aggregation is enabled.
+var aggregator *Aggregator
+
+func newAggregator(conf AggregateConfig) *Aggregator {
+	return &Aggregator{
+		window:    uint64(conf.Window.Std() / time.Second),
+		functions: conf.Functions,
+		buckets:   map[aggKey]*aggBucket{},
+	}
+}
+
+// Add folds a record into the bucket of the window its timestamp falls in.
+func (a *Aggregator) Add(d DeviceData) {
+	key := aggKey{name: d.Name, metric: d.Metric, device: d.Device, cpu: d.CPUNumber, start: d.Timestamp - d.Timestamp%a.window}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	b, ok := a.buckets[key]
+	if !ok {
+		b = &aggBucket{stats: map[string]*aggStats{}}
+		a.buckets[key] = b
+	}
+	b.appliance = d.appliance
+	b.spanContext = d.spanContext
+	b.labels = d.Labels
+	for _, ind := range d.Indicators {
+		s, ok := b.stats[ind.Name]
+		if !ok {
+			s = &aggStats{min: ind.Value, max: ind.Value}
+			b.stats[ind.Name] = s
+			b.order = append(b.order, ind.Name)
+		}
+		s.min = min(s.min, ind.Value)
+		s.max = max(s.max, ind.Value)
+		s.n++
+		s.sum += ind.Value
+		s.last = ind.Value
+	}
+}
+
+// Flush removes and returns the records of windows that ended by now, or
+// of every window if all is set. The record timestamp is the window start.
+func (a *Aggregator) Flush(now time.Time, all bool) []DeviceData {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var keys []aggKey
+	for k := range a.buckets {
+		if all || k.start+a.window <= uint64(now.Unix()) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].start != keys[j].start {
+			return keys[i].start < keys[j].start
+		}
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		if keys[i].metric != keys[j].metric {
+			return keys[i].metric < keys[j].metric
+		}
+		if keys[i].device != keys[j].device {
+			return keys[i].device < keys[j].device
+		}
+		return keys[i].cpu < keys[j].cpu
+	})
+
+	out := make([]DeviceData, 0, len(keys))
+	for _, k := range keys {
+		b := a.buckets[k]
+		delete(a.buckets, k)
+
+		d := DeviceData{
+			Name:        k.name,
+			CPUNumber:   k.cpu,
+			Metric:      k.metric,
+			Device:      k.device,
+			Timestamp:   k.start,
+			Labels:      b.labels,
+			spanContext: b.spanContext,
+			appliance:   b.appliance,
+		}
+		for _, name := range b.order {
+			s := b.stats[name]
+			for _, fn := range a.functions {
+				var v float64
+				switch fn {
+				case "min":
+					v = s.min
+				case "max":
+					v = s.max
+				case "avg":
+					v = s.sum / float64(s.n)
+				case "sum":
+					v = s.sum
+				case "count":
+					v = float64(s.n)
+				case "last":
+					v = s.last
+				}
+				ind := name + "_" + fn
+				if a.keepNames {
+					ind = name
+				}
+				d.Indicators = append(d.Indicators, Indicator{ind, v})
+			}
+		}
+		out = append(out, d)
+	}
+	return out
+}
+
+// Pending returns the number of open windows.
+func (a *Aggregator) Pending() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.buckets)
+}
+
+// drainAggregator loads the windows still open when the daemon stops
+// between runs. No loaders are running then, so batches go straight to the
+// sinks.
+func drainAggregator() {
+	windows := aggregator.Flush(time.Now(), true)
+	if len(windows) == 0 {
+		return
+	}
+	runStats = newRunStats("", loadSinks)
+	for batch := range slices.Chunk(windows, cfg.Load.BufferThreshold) {
+		flushBuffer(&Buffer{Data: batch}, 0)
+	}
+	slog.Info("Flushed open aggregation windows on shutdown", "component", "aggregate", "emitted", len(windows))
+}
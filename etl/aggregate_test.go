@@ -0,0 +1,65 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestAggregatorFlush(t *testing.T) {
+	a := newAggregator(AggregateConfig{Window: Duration(time.Minute), Functions: []string{"min", "max", "avg", "count", "last"}})
+	for _, r := range []struct {
+		name string
+		ts   uint64
+		v    float64
+	}{
+		{"a", 600, 10}, {"a", 630, 30}, {"a", 650, 20}, // window 600-660
+		{"b", 610, 5},  // another host, same window
+		{"a", 660, 50}, // next window
+	} {
+		a.Add(DeviceData{Name: r.name, CPUNumber: "0", Timestamp: r.ts, Indicators: []Indicator{{"utilization", r.v}}})
+	}
+
+	if got := a.Flush(time.Unix(659, 0), false); len(got) != 0 {
+		t.Fatalf("flushed %d windows before the first ended", len(got))
+	}
+	got := a.Flush(time.Unix(660, 0), false)
+	want := []DeviceData{
+		{Name: "a", CPUNumber: "0", Timestamp: 600, Indicators: []Indicator{
+			{"utilization_min", 10}, {"utilization_max", 30}, {"utilization_avg", 20}, {"utilization_count", 3}, {"utilization_last", 20}}},
+		{Name: "b", CPUNumber: "0", Timestamp: 600, Indicators: []Indicator{
+			{"utilization_min", 5}, {"utilization_max", 5}, {"utilization_avg", 5}, {"utilization_count", 1}, {"utilization_last", 5}}},
+	}
+	if !equalRecords(got, want) {
+		t.Errorf("Flush = %+v, want %+v", got, want)
+	}
+	if a.Pending() != 1 {
+		t.Errorf("Pending = %d, want 1", a.Pending())
+	}
+	if got := a.Flush(time.Unix(660, 0), true); len(got) != 1 || got[0].Timestamp != 660 {
+		t.Errorf("flushing all = %+v, want the open window at 660", got)
+	}
+	if a.Pending() != 0 {
+		t.Errorf("Pending = %d after flushing all, want 0", a.Pending())
+	}
+}
+
+func TestRollupFlush(t *testing.T) {
+	a := newRollup(RollupConfig{Window: Duration(5 * time.Minute)})
+	for i, v := range []float64{10, 20, 60} {
+		a.Add(DeviceData{Name: "a", CPUNumber: "1", Timestamp: uint64(300 + 60*i),
+			Indicators: []Indicator{{"utilization", v}, {"user", v / 2}}})
+	}
+	got := a.Flush(time.Unix(600, 0), false)
+	want := []DeviceData{{Name: "a", CPUNumber: "1", Timestamp: 300, Indicators: []Indicator{{"utilization", 30}, {"user", 15}}}}
+	if !equalRecords(got, want) {
+		t.Errorf("Flush = %+v, want %+v", got, want)
+	}
+}
+
+func equalRecords(a, b []DeviceData) bool {
+	return slices.EqualFunc(a, b, func(x, y DeviceData) bool {
+		return x.Name == y.Name && x.CPUNumber == y.CPUNumber && x.Metric == y.Metric && x.Device == y.Device &&
+			x.Timestamp == y.Timestamp && slices.Equal(x.Indicators, y.Indicators)
+	})
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// Delivery Audit Log
+//////////////////////////////////////////////////
+
+// AuditConfig enables the delivery audit log: one JSON line per load
+// attempt and per batch delivery, appended to File and never rewritten, as
+// a record of what reached each sink.
+type AuditConfig struct {
+	File  string `yaml:"file" json:"file"`   // "" disables the log
+	Fsync bool   `yaml:"fsync" json:"fsync"` // sync the file after every entry
+}
+
+func defaultAuditConfig() AuditConfig {
+	return AuditConfig{}
+}
+
+// Audit entry events. The http sink logs an attempt entry per request; for
+// every sink, a delivery entry records what became of the batch.
+const (
+	auditAttempt  = "attempt"
+	auditDelivery = "delivery"
+)
+
+// Attempt decisions; deliveries take the report's load outcomes (loaded,
+// spilled, dead_lettered, lost), already_acked for a batch not sent again
+// or queued for one retried later in the run.
+const (
+	decisionRetry        = "retry"
+	decisionDone         = "done"
+	decisionAlreadyAcked = "already_acked"
+	decisionQueued       = "queued"
+)
+
+// AuditEntry is one line of the audit log.
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	RunID    string    `json:"run_id,omitempty"`
+	BatchID  string    `json:"batch_id"`
+	Sink     string    `json:"sink"`
+	Target   string    `json:"target,omitempty"` // endpoint, for the http sink
+	WorkerID int       `json:"worker_id"`
+	Records  int       `json:"records"`
+	// Attempt is the attempt's number, from 1; on a delivery, the number of
+	// attempts the sink made.
+	Attempt   int    `json:"attempt"`
+	Status    int    `json:"status,omitempty"` // HTTP status, when there was a response
+	LatencyMS int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+	// Decision is what was done next: retry or done for an attempt, the
+	// outcome of the records not loaded for a delivery.
+	Decision     string `json:"decision"`
+	Loaded       int    `json:"loaded"` // deliveries only
+	SpillID      string `json:"spill_id,omitempty"`
+	DeadLetterID string `json:"dlq_id,omitempty"`
+}
+
+// AuditLog appends entries to the audit file. Its methods are no-ops on a
+// nil log, so callers don't check whether auditing is on.
+type AuditLog struct {
+	mu    sync.Mutex
+	f     *os.File
+	fsync bool
+}
+
+// auditLog is the process' audit log, nil when audit.file is unset.
+var auditLog *AuditLog
+
+// openAuditLog opens the audit file for appending, creating it if needed.
+func openAuditLog(conf AuditConfig) (*AuditLog, error) {
+	if dir := filepath.Dir(conf.File); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(conf.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{f: f, fsync: conf.Fsync}, nil
+}
+
+func (l *AuditLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return errors.Join(l.f.Sync(), l.f.Close())
+}
+
+// write appends an entry as a single line, so concurrent writers never
+// interleave.
+func (l *AuditLog) write(e AuditEntry) {
+	if l == nil {
+		return
+	}
+	e.Time = time.Now().UTC()
+	line, err := json.Marshal(e)
+	if err != nil {
+		slog.Error("Failed to encode audit entry", "component", "audit", "batch_id", e.BatchID, "error", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.f.Write(line)
+	if err == nil && l.fsync {
+		err = l.f.Sync()
+	}
+	if err != nil {
+		slog.Error("Failed to write audit entry", "component", "audit", "batch_id", e.BatchID, "error", err)
+	}
+}
+
+// attempt logs one request of a sink's batch, the batch being named by ctx.
+func (l *AuditLog) attempt(ctx context.Context, sink, target string, records, attempt, status int, latency time.Duration, err error, decision string) {
+	if l == nil {
+		return
+	}
+	e := AuditEntry{
+		Event:     auditAttempt,
+		RunID:     currentRunID(),
+		BatchID:   batchIDFrom(ctx),
+		Sink:      sink,
+		Target:    target,
+		WorkerID:  workerIDFrom(ctx),
+		Records:   records,
+		Attempt:   attempt,
+		Status:    status,
+		LatencyMS: latency.Milliseconds(),
+		Decision:  decision,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	l.write(e)
+}
+
+// currentRunID is the ID of the run in progress, "" outside of runs such as
+// in etl dlq replay.
+func currentRunID() string {
+	if stats := runStats; stats != nil {
+		return stats.RunID
+	}
+	return ""
+}
+
+// statusOf is the HTTP status of a failed load, 0 if it got no response.
+func statusOf(err error) int {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode
+	}
+	return 0
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// Avro Encoding
+//////////////////////////////////////////////////
+
+// avroSchema is the Avro schema of a DeviceData record. Field names match
+// the JSON output, so consumers can switch formats without renaming.
+const avroSchema = `{"type":"record","name":"DeviceData","namespace":"concurrentetl.v1","fields":[` +
+	`{"name":"name","type":"string"},` +
+	`{"name":"cpu_number","type":"string"},` +
+	`{"name":"timestamp","type":"long"},` +
+	`{"name":"indicators","type":{"type":"array","items":{"type":"record","name":"Indicator","fields":[` +
+	`{"name":"name","type":"string"},{"name":"value","type":"double"}]}}},` +
+	`{"name":"metric","type":"string","default":""},` +
+	`{"name":"device","type":"string","default":""},` +
+	`{"name":"labels","type":{"type":"map","values":"string"},"default":{}}]}`
+
+// appendAvroRecord appends the Avro binary encoding of d.
+func appendAvroRecord(b []byte, d DeviceData) []byte {
+	b = appendAvroString(b, d.Name)
+	b = appendAvroString(b, d.CPUNumber)
+	b = binary.AppendVarint(b, int64(d.Timestamp))
+	if len(d.Indicators) > 0 {
+		b = binary.AppendVarint(b, int64(len(d.Indicators)))
+		for _, ind := range d.Indicators {
+			b = appendAvroString(b, ind.Name)
+			b = binary.LittleEndian.AppendUint64(b, math.Float64bits(ind.Value))
+		}
+	}
+	b = append(b, 0) // end of array
+	b = appendAvroString(b, d.Metric)
+	b = appendAvroString(b, d.Device)
+	if len(d.Labels) > 0 {
+		keys := make([]string, 0, len(d.Labels))
+		for k := range d.Labels {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		b = binary.AppendVarint(b, int64(len(keys)))
+		for _, k := range keys {
+			b = appendAvroString(b, k)
+			b = appendAvroString(b, d.Labels[k])
+		}
+	}
+	return append(b, 0) // end of map
+}
+
+// appendAvroString appends a string, or bytes, as its length (a zig-zag
+// varint long, as every Avro int and long) followed by its contents.
+func appendAvroString(b []byte, s string) []byte {
+	b = binary.AppendVarint(b, int64(len(s)))
+	return append(b, s...)
+}
+
+// avroContainer writes an Avro object container file: a header carrying
+// the schema and codec, then one block of records per call to WriteBlock.
+// Readers such as Spark, Flink or avro-tools need nothing else.
+type avroContainer struct {
+	w       io.Writer
+	deflate bool
+	sync    [16]byte
+}
+
+// newAvroContainer writes the header to w. With deflate, blocks are
+// compressed with the Avro "deflate" codec.
+func newAvroContainer(w io.Writer, deflate bool) (*avroContainer, error) {
+	c := &avroContainer{w: w, deflate: deflate}
+	rand.Read(c.sync[:])
+
+	codec := "null"
+	if deflate {
+		codec = "deflate"
+	}
+	h := []byte("Obj\x01")
+	h = binary.AppendVarint(h, 2)
+	h = appendAvroString(h, "avro.schema")
+	h = appendAvroString(h, avroSchema)
+	h = appendAvroString(h, "avro.codec")
+	h = appendAvroString(h, codec)
+	h = append(h, 0)
+	h = append(h, c.sync[:]...)
+	if _, err := w.Write(h); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// WriteBlock writes the records as one block.
+func (c *avroContainer) WriteBlock(data []DeviceData) error {
+	if len(data) == 0 {
+		return nil
+	}
+	var body []byte
+	for _, d := range data {
+		body = appendAvroRecord(body, d)
+	}
+	if c.deflate {
+		var buf bytes.Buffer
+		zw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+		zw.Write(body)
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+
+	block := binary.AppendVarint(nil, int64(len(data)))
+	block = binary.AppendVarint(block, int64(len(body)))
+	block = append(block, body...)
+	block = append(block, c.sync[:]...)
+	_, err := c.w.Write(block)
+	return err
+}
+
+// marshalAvroContainer encodes records as a complete container file, for
+// messages that must carry their own schema.
+func marshalAvroContainer(data []DeviceData) ([]byte, error) {
+	var buf bytes.Buffer
+	c, err := newAvroContainer(&buf, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.WriteBlock(data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//////////////////////////////////////////////////
+// Schema Registry
+//////////////////////////////////////////////////
+
+type SchemaRegistryConfig struct {
+	URL      string   `yaml:"url" json:"url"`
+	Subject  string   `yaml:"subject" json:"subject"` // default <topic>-value
+	Username string   `yaml:"username" json:"username"`
+	Password string   `yaml:"password" json:"password" secret:"true"`
+	Timeout  Duration `yaml:"timeout" json:"timeout"`
+}
+
+func defaultSchemaRegistryConfig() SchemaRegistryConfig {
+	return SchemaRegistryConfig{Timeout: Duration(10 * time.Second)}
+}
+
+// registerAvroSchema registers avroSchema under the subject with a
+// Confluent-compatible schema registry and returns its schema ID. The
+// registry returns the existing ID when the schema is already registered.
+func registerAvroSchema(ctx context.Context, conf SchemaRegistryConfig) (uint32, error) {
+	body, err := json.Marshal(map[string]string{"schema": avroSchema})
+	if err != nil {
+		return 0, err
+	}
+	endpoint := strings.TrimSuffix(conf.URL, "/") + "/subjects/" + url.PathEscape(conf.Subject) + "/versions"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	if conf.Username != "" {
+		req.SetBasicAuth(conf.Username, conf.Password)
+	}
+
+	resp, err := loadClient(conf.Timeout.Std()).Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("schema registry: %w", err)
+	}
+	defer func() {
+		drainBody(resp.Body)
+		resp.Body.Close()
+	}()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return 0, fmt.Errorf("schema registry: %w", &APIError{StatusCode: resp.StatusCode, Body: string(msg)})
+	}
+	var result struct {
+		ID uint32 `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("schema registry: decoding response: %w", err)
+	}
+	return result.ID, nil
+}
+
+// appendConfluentAvro appends d in the Confluent wire format: a zero magic
+// byte, the big-endian schema ID, then the Avro binary record.
+func appendConfluentAvro(b []byte, schemaID uint32, d DeviceData) []byte {
+	b = append(b, 0)
+	b = binary.BigEndian.AppendUint32(b, schemaID)
+	return appendAvroRecord(b, d)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// Load Backpressure
+//////////////////////////////////////////////////
+
+// BackpressureConfig holds back dispatch while the records waiting to be
+// loaded pass a watermark of the load queues' total capacity, so extraction
+// slows down as soon as the loaders or the API do rather than when one
+// worker's queue is full.
+type BackpressureConfig struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// HighWatermark pauses dispatch, LowWatermark resumes it; both are
+	// fractions of load.workers × load.channel_capacity.
+	HighWatermark float64  `yaml:"high_watermark" json:"high_watermark"`
+	LowWatermark  float64  `yaml:"low_watermark" json:"low_watermark"`
+	CheckInterval Duration `yaml:"check_interval" json:"check_interval"`
+}
+
+func defaultBackpressureConfig() BackpressureConfig {
+	return BackpressureConfig{
+		Enabled:       true,
+		HighWatermark: 0.8,
+		LowWatermark:  0.5,
+		CheckInterval: Duration(100 * time.Millisecond),
+	}
+}
+
+func (b *BackpressureConfig) validate() []error {
+	if !b.Enabled {
+		return nil
+	}
+	var errs []error
+	if b.HighWatermark <= 0 || b.HighWatermark > 1 {
+		errs = append(errs, errors.New("load.backpressure.high_watermark must be within (0, 1]"))
+	}
+	if b.LowWatermark <= 0 || b.LowWatermark >= b.HighWatermark {
+		errs = append(errs, errors.New("load.backpressure.low_watermark must be within (0, high_watermark)"))
+	}
+	if b.CheckInterval <= 0 {
+		errs = append(errs, errors.New("load.backpressure.check_interval must be > 0"))
+	}
+	return errs
+}
+
+// Backpressure counts the records of a run from the moment they are queued
+// for a loader until the loader takes them, including those of extracts
+// blocked on a full queue. Together with the records in the retry queue
+// they make the fill checked against the watermarks. Records in the
+// loaders' buffers don't count: a loader only flushes a full buffer, so in
+// a batch run they would keep the fill up with nothing left to drain it.
+// Its methods are no-ops on a nil value.
+type Backpressure struct {
+	pauseGate
+	high     float64
+	low      float64
+	capacity int64
+	interval time.Duration
+	pending  atomic.Int64
+}
+
+// backpressure is the gate of the run in progress, nil when disabled and
+// outside of runs.
+var backpressure *Backpressure
+
+func newBackpressure(conf BackpressureConfig, capacity int) *Backpressure {
+	return &Backpressure{
+		high:     conf.HighWatermark,
+		low:      conf.LowWatermark,
+		capacity: int64(max(capacity, 1)),
+		interval: conf.CheckInterval.Std(),
+	}
+}
+
+// Queued counts records handed to a loader.
+func (b *Backpressure) Queued(n int) {
+	if b != nil {
+		b.pending.Add(int64(n))
+	}
+}
+
+// Dequeued counts records a loader took from its queues.
+func (b *Backpressure) Dequeued(n int) {
+	if b != nil {
+		b.pending.Add(-int64(n))
+	}
+}
+
+// Fill is the fraction of the load queues' capacity taken by queued
+// records and those waiting for a retry. It may exceed 1, since neither
+// blocked senders nor the retry queue are bounded by the queues.
+func (b *Backpressure) Fill() float64 {
+	return float64(b.pending.Load()+int64(retries.Records())) / float64(b.capacity)
+}
+
+// Wait blocks while dispatch is held back, or until ctx is done.
+func (b *Backpressure) Wait(ctx context.Context) error {
+	if b == nil {
+		return ctx.Err()
+	}
+	return b.pauseGate.Wait(ctx)
+}
+
+// Run checks the fill every check interval until ctx is done, pausing
+// dispatch at the high watermark and resuming it at the low one.
+func (b *Backpressure) Run(ctx context.Context) {
+	b.run(ctx, b.interval, func() bool {
+		fill := b.Fill()
+		if fill >= b.high {
+			slog.Warn("Load queues backing up, pausing dispatch", "component", "backpressure", "queue_fill", fill)
+		}
+		return fill >= b.high
+	}, func(paused time.Duration) bool {
+		fill := b.Fill()
+		if fill <= b.low {
+			slog.Info("Load queues drained, resuming dispatch", "component", "backpressure",
+				"queue_fill", fill, "paused_ms", paused.Milliseconds())
+		}
+		return fill <= b.low
+	})
+}
+
+// Over reports whether dispatch is currently held back.
+func (b *Backpressure) Over() bool {
+	if b == nil {
+		return false
+	}
+	return b.pauseGate.Over()
+}
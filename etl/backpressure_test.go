@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A batch run whose loader buffers hold more records than the watermarks
+// allow in the queues still drains: buffered records don't hold the gate.
+func TestBackpressureDrainsBufferedRecords(t *testing.T) {
+	s := &testSink{name: "test"}
+	withTestLoadStage(t, s)
+	prevCfg, prevGate := *cfg, backpressure
+	t.Cleanup(func() { *cfg, backpressure = prevCfg, prevGate })
+	cfg.Load.Workers, cfg.Load.ChannelCapacity, cfg.Load.BufferThreshold = 2, 5, 100
+	cfg.Stream.Enabled = false
+	initBuffers(cfg.Load.Workers)
+	initChannels(cfg.Load.Workers)
+	backpressure = newBackpressure(BackpressureConfig{Enabled: true, HighWatermark: 0.8, LowWatermark: 0.5,
+		CheckInterval: Duration(time.Millisecond)}, cfg.Load.Workers*cfg.Load.ChannelCapacity)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	gateDone := make(chan struct{})
+	defer func() {
+		cancel()
+		<-gateDone
+	}()
+	go func() {
+		defer close(gateDone)
+		backpressure.Run(ctx)
+	}()
+	var loadWg sync.WaitGroup
+	for i := range cfg.Load.Workers {
+		loadWg.Add(1)
+		go loadWorker(&loadWg, i)
+	}
+
+	const records = 150
+	for i, d := range testRecords(records) {
+		if err := backpressure.Wait(ctx); err != nil {
+			t.Fatalf("dispatch held back after %d records: %v", i, err)
+		}
+		backpressure.Queued(1)
+		dataChan[i%cfg.Load.Workers] <- d
+		// Give the gate a check between records.
+		time.Sleep(2 * time.Millisecond)
+	}
+	closeChannels()
+	loadWg.Wait()
+	if got, want := countsOf("test"), (sinkCounts{loaded: records}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestBackpressureValidation(t *testing.T) {
+	tests := []struct {
+		name      string
+		workers   int
+		capacity  int
+		high      float64
+		wantValid bool
+	}{
+		{"defaults", 4, 2000, 0.8, true},
+		{"one record", 1, 2, 0.5, true},
+		{"no queue capacity", 4, 0, 0.8, false},
+		{"watermark below one record", 1, 1, 0.5, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := *cfg
+			c.Load.Workers, c.Load.ChannelCapacity = tt.workers, tt.capacity
+			c.Load.Backpressure = defaultBackpressureConfig()
+			c.Load.Backpressure.HighWatermark = tt.high
+			c.Load.Backpressure.LowWatermark = tt.high / 2
+			if err := c.Validate(); (err == nil) != tt.wantValid {
+				t.Errorf("Validate() = %v, want valid %v", err, tt.wantValid)
+			}
+		})
+	}
+}
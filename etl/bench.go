@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+//////////////////////////////////////////////////
+// Benchmarks
+//////////////////////////////////////////////////
+
+const benchUsage = `usage: etl [flags] bench [-run regexp] [-benchtime 1s|100x] [-count n] [-batch n] [-appliances n]
+
+Runs the pipeline benchmarks and prints them in "go test -bench" format, so
+results of two releases can be compared with benchstat. The same benchmarks
+run with "go test -bench" in etl/.`
+
+// pipelineBenchmark is one benchmark of a pipeline stage.
+type pipelineBenchmark struct {
+	name string
+	fn   func(b *testing.B)
+}
+
+// pipelineBenchmarks returns the stage benchmarks, on batches of batchSize
+// records and end-to-end runs over applianceCount appliances. etl bench
+// and the Benchmark functions of bench_test.go both run them.
+func pipelineBenchmarks(batchSize, applianceCount int) []pipelineBenchmark {
+	bms := []pipelineBenchmark{{"Transform", benchTransform}}
+	for _, format := range []string{"json", "protobuf", "msgpack", "avro"} {
+		bms = append(bms, pipelineBenchmark{"Encode/" + format, func(b *testing.B) { benchEncode(b, format, batchSize) }})
+	}
+	for _, codec := range []string{"gzip", "zstd"} {
+		bms = append(bms, pipelineBenchmark{"Compress/" + codec, func(b *testing.B) { benchCompress(b, codec, batchSize) }})
+	}
+	return append(bms,
+		pipelineBenchmark{"Flush", func(b *testing.B) { benchFlush(b, batchSize) }},
+		pipelineBenchmark{"EndToEnd", func(b *testing.B) { benchEndToEnd(b, applianceCount) }},
+	)
+}
+
+func runBenchCommand(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprintln(fs.Output(), benchUsage) }
+	run := fs.String("run", ".", "run only benchmarks matching this regexp")
+	benchtime := fs.String("benchtime", "1s", "run each benchmark for this long, or Nx times")
+	count := fs.Int("count", 1, "run each benchmark n times")
+	batchSize := fs.Int("batch", cfg.Load.BufferThreshold, "records per batch")
+	applianceCount := fs.Int("appliances", 1000, "appliances per end-to-end run")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	match, err := regexp.Compile(*run)
+	if err != nil {
+		return fmt.Errorf("-run: %w", err)
+	}
+	if *count <= 0 || *batchSize <= 0 || *applianceCount <= 0 {
+		return fmt.Errorf("-count, -batch and -appliances must be > 0")
+	}
+	testing.Init()
+	if err := flag.Set("test.benchtime", *benchtime); err != nil {
+		return fmt.Errorf("-benchtime: %w", err)
+	}
+
+	// Benchmarks log nothing; a flush alone would write a line per op.
+	prevLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.DiscardHandler))
+	defer slog.SetDefault(prevLogger)
+
+	procs := runtime.GOMAXPROCS(0)
+	fmt.Printf("goos: %s\ngoarch: %s\npkg: etl\n", runtime.GOOS, runtime.GOARCH)
+	for _, bm := range pipelineBenchmarks(*batchSize, *applianceCount) {
+		if !match.MatchString(bm.name) {
+			continue
+		}
+		for range *count {
+			r := testing.Benchmark(bm.fn)
+			if r.N == 0 {
+				return fmt.Errorf("benchmark %s failed", bm.name)
+			}
+			fmt.Printf("Benchmark%s-%d\t%s\t%s\n", bm.name, procs, r.String(), r.MemString())
+		}
+	}
+	return nil
+}
+
+// reportRecords adds the records/s metric, for records processed per op.
+func reportRecords(b *testing.B, records int) {
+	if secs := b.Elapsed().Seconds(); secs > 0 {
+		b.ReportMetric(float64(records*b.N)/secs, "records/s")
+	}
+}
+
+func benchTransform(b *testing.B) {
+	chain, err := newTransformChain(cfg.Transform)
+	if err != nil {
+		b.Fatal(err)
+	}
+	raw := &CpuStats{Name: "bench-0", CPUNumber: "0", PIdle: "95", PUser: "3", PSys: "1", PIRQ: "0.5", PNice: "0",
+		Timestamp: uint64(time.Now().Unix())}
+	ap := Appliance{IP: "10.0.0.1", HostName: "bench-0"}
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, _, err := chain.Apply(raw, ap); err != nil {
+			b.Fatal(err)
+		}
+	}
+	reportRecords(b, 1)
+}
+
+func benchEncode(b *testing.B, format string, batchSize int) {
+	batch := syntheticBatch(batchSize)
+	encode := map[string]func(){
+		"json":     func() { json.Marshal(batch) },
+		"protobuf": func() { appendBatchProto(nil, batch) },
+		"msgpack":  func() { appendBatchMsgpack(nil, batch) },
+		"avro":     func() { marshalAvroContainer(batch) },
+	}[format]
+	b.ReportAllocs()
+	for b.Loop() {
+		encode()
+	}
+	reportRecords(b, len(batch))
+}
+
+func benchCompress(b *testing.B, codec string, batchSize int) {
+	batch := syntheticBatch(batchSize)
+	payload, err := json.Marshal(batch)
+	if err != nil {
+		b.Fatal(err)
+	}
+	compress := func() {
+		buf := getBuffer()
+		zw := getGzipWriter(buf)
+		zw.Write(payload)
+		zw.Close()
+		putGzipWriter(zw)
+		putBuffer(buf)
+	}
+	if codec == "zstd" {
+		zenc, err := zstd.NewWriter(nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer zenc.Close()
+		compress = func() { zenc.EncodeAll(payload, nil) }
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(payload)))
+	for b.Loop() {
+		compress()
+	}
+	reportRecords(b, len(batch))
+}
+
+func benchFlush(b *testing.B, batchSize int) {
+	defer withBenchPipeline()()
+	batch := syntheticBatch(batchSize)
+	buffer := &Buffer{Data: make([]DeviceData, 0, len(batch))}
+	b.ReportAllocs()
+	for b.Loop() {
+		buffer.Data = append(buffer.Data, batch...)
+		flushBuffer(buffer, 0)
+	}
+	reportRecords(b, len(batch))
+}
+
+// benchEndToEnd runs the whole pipeline over synthetic appliances, with the
+// simulated extractor and no delay.
+func benchEndToEnd(b *testing.B, applianceCount int) {
+	defer withBenchPipeline()()
+	dir := b.TempDir()
+	if err := writeBenchAppliances(filepath.Join(dir, "appliances.csv"), applianceCount); err != nil {
+		b.Fatal(err)
+	}
+	prevCfg := *cfg
+	defer func() { *cfg = prevCfg }()
+	cfg.InputFile = filepath.Join(dir, "appliances.csv")
+	cfg.Checkpoint.Resume = false
+	cfg.Extract.SimulatedDelay = 0
+
+	chain, err := newTransformChain(cfg.Transform)
+	if err != nil {
+		b.Fatal(err)
+	}
+	store, err := openStateStore(StateConfig{File: filepath.Join(dir, "state.db"), RunHistory: 1})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer store.Close()
+	prevSource, prevChain, prevExtractor, prevSpills, prevState := applianceSource, transformChain, extractor, spills, state
+	defer func() {
+		applianceSource, transformChain, extractor, spills, state = prevSource, prevChain, prevExtractor, prevSpills, prevState
+	}()
+	applianceSource = csvSource{file: cfg.InputFile}
+	transformChain = chain
+	extractor = &simulatedExtractor{}
+	spills = &dirSpillStore{dir: filepath.Join(dir, "spill"), format: "json"}
+	state = store
+
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := runETL(context.Background(), "bench"); err != nil {
+			b.Fatal(err)
+		}
+	}
+	reportRecords(b, applianceCount)
+}
+
+// benchSink accepts every batch without doing anything with it.
+type benchSink struct{}
+
+func (benchSink) Name() string                                      { return "bench" }
+func (benchSink) Load(ctx context.Context, data []DeviceData) error { return nil }
+
+// withBenchPipeline points the load stage at benchSink and returns a
+// function restoring what it replaced.
+func withBenchPipeline() (restore func()) {
+	prevSinks, prevStats, prevCheckpoint := loadSinks, runStats, checkpoint
+	loadSinks = []Sink{benchSink{}}
+	runStats = newRunStats("bench", loadSinks)
+	checkpoint = nil
+	return func() {
+		loadSinks, runStats, checkpoint = prevSinks, prevStats, prevCheckpoint
+	}
+}
+
+// syntheticBatch returns n records shaped like the cpu transform's output.
+func syntheticBatch(n int) []DeviceData {
+	batch := make([]DeviceData, n)
+	now := uint64(time.Now().Unix())
+	for i := range batch {
+		batch[i] = DeviceData{
+			Name:      "device-" + strconv.Itoa(i),
+			CPUNumber: "0",
+			Timestamp: now,
+			Indicators: []Indicator{
+				{"utilization", 5}, {"nice", 0}, {"user", 3}, {"system", 1}, {"irq", 0.5},
+			},
+			Metric: "cpu",
+			Labels: map[string]string{"site": "dc1"},
+		}
+	}
+	return batch
+}
+
+func writeBenchAppliances(path string, n int) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	for i := range n {
+		fmt.Fprintf(f, "10.%d.%d.%d,bench-%d\n", i>>16&255, i>>8&255, i&255, i)
+	}
+	return f.Close()
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+// Pipeline benchmarks, the stage benchmarks of bench.go that etl bench
+// runs too, e.g.
+//
+//	go test -run '^$' -bench . -count 6 > old.txt
+//	benchstat old.txt new.txt
+var (
+	benchBatch      = flag.Int("batch", 0, "records per batch of the benchmarks (default load.buffer_threshold)")
+	benchAppliances = flag.Int("appliances", 1000, "appliances per end-to-end benchmark run")
+)
+
+// runPipelineBenchmarks runs the stage benchmarks named prefix, or
+// prefix/<variant> as sub-benchmarks.
+func runPipelineBenchmarks(b *testing.B, prefix string) {
+	batch := *benchBatch
+	if batch <= 0 {
+		batch = cfg.Load.BufferThreshold
+	}
+	for _, bm := range pipelineBenchmarks(batch, *benchAppliances) {
+		switch {
+		case bm.name == prefix:
+			bm.fn(b)
+		case strings.HasPrefix(bm.name, prefix+"/"):
+			b.Run(strings.TrimPrefix(bm.name, prefix+"/"), bm.fn)
+		}
+	}
+}
+
+func BenchmarkTransform(b *testing.B) { runPipelineBenchmarks(b, "Transform") }
+func BenchmarkEncode(b *testing.B)    { runPipelineBenchmarks(b, "Encode") }
+func BenchmarkCompress(b *testing.B)  { runPipelineBenchmarks(b, "Compress") }
+func BenchmarkFlush(b *testing.B)     { runPipelineBenchmarks(b, "Flush") }
+func BenchmarkEndToEnd(b *testing.B)  { runPipelineBenchmarks(b, "EndToEnd") }
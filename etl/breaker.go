@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// Circuit Breaker
+//////////////////////////////////////////////////
+
+type CircuitBreakerConfig struct {
+	Enabled          bool     `yaml:"enabled" json:"enabled"`
+	FailureThreshold int      `yaml:"failure_threshold" json:"failure_threshold"`
+	Cooldown         Duration `yaml:"cooldown" json:"cooldown"`
+	HealthEndpoint   string   `yaml:"health_endpoint" json:"health_endpoint"`
+}
+
+func defaultCircuitBreakerConfig() CircuitBreakerConfig {
+	return CircuitBreakerConfig{
+		Enabled:          true,
+		FailureThreshold: 5,
+		Cooldown:         Duration(30 * time.Second),
+		HealthEndpoint:   "http://localhost:8080/health",
+	}
+}
+
+func (c *CircuitBreakerConfig) validate() []error {
+	if !c.Enabled {
+		return nil
+	}
+	var errs []error
+	if c.FailureThreshold <= 0 {
+		errs = append(errs, fmt.Errorf("api.circuit_breaker.failure_threshold must be > 0, got %d", c.FailureThreshold))
+	}
+	if c.Cooldown <= 0 {
+		errs = append(errs, errors.New("api.circuit_breaker.cooldown must be > 0"))
+	}
+	if c.HealthEndpoint == "" {
+		errs = append(errs, errors.New("api.circuit_breaker.health_endpoint must be set"))
+	}
+	return errs
+}
+
+var errCircuitOpen = errors.New("circuit breaker open")
+
+// CircuitBreaker is shared by all load workers. After FailureThreshold
+// consecutive transient failures it opens and sends are refused outright.
+// Once Cooldown has passed, a single caller probes the health endpoint; a
+// healthy answer closes the breaker, anything else restarts the cooldown.
+type CircuitBreaker struct {
+	mu       sync.Mutex
+	open     bool
+	probing  bool
+	failures int
+	openedAt time.Time
+
+	threshold int
+	cooldown  time.Duration
+	probe     func() error
+}
+
+func newCircuitBreaker(conf CircuitBreakerConfig, probe func() error) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold: conf.FailureThreshold,
+		cooldown:  conf.Cooldown.Std(),
+		probe:     probe,
+	}
+}
+
+// Allow reports whether a send may go ahead.
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	if !b.open {
+		b.mu.Unlock()
+		return true
+	}
+	if b.probing || time.Since(b.openedAt) < b.cooldown {
+		b.mu.Unlock()
+		return false
+	}
+	b.probing = true
+	b.mu.Unlock()
+
+	err := b.probe()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err != nil {
+		b.openedAt = time.Now()
+		slog.Warn("Health probe failed, circuit stays open", "component", "breaker", "cooldown_ms", b.cooldown.Milliseconds(), "error", err)
+		return false
+	}
+	b.open = false
+	b.failures = 0
+	slog.Info("Health probe succeeded, circuit closed", "component", "breaker")
+	return true
+}
+
+func (b *CircuitBreaker) RecordSuccess() {
+	b.mu.Lock()
+	b.failures = 0
+	b.mu.Unlock()
+}
+
+func (b *CircuitBreaker) RecordFailure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if !b.open && b.failures >= b.threshold {
+		b.open = true
+		b.openedAt = time.Now()
+		slog.Warn("Circuit opened", "component", "breaker", "consecutive_failures", b.failures, "cooldown_ms", b.cooldown.Milliseconds())
+	}
+}
+
+func probeHealth(endpoint string, timeout time.Duration) func() error {
+	return func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := loadClient(0).Do(req)
+		if err != nil {
+			return err
+		}
+		drainBody(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("health endpoint returned %s", resp.Status)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+)
+
+//////////////////////////////////////////////////
+// Buffer Pools
+//////////////////////////////////////////////////
+
+// countingPool is a sync.Pool that counts its gets and how many of them had
+// to allocate, so the hit rate can be checked against mem.prof.
+type countingPool struct {
+	sync.Pool
+	gets   atomic.Int64
+	allocs atomic.Int64
+}
+
+func newCountingPool(alloc func() any) *countingPool {
+	p := &countingPool{}
+	p.New = func() any {
+		p.allocs.Add(1)
+		return alloc()
+	}
+	return p
+}
+
+func (p *countingPool) Get() any {
+	p.gets.Add(1)
+	return p.Pool.Get()
+}
+
+// maxPooledBuffer caps the encode buffers kept for reuse, so one huge batch
+// doesn't pin its buffer for the rest of the process.
+const maxPooledBuffer = 16 << 20
+
+var (
+	batchPool  = newCountingPool(func() any { return new([]DeviceData) })
+	gzipPool   = newCountingPool(func() any { return gzip.NewWriter(nil) })
+	bufferPool = newCountingPool(func() any { return new(bytes.Buffer) })
+)
+
+// getBatch returns an empty batch slice, with the capacity of an earlier
+// flush when one is free.
+func getBatch() *[]DeviceData {
+	return batchPool.Get().(*[]DeviceData)
+}
+
+// putBatch recycles a batch. Sinks must not keep the slice once Load
+// returns.
+func putBatch(b *[]DeviceData) {
+	clear(*b) // drop the records' indicators and labels for the GC
+	*b = (*b)[:0]
+	batchPool.Put(b)
+}
+
+// getGzipWriter returns a gzip writer reset to write to w.
+func getGzipWriter(w io.Writer) *gzip.Writer {
+	zw := gzipPool.Get().(*gzip.Writer)
+	zw.Reset(w)
+	return zw
+}
+
+// putGzipWriter recycles a gzip writer after Close.
+func putGzipWriter(zw *gzip.Writer) {
+	gzipPool.Put(zw)
+}
+
+// getBuffer returns an empty encode buffer.
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// putBuffer recycles an encode buffer; nothing may use its bytes afterwards.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBuffer {
+		bufferPool.Put(buf)
+	}
+}
+
+// logPoolUsage logs each pool's gets and how many of them allocated; the
+// rest were served by reuse.
+func logPoolUsage() {
+	slog.Info("Buffer pool usage", "component", "pool",
+		"batch_gets", batchPool.gets.Load(), "batch_allocs", batchPool.allocs.Load(),
+		"gzip_gets", gzipPool.gets.Load(), "gzip_allocs", gzipPool.allocs.Load(),
+		"buffer_gets", bufferPool.gets.Load(), "buffer_allocs", bufferPool.allocs.Load())
+}
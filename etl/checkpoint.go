@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+//////////////////////////////////////////////////
+// Run Checkpointing
+//////////////////////////////////////////////////
+
+type CheckpointConfig struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// Resume makes the first run skip appliances the interrupted run it
+	// finds in the checkpoint had already extracted and loaded.
+	Resume bool `yaml:"resume" json:"resume"`
+}
+
+func defaultCheckpointConfig() CheckpointConfig {
+	return CheckpointConfig{
+		Enabled: true,
+	}
+}
+
+func (c *CheckpointConfig) validate() []error {
+	var errs []error
+	if c.Resume && !c.Enabled {
+		errs = append(errs, errors.New("checkpoint.resume needs checkpoint.enabled"))
+	}
+	return errs
+}
+
+// Keys inside the state store's checkpoint bucket.
+var (
+	checkpointRunKey  = []byte("run")
+	checkpointDoneKey = []byte("done")
+)
+
+// checkpointRun describes the run a checkpoint belongs to.
+type checkpointRun struct {
+	RunID      string    `json:"run_id"`
+	InputFile  string    `json:"input_file"`
+	StartedAt  time.Time `json:"started_at"`
+	Appliances int       `json:"appliances"`
+}
+
+// Checkpoint records, in the state store, which appliances of the current
+// run have been extracted and handed off by every sink (loaded, spilled or
+// dead-lettered). A run that finishes clears it; one that is killed or
+// interrupted leaves it behind for -resume.
+type Checkpoint struct {
+	db *bolt.DB
+
+	mu sync.Mutex
+	// pending counts the deliveries of an appliance's records not yet
+	// settled, a record once per sink.
+	pending map[string]int
+}
+
+// checkpoint is nil when checkpointing is disabled.
+var checkpoint *Checkpoint
+
+func newCheckpoint(s *StateStore) *Checkpoint {
+	return &Checkpoint{db: s.db, pending: map[string]int{}}
+}
+
+// Begin starts checkpointing a run. With resume set and an unfinished run
+// over the same input file on record, it keeps that run's progress and
+// returns the appliance keys already done; otherwise it starts afresh.
+func (c *Checkpoint) Begin(runID, inputFile string, appliances int, resume bool) (map[string]bool, error) {
+	c.mu.Lock()
+	clear(c.pending)
+	c.mu.Unlock()
+
+	done := map[string]bool{}
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(stateCheckpointBucket)
+
+		var prev checkpointRun
+		if raw := b.Get(checkpointRunKey); raw != nil {
+			if err := json.Unmarshal(raw, &prev); err != nil {
+				return err
+			}
+		}
+		switch {
+		case resume && prev.RunID != "" && prev.InputFile == inputFile:
+			if d := b.Bucket(checkpointDoneKey); d != nil {
+				d.ForEach(func(k, _ []byte) error {
+					done[string(k)] = true
+					return nil
+				})
+			}
+			slog.Info("Resuming from checkpoint", "component", "checkpoint", "previous_run_id", prev.RunID,
+				"done", len(done), "appliances", prev.Appliances)
+		case resume && prev.RunID != "":
+			slog.Warn("Checkpoint is for a different input file, starting from scratch", "component", "checkpoint",
+				"previous_run_id", prev.RunID, "checkpoint_input", prev.InputFile, "input", inputFile)
+		case resume:
+			slog.Info("No unfinished run to resume, starting from scratch", "component", "checkpoint")
+		case prev.RunID != "":
+			slog.Warn("Discarding checkpoint of unfinished run, use -resume to continue it", "component", "checkpoint",
+				"previous_run_id", prev.RunID)
+		}
+
+		if len(done) == 0 {
+			if err := b.DeleteBucket(checkpointDoneKey); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+				return err
+			}
+		}
+		if _, err := b.CreateBucketIfNotExists(checkpointDoneKey); err != nil {
+			return err
+		}
+		raw, err := json.Marshal(checkpointRun{RunID: runID, InputFile: inputFile, StartedAt: time.Now().UTC(), Appliances: appliances})
+		if err != nil {
+			return err
+		}
+		return b.Put(checkpointRunKey, raw)
+	})
+	return done, err
+}
+
+// Expect notes that the appliance yielded n records, each of which every
+// sink has to settle before the appliance is done.
+func (c *Checkpoint) Expect(key string, n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending[key] = n * checkpointSinks()
+}
+
+// MarkDone records that one record of each appliance in keys needs no sink
+// any more, e.g. because it was dropped before load, and marks the
+// appliances with no records left as done. It is a no-op between runs,
+// when there is no checkpoint to add to.
+func (c *Checkpoint) MarkDone(keys []string) error {
+	return c.settle(keys, checkpointSinks())
+}
+
+// Settled records that one sink has settled one record of each appliance
+// in keys, by loading, spilling or dead-lettering it. A record queued for
+// another attempt isn't settled yet.
+func (c *Checkpoint) Settled(keys []string) error {
+	return c.settle(keys, 1)
+}
+
+// checkpointSinks is the number of sinks that settle each record.
+func checkpointSinks() int {
+	return max(1, len(loadSinks))
+}
+
+func (c *Checkpoint) settle(keys []string, n int) error {
+	c.mu.Lock()
+	done := keys[:0:0]
+	for _, k := range keys {
+		if p := c.pending[k]; p > n {
+			c.pending[k] = p - n
+			continue
+		}
+		delete(c.pending, k)
+		done = append(done, k)
+	}
+	c.mu.Unlock()
+	if len(done) == 0 {
+		return nil
+	}
+
+	return c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(stateCheckpointBucket).Bucket(checkpointDoneKey)
+		if b == nil {
+			return nil
+		}
+		for _, k := range done {
+			if err := b.Put([]byte(k), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Complete clears the checkpoint after a run that went through every
+// appliance.
+func (c *Checkpoint) Complete() error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(stateCheckpointBucket)
+		if err := b.DeleteBucket(checkpointDoneKey); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return err
+		}
+		return b.Delete(checkpointRunKey)
+	})
+}
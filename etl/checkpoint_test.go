@@ -0,0 +1,124 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCheckpointSettle(t *testing.T) {
+	withTestLoadStage(t, &testSink{name: "a"}, &testSink{name: "b"})
+	checkpoint = newCheckpoint(state)
+	if _, err := checkpoint.Begin("run", "in.csv", 3, false); err != nil {
+		t.Fatal(err)
+	}
+	// Two records of "multi", each settled by both sinks; "dropped" yields
+	// one record dropped before load; "empty" none.
+	checkpoint.Expect("multi", 2)
+	checkpoint.Expect("dropped", 1)
+
+	steps := []struct {
+		name string
+		do   func() error
+		want []string
+	}{
+		{"one sink settles a record", func() error { return checkpoint.Settled([]string{"multi"}) }, nil},
+		{"the other sink settles it", func() error { return checkpoint.Settled([]string{"multi"}) }, nil},
+		{"record dropped before load", func() error { return checkpoint.MarkDone([]string{"dropped"}) }, []string{"dropped"}},
+		{"appliance without records", func() error { return checkpoint.MarkDone([]string{"empty"}) }, []string{"dropped", "empty"}},
+		{"both sinks settle the last record", func() error { return checkpoint.Settled([]string{"multi", "multi"}) },
+			[]string{"dropped", "empty", "multi"}},
+	}
+	for _, st := range steps {
+		if err := st.do(); err != nil {
+			t.Fatalf("%s: %v", st.name, err)
+		}
+		var got []string
+		for k := range checkpointDone(t) {
+			got = append(got, k)
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, st.want) {
+			t.Errorf("%s: done %v, want %v", st.name, got, st.want)
+		}
+	}
+}
+
+func TestCheckpointResume(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		resume bool
+		want   bool
+	}{
+		{"same input file", "in.csv", true, true},
+		{"other input file", "other.csv", true, false},
+		{"without resume", "in.csv", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withTestLoadStage(t, &testSink{name: "a"})
+			c := newCheckpoint(state)
+			if _, err := c.Begin("run", "in.csv", 2, false); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.MarkDone([]string{"x"}); err != nil {
+				t.Fatal(err)
+			}
+			done, err := newCheckpoint(state).Begin("next", tt.input, 2, tt.resume)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if done["x"] != tt.want {
+				t.Errorf("done = %v, want x done: %v", done, tt.want)
+			}
+		})
+	}
+}
+
+func TestSettleFlushCheckpoint(t *testing.T) {
+	data := testRecords(2)
+	tests := []struct {
+		name     string
+		err      error
+		requeue  bool
+		wantDone int
+	}{
+		{"loaded", nil, false, 2},
+		{"spilled", &APIError{StatusCode: 503}, false, 2},
+		{"dead-lettered", &APIError{StatusCode: 400}, false, 2},
+		{"queued for retry", &APIError{StatusCode: 503}, true, 0},
+		{"partly loaded", &PartialError{Failed: data[:1], Err: &APIError{StatusCode: 503}}, true, 1},
+		{"partly rejected", &PartialError{Rejected: data[:1], RejectErr: &APIError{StatusCode: 400}}, true, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &testSink{name: "test"}
+			withTestLoadStage(t, s)
+			holdRetries(t)
+			checkpoint = newCheckpoint(state)
+			if _, err := checkpoint.Begin("run", "in.csv", len(data), false); err != nil {
+				t.Fatal(err)
+			}
+			for _, d := range data {
+				checkpoint.Expect(d.appliance, 1)
+			}
+
+			settleFlush(s, newBatchID(data), data, 0, time.Now(), tt.err, tt.requeue)
+			if done := checkpointDone(t); len(done) != tt.wantDone {
+				t.Errorf("%d appliances done, want %d: %v", len(done), tt.wantDone, done)
+			}
+		})
+	}
+}
+
+// checkpointDone returns the appliances the checkpoint of the state store
+// has as done.
+func checkpointDone(t *testing.T) map[string]bool {
+	t.Helper()
+	done, err := newCheckpoint(state).Begin("next", "in.csv", 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return done
+}
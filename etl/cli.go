@@ -0,0 +1,473 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// Commands
+//////////////////////////////////////////////////
+
+const usage = `usage: etl [flags] [command] [command flags]
+
+commands:
+  run                 run the ETL once (the default), or with -stream poll until shut down
+  serve               keep running, repeating the ETL on daemon.schedule or daemon.interval
+  replay              resend spilled batches, or the spill files given, without extracting anything
+  validate-config     check the configuration, the input CSV and optionally the endpoints
+  buffers <command>   list, inspect or purge spilled batches
+  dlq <command>       inspect, replay or purge the dead-letter queue
+  spill <command>     query the SQLite spill store
+  bench               run the pipeline benchmarks
+
+Flags go before or after the command; run "etl -h" to list them.`
+
+// commands maps each command to its implementation. Commands get the
+// arguments after their name; the configuration is already loaded.
+// validate-config is run by main itself, as it has to run on a
+// configuration that failed to load.
+//
+// The commands sit on the flag package rather than cobra on purpose: pflag
+// only takes long flags with two dashes, and the scripts, unit files and
+// cron jobs running etl pass -config, -input and the rest with one.
+var commands = map[string]func(args []string) error{
+	"run":     runCommand,
+	"serve":   serveCommand,
+	"replay":  runReplayCommand,
+	"buffers": runBuffersCommand,
+	"dlq":     runDLQCommand,
+	"spill":   runSpillCommand,
+	"bench":   runBenchCommand,
+	"help": func([]string) error {
+		fmt.Println(usage)
+		return nil
+	},
+}
+
+// commandFlags are the flags of a command, or of its subcommands, named like
+// a global flag. After the command they are the command's.
+// TestCommandFlags checks them against the commands' usages.
+var commandFlags = map[string][]string{
+	"buffers": {"sink"},
+	"spill":   {"sink"},
+}
+
+// splitGlobalFlags separates the flags of fs in the arguments of a command
+// from the command's own arguments. Everything after "--" is the command's.
+func splitGlobalFlags(fs *flag.FlagSet, args, shadowed []string) (global, rest []string) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return global, append(rest, args[i:]...)
+		}
+		name, _, hasValue := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-"), "=")
+		f := fs.Lookup(name)
+		if !strings.HasPrefix(arg, "-") || f == nil || slices.Contains(shadowed, name) {
+			rest = append(rest, arg)
+			continue
+		}
+		global = append(global, arg)
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); !hasValue && !(ok && b.IsBoolFlag()) && i+1 < len(args) {
+			i++
+			global = append(global, args[i])
+		}
+	}
+	return global, rest
+}
+
+// noArgs fails for commands that take no arguments.
+func noArgs(command string, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("usage: etl [flags] %s", command)
+	}
+	return nil
+}
+
+// runCommand runs the ETL once, or as a daemon with -daemon or
+// daemon.enabled, as the binary always has without a command.
+func runCommand(args []string) error {
+	if err := noArgs("run", args); err != nil {
+		return err
+	}
+	runPipeline(cfg.Daemon.Enabled)
+	return nil
+}
+
+func serveCommand(args []string) error {
+	if err := noArgs("serve", args); err != nil {
+		return err
+	}
+	if cfg.Stream.Enabled {
+		return errors.New("serve repeats runs on a schedule; a stream (stream.enabled) is started with run")
+	}
+	runPipeline(true)
+	return nil
+}
+
+//////////////////////////////////////////////////
+// Replay Command
+//////////////////////////////////////////////////
+
+const replayUsage = `usage: etl [flags] replay [-file glob] [-endpoint url]
+
+Resends spilled batches without extracting anything: every batch in the
+spill store and the legacy spill files in the working directory or, with
+-file, only the spill files matching the glob. A file goes to the sink its
+directory is named after, or to every sink if that isn't one. Batches that
+fail again are spilled to the spill store.`
+
+// runReplayCommand loads spilled batches into the configured sinks and
+// fails if any of them couldn't be delivered.
+func runReplayCommand(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprintln(fs.Output(), replayUsage) }
+	fileGlob := fs.String("file", "", "replay only the spill files matching this glob, e.g. 'spill/http/*.json.gz'")
+	endpoint := fs.String("endpoint", "", "load API URL to send to instead of api.endpoint")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return errors.New(replayUsage)
+	}
+	if *endpoint != "" {
+		if !slices.Contains(cfg.Load.sinkList(), "http") {
+			return errors.New("-endpoint sets the http sink's URL, but the http sink isn't configured")
+		}
+		if !strings.HasPrefix(*endpoint, "http://") && !strings.HasPrefix(*endpoint, "https://") {
+			return fmt.Errorf("-endpoint must be an http(s) URL, got %q", *endpoint)
+		}
+		cfg.API.Endpoint = *endpoint
+	}
+	var files []string
+	if *fileGlob != "" {
+		var err error
+		if files, err = filepath.Glob(*fileGlob); err != nil {
+			return fmt.Errorf("-file: %w", err)
+		}
+		if len(files) == 0 {
+			return fmt.Errorf("-file %s matches no files", *fileGlob)
+		}
+	}
+
+	if err := resolveSecrets(); err != nil {
+		return fmt.Errorf("resolving secrets: %w", err)
+	}
+	closeStores := openLoadStage()
+	defer closeStores()
+	defer closeSinks(loadSinks)
+
+	startTime = time.Now()
+	runStats = newRunStats(newRunID(), loadSinks)
+	unreadable := 0
+	if files != nil {
+		unreadable = replaySpillFiles(files)
+	} else {
+		initBuffers(cfg.Load.Workers)
+		initChannels(cfg.Load.Workers)
+		var loadWg sync.WaitGroup
+		for i := 0; i < cfg.Load.Workers; i++ {
+			loadWg.Add(1)
+			go loadWorker(&loadWg, i)
+		}
+
+		loadFailedBuffers()
+		pruneSpilledBatches()
+		pruneAcks()
+		replaySpilledBatches()
+		closeChannels()
+		loadWg.Wait()
+	}
+
+	sum := runStats.Summary()
+	slog.Info("Replay summary", append(sum.SinkSummary.logAttrs(), "duration_ms", time.Since(startTime).Milliseconds())...)
+	fmt.Printf("%d records loaded, %d spilled again, %d dead-lettered\n",
+		sum.RecordsLoaded, sum.RecordsSpilled, sum.RecordsDeadLettered)
+	if unreadable > 0 {
+		return fmt.Errorf("%d spill file(s) could not be read; see the log", unreadable)
+	}
+	if sum.RecordsSpilled > 0 || sum.RecordsDeadLettered > 0 {
+		return errors.New("some batches could not be replayed")
+	}
+	return nil
+}
+
+//////////////////////////////////////////////////
+// Buffers Command
+//////////////////////////////////////////////////
+
+const buffersUsage = `usage: etl [flags] buffers <command>
+
+commands:
+  list [-sink name]                                    list spilled batches waiting for replay
+  inspect [-top n] [-ndjson] (<file> | <sink> <id>)    summarize a spilled batch, or dump its records
+  purge [-sink name] (<id>... | -all | -older-than d)  delete batches without sending them`
+
+func runBuffersCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New(buffersUsage)
+	}
+	switch args[0] {
+	case "list":
+		fs := flag.NewFlagSet("buffers list", flag.ContinueOnError)
+		sink := fs.String("sink", "", "only list batches of this sink")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		store, closeStore, err := openSpillStore()
+		if err != nil {
+			return err
+		}
+		defer closeStore()
+		return buffersList(store, selectSinks(*sink))
+	case "inspect":
+		return buffersInspect(args[1:])
+	case "purge":
+		store, closeStore, err := openSpillStore()
+		if err != nil {
+			return err
+		}
+		defer closeStore()
+		return buffersPurge(store, args[1:])
+	default:
+		return fmt.Errorf("unknown buffers command %q\n%s", args[0], buffersUsage)
+	}
+}
+
+// openSpillStore opens the configured spill store, and the state store it
+// may live in, outside of a run. Secrets are resolved first for the spill
+// key.
+func openSpillStore() (store SpillStore, closeStore func(), err error) {
+	if err := resolveSecrets(); err != nil {
+		return nil, nil, fmt.Errorf("resolving secrets: %w", err)
+	}
+	state, err = openStateStore(cfg.State)
+	if err != nil {
+		return nil, nil, err
+	}
+	store, err = newSpillStore(cfg, state)
+	if err != nil {
+		state.Close()
+		return nil, nil, err
+	}
+	return store, func() {
+		if c, ok := store.(io.Closer); ok {
+			c.Close()
+		}
+		state.Close()
+	}, nil
+}
+
+// selectSinks returns the sink, or every configured sink when it is empty.
+func selectSinks(sink string) []string {
+	if sink != "" {
+		return []string{sink}
+	}
+	return cfg.Load.sinkList()
+}
+
+func buffersList(store SpillStore, sinks []string) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SINK\tID\tRECORDS\tATTEMPTS\tSPILLED AT\tERROR")
+	for _, sink := range sinks {
+		ids, err := store.List(sink)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			b, err := store.Get(sink, id)
+			if errors.Is(err, errSpillGone) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\n", sink, id, len(b.Records), b.Attempts,
+				b.SpilledAt.Format(time.RFC3339), truncate(b.Error, 60))
+		}
+	}
+	return w.Flush()
+}
+
+func buffersPurge(store SpillStore, args []string) error {
+	fs := flag.NewFlagSet("buffers purge", flag.ContinueOnError)
+	sink := fs.String("sink", "", "sink the batches belong to; every configured sink with -all or -older-than")
+	all := fs.Bool("all", false, "purge every spilled batch")
+	var olderThan Duration
+	fs.Var(&olderThan, "older-than", "purge the batches spilled longer ago than this, e.g. 7d or 36h")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	modes := 0
+	for _, set := range []bool{*all, olderThan > 0, fs.NArg() > 0} {
+		if set {
+			modes++
+		}
+	}
+	if modes != 1 || (fs.NArg() > 0 && *sink == "") {
+		return errors.New("usage: etl buffers purge -sink <name> <id>... | etl buffers purge [-sink <name>] (-all | -older-than <duration>)")
+	}
+
+	if olderThan > 0 {
+		pruned, err := spillRetention{maxAge: olderThan.Std()}.prune(store, selectSinks(*sink), time.Now())
+		for _, e := range pruned {
+			fmt.Printf("%s/%s: purged (spilled %s, %d records)\n", e.sink, e.id, e.spilledAt.Format(time.RFC3339), e.records)
+		}
+		return err
+	}
+	for _, s := range selectSinks(*sink) {
+		ids := fs.Args()
+		if *all {
+			var err error
+			if ids, err = store.List(s); err != nil {
+				return err
+			}
+		}
+		for _, id := range ids {
+			if err := store.Delete(s, id); err != nil && !errors.Is(err, errSpillGone) {
+				return err
+			}
+			slog.Info("Purged spilled batch", "component", "buffers", "sink", s, "spill_id", id)
+			fmt.Printf("%s/%s: purged\n", s, id)
+		}
+	}
+	return nil
+}
+
+// buffersInspect prints what a spilled batch holds: its records per host
+// and their time range, or with -ndjson the records themselves, one JSON
+// object per line. A spill file, in any format, is read directly, without
+// the spill store, so it can be inspected while a run holds the state
+// store or after being copied off another host.
+func buffersInspect(args []string) error {
+	fs := flag.NewFlagSet("buffers inspect", flag.ContinueOnError)
+	top := fs.Int("top", 20, "hosts to list, by record count (0 = all)")
+	ndjson := fs.Bool("ndjson", false, "print the records as NDJSON instead of a summary")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var b *SpilledBatch
+	var err error
+	name := strings.Join(fs.Args(), "/")
+	switch fs.NArg() {
+	case 1:
+		if err := resolveSecrets(); err != nil {
+			return fmt.Errorf("resolving secrets: %w", err)
+		}
+		if err := setupSpillEncryption(&cfg.Load); err != nil {
+			return err
+		}
+		b, err = readSpillFile(fs.Arg(0))
+	case 2:
+		store, closeStore, openErr := openSpillStore()
+		if openErr != nil {
+			return openErr
+		}
+		defer closeStore()
+		b, err = store.Get(fs.Arg(0), fs.Arg(1))
+	default:
+		return errors.New("usage: etl buffers inspect [-top n] [-ndjson] (<file> | <sink> <id>)")
+	}
+	if err != nil {
+		return err
+	}
+
+	if *ndjson {
+		enc := json.NewEncoder(os.Stdout)
+		for _, d := range b.Records {
+			if err := enc.Encode(d); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	printSpillSummary(os.Stdout, name, b, *top)
+	return nil
+}
+
+func printSpillSummary(out io.Writer, name string, b *SpilledBatch, top int) {
+	hosts := map[string]int{}
+	metrics := map[string]int{}
+	var first, last uint64
+	for _, d := range b.Records {
+		hosts[d.Name]++
+		metric := d.Metric
+		if metric == "" {
+			metric = "cpu"
+		}
+		metrics[metric]++
+		if d.Timestamp == 0 {
+			continue
+		}
+		if first == 0 || d.Timestamp < first {
+			first = d.Timestamp
+		}
+		last = max(last, d.Timestamp)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Batch:\t%s\n", name)
+	if b.RunID != "" {
+		fmt.Fprintf(w, "Run:\t%s\n", b.RunID)
+	}
+	fmt.Fprintf(w, "Worker:\t%d\n", b.WorkerID)
+	fmt.Fprintf(w, "Spilled at:\t%s\n", b.SpilledAt.Format(time.RFC3339))
+	if b.Error != "" {
+		fmt.Fprintf(w, "Error:\t%s (%d attempts)\n", b.Error, b.Attempts)
+	}
+	fmt.Fprintf(w, "Records:\t%d\n", len(b.Records))
+	if first != 0 {
+		from, to := time.Unix(int64(first), 0).UTC(), time.Unix(int64(last), 0).UTC()
+		fmt.Fprintf(w, "Timestamps:\t%s .. %s (%s)\n", from.Format(time.RFC3339), to.Format(time.RFC3339), to.Sub(from))
+	}
+	fmt.Fprintf(w, "Metrics:\t%s\n", formatCounts(metrics))
+	fmt.Fprintf(w, "Hosts:\t%d\n", len(hosts))
+	w.Flush()
+
+	w = tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "\nHOST\tRECORDS")
+	names := sortedByCount(hosts)
+	for i, name := range names {
+		if top > 0 && i == top {
+			fmt.Fprintf(w, "(%d more)\t\n", len(names)-top)
+			break
+		}
+		fmt.Fprintf(w, "%s\t%d\n", name, hosts[name])
+	}
+	w.Flush()
+}
+
+// sortedByCount returns the keys of counts, most counted first.
+func sortedByCount(counts map[string]int) []string {
+	keys := slices.Collect(maps.Keys(counts))
+	slices.SortFunc(keys, func(a, b string) int {
+		if c := cmp.Compare(counts[b], counts[a]); c != 0 {
+			return c
+		}
+		return strings.Compare(a, b)
+	})
+	return keys
+}
+
+// formatCounts formats counts as "a 3, b 1", most counted first.
+func formatCounts(counts map[string]int) string {
+	var parts []string
+	for _, k := range sortedByCount(counts) {
+		parts = append(parts, fmt.Sprintf("%s %d", k, counts[k]))
+	}
+	return strings.Join(parts, ", ")
+}
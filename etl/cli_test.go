@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigFlagsAfterCommand(t *testing.T) {
+	tests := []struct {
+		args      []string
+		wantArgs  []string
+		wantInput string
+		wantSink  string
+	}{
+		{[]string{"-input", "a.csv", "run"}, []string{"run"}, "a.csv", "http"},
+		{[]string{"run", "-input", "a.csv", "-resume"}, []string{"run"}, "a.csv", "http"},
+		{[]string{"run", "-input=a.csv"}, []string{"run"}, "a.csv", "http"},
+		{[]string{"-sink", "file", "replay", "-file", "spill/*.json.gz", "--input", "a.csv"},
+			[]string{"replay", "-file", "spill/*.json.gz"}, "a.csv", "file"},
+		{[]string{"dlq", "replay", "-all", "-input", "a.csv"}, []string{"dlq", "replay", "-all"}, "a.csv", "http"},
+		// -sink after buffers filters the batches listed.
+		{[]string{"buffers", "list", "-sink", "s3", "-input", "a.csv"}, []string{"buffers", "list", "-sink", "s3"}, "a.csv", "http"},
+		{[]string{"spill", "query", "--", "-input", "a.csv"}, []string{"spill", "query", "--", "-input", "a.csv"}, "appliances.csv", "http"},
+		{[]string{"validate-config", "-check-endpoints", "-h"}, []string{"validate-config", "-check-endpoints", "-h"}, "appliances.csv", "http"},
+	}
+	for _, tt := range tests {
+		c, args, err := loadConfig(tt.args)
+		if c == nil {
+			t.Errorf("loadConfig(%q): %v", tt.args, err)
+			continue
+		}
+		if !slices.Equal(args, tt.wantArgs) {
+			t.Errorf("loadConfig(%q) args = %q, want %q", tt.args, args, tt.wantArgs)
+		}
+		if sinks := c.Load.sinkList(); c.InputFile != tt.wantInput || !slices.Equal(sinks, []string{tt.wantSink}) {
+			t.Errorf("loadConfig(%q) input %s, sinks %q; want %s, %s", tt.args, c.InputFile, sinks, tt.wantInput, tt.wantSink)
+		}
+	}
+}
+
+// The flags a command's usage names like a global flag are in
+// commandFlags, so they stay the command's when they follow it.
+func TestCommandFlags(t *testing.T) {
+	usages := map[string]string{
+		"replay":          replayUsage,
+		"buffers":         buffersUsage,
+		"dlq":             dlqUsage,
+		"spill":           spillUsage,
+		"bench":           benchUsage,
+		"validate-config": validateConfigUsage,
+	}
+	flagName := regexp.MustCompile(`(?:^|[\s\[(|])-([a-z][a-z-]*)`)
+	for command, usage := range usages {
+		// The flags before the command are global.
+		_, usage, _ = strings.Cut(usage, " "+command)
+		var want []string
+		for _, m := range flagName.FindAllStringSubmatch(usage, -1) {
+			if !slices.Contains(want, m[1]) && isGlobalFlag(m[1]) {
+				want = append(want, m[1])
+			}
+		}
+		slices.Sort(want)
+		if got := slices.Sorted(slices.Values(commandFlags[command])); !slices.Equal(got, want) {
+			t.Errorf("commandFlags[%q] = %q, want %q", command, got, want)
+		}
+	}
+}
+
+// isGlobalFlag reports whether loadConfig knows the flag name.
+func isGlobalFlag(name string) bool {
+	// loadConfig prints its usage on bad flags.
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		panic(err)
+	}
+	defer devNull.Close()
+	stderr := os.Stderr
+	defer func() { os.Stderr = stderr }()
+	os.Stderr = devNull
+	_, _, err = loadConfig([]string{"-" + name})
+	return err == nil || !strings.Contains(err.Error(), "not defined")
+}
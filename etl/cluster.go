@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+//////////////////////////////////////////////////
+// Distributed Mode
+//////////////////////////////////////////////////
+
+// ClusterConfig splits the appliances among several ETL instances, each
+// extracting only its share. With static the instances are numbered 0 to
+// Instances-1 and each is told its Index; with redis they find each other
+// through a Redis server and the share of an instance that goes away is
+// taken over by the others.
+type ClusterConfig struct {
+	Mode      string `yaml:"mode" json:"mode"` // none, static or redis
+	Instances int    `yaml:"instances" json:"instances"`
+	Index     int    `yaml:"index" json:"index"`
+	// InstanceID names the instance among the redis members; it defaults
+	// to the host name and process ID.
+	InstanceID string           `yaml:"instance_id" json:"instance_id"`
+	Redis      RedisSpillConfig `yaml:"redis" json:"redis"`
+	// An instance refreshes its membership every HeartbeatInterval and is
+	// dropped by the others once it hasn't for MemberTTL.
+	HeartbeatInterval Duration `yaml:"heartbeat_interval" json:"heartbeat_interval"`
+	MemberTTL         Duration `yaml:"member_ttl" json:"member_ttl"`
+}
+
+func defaultClusterConfig() ClusterConfig {
+	return ClusterConfig{
+		Mode:              "none",
+		Instances:         1,
+		Redis:             defaultRedisSpillConfig(),
+		HeartbeatInterval: Duration(5 * time.Second),
+		MemberTTL:         Duration(15 * time.Second),
+	}
+}
+
+func (c *ClusterConfig) validate() []error {
+	var errs []error
+	switch c.Mode {
+	case "none":
+	case "static":
+		if c.Instances <= 0 {
+			errs = append(errs, fmt.Errorf("cluster.instances must be > 0, got %d", c.Instances))
+		}
+		if c.Index < 0 || c.Index >= c.Instances {
+			errs = append(errs, fmt.Errorf("cluster.index must be between 0 and cluster.instances-1, got %d", c.Index))
+		}
+	case "redis":
+		errs = append(errs, c.Redis.validate("cluster.redis")...)
+		if c.HeartbeatInterval <= 0 {
+			errs = append(errs, errors.New("cluster.heartbeat_interval must be > 0"))
+		}
+		if c.MemberTTL <= c.HeartbeatInterval {
+			errs = append(errs, errors.New("cluster.member_ttl must be longer than cluster.heartbeat_interval"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("cluster.mode must be none, static or redis, got %q", c.Mode))
+	}
+	return errs
+}
+
+// Cluster decides which appliances this instance owns. Appliances are
+// assigned by rendezvous hashing: each goes to the member with the highest
+// hash of member and appliance, so a member joining or leaving only moves
+// its own share. Methods are safe on a nil *Cluster, which owns everything.
+type Cluster struct {
+	conf   ClusterConfig
+	self   string
+	client *redis.Client // nil with static
+
+	mu      sync.Mutex
+	members []string // sorted, as last seen
+	owned   int
+}
+
+// cluster is the cluster of the process, nil unless cluster.mode is set.
+var cluster *Cluster
+
+func newCluster(conf ClusterConfig) (*Cluster, error) {
+	c := &Cluster{conf: conf}
+	if conf.Mode == "static" {
+		c.self = strconv.Itoa(conf.Index)
+		for i := range conf.Instances {
+			c.members = append(c.members, strconv.Itoa(i))
+		}
+		return c, nil
+	}
+
+	c.self = conf.InstanceID
+	if c.self == "" {
+		host, _ := os.Hostname()
+		c.self = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+	client, err := newRedisClient(conf.Redis)
+	if err != nil {
+		return nil, err
+	}
+	c.client = client
+	if err := c.heartbeat(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Cluster) membersKey() string {
+	return c.conf.Redis.KeyPrefix + "cluster:members"
+}
+
+// heartbeat refreshes this instance's membership and drops the members
+// that stopped refreshing theirs.
+func (c *Cluster) heartbeat() error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.conf.Redis.Timeout.Std())
+	defer cancel()
+	now := time.Now()
+	_, err := c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, c.membersKey(), redis.Z{Score: float64(now.UnixMilli()), Member: c.self})
+		pipe.ZRemRangeByScore(ctx, c.membersKey(), "-inf", strconv.FormatInt(now.Add(-c.conf.MemberTTL.Std()).UnixMilli(), 10))
+		return nil
+	})
+	return err
+}
+
+// Run keeps the membership fresh until ctx is done.
+func (c *Cluster) Run(ctx context.Context) {
+	if c == nil || c.client == nil {
+		return
+	}
+	ticker := time.NewTicker(c.conf.HeartbeatInterval.Std())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.heartbeat(); err != nil {
+				slog.Warn("Cluster heartbeat failed", "component", "cluster", "instance", c.self, "error", err)
+			}
+		}
+	}
+}
+
+// Close leaves the cluster, so the others take over this instance's share
+// on their next run rather than once member_ttl has passed.
+func (c *Cluster) Close() {
+	if c == nil || c.client == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.conf.Redis.Timeout.Std())
+	defer cancel()
+	if err := c.client.ZRem(ctx, c.membersKey(), c.self).Err(); err != nil {
+		slog.Warn("Failed to leave the cluster", "component", "cluster", "instance", c.self, "error", err)
+	}
+	c.client.Close()
+}
+
+// currentMembers reads the live members from Redis. If that fails the
+// members last seen are used.
+func (c *Cluster) currentMembers(ctx context.Context) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client == nil {
+		return c.members
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.conf.Redis.Timeout.Std())
+	defer cancel()
+	since := time.Now().Add(-c.conf.MemberTTL.Std()).UnixMilli()
+	members, err := c.client.ZRangeByScore(ctx, c.membersKey(), &redis.ZRangeBy{
+		Min: strconv.FormatInt(since, 10), Max: "+inf",
+	}).Result()
+	if err != nil {
+		slog.Warn("Failed to read cluster members, using the last known", "component", "cluster",
+			"members", len(c.members), "error", err)
+		return c.members
+	}
+	// This instance counts even if its last heartbeat didn't get through,
+	// so it always owns a share.
+	if !slices.Contains(members, c.self) {
+		members = append(members, c.self)
+	}
+	slices.Sort(members)
+	if !slices.Equal(members, c.members) {
+		slog.Info("Cluster members changed", "component", "cluster", "instance", c.self,
+			"members", members, "previous", c.members)
+		c.members = members
+	}
+	return members
+}
+
+// Partition returns the appliances this instance owns.
+func (c *Cluster) Partition(ctx context.Context, appliances []Appliance) []Appliance {
+	if c == nil {
+		return appliances
+	}
+	members := c.currentMembers(ctx)
+	owned := make([]Appliance, 0, len(appliances)/max(1, len(members))+1)
+	for _, ap := range appliances {
+		if owner(members, ap.key()) == c.self {
+			owned = append(owned, ap)
+		}
+	}
+	c.mu.Lock()
+	level := slog.LevelDebug
+	if len(owned) != c.owned {
+		level, c.owned = slog.LevelInfo, len(owned)
+	}
+	c.mu.Unlock()
+	slog.Log(ctx, level, "Appliances partitioned", "component", "cluster", "instance", c.self, "members", len(members),
+		"owned", len(owned), "appliances", len(appliances))
+	return owned
+}
+
+// owner is the member an appliance key is assigned to.
+func owner(members []string, key string) string {
+	var best string
+	var bestScore uint64
+	for _, m := range members {
+		h := fnv.New64a()
+		h.Write([]byte(m))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		if score := h.Sum64(); best == "" || score > bestScore {
+			best, bestScore = m, score
+		}
+	}
+	return best
+}
+
+// ownedAppliances lists the appliances of a run and keeps this instance's
+// share of them.
+func ownedAppliances(ctx context.Context) ([]Appliance, error) {
+	appliances, err := listAppliances(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return cluster.Partition(ctx, appliances), nil
+}
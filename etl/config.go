@@ -0,0 +1,731 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+//////////////////////////////////////////////////
+// Configuration
+//////////////////////////////////////////////////
+
+type Config struct {
+	InputFile  string           `yaml:"input_file" json:"input_file"`
+	LogFile    string           `yaml:"log_file" json:"log_file"`
+	LogLevel   string           `yaml:"log_level" json:"log_level"`
+	LogFormat  string           `yaml:"log_format" json:"log_format"`
+	Progress   string           `yaml:"progress" json:"progress"` // auto, always or never
+	Discovery  DiscoveryConfig  `yaml:"discovery" json:"discovery"`
+	Extract    ExtractConfig    `yaml:"extract" json:"extract"`
+	Transform  TransformConfig  `yaml:"transform" json:"transform"`
+	Filter     FilterConfig     `yaml:"filter" json:"filter"`
+	Aggregate  AggregateConfig  `yaml:"aggregate" json:"aggregate"`
+	Rollup     RollupConfig     `yaml:"rollup" json:"rollup"`
+	Dedup      DedupConfig      `yaml:"dedup" json:"dedup"`
+	Validation ValidationConfig `yaml:"validation" json:"validation"`
+	Quality    QualityConfig    `yaml:"quality" json:"quality"`
+	Load       LoadConfig       `yaml:"load" json:"load"`
+	API        APIConfig        `yaml:"api" json:"api"`
+	Tracing    TracingConfig    `yaml:"tracing" json:"tracing"`
+	DLQ        DLQConfig        `yaml:"dlq" json:"dlq"`
+	Sinks      SinksConfig      `yaml:"sinks" json:"sinks"`
+	Daemon     DaemonConfig     `yaml:"daemon" json:"daemon"`
+	Stream     StreamConfig     `yaml:"stream" json:"stream"`
+	Cluster    ClusterConfig    `yaml:"cluster" json:"cluster"`
+	Election   ElectionConfig   `yaml:"election" json:"election"`
+	Checkpoint CheckpointConfig `yaml:"checkpoint" json:"checkpoint"`
+	State      StateConfig      `yaml:"state" json:"state"`
+	Memory     MemoryConfig     `yaml:"memory" json:"memory"`
+	Secrets    SecretsConfig    `yaml:"secrets" json:"secrets"`
+	Debug      DebugConfig      `yaml:"debug" json:"debug"`
+	Report     ReportConfig     `yaml:"report" json:"report"`
+	Audit      AuditConfig      `yaml:"audit" json:"audit"`
+}
+
+type ExtractConfig struct {
+	Type           string            `yaml:"type" json:"type"`
+	Metrics        []string          `yaml:"metrics" json:"metrics"`         // cpu, memory, disk, network
+	CPURecords     string            `yaml:"cpu_records" json:"cpu_records"` // host, cores, both
+	Workers        int               `yaml:"workers" json:"workers"`
+	Timeout        Duration          `yaml:"timeout" json:"timeout"`
+	SimulatedDelay Duration          `yaml:"simulated_delay" json:"simulated_delay"`
+	Splay          Duration          `yaml:"splay" json:"splay"`   // spread a run's dispatches evenly over this long
+	Jitter         Duration          `yaml:"jitter" json:"jitter"` // delay each dispatch or stream poll by up to this much at random
+	Autoscale      AutoscaleConfig   `yaml:"autoscale" json:"autoscale"`
+	Politeness     PolitenessConfig  `yaml:"politeness" json:"politeness"`
+	Priority       PriorityConfig    `yaml:"priority" json:"priority"`
+	HTTP           HTTPExtractConfig `yaml:"http" json:"http"`
+	SNMP           SNMPExtractConfig `yaml:"snmp" json:"snmp"`
+	SSH            SSHExtractConfig  `yaml:"ssh" json:"ssh"`
+	GRPC           GRPCExtractConfig `yaml:"grpc" json:"grpc"`
+	// Credentials are named by the third column of the appliance CSV.
+	Credentials map[string]*ApplianceCredentials `yaml:"credentials" json:"credentials"`
+}
+
+type LoadConfig struct {
+	Sink        string   `yaml:"sink" json:"sink"`
+	Sinks       []string `yaml:"sinks" json:"sinks"`
+	SpillStore  string   `yaml:"spill_store" json:"spill_store"`
+	SpillDir    string   `yaml:"spill_dir" json:"spill_dir"`
+	SpillFormat string   `yaml:"spill_format" json:"spill_format"` // json, msgpack or parquet, with spill_store: files
+	SpillDB     string   `yaml:"spill_db" json:"spill_db"`
+	// SpillRetention is how long the SQLite spill store keeps replayed
+	// batches for querying.
+	SpillRetention Duration `yaml:"spill_retention" json:"spill_retention"`
+	SpillMaxAge    Duration `yaml:"spill_max_age" json:"spill_max_age"`         // 0 keeps spills until replayed
+	SpillMaxSizeMB int      `yaml:"spill_max_size_mb" json:"spill_max_size_mb"` // 0 = no limit
+	// SpillKey encrypts spills at rest (spill_store files, bolt, s3 or
+	// gcs) with AES-GCM: a base64 AES key, normally a secret reference.
+	// SpillOldKey is the key before a rotation, still used to decrypt.
+	SpillKey        string             `yaml:"spill_key" json:"spill_key" secret:"true"`
+	SpillOldKey     string             `yaml:"spill_old_key" json:"spill_old_key" secret:"true"`
+	Redis           RedisSpillConfig   `yaml:"redis" json:"redis"`
+	S3              S3SpillConfig      `yaml:"s3" json:"s3"`
+	GCS             GCSSpillConfig     `yaml:"gcs" json:"gcs"`
+	HTTPClient      HTTPClientConfig   `yaml:"http_client" json:"http_client"`
+	Acks            AckConfig          `yaml:"acks" json:"acks"`
+	RetryQueue      RetryQueueConfig   `yaml:"retry_queue" json:"retry_queue"`
+	SpillReplay     SpillReplayConfig  `yaml:"spill_replay" json:"spill_replay"`
+	Backpressure    BackpressureConfig `yaml:"backpressure" json:"backpressure"`
+	Workers         int                `yaml:"workers" json:"workers"`
+	BufferThreshold int                `yaml:"buffer_threshold" json:"buffer_threshold"`
+	ChannelCapacity int                `yaml:"channel_capacity" json:"channel_capacity"`
+}
+
+// sinkList returns the sinks every batch is delivered to: load.sinks when
+// set, otherwise the single load.sink.
+func (l *LoadConfig) sinkList() []string {
+	if len(l.Sinks) > 0 {
+		return l.Sinks
+	}
+	return []string{l.Sink}
+}
+
+type APIConfig struct {
+	Endpoint             string               `yaml:"endpoint" json:"endpoint"`
+	AuthToken            string               `yaml:"auth_token" json:"auth_token" secret:"true"`
+	OAuth2               OAuth2Config         `yaml:"oauth2" json:"oauth2"` // overrides auth_token when token_url is set
+	Timeout              Duration             `yaml:"timeout" json:"timeout"`
+	Format               string               `yaml:"format" json:"format"`                               // json, protobuf, msgpack, auto
+	Compression          string               `yaml:"compression" json:"compression"`                     // none, gzip, zstd
+	CompressionThreshold int                  `yaml:"compression_threshold" json:"compression_threshold"` // bytes; smaller batches go uncompressed
+	StreamThreshold      int                  `yaml:"stream_threshold" json:"stream_threshold"`           // records; larger JSON batches are streamed chunked, 0 never
+	Retry                RetryConfig          `yaml:"retry" json:"retry"`
+	CircuitBreaker       CircuitBreakerConfig `yaml:"circuit_breaker" json:"circuit_breaker"`
+	RateLimit            RateLimitConfig      `yaml:"rate_limit" json:"rate_limit"`
+	// IdempotencyKey sends each batch's ID as Idempotency-Key, so the API
+	// can drop batches it already took when a retry or replay resends them.
+	IdempotencyKey bool `yaml:"idempotency_key" json:"idempotency_key"`
+}
+
+// Duration accepts Go duration strings ("15s", "2m") and days ("7d") in
+// both YAML and JSON.
+type Duration time.Duration
+
+func (d Duration) Std() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"15s\": %w", err)
+	}
+	return d.parse(s)
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	return d.parse(node.Value)
+}
+
+// Set and String make Duration a flag.Value.
+func (d *Duration) Set(s string) error {
+	return d.parse(s)
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// parse takes what time.ParseDuration does, or a number of days such as
+// "7d".
+func (d *Duration) parse(s string) error {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", s)
+		}
+		*d = Duration(n * float64(24*time.Hour))
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func defaultConfig() Config {
+	return Config{
+		InputFile: "appliances.csv",
+		LogFile:   "etl.log",
+		LogLevel:  "info",
+		LogFormat: "text",
+		Progress:  "auto",
+		Extract: ExtractConfig{
+			Type:           "simulated",
+			Metrics:        []string{"cpu"},
+			CPURecords:     "host",
+			Workers:        1000,
+			Timeout:        Duration(8 * time.Second),
+			SimulatedDelay: Duration(6 * time.Second),
+			Autoscale:      defaultAutoscaleConfig(),
+			Politeness:     defaultPolitenessConfig(),
+			HTTP:           defaultHTTPExtractConfig(),
+			SNMP:           defaultSNMPExtractConfig(),
+			SSH:            defaultSSHExtractConfig(),
+			GRPC:           defaultGRPCExtractConfig(),
+		},
+		Load: LoadConfig{
+			Sink:            "http",
+			SpillStore:      "bolt",
+			SpillDir:        "spill",
+			SpillFormat:     "json",
+			SpillDB:         "spill.db",
+			SpillRetention:  Duration(7 * 24 * time.Hour),
+			Redis:           defaultRedisSpillConfig(),
+			S3:              defaultS3SpillConfig(),
+			GCS:             defaultGCSSpillConfig(),
+			HTTPClient:      defaultHTTPClientConfig(),
+			Acks:            defaultAckConfig(),
+			RetryQueue:      defaultRetryQueueConfig(),
+			SpillReplay:     defaultSpillReplayConfig(),
+			Backpressure:    defaultBackpressureConfig(),
+			Workers:         10,
+			BufferThreshold: 200,
+			ChannelCapacity: 2000,
+		},
+		API: APIConfig{
+			Endpoint:             "http://localhost:8080/load",
+			AuthToken:            "Bearer your-token-here",
+			Timeout:              Duration(15 * time.Second),
+			Format:               "json",
+			Compression:          "none",
+			CompressionThreshold: 1024,
+			StreamThreshold:      1000,
+			Retry:                defaultRetryConfig(),
+			CircuitBreaker:       defaultCircuitBreakerConfig(),
+			RateLimit:            defaultRateLimitConfig(),
+			OAuth2:               defaultOAuth2Config(),
+			IdempotencyKey:       true,
+		},
+		Tracing:    defaultTracingConfig(),
+		DLQ:        defaultDLQConfig(),
+		Sinks:      defaultSinksConfig(),
+		Daemon:     defaultDaemonConfig(),
+		Stream:     defaultStreamConfig(),
+		Cluster:    defaultClusterConfig(),
+		Election:   defaultElectionConfig(),
+		Checkpoint: defaultCheckpointConfig(),
+		Transform:  defaultTransformConfig(),
+		Aggregate:  defaultAggregateConfig(),
+		Rollup:     defaultRollupConfig(),
+		Dedup:      defaultDedupConfig(),
+		Validation: defaultValidationConfig(),
+		Quality:    defaultQualityConfig(),
+		State:      defaultStateConfig(),
+		Memory:     defaultMemoryConfig(),
+		Secrets:    defaultSecretsConfig(),
+		Debug:      defaultDebugConfig(),
+		Report:     defaultReportConfig(),
+		Audit:      defaultAuditConfig(),
+		Discovery:  defaultDiscoveryConfig(),
+	}
+}
+
+//////////////////////////////////////////////////
+// Loading
+//////////////////////////////////////////////////
+
+// loadConfig builds the effective configuration: defaults, then the config
+// file (if any), then command-line flags that were explicitly set. Arguments
+// left after the flags (a subcommand) are returned as-is. Problems with the
+// file or the values are joined into the error, which comes with the
+// configuration as far as it could be loaded; only bad flags return none.
+func loadConfig(args []string) (*Config, []string, error) {
+	c := defaultConfig()
+
+	fs := flag.NewFlagSet("etl", flag.ContinueOnError)
+	configPath := fs.String("config", "", "path to YAML or JSON config file")
+	inputFile := fs.String("input", c.InputFile, "appliance CSV file")
+	logFile := fs.String("log-file", c.LogFile, "log file path")
+	logLevel := fs.String("log-level", c.LogLevel, "log level: debug, info, warn or error")
+	logFormat := fs.String("log-format", c.LogFormat, "log format: text or json")
+	progress := fs.String("progress", c.Progress, "progress line on stderr: auto (when a terminal), always or never")
+	extractorType := fs.String("extractor", c.Extract.Type, "extractor implementation to use")
+	extractWorkers := fs.Int("extract-workers", c.Extract.Workers, "number of concurrent extract goroutines")
+	sink := fs.String("sink", c.Load.Sink, "sink to load records into; comma-separated to fan out to several")
+	loadWorkers := fs.Int("load-workers", c.Load.Workers, "number of loader workers")
+	bufferThreshold := fs.Int("buffer-threshold", c.Load.BufferThreshold, "records per buffer flush")
+	apiEndpoint := fs.String("api-endpoint", c.API.Endpoint, "target load API URL")
+	apiToken := fs.String("api-token", c.API.AuthToken, "Authorization header for the load API")
+	apiRetries := fs.Int("api-max-attempts", c.API.Retry.MaxAttempts, "load API attempts per batch before spilling to disk")
+	apiRPS := fs.Float64("api-rps", c.API.RateLimit.RequestsPerSecond, "max load API requests per second across all workers (0 = unlimited)")
+	apiTimeout := fs.Duration("api-timeout", c.API.Timeout.Std(), "load API request timeout")
+	resume := fs.Bool("resume", c.Checkpoint.Resume, "skip appliances the interrupted previous run already finished (see checkpoint)")
+	auditFile := fs.String("audit-log", c.Audit.File, "append an entry for every load attempt and batch delivery to this file")
+	reportFile := fs.String("report", c.Report.File, "write a per-appliance outcome report to this file ({run_id} is replaced)")
+	debugAddr := fs.String("debug-addr", c.Debug.Addr, "serve live pprof and /status on this address, e.g. 127.0.0.1:6060")
+	daemon := fs.Bool("daemon", c.Daemon.Enabled, "keep running and repeat the ETL cycle on daemon.schedule or daemon.interval")
+	stream := fs.Bool("stream", c.Stream.Enabled, "keep running and poll each appliance every stream.interval")
+	clusterIndex := fs.Int("cluster-index", c.Cluster.Index, "this instance's number, from 0, among -cluster-instances sharing the appliances")
+	clusterInstances := fs.Int("cluster-instances", c.Cluster.Instances, "number of instances sharing the appliances (cluster.mode static)")
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	// Global flags may follow the command too, e.g. "etl run -config x".
+	args = fs.Args()
+	if len(args) > 0 {
+		global, rest := splitGlobalFlags(fs, args[1:], commandFlags[args[0]])
+		if err := fs.Parse(global); err != nil {
+			return nil, nil, err
+		}
+		args = append([]string{args[0]}, rest...)
+	}
+
+	var errs []error
+	if *configPath != "" {
+		errs = append(errs, readConfigFile(*configPath, &c))
+	}
+
+	// Flags win over the file, but only the ones the user actually passed.
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "input":
+			c.InputFile = *inputFile
+		case "log-file":
+			c.LogFile = *logFile
+		case "log-level":
+			c.LogLevel = *logLevel
+		case "log-format":
+			c.LogFormat = *logFormat
+		case "progress":
+			c.Progress = *progress
+		case "extractor":
+			c.Extract.Type = *extractorType
+		case "extract-workers":
+			c.Extract.Workers = *extractWorkers
+		case "sink":
+			c.Load.Sinks = strings.Split(*sink, ",")
+		case "load-workers":
+			c.Load.Workers = *loadWorkers
+		case "buffer-threshold":
+			c.Load.BufferThreshold = *bufferThreshold
+		case "api-endpoint":
+			c.API.Endpoint = *apiEndpoint
+		case "api-token":
+			c.API.AuthToken = *apiToken
+		case "api-max-attempts":
+			c.API.Retry.MaxAttempts = *apiRetries
+		case "api-rps":
+			c.API.RateLimit.RequestsPerSecond = *apiRPS
+		case "api-timeout":
+			c.API.Timeout = Duration(*apiTimeout)
+		case "resume":
+			c.Checkpoint.Resume = *resume
+		case "report":
+			c.Report.File = *reportFile
+		case "audit-log":
+			c.Audit.File = *auditFile
+		case "debug-addr":
+			c.Debug.Addr = *debugAddr
+		case "daemon":
+			c.Daemon.Enabled = *daemon
+		case "stream":
+			c.Stream.Enabled = *stream
+		case "cluster-index":
+			c.Cluster.Index = *clusterIndex
+		case "cluster-instances":
+			c.Cluster.Instances = *clusterInstances
+		}
+	})
+
+	// -cluster-index and -cluster-instances are enough to split the
+	// appliances without a cluster section in the file.
+	if c.Cluster.Mode == "none" && c.Cluster.Instances > 1 {
+		c.Cluster.Mode = "static"
+	}
+
+	errs = append(errs, c.Validate())
+	return &c, args, errors.Join(errs...)
+}
+
+// readConfigFile decodes the config file over c. Unknown keys don't stop the
+// decoding; they are all reported, with the line they are on.
+func readConfigFile(path string, c *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, c)
+	case ".json":
+		err = json.Unmarshal(data, c)
+	default:
+		return fmt.Errorf("config %s: unsupported extension %q (want .yaml, .yml or .json)", path, filepath.Ext(path))
+	}
+	if err != nil {
+		return fmt.Errorf("config %s: %w", path, err)
+	}
+
+	// JSON is YAML, so one walk over the YAML nodes covers both formats.
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return fmt.Errorf("config %s: %w", path, err)
+	}
+	var errs []error
+	for _, k := range unknownConfigKeys(&root, reflect.TypeFor[Config](), "") {
+		msg := fmt.Sprintf("%s:%d: unknown key %q", path, k.line, k.path)
+		if k.suggestion != "" {
+			msg += fmt.Sprintf(", did you mean %q?", k.suggestion)
+		}
+		errs = append(errs, errors.New(msg))
+	}
+	return errors.Join(errs...)
+}
+
+type unknownConfigKey struct {
+	path       string // dotted, e.g. load.workerz
+	line       int
+	suggestion string // closest known key at the same level, if any is close
+}
+
+// unknownConfigKeys walks node against the config type t and returns the
+// keys that no field of t matches.
+func unknownConfigKeys(node *yaml.Node, t reflect.Type, prefix string) []unknownConfigKey {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			return nil
+		}
+		return unknownConfigKeys(node.Content[0], t, prefix)
+	case yaml.AliasNode:
+		return unknownConfigKeys(node.Alias, t, prefix)
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	// Types decoding themselves, such as Duration, have no keys to check.
+	if reflect.PointerTo(t).Implements(reflect.TypeFor[yaml.Unmarshaler]()) {
+		return nil
+	}
+
+	var unknown []unknownConfigKey
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			return nil
+		}
+		fields := map[string]reflect.Type{}
+		for i := range t.NumField() {
+			f := t.Field(i)
+			if name, _, _ := strings.Cut(f.Tag.Get("yaml"), ","); name != "" && name != "-" {
+				fields[name] = f.Type
+			}
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if key.Tag == "!!merge" {
+				unknown = append(unknown, unknownConfigKeys(value, t, prefix)...)
+				continue
+			}
+			path := joinConfigPath(prefix, key.Value)
+			ft, ok := fields[key.Value]
+			if !ok {
+				unknown = append(unknown, unknownConfigKey{path, key.Line, closestConfigKey(key.Value, fields, prefix)})
+				continue
+			}
+			unknown = append(unknown, unknownConfigKeys(value, ft, path)...)
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			return nil
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			path := joinConfigPath(prefix, node.Content[i].Value)
+			unknown = append(unknown, unknownConfigKeys(node.Content[i+1], t.Elem(), path)...)
+		}
+	case reflect.Slice, reflect.Array:
+		if node.Kind != yaml.SequenceNode {
+			return nil
+		}
+		for i, item := range node.Content {
+			unknown = append(unknown, unknownConfigKeys(item, t.Elem(), fmt.Sprintf("%s[%d]", prefix, i))...)
+		}
+	}
+	return unknown
+}
+
+func joinConfigPath(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+// closestConfigKey returns the full path of the known key within two edits
+// of key, or "" when none is that close.
+func closestConfigKey(key string, known map[string]reflect.Type, prefix string) string {
+	best, bestDist := "", 3
+	for name := range known {
+		if d := editDistance(key, name); d < bestDist || (d == bestDist && name < best) {
+			best, bestDist = name, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return joinConfigPath(prefix, best)
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+//////////////////////////////////////////////////
+// Validation
+//////////////////////////////////////////////////
+
+func (c *Config) Validate() error {
+	var errs []error
+
+	if c.InputFile == "" && (c.Discovery.Type == "csv" || c.Discovery.Type == "json") {
+		errs = append(errs, errors.New("input_file must be set"))
+	}
+	errs = append(errs, c.Discovery.validate()...)
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		errs = append(errs, fmt.Errorf("log_level must be debug, info, warn or error, got %q", c.LogLevel))
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		errs = append(errs, fmt.Errorf("log_format must be text or json, got %q", c.LogFormat))
+	}
+	if c.Progress != "auto" && c.Progress != "always" && c.Progress != "never" {
+		errs = append(errs, fmt.Errorf("progress must be auto, always or never, got %q", c.Progress))
+	}
+	if _, ok := extractorRegistry[c.Extract.Type]; !ok {
+		errs = append(errs, fmt.Errorf("extract.type %q is not a known extractor (available: %v)", c.Extract.Type, extractorNames()))
+	}
+	if c.Extract.Workers <= 0 {
+		errs = append(errs, fmt.Errorf("extract.workers must be > 0, got %d", c.Extract.Workers))
+	}
+	errs = append(errs, c.Extract.Autoscale.validate(c.Extract.Workers)...)
+	errs = append(errs, c.Extract.Politeness.validate()...)
+	errs = append(errs, c.Extract.Priority.validate()...)
+	if c.Extract.Timeout <= 0 {
+		errs = append(errs, errors.New("extract.timeout must be > 0"))
+	}
+	errs = append(errs, validateMetrics(c.Extract.Metrics)...)
+	switch c.Extract.CPURecords {
+	case "host", "cores", "both":
+	default:
+		errs = append(errs, fmt.Errorf("extract.cpu_records must be host, cores or both, got %q", c.Extract.CPURecords))
+	}
+	if c.Extract.SimulatedDelay < 0 {
+		errs = append(errs, errors.New("extract.simulated_delay must be >= 0"))
+	}
+	if c.Extract.Splay < 0 {
+		errs = append(errs, errors.New("extract.splay must be >= 0"))
+	}
+	if c.Extract.Jitter < 0 {
+		errs = append(errs, errors.New("extract.jitter must be >= 0"))
+	}
+	switch c.Extract.Type {
+	case "http":
+		errs = append(errs, c.Extract.HTTP.validate()...)
+	case "snmp":
+		errs = append(errs, c.Extract.SNMP.validate()...)
+	case "ssh":
+		errs = append(errs, c.Extract.SSH.validate()...)
+	case "grpc":
+		errs = append(errs, c.Extract.GRPC.validate()...)
+	}
+	errs = append(errs, validateCredentials(c.Extract.Credentials)...)
+	seen := map[string]bool{}
+	for _, name := range c.Load.sinkList() {
+		if _, ok := sinkRegistry[name]; !ok {
+			errs = append(errs, fmt.Errorf("load.sink %q is not a known sink (available: %v)", name, sinkNames()))
+			continue
+		}
+		if seen[name] {
+			errs = append(errs, fmt.Errorf("load.sinks lists %q more than once", name))
+			continue
+		}
+		seen[name] = true
+		errs = append(errs, c.Sinks.validate(name)...)
+	}
+	switch c.Load.SpillStore {
+	case "bolt":
+	case "files":
+		if c.Load.SpillDir == "" {
+			errs = append(errs, errors.New("load.spill_dir must be set"))
+		}
+		switch c.Load.SpillFormat {
+		case "json", "msgpack", "parquet":
+		default:
+			errs = append(errs, fmt.Errorf("load.spill_format must be json, msgpack or parquet, got %q", c.Load.SpillFormat))
+		}
+	case "sqlite":
+		if c.Load.SpillDB == "" {
+			errs = append(errs, errors.New("load.spill_db must be set"))
+		}
+		if c.Load.SpillRetention < 0 {
+			errs = append(errs, errors.New("load.spill_retention must be >= 0"))
+		}
+	case "redis":
+		errs = append(errs, c.Load.Redis.validate("load.redis")...)
+	case "s3":
+		errs = append(errs, c.Load.S3.validate("load.s3")...)
+	case "gcs":
+		errs = append(errs, c.Load.GCS.validate("load.gcs")...)
+	default:
+		errs = append(errs, fmt.Errorf("load.spill_store must be bolt, files, sqlite, redis, s3 or gcs, got %q", c.Load.SpillStore))
+	}
+	if c.Load.SpillKey != "" && (c.Load.SpillStore == "sqlite" || c.Load.SpillStore == "redis") {
+		errs = append(errs, fmt.Errorf("load.spill_key only applies to spill_store files, bolt, s3 or gcs, not %s", c.Load.SpillStore))
+	}
+	if c.Load.SpillMaxAge < 0 {
+		errs = append(errs, errors.New("load.spill_max_age must be >= 0"))
+	}
+	if c.Load.SpillMaxSizeMB < 0 {
+		errs = append(errs, fmt.Errorf("load.spill_max_size_mb must be >= 0, got %d", c.Load.SpillMaxSizeMB))
+	}
+	errs = append(errs, c.Load.HTTPClient.validate()...)
+	errs = append(errs, c.Load.Acks.validate()...)
+	errs = append(errs, c.Load.RetryQueue.validate()...)
+	errs = append(errs, c.Load.SpillReplay.validate()...)
+	errs = append(errs, c.Load.Backpressure.validate()...)
+	if c.Load.Workers <= 0 {
+		errs = append(errs, fmt.Errorf("load.workers must be > 0, got %d", c.Load.Workers))
+	}
+	if c.Load.BufferThreshold <= 0 {
+		errs = append(errs, fmt.Errorf("load.buffer_threshold must be > 0, got %d", c.Load.BufferThreshold))
+	}
+	if c.Load.ChannelCapacity < 0 {
+		errs = append(errs, fmt.Errorf("load.channel_capacity must be >= 0, got %d", c.Load.ChannelCapacity))
+	}
+	if bp := c.Load.Backpressure; bp.Enabled && c.Load.Workers > 0 {
+		// Below one record the gate would close on every record queued.
+		if c.Load.ChannelCapacity == 0 {
+			errs = append(errs, errors.New("load.channel_capacity must be > 0 with load.backpressure.enabled"))
+		} else if bp.HighWatermark*float64(c.Load.Workers*c.Load.ChannelCapacity) < 1 {
+			errs = append(errs, fmt.Errorf("load.backpressure.high_watermark × load.workers × load.channel_capacity must be at least 1 record, got %g",
+				bp.HighWatermark*float64(c.Load.Workers*c.Load.ChannelCapacity)))
+		}
+	}
+	if !strings.HasPrefix(c.API.Endpoint, "http://") && !strings.HasPrefix(c.API.Endpoint, "https://") {
+		errs = append(errs, fmt.Errorf("api.endpoint must be an http(s) URL, got %q", c.API.Endpoint))
+	}
+	if c.API.Timeout <= 0 {
+		errs = append(errs, errors.New("api.timeout must be > 0"))
+	}
+	switch c.API.Format {
+	case "json", "protobuf", "msgpack", "auto":
+	default:
+		errs = append(errs, fmt.Errorf("api.format must be json, protobuf, msgpack or auto, got %q", c.API.Format))
+	}
+	switch c.API.Compression {
+	case "none", "gzip", "zstd":
+	default:
+		errs = append(errs, fmt.Errorf("api.compression must be none, gzip or zstd, got %q", c.API.Compression))
+	}
+	if c.API.CompressionThreshold < 0 {
+		errs = append(errs, errors.New("api.compression_threshold must be >= 0"))
+	}
+	if c.API.StreamThreshold < 0 {
+		errs = append(errs, errors.New("api.stream_threshold must be >= 0"))
+	}
+	errs = append(errs, c.API.OAuth2.validate()...)
+	errs = append(errs, c.API.Retry.validate("api.retry")...)
+	errs = append(errs, c.API.CircuitBreaker.validate()...)
+	errs = append(errs, c.API.RateLimit.validate()...)
+	errs = append(errs, c.Tracing.validate()...)
+	errs = append(errs, c.DLQ.validate()...)
+	errs = append(errs, c.Checkpoint.validate()...)
+	errs = append(errs, c.Transform.validate()...)
+	errs = append(errs, c.Filter.validate()...)
+	errs = append(errs, c.Aggregate.validate()...)
+	errs = append(errs, c.Rollup.validate()...)
+	if c.Rollup.Enabled && c.Aggregate.Enabled {
+		errs = append(errs, errors.New("rollup.enabled and aggregate.enabled can't both be set"))
+	}
+	errs = append(errs, c.Dedup.validate()...)
+	errs = append(errs, c.Validation.validate()...)
+	errs = append(errs, c.Quality.validate()...)
+	errs = append(errs, c.State.validate()...)
+	errs = append(errs, c.Memory.validate()...)
+	errs = append(errs, c.Secrets.validate()...)
+	errs = append(errs, c.Debug.validate()...)
+	errs = append(errs, c.Report.validate()...)
+	errs = append(errs, c.Cluster.validate()...)
+	errs = append(errs, c.Election.validate()...)
+	// The election reaches Consul or the API server as discovery does;
+	// those settings are checked above when discovery uses them too.
+	if c.Election.Backend == "consul" && c.Discovery.Type != "consul" {
+		errs = append(errs, c.Discovery.Consul.validate()...)
+	}
+	if c.Election.Backend == "kubernetes" && c.Discovery.Type != "kubernetes" {
+		errs = append(errs, c.Discovery.Kubernetes.validate()...)
+	}
+	errs = append(errs, secretRefErrors(c)...)
+	if c.Daemon.Enabled {
+		errs = append(errs, c.Daemon.validate()...)
+	}
+	if c.Stream.Enabled {
+		errs = append(errs, c.Stream.validate()...)
+		if c.Daemon.Enabled {
+			errs = append(errs, errors.New("stream.enabled and daemon.enabled can't both be set"))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// Dispatch Control
+//////////////////////////////////////////////////
+
+var errDraining = errors.New("run is draining")
+
+// DispatchControl gates how runETL hands appliances to extract workers.
+// Pausing holds dispatch (in-flight extracts and loads carry on); draining
+// stops it for the rest of the run so the run finishes with what it has.
+type DispatchControl struct {
+	mu       sync.Mutex
+	paused   bool
+	draining bool
+	changed  chan struct{} // closed and replaced on every state change
+}
+
+var dispatch = &DispatchControl{changed: make(chan struct{})}
+
+// Wait blocks while dispatch is paused. It returns errDraining once the run
+// is draining, or ctx's error when ctx is done.
+func (c *DispatchControl) Wait(ctx context.Context) error {
+	for {
+		c.mu.Lock()
+		paused, draining, changed := c.paused, c.draining, c.changed
+		c.mu.Unlock()
+
+		switch {
+		case draining:
+			return errDraining
+		case !paused:
+			return ctx.Err()
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *DispatchControl) set(fn func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fn()
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *DispatchControl) Pause()  { c.set(func() { c.paused = true }) }
+func (c *DispatchControl) Resume() { c.set(func() { c.paused = false }) }
+func (c *DispatchControl) Drain()  { c.set(func() { c.draining = true }) }
+
+// startRun clears a drain left over from the previous run. Pause persists
+// across runs until resumed.
+func (c *DispatchControl) startRun() { c.set(func() { c.draining = false }) }
+
+func (c *DispatchControl) State() (paused, draining bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.paused, c.draining
+}
+
+// runState exposes the run in progress to the control API.
+type runState struct {
+	id      string
+	started time.Time
+	stats   *RunStats
+	queues  []chan DeviceData
+	pool    *ExtractPool
+	gate    *Backpressure
+}
+
+// activeRun is set by runETL once its workers are started and cleared when
+// it returns.
+var activeRun atomic.Pointer[runState]
+
+//////////////////////////////////////////////////
+// Control API
+//////////////////////////////////////////////////
+
+type runStatus struct {
+	ID        string     `json:"id"`
+	StartedAt time.Time  `json:"started_at"`
+	ElapsedMS int64      `json:"elapsed_ms"`
+	Stats     RunSummary `json:"stats"`
+	// Per-second rates since the run started.
+	ExtractedPerSec     float64 `json:"extracted_per_sec"`
+	RecordsLoadedPerSec float64 `json:"records_loaded_per_sec"`
+	ExtractLimit        int     `json:"extract_limit"`
+	ExtractInFlight     int     `json:"extract_in_flight"`
+	QueueDepths         []int   `json:"queue_depths"`
+	QueueCapacity       int     `json:"queue_capacity"`
+	Backpressure        bool    `json:"backpressure"` // dispatch held back by load.backpressure
+}
+
+type daemonStatus struct {
+	State           string     `json:"state"`
+	Paused          bool       `json:"paused"`
+	Draining        bool       `json:"draining"`
+	OverBudget      bool       `json:"over_memory_budget"` // dispatch held back by memory.budget_mb
+	SkippedTriggers int64      `json:"skipped_triggers"`
+	Election        string     `json:"election,omitempty"` // leader or standby, with election.backend
+	Current         *RunRecord `json:"current_run,omitempty"`
+	Live            *runStatus `json:"live,omitempty"`
+	LastRun         *RunRecord `json:"last_run,omitempty"`
+	RunsKept        int        `json:"runs_kept"`
+}
+
+// serveControl runs the control API on addr until ctx is done.
+func (d *Daemon) serveControl(ctx context.Context, addr, token string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", d.handleStatus)
+	mux.HandleFunc("GET /runs", d.handleRuns)
+	mux.HandleFunc("POST /pause", d.handlePause)
+	mux.HandleFunc("POST /resume", d.handleResume)
+	mux.HandleFunc("POST /run", d.handleRun)
+	mux.HandleFunc("POST /drain", d.handleDrain)
+
+	srv := &http.Server{Addr: addr, Handler: requireToken(token, mux), ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	d.log.Info("Control API listening", "addr", addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		d.log.Error("Control API stopped", "addr", addr, "error", err)
+	}
+}
+
+// requireToken rejects requests without "Authorization: Bearer <token>".
+// An empty token disables the check.
+func requireToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (d *Daemon) handleStatus(w http.ResponseWriter, _ *http.Request) {
+	history, current := d.History()
+	paused, draining := dispatch.State()
+
+	d.mu.Lock()
+	skipped := d.skipped
+	d.mu.Unlock()
+
+	st := daemonStatus{
+		State:           "idle",
+		Paused:          paused,
+		Draining:        draining && current != nil,
+		SkippedTriggers: skipped,
+		Election:        electionState(),
+		Current:         current,
+		RunsKept:        len(history),
+	}
+	if current != nil {
+		st.State = "running"
+	}
+	if memoryBudget != nil {
+		st.OverBudget = memoryBudget.Over()
+	}
+	if len(history) > 0 {
+		st.LastRun = &history[len(history)-1]
+	}
+	if run := activeRun.Load(); run != nil {
+		st.Live = run.status()
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+func (r *runState) status() *runStatus {
+	elapsed := time.Since(r.started)
+	sum := r.stats.Summary()
+	st := &runStatus{
+		ID:              r.id,
+		StartedAt:       r.started.UTC(),
+		ElapsedMS:       elapsed.Milliseconds(),
+		Stats:           sum,
+		ExtractLimit:    r.pool.Limit(),
+		ExtractInFlight: r.pool.InUse(),
+		QueueDepths:     make([]int, len(r.queues)),
+		Backpressure:    r.gate.Over(),
+	}
+	if secs := elapsed.Seconds(); secs > 0 {
+		st.ExtractedPerSec = float64(sum.Extracted) / secs
+		st.RecordsLoadedPerSec = float64(sum.RecordsLoaded) / secs
+	}
+	for i, q := range r.queues {
+		st.QueueDepths[i] = len(q)
+		st.QueueCapacity = cap(q)
+	}
+	return st
+}
+
+func (d *Daemon) handleRuns(w http.ResponseWriter, _ *http.Request) {
+	history, _ := d.History()
+	writeJSON(w, http.StatusOK, history)
+}
+
+func (d *Daemon) handlePause(w http.ResponseWriter, _ *http.Request) {
+	dispatch.Pause()
+	d.log.Warn("Dispatch paused via control API")
+	writeJSON(w, http.StatusOK, map[string]bool{"paused": true})
+}
+
+func (d *Daemon) handleResume(w http.ResponseWriter, _ *http.Request) {
+	dispatch.Resume()
+	d.log.Info("Dispatch resumed via control API")
+	writeJSON(w, http.StatusOK, map[string]bool{"paused": false})
+}
+
+func (d *Daemon) handleRun(w http.ResponseWriter, _ *http.Request) {
+	rec, started := d.Trigger("api")
+	if !started {
+		writeJSON(w, http.StatusConflict, map[string]any{"error": "a run is already in progress", "run": rec})
+		return
+	}
+	writeJSON(w, http.StatusAccepted, rec)
+}
+
+func (d *Daemon) handleDrain(w http.ResponseWriter, _ *http.Request) {
+	_, current := d.History()
+	if current == nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "no run in progress"})
+		return
+	}
+	dispatch.Drain()
+	d.log.Warn("Drain requested via control API, stopping dispatch", "running", current.ID)
+	writeJSON(w, http.StatusAccepted, current)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Debug("Writing control API response failed", "error", err)
+	}
+}
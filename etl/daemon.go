@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+//////////////////////////////////////////////////
+// Daemon Mode
+//////////////////////////////////////////////////
+
+type DaemonConfig struct {
+	Enabled     bool     `yaml:"enabled" json:"enabled"`
+	Schedule    string   `yaml:"schedule" json:"schedule"`
+	Interval    Duration `yaml:"interval" json:"interval"`
+	RunOnStart  bool     `yaml:"run_on_start" json:"run_on_start"`
+	HistorySize int      `yaml:"history_size" json:"history_size"`
+	// ControlAddr is where the control API listens; empty disables it.
+	ControlAddr  string `yaml:"control_addr" json:"control_addr"`
+	ControlToken string `yaml:"control_token" json:"control_token" secret:"true"`
+}
+
+func defaultDaemonConfig() DaemonConfig {
+	return DaemonConfig{
+		Interval:    Duration(15 * time.Minute),
+		RunOnStart:  true,
+		HistorySize: 50,
+		ControlAddr: "127.0.0.1:8091",
+	}
+}
+
+func (d *DaemonConfig) validate() []error {
+	var errs []error
+	if d.Schedule != "" {
+		if _, err := cron.ParseStandard(d.Schedule); err != nil {
+			errs = append(errs, fmt.Errorf("daemon.schedule: %w", err))
+		}
+	} else if d.Interval <= 0 {
+		errs = append(errs, errors.New("daemon.interval must be > 0 when daemon.schedule is empty"))
+	}
+	if d.HistorySize <= 0 {
+		errs = append(errs, fmt.Errorf("daemon.history_size must be > 0, got %d", d.HistorySize))
+	}
+	return errs
+}
+
+// schedule returns the cron schedule if one is configured, otherwise the
+// fixed interval.
+func (d *DaemonConfig) schedule() cron.Schedule {
+	if d.Schedule != "" {
+		sched, _ := cron.ParseStandard(d.Schedule) // checked by validate
+		return sched
+	}
+	return cron.Every(d.Interval.Std())
+}
+
+// RunRecord describes one ETL cycle in the run history.
+type RunRecord struct {
+	ID          string      `json:"id"`
+	Trigger     string      `json:"trigger"`
+	StartedAt   time.Time   `json:"started_at"`
+	FinishedAt  time.Time   `json:"finished_at,omitzero"`
+	Interrupted bool        `json:"interrupted"`
+	Error       string      `json:"error,omitempty"`
+	Summary     *RunSummary `json:"summary,omitempty"`
+}
+
+// recordRun performs the run described by rec (ID, trigger and start time
+// set) and returns rec completed with its outcome, which is also added to
+// the run history in the state store.
+func recordRun(ctx context.Context, rec RunRecord) RunRecord {
+	stats, err := runETL(ctx, rec.ID)
+
+	rec.FinishedAt = time.Now().UTC()
+	_, drained := dispatch.State()
+	rec.Interrupted = ctx.Err() != nil || drained
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	if stats != nil {
+		sum := stats.Summary()
+		rec.Summary = &sum
+	}
+	if err := state.SaveRun(rec); err != nil {
+		slog.Error("Failed to save run history", "run_id", rec.ID, "error", err)
+	}
+	return rec
+}
+
+func newRunID() string {
+	var suffix [4]byte
+	rand.Read(suffix[:])
+	return fmt.Sprintf("%s-%s", time.Now().UTC().Format("20060102T150405Z"), hex.EncodeToString(suffix[:]))
+}
+
+// Daemon runs the ETL cycle on a schedule, one run at a time, and keeps the
+// most recent runs in memory, seeded from the state store on start.
+type Daemon struct {
+	conf DaemonConfig
+	ctx  context.Context
+	wg   sync.WaitGroup
+	// log is captured before the first run; runETL tags the default
+	// logger with its run ID while it runs.
+	log *slog.Logger
+
+	mu      sync.Mutex
+	current *RunRecord
+	history []RunRecord // oldest first, at most conf.HistorySize
+	skipped int64
+}
+
+// etlDaemon is the running daemon, nil outside daemon mode.
+var etlDaemon *Daemon
+
+// runDaemon triggers runs until ctx is cancelled, then waits for the run in
+// progress to drain.
+func runDaemon(ctx context.Context, conf DaemonConfig) {
+	log := slog.With("component", "daemon")
+	etlDaemon = &Daemon{conf: conf, ctx: ctx, log: log}
+	d := etlDaemon
+	history, err := state.Runs(conf.HistorySize)
+	if err != nil {
+		log.Error("Failed to load run history", "error", err)
+	}
+	d.history = history
+	sched := conf.schedule()
+	log.Info("Daemon started", "schedule", conf.Schedule, "interval", conf.Interval.Std().String())
+
+	if conf.ControlAddr != "" {
+		go d.serveControl(ctx, conf.ControlAddr, conf.ControlToken)
+	}
+
+	if conf.RunOnStart && d.leading("startup") {
+		d.Trigger("startup")
+	}
+	for {
+		next := sched.Next(time.Now())
+		log.Debug("Next run scheduled", "at", next)
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+			if paused, _ := dispatch.State(); paused {
+				log.Info("Dispatch paused, skipping scheduled run")
+				continue
+			}
+			if d.leading("schedule") {
+				d.Trigger("schedule")
+			}
+		case <-ctx.Done():
+			timer.Stop()
+			d.wg.Wait()
+			if aggregator != nil {
+				drainAggregator()
+			}
+			log.Info("Daemon stopped")
+			return
+		}
+	}
+}
+
+// leading reports whether this instance runs scheduled cycles: with leader
+// election, only the leader does. Ad-hoc runs from the control API aren't
+// held back.
+func (d *Daemon) leading(trigger string) bool {
+	if election.Leader() {
+		return true
+	}
+	d.log.Debug("Not the leader, skipping run", "trigger", trigger)
+	return false
+}
+
+// Trigger starts a run in the background unless one is already in
+// progress, in which case it returns false and the trigger is dropped.
+func (d *Daemon) Trigger(trigger string) (RunRecord, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.current != nil {
+		d.skipped++
+		d.log.Warn("Previous run still in progress, skipping", "trigger", trigger, "running", d.current.ID)
+		return *d.current, false
+	}
+	if d.ctx.Err() != nil {
+		return RunRecord{}, false
+	}
+
+	rec := &RunRecord{ID: newRunID(), Trigger: trigger, StartedAt: time.Now().UTC()}
+	d.current = rec
+	d.wg.Add(1)
+	go d.run(rec)
+	return *rec, true
+}
+
+func (d *Daemon) run(rec *RunRecord) {
+	defer d.wg.Done()
+
+	refreshSecrets(d.ctx)
+	finished := recordRun(d.ctx, *rec)
+	if finished.Error != "" {
+		d.log.Error("Run failed", "run_id", rec.ID, "error", finished.Error)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.history = append(d.history, finished)
+	if len(d.history) > d.conf.HistorySize {
+		d.history = d.history[len(d.history)-d.conf.HistorySize:]
+	}
+	d.current = nil
+}
+
+// History returns the finished runs, oldest first, and the one in progress
+// (nil if idle).
+func (d *Daemon) History() ([]RunRecord, *RunRecord) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	history := append([]RunRecord(nil), d.history...)
+	if d.current == nil {
+		return history, nil
+	}
+	current := *d.current
+	return history, &current
+}
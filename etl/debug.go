@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"slices"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// Debug Server
+//////////////////////////////////////////////////
+
+// DebugConfig enables an HTTP server with live pprof profiles and a JSON
+// status of the run, for looking into a run while it goes instead of only
+// at the cpu.prof and mem.prof it leaves behind.
+type DebugConfig struct {
+	Addr  string `yaml:"addr" json:"addr"` // empty disables the server
+	Token string `yaml:"token" json:"token" secret:"true"`
+}
+
+func defaultDebugConfig() DebugConfig {
+	return DebugConfig{}
+}
+
+func (d *DebugConfig) validate() []error {
+	if d.Addr == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(d.Addr); err != nil {
+		return []error{fmt.Errorf("debug.addr: %w", err)}
+	}
+	return nil
+}
+
+type debugStatus struct {
+	Uptime      string         `json:"uptime"`
+	Goroutines  int            `json:"goroutines"`
+	HeapAllocMB uint64         `json:"heap_alloc_mb"`
+	NumGC       uint32         `json:"num_gc"`
+	Run         *runStatus     `json:"run,omitempty"` // absent between runs
+	Workers     []workerStatus `json:"workers,omitempty"`
+}
+
+type workerStatus struct {
+	ID             int        `json:"id"`
+	QueueDepth     int        `json:"queue_depth"`
+	Buffered       int64      `json:"buffered"` // received but not flushed yet
+	Received       int64      `json:"received"`
+	Flushes        int64      `json:"flushes"`
+	RecordsFlushed int64      `json:"records_flushed"`
+	AvgFlushMS     float64    `json:"avg_flush_ms"`
+	LastFlushAt    *time.Time `json:"last_flush_at,omitempty"`
+}
+
+// debugStarted is when the process started serving, for debugStatus.Uptime.
+var debugStarted = time.Now()
+
+// startDebugServer serves /debug/pprof/ and /status on conf.Addr until the
+// returned function is called. It does nothing without an address.
+func startDebugServer(conf DebugConfig) (stop func()) {
+	if conf.Addr == "" {
+		return func() {}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", handleDebugStatus)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	// No WriteTimeout: CPU profiles and traces stream for ?seconds=.
+	srv := &http.Server{Addr: conf.Addr, Handler: requireToken(conf.Token, mux), ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		slog.Info("Debug server listening", "component", "debug", "addr", conf.Addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Debug server stopped", "component", "debug", "addr", conf.Addr, "error", err)
+		}
+	}()
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}
+}
+
+func handleDebugStatus(w http.ResponseWriter, _ *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	st := debugStatus{
+		Uptime:      time.Since(debugStarted).Round(time.Second).String(),
+		Goroutines:  runtime.NumGoroutine(),
+		HeapAllocMB: bToMb(mem.HeapAlloc),
+		NumGC:       mem.NumGC,
+	}
+	if run := activeRun.Load(); run != nil {
+		st.Run = run.status()
+		st.Workers = run.workerStatus()
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+// workerStatus reports every loader worker of the run, and any other
+// worker ID that has flushed in it.
+func (r *runState) workerStatus() []workerStatus {
+	r.stats.workersMu.Lock()
+	ids := make([]int, 0, len(r.stats.workers))
+	for id := range r.stats.workers {
+		ids = append(ids, id)
+	}
+	r.stats.workersMu.Unlock()
+	for id := range r.queues {
+		if !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+
+	out := make([]workerStatus, 0, len(ids))
+	for _, id := range ids {
+		ws := r.stats.Worker(id)
+		st := workerStatus{
+			ID:             id,
+			Received:       ws.Received.Load(),
+			Flushes:        ws.Flushes.Load(),
+			RecordsFlushed: ws.RecordsFlushed.Load(),
+		}
+		st.Buffered = max(st.Received-st.RecordsFlushed, 0)
+		if id < len(r.queues) {
+			st.QueueDepth = len(r.queues[id])
+		}
+		if st.Flushes > 0 {
+			st.AvgFlushMS = float64(ws.FlushNanos.Load()) / float64(st.Flushes) / float64(time.Millisecond)
+		}
+		if last := ws.LastFlush.Load(); last != 0 {
+			t := time.Unix(0, last).UTC()
+			st.LastFlushAt = &t
+		}
+		out = append(out, st)
+	}
+	return out
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// Deduplication
+//////////////////////////////////////////////////
+
+type DedupConfig struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// TTL is how long a record key is remembered after it was last seen.
+	TTL Duration `yaml:"ttl" json:"ttl"`
+}
+
+func defaultDedupConfig() DedupConfig {
+	return DedupConfig{TTL: Duration(time.Hour)}
+}
+
+func (d *DedupConfig) validate() []error {
+	if d.Enabled && d.TTL <= 0 {
+		return []error{errors.New("dedup.ttl must be > 0")}
+	}
+	return nil
+}
+
+type dedupKey struct {
+	name      string
+	metric    string
+	device    string
+	cpu       string
+	timestamp uint64
+}
+
+func dedupKeyOf(d DeviceData) dedupKey {
+	return dedupKey{name: d.Name, metric: d.Metric, device: d.Device, cpu: d.CPUNumber, timestamp: d.Timestamp}
+}
+
+// Deduper remembers the (name, cpu_number, timestamp) of records headed for
+// the sinks, with metric and device for metric types other than cpu, so a
+// sample that is loaded again, typically because a replayed spill and a
+// fresh extract of the same appliance both carry it, is dropped before
+// load. In daemon mode it lives across runs.
+type Deduper struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	seen      map[dedupKey]time.Time // key -> expiry
+	lastSweep time.Time
+}
+
+// deduper is nil unless dedup is enabled.
+var deduper *Deduper
+
+func newDeduper(conf DedupConfig) *Deduper {
+	return &Deduper{
+		ttl:       conf.TTL.Std(),
+		seen:      map[dedupKey]time.Time{},
+		lastSweep: time.Now(),
+	}
+}
+
+// Seen reports whether d's key was seen within the TTL, and remembers it
+// either way.
+func (c *Deduper) Seen(d DeviceData) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	k := dedupKeyOf(d)
+	exp, ok := c.seen[k]
+	c.seen[k] = now.Add(c.ttl)
+	c.sweep(now)
+	return ok && now.Before(exp)
+}
+
+// Remember records the keys of records that are loaded without passing
+// through Seen, such as replayed spills.
+func (c *Deduper) Remember(records []DeviceData) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for _, d := range records {
+		c.seen[dedupKeyOf(d)] = now.Add(c.ttl)
+	}
+	c.sweep(now)
+}
+
+// sweep drops expired keys, at most once per TTL. The caller holds mu.
+func (c *Deduper) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < c.ttl {
+		return
+	}
+	for k, exp := range c.seen {
+		if !now.Before(exp) {
+			delete(c.seen, k)
+		}
+	}
+	c.lastSweep = now
+}
+
+// Len returns the number of keys remembered.
+func (c *Deduper) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.seen)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// Appliance Source Interface & Registry
+//////////////////////////////////////////////////
+
+// ApplianceSource lists the appliances a run extracts from: the system of
+// record for the inventory, such as a file, an API, a database or a
+// service catalog.
+type ApplianceSource interface {
+	Appliances(ctx context.Context) ([]Appliance, error)
+	// Name identifies the source in logs and in the checkpoint, which is
+	// only resumed from the same source.
+	Name() string
+}
+
+// FileSource is implemented by sources that read a local file. The file is
+// read again when it changes; the other sources are read once per
+// discovery.refresh_interval.
+type FileSource interface {
+	File() string
+}
+
+// ApplianceSourceFactory builds an ApplianceSource from the run
+// configuration.
+type ApplianceSourceFactory func(cfg *Config) (ApplianceSource, error)
+
+var sourceRegistry = map[string]ApplianceSourceFactory{}
+
+// registerSource makes a source selectable via discovery.type. It is meant
+// to be called from init() in the file that implements the source.
+func registerSource(name string, factory ApplianceSourceFactory) {
+	if _, dup := sourceRegistry[name]; dup {
+		panic("appliance source already registered: " + name)
+	}
+	sourceRegistry[name] = factory
+}
+
+func newApplianceSource(cfg *Config) (ApplianceSource, error) {
+	factory, ok := sourceRegistry[cfg.Discovery.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown appliance source %q (available: %v)", cfg.Discovery.Type, sourceNames())
+	}
+	return factory(cfg)
+}
+
+func sourceNames() []string {
+	names := make([]string, 0, len(sourceRegistry))
+	for name := range sourceRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DiscoveryConfig chooses where a run gets its appliances. Sources other
+// than files are queried again once RefreshInterval has passed, so a
+// daemon picks up appliances as they are added and removed.
+type DiscoveryConfig struct {
+	Type            string              `yaml:"type" json:"type"` // csv, json, http, sql, consul or kubernetes
+	RefreshInterval Duration            `yaml:"refresh_interval" json:"refresh_interval"`
+	HTTP            HTTPInventoryConfig `yaml:"http" json:"http"`
+	SQL             SQLInventoryConfig  `yaml:"sql" json:"sql"`
+	Consul          ConsulConfig        `yaml:"consul" json:"consul"`
+	Kubernetes      KubernetesConfig    `yaml:"kubernetes" json:"kubernetes"`
+}
+
+func defaultDiscoveryConfig() DiscoveryConfig {
+	return DiscoveryConfig{
+		Type:            "csv",
+		RefreshInterval: Duration(5 * time.Minute),
+		HTTP:            defaultHTTPInventoryConfig(),
+		SQL:             defaultSQLInventoryConfig(),
+		Consul:          defaultConsulConfig(),
+		Kubernetes:      defaultKubernetesConfig(),
+	}
+}
+
+func (d *DiscoveryConfig) validate() []error {
+	var errs []error
+	if _, ok := sourceRegistry[d.Type]; !ok {
+		errs = append(errs, fmt.Errorf("discovery.type %q is not a known appliance source (available: %v)", d.Type, sourceNames()))
+	}
+	switch d.Type {
+	case "http":
+		errs = append(errs, d.HTTP.validate()...)
+	case "sql":
+		errs = append(errs, d.SQL.validate()...)
+	case "consul":
+		errs = append(errs, d.Consul.validate()...)
+	case "kubernetes":
+		errs = append(errs, d.Kubernetes.validate()...)
+	}
+	if d.RefreshInterval < 0 {
+		errs = append(errs, errors.New("discovery.refresh_interval must be >= 0"))
+	}
+	return errs
+}
+
+// applianceSource is the source of the process, rebuilt when secrets
+// change.
+var applianceSource ApplianceSource
+
+// closeSource releases what a source holds open, such as a database pool.
+func closeSource(src ApplianceSource) {
+	closer, ok := src.(io.Closer)
+	if !ok {
+		return
+	}
+	if err := closer.Close(); err != nil {
+		slog.Error("Error closing appliance source", "component", "discovery", "source", src.Name(), "error", err)
+	}
+}
+
+// inventory keeps the last appliance list across daemon runs, with the
+// source it came from, when it was read and, for a file source, the file's
+// size and modification time then.
+var inventory struct {
+	sync.Mutex
+	source     string
+	appliances []Appliance
+	at         time.Time
+	file       os.FileInfo
+}
+
+// listAppliances returns the appliances of a run. A file is read again
+// when its size or modification time changed, other sources once
+// discovery.refresh_interval has passed; if a query fails the previous
+// list is used again. Changes from the previous list are logged.
+func listAppliances(ctx context.Context) ([]Appliance, error) {
+	inventory.Lock()
+	defer inventory.Unlock()
+	src := applianceSource
+	if inventory.source != src.Name() {
+		inventory.source, inventory.appliances, inventory.file = src.Name(), nil, nil
+	}
+
+	if fs, ok := src.(FileSource); ok {
+		info, err := os.Stat(fs.File())
+		if err == nil && inventory.file != nil &&
+			info.Size() == inventory.file.Size() && info.ModTime().Equal(inventory.file.ModTime()) {
+			return inventory.appliances, nil
+		}
+		appliances, err := src.Appliances(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", src.Name(), err)
+		}
+		inventory.file = info
+		setInventory(src.Name(), appliances)
+		return appliances, nil
+	}
+
+	if inventory.appliances != nil && time.Since(inventory.at) < cfg.Discovery.RefreshInterval.Std() {
+		return inventory.appliances, nil
+	}
+	appliances, err := src.Appliances(ctx)
+	if err != nil {
+		if inventory.appliances == nil {
+			return nil, fmt.Errorf("%s: %w", src.Name(), err)
+		}
+		slog.Warn("Appliance discovery failed, using the previous list", "component", "discovery", "source", src.Name(),
+			"appliances", len(inventory.appliances), "discovered_at", inventory.at, "error", err)
+		return inventory.appliances, nil
+	}
+	inventory.file = nil
+	setInventory(src.Name(), appliances)
+	return appliances, nil
+}
+
+// maxDiffLines caps the appliances logged one by one when the list changes.
+const maxDiffLines = 50
+
+// setInventory replaces the list, logging which appliances were added,
+// removed or had their credentials or priority changed.
+func setInventory(source string, appliances []Appliance) {
+	prev := inventory.appliances
+	inventory.appliances, inventory.at = appliances, time.Now()
+	if prev == nil {
+		slog.Info("Appliances loaded", "component", "discovery", "source", source, "appliances", len(appliances))
+		return
+	}
+
+	before := make(map[string]Appliance, len(prev))
+	for _, ap := range prev {
+		before[ap.key()] = ap
+	}
+	var added, removed, changed int
+	logged := 0
+	logDiff := func(msg string, ap Appliance) {
+		if logged++; logged <= maxDiffLines {
+			slog.Info(msg, "component", "discovery", "source", source, "host", ap.HostName, "ip", ap.IP,
+				"priority", ap.Priority.String())
+		}
+	}
+	for _, ap := range appliances {
+		old, ok := before[ap.key()]
+		delete(before, ap.key())
+		switch {
+		case !ok:
+			added++
+			logDiff("Appliance added", ap)
+		case old.Credentials != ap.Credentials || old.Priority != ap.Priority:
+			changed++
+			logDiff("Appliance changed", ap)
+		}
+	}
+	for _, ap := range prev {
+		if _, ok := before[ap.key()]; ok {
+			removed++
+			logDiff("Appliance removed", ap)
+		}
+	}
+	if added+removed+changed == 0 {
+		slog.Debug("Appliance list unchanged", "component", "discovery", "source", source, "appliances", len(appliances))
+		return
+	}
+	slog.Info("Appliance list changed", "component", "discovery", "source", source, "appliances", len(appliances),
+		"added", added, "removed", removed, "changed", changed, "not_logged", max(0, logged-maxDiffLines))
+}
+
+//////////////////////////////////////////////////
+// Appliance Records
+//////////////////////////////////////////////////
+
+// applianceRecord is an appliance as the json, http and sql sources read
+// it. The fields are the CSV's columns.
+type applianceRecord struct {
+	IP          string `json:"ip"`
+	HostName    string `json:"hostname"`
+	Credentials string `json:"credentials"`
+	Priority    string `json:"priority"`
+}
+
+// toAppliances checks records the way CSV lines are checked: a record
+// without an IP or host name, or naming unknown credentials, is skipped;
+// an unknown priority is ignored. Both are logged with the record's index.
+func toAppliances(source string, records []applianceRecord) []Appliance {
+	appliances := make([]Appliance, 0, len(records))
+	for i, rec := range records {
+		ap := Appliance{IP: strings.TrimSpace(rec.IP), HostName: strings.TrimSpace(rec.HostName)}
+		if ap.IP == "" || ap.HostName == "" {
+			slog.Warn("Skipping invalid appliance record", "component", "discovery", "source", source, "index", i)
+			continue
+		}
+		ap.Priority = cfg.Extract.Priority.of(ap)
+		var err error
+		if ap.Credentials, err = applianceCredentials(strings.TrimSpace(rec.Credentials)); err != nil {
+			slog.Warn("Skipping appliance", "component", "discovery", "source", source, "index", i, "host", ap.HostName, "error", err)
+			continue
+		}
+		if s := strings.TrimSpace(rec.Priority); s != "" {
+			if p, err := parsePriority(s); err != nil {
+				slog.Warn("Ignoring appliance priority", "component", "discovery", "source", source, "index", i, "host", ap.HostName, "error", err)
+			} else {
+				ap.Priority = p
+			}
+		}
+		appliances = append(appliances, ap)
+	}
+	return appliances
+}
+
+//////////////////////////////////////////////////
+// CSV Source
+//////////////////////////////////////////////////
+
+func init() {
+	registerSource("csv", func(cfg *Config) (ApplianceSource, error) {
+		return csvSource{file: cfg.InputFile}, nil
+	})
+}
+
+// csvSource reads input_file, see readAppliancesFromCSV.
+type csvSource struct{ file string }
+
+func (s csvSource) Appliances(context.Context) ([]Appliance, error) {
+	return readAppliancesFromCSV(s.file)
+}
+
+func (s csvSource) Name() string { return s.file }
+func (s csvSource) File() string { return s.file }
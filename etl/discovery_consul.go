@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// Consul Discovery
+//////////////////////////////////////////////////
+
+// ConsulConfig finds the appliances among the service instances registered
+// in Consul with Tag. An instance's service address, else its node's, is
+// the appliance IP; service metadata can set the host name, credentials
+// and priority (see consulMeta*).
+type ConsulConfig struct {
+	Address    string `yaml:"address" json:"address"`           // default $CONSUL_HTTP_ADDR, else http://127.0.0.1:8500
+	Token      string `yaml:"token" json:"token" secret:"true"` // default $CONSUL_HTTP_TOKEN
+	Datacenter string `yaml:"datacenter" json:"datacenter"`     // "" is the agent's
+	Tag        string `yaml:"tag" json:"tag"`
+	// Services limits discovery to these services; empty looks at every
+	// service of the catalog that has Tag.
+	Services []string `yaml:"services" json:"services"`
+	// PassingOnly skips instances with a failing health check.
+	PassingOnly bool      `yaml:"passing_only" json:"passing_only"`
+	Timeout     Duration  `yaml:"timeout" json:"timeout"`
+	TLS         TLSConfig `yaml:"tls" json:"tls"`
+}
+
+func defaultConsulConfig() ConsulConfig {
+	return ConsulConfig{
+		Tag:         "appliance",
+		PassingOnly: true,
+		Timeout:     Duration(10 * time.Second),
+		TLS:         defaultTLSConfig(),
+	}
+}
+
+func (c *ConsulConfig) validate() []error {
+	var errs []error
+	if c.Address != "" && !strings.HasPrefix(c.Address, "http://") && !strings.HasPrefix(c.Address, "https://") {
+		errs = append(errs, fmt.Errorf("discovery.consul.address must be an http(s) URL, got %q", c.Address))
+	}
+	if c.Tag == "" {
+		errs = append(errs, errors.New("discovery.consul.tag must be set"))
+	}
+	if c.Timeout <= 0 {
+		errs = append(errs, errors.New("discovery.consul.timeout must be > 0"))
+	}
+	errs = append(errs, c.TLS.validate("discovery.consul.tls")...)
+	return errs
+}
+
+// Service metadata keys read from each instance.
+const (
+	consulMetaHostname    = "hostname"    // default: the node name
+	consulMetaCredentials = "credentials" // like the CSV's third column
+	consulMetaPriority    = "priority"    // like the CSV's fourth column
+)
+
+// address is the configured Consul address, or the one of the environment
+// the consul CLI uses.
+func (c *ConsulConfig) address() string {
+	addr := c.Address
+	if addr == "" {
+		addr = os.Getenv("CONSUL_HTTP_ADDR")
+	}
+	if addr == "" {
+		return "http://127.0.0.1:8500"
+	}
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return strings.TrimSuffix(addr, "/")
+}
+
+type consulHealthEntry struct {
+	Node struct {
+		Node    string `json:"Node"`
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		ID      string            `json:"ID"`
+		Service string            `json:"Service"`
+		Address string            `json:"Address"`
+		Meta    map[string]string `json:"Meta"`
+	} `json:"Service"`
+}
+
+func init() {
+	registerSource("consul", func(cfg *Config) (ApplianceSource, error) {
+		return &consulSource{conf: cfg.Discovery.Consul}, nil
+	})
+}
+
+type consulSource struct {
+	conf ConsulConfig
+}
+
+func (s *consulSource) Name() string { return "consul:" + s.conf.Tag }
+
+// Appliances lists the appliances registered in Consul. An instance naming
+// unknown credentials is skipped, as a CSV line would be; an appliance
+// registered under several services is listed once.
+func (s *consulSource) Appliances(ctx context.Context) ([]Appliance, error) {
+	conf := s.conf
+	tlsConf, err := conf.TLS.build()
+	if err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+	client := &http.Client{Timeout: conf.Timeout.Std(), Transport: &http.Transport{TLSClientConfig: tlsConf}}
+	defer client.CloseIdleConnections()
+
+	services := conf.Services
+	if len(services) == 0 {
+		var catalog map[string][]string
+		if err := consulGet(ctx, client, conf, "/v1/catalog/services", nil, &catalog); err != nil {
+			return nil, err
+		}
+		for name, tags := range catalog {
+			if slices.Contains(tags, conf.Tag) {
+				services = append(services, name)
+			}
+		}
+		slices.Sort(services)
+	}
+
+	var appliances []Appliance
+	seen := map[string]bool{}
+	for _, service := range services {
+		query := url.Values{"tag": {conf.Tag}}
+		if conf.PassingOnly {
+			query.Set("passing", "true")
+		}
+		var entries []consulHealthEntry
+		if err := consulGet(ctx, client, conf, "/v1/health/service/"+url.PathEscape(service), query, &entries); err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			ap := Appliance{IP: e.Service.Address, HostName: e.Service.Meta[consulMetaHostname]}
+			if ap.IP == "" {
+				ap.IP = e.Node.Address
+			}
+			if ap.HostName == "" {
+				ap.HostName = e.Node.Node
+			}
+			if ap.IP == "" || seen[ap.key()] {
+				continue
+			}
+			seen[ap.key()] = true
+
+			ap.Priority = cfg.Extract.Priority.of(ap)
+			if ap.Credentials, err = applianceCredentials(e.Service.Meta[consulMetaCredentials]); err != nil {
+				slog.Warn("Skipping appliance", "component", "discovery", "service", service, "service_id", e.Service.ID,
+					"host", ap.HostName, "error", err)
+				continue
+			}
+			if meta := e.Service.Meta[consulMetaPriority]; meta != "" {
+				if p, err := parsePriority(meta); err != nil {
+					slog.Warn("Ignoring appliance priority", "component", "discovery", "service", service,
+						"service_id", e.Service.ID, "host", ap.HostName, "error", err)
+				} else {
+					ap.Priority = p
+				}
+			}
+			appliances = append(appliances, ap)
+		}
+	}
+	return appliances, nil
+}
+
+func consulGet(ctx context.Context, client *http.Client, conf ConsulConfig, apiPath string, query url.Values, out any) error {
+	return consulDo(ctx, client, conf, http.MethodGet, apiPath, query, nil, out)
+}
+
+// consulDo sends a request, with body encoded as JSON unless nil, and
+// decodes the response into out unless nil.
+func consulDo(ctx context.Context, client *http.Client, conf ConsulConfig, method, apiPath string, query url.Values, body, out any) error {
+	if query == nil {
+		query = url.Values{}
+	}
+	if conf.Datacenter != "" {
+		query.Set("dc", conf.Datacenter)
+	}
+	u := conf.address() + apiPath
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var reqBody io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reqBody)
+	if err != nil {
+		return err
+	}
+	token := conf.Token
+	if token == "" {
+		token = os.Getenv("CONSUL_HTTP_TOKEN")
+	}
+	if token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 32<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("consul %s returned %s: %s", apiPath, resp.Status, truncate(string(raw), 200))
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(raw, out); err != nil {
+		return fmt.Errorf("decoding consul %s: %w", apiPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// HTTP Inventory Source
+//////////////////////////////////////////////////
+
+// HTTPInventoryConfig reads the appliances from an inventory API that
+// answers a GET with appliance records in JSON, as a top-level array or
+// under Field.
+type HTTPInventoryConfig struct {
+	URL       string            `yaml:"url" json:"url"`
+	AuthToken string            `yaml:"auth_token" json:"auth_token" secret:"true"` // Authorization header value
+	Headers   map[string]string `yaml:"headers" json:"headers"`
+	Field     string            `yaml:"field" json:"field"` // e.g. "appliances" for {"appliances": [...]}
+	Timeout   Duration          `yaml:"timeout" json:"timeout"`
+	TLS       TLSConfig         `yaml:"tls" json:"tls"`
+}
+
+func defaultHTTPInventoryConfig() HTTPInventoryConfig {
+	return HTTPInventoryConfig{
+		Timeout: Duration(30 * time.Second),
+		TLS:     defaultTLSConfig(),
+	}
+}
+
+func (h *HTTPInventoryConfig) validate() []error {
+	var errs []error
+	if !strings.HasPrefix(h.URL, "http://") && !strings.HasPrefix(h.URL, "https://") {
+		errs = append(errs, fmt.Errorf("discovery.http.url must be an http(s) URL, got %q", h.URL))
+	}
+	if h.Timeout <= 0 {
+		errs = append(errs, errors.New("discovery.http.timeout must be > 0"))
+	}
+	errs = append(errs, h.TLS.validate("discovery.http.tls")...)
+	return errs
+}
+
+func init() {
+	registerSource("http", func(cfg *Config) (ApplianceSource, error) {
+		conf := cfg.Discovery.HTTP
+		tlsConf, err := conf.TLS.build()
+		if err != nil {
+			return nil, fmt.Errorf("discovery.http.tls: %w", err)
+		}
+		return &httpInventorySource{
+			conf:   conf,
+			client: &http.Client{Timeout: conf.Timeout.Std(), Transport: &http.Transport{TLSClientConfig: tlsConf}},
+		}, nil
+	})
+}
+
+type httpInventorySource struct {
+	conf   HTTPInventoryConfig
+	client *http.Client
+}
+
+func (s *httpInventorySource) Name() string { return s.conf.URL }
+
+func (s *httpInventorySource) Appliances(ctx context.Context) ([]Appliance, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.conf.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	for k, v := range s.conf.Headers {
+		req.Header.Set(k, v)
+	}
+	if s.conf.AuthToken != "" {
+		req.Header.Set("Authorization", s.conf.AuthToken)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 64<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("inventory returned %s: %s", resp.Status, truncate(string(raw), 200))
+	}
+
+	if s.conf.Field != "" {
+		var wrapped map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &wrapped); err != nil {
+			return nil, fmt.Errorf("decoding inventory response: %w", err)
+		}
+		if raw = wrapped[s.conf.Field]; raw == nil {
+			return nil, fmt.Errorf("inventory response has no %q field", s.conf.Field)
+		}
+	}
+	var records []applianceRecord
+	if err := json.Unmarshal(raw, &records); err != nil {
+		return nil, fmt.Errorf("decoding inventory response: %w", err)
+	}
+	return toAppliances(s.conf.URL, records), nil
+}
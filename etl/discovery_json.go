@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+)
+
+//////////////////////////////////////////////////
+// JSON File Source
+//////////////////////////////////////////////////
+
+func init() {
+	registerSource("json", func(cfg *Config) (ApplianceSource, error) {
+		return jsonSource{file: cfg.InputFile}, nil
+	})
+}
+
+// jsonSource reads input_file as a JSON array of appliance records:
+//
+//	[{"ip": "192.168.0.3", "hostname": "Device-3", "credentials": "core-switches", "priority": "high"}]
+type jsonSource struct{ file string }
+
+func (s jsonSource) Appliances(context.Context) ([]Appliance, error) {
+	raw, err := os.ReadFile(s.file)
+	if err != nil {
+		return nil, err
+	}
+	var records []applianceRecord
+	if err := json.Unmarshal(raw, &records); err != nil {
+		return nil, err
+	}
+	return toAppliances(s.file, records), nil
+}
+
+func (s jsonSource) Name() string { return s.file }
+func (s jsonSource) File() string { return s.file }
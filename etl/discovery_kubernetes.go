@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// Kubernetes Discovery
+//////////////////////////////////////////////////
+
+// KubernetesConfig finds the appliances among the pods, or the endpoints of
+// services, that match LabelSelector, like Prometheus' kubernetes_sd. Run
+// in the cluster it needs nothing more: the API server, token and CA are
+// those of the pod's service account.
+type KubernetesConfig struct {
+	Role          string   `yaml:"role" json:"role"`             // pod or endpoints
+	Namespaces    []string `yaml:"namespaces" json:"namespaces"` // empty: all
+	LabelSelector string   `yaml:"label_selector" json:"label_selector"`
+	FieldSelector string   `yaml:"field_selector" json:"field_selector"`
+	// AnnotationPrefix names the pod annotations read as the host name,
+	// credentials and priority, e.g. etl.appliance/credentials.
+	AnnotationPrefix string `yaml:"annotation_prefix" json:"annotation_prefix"`
+	APIServer        string `yaml:"api_server" json:"api_server"`     // default: in-cluster
+	Token            string `yaml:"token" json:"token" secret:"true"` // default: the service account's
+	TokenFile        string `yaml:"token_file" json:"token_file"`
+	// TLS.CAFile defaults to the service account's CA in the cluster.
+	TLS     TLSConfig `yaml:"tls" json:"tls"`
+	Timeout Duration  `yaml:"timeout" json:"timeout"`
+}
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+func defaultKubernetesConfig() KubernetesConfig {
+	return KubernetesConfig{
+		Role:             "pod",
+		AnnotationPrefix: "etl.appliance/",
+		TLS:              defaultTLSConfig(),
+		Timeout:          Duration(30 * time.Second),
+	}
+}
+
+func (k *KubernetesConfig) validate() []error {
+	var errs []error
+	if k.Role != "pod" && k.Role != "endpoints" {
+		errs = append(errs, fmt.Errorf("discovery.kubernetes.role must be pod or endpoints, got %q", k.Role))
+	}
+	if k.APIServer != "" && !strings.HasPrefix(k.APIServer, "http://") && !strings.HasPrefix(k.APIServer, "https://") {
+		errs = append(errs, fmt.Errorf("discovery.kubernetes.api_server must be an http(s) URL, got %q", k.APIServer))
+	}
+	if k.Token != "" && k.TokenFile != "" {
+		errs = append(errs, errors.New("discovery.kubernetes: set only one of token and token_file"))
+	}
+	if k.Timeout <= 0 {
+		errs = append(errs, errors.New("discovery.kubernetes.timeout must be > 0"))
+	}
+	errs = append(errs, k.TLS.validate("discovery.kubernetes.tls")...)
+	return errs
+}
+
+// apiServer is the configured API server, or the in-cluster one.
+func (k *KubernetesConfig) apiServer() (string, error) {
+	if k.APIServer != "" {
+		return strings.TrimSuffix(k.APIServer, "/"), nil
+	}
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return "", errors.New("not running in a cluster: set discovery.kubernetes.api_server")
+	}
+	return "https://" + net.JoinHostPort(host, port), nil
+}
+
+func init() {
+	registerSource("kubernetes", func(cfg *Config) (ApplianceSource, error) {
+		api, err := newK8sClient(cfg.Discovery.Kubernetes)
+		if err != nil {
+			return nil, err
+		}
+		return &kubernetesSource{conf: cfg.Discovery.Kubernetes, api: api}, nil
+	})
+}
+
+type kubernetesSource struct {
+	conf KubernetesConfig
+	api  *k8sClient
+}
+
+func (s *kubernetesSource) Name() string {
+	if s.conf.LabelSelector == "" {
+		return "kubernetes:" + s.conf.Role
+	}
+	return "kubernetes:" + s.conf.Role + ":" + s.conf.LabelSelector
+}
+
+type k8sMeta struct {
+	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+type k8sPod struct {
+	Metadata k8sMeta `json:"metadata"`
+	Status   struct {
+		Phase string `json:"phase"`
+		PodIP string `json:"podIP"`
+	} `json:"status"`
+}
+
+type k8sEndpointSlice struct {
+	Metadata  k8sMeta `json:"metadata"`
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Hostname   string   `json:"hostname"`
+		Conditions struct {
+			Ready *bool `json:"ready"`
+		} `json:"conditions"`
+		TargetRef *struct {
+			Name string `json:"name"`
+		} `json:"targetRef"`
+	} `json:"endpoints"`
+}
+
+// Appliances lists the running pods with an IP, or the ready endpoints of
+// the matching services' EndpointSlices, in each namespace. An appliance
+// found twice is listed once.
+func (s *kubernetesSource) Appliances(ctx context.Context) ([]Appliance, error) {
+	namespaces := s.conf.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{""}
+	}
+	var records []applianceRecord
+	for _, ns := range namespaces {
+		var err error
+		if s.conf.Role == "pod" {
+			err = s.list(ctx, "/api/v1", ns, "pods", func(raw json.RawMessage) error {
+				var pod k8sPod
+				if err := json.Unmarshal(raw, &pod); err != nil {
+					return err
+				}
+				if pod.Status.Phase == "Running" && pod.Status.PodIP != "" {
+					records = append(records, s.record(pod.Status.PodIP, pod.Metadata.Name, pod.Metadata))
+				}
+				return nil
+			})
+		} else {
+			err = s.list(ctx, "/apis/discovery.k8s.io/v1", ns, "endpointslices", func(raw json.RawMessage) error {
+				var slice k8sEndpointSlice
+				if err := json.Unmarshal(raw, &slice); err != nil {
+					return err
+				}
+				for _, ep := range slice.Endpoints {
+					if len(ep.Addresses) == 0 || (ep.Conditions.Ready != nil && !*ep.Conditions.Ready) {
+						continue
+					}
+					name := ep.Hostname
+					if ep.TargetRef != nil && ep.TargetRef.Name != "" {
+						name = ep.TargetRef.Name
+					}
+					if name == "" {
+						name = ep.Addresses[0]
+					}
+					records = append(records, s.record(ep.Addresses[0], name, slice.Metadata))
+				}
+				return nil
+			})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	seen := map[string]bool{}
+	unique := records[:0]
+	for _, rec := range records {
+		if key := rec.HostName + "|" + rec.IP; !seen[key] {
+			seen[key] = true
+			unique = append(unique, rec)
+		}
+	}
+	return toAppliances(s.Name(), unique), nil
+}
+
+// record builds the record of a target, with the host name, credentials
+// and priority annotations of the object it was found in.
+func (s *kubernetesSource) record(ip, name string, meta k8sMeta) applianceRecord {
+	annotation := func(key string) string { return meta.Annotations[s.conf.AnnotationPrefix+key] }
+	rec := applianceRecord{
+		IP:          ip,
+		HostName:    annotation("hostname"),
+		Credentials: annotation("credentials"),
+		Priority:    annotation("priority"),
+	}
+	if rec.HostName == "" {
+		rec.HostName = name
+	}
+	return rec
+}
+
+// list calls each with every item of a resource, following the API's
+// pagination. ns "" lists all namespaces.
+func (s *kubernetesSource) list(ctx context.Context, group, ns, resource string, each func(json.RawMessage) error) error {
+	path := group + "/" + resource
+	if ns != "" {
+		path = group + "/namespaces/" + url.PathEscape(ns) + "/" + resource
+	}
+
+	query := url.Values{"limit": {"500"}}
+	if s.conf.LabelSelector != "" {
+		query.Set("labelSelector", s.conf.LabelSelector)
+	}
+	if s.conf.FieldSelector != "" {
+		query.Set("fieldSelector", s.conf.FieldSelector)
+	}
+	for {
+		status, raw, err := s.api.do(ctx, http.MethodGet, path+"?"+query.Encode(), nil)
+		if err != nil {
+			return err
+		}
+		if status < 200 || status > 299 {
+			return fmt.Errorf("kubernetes %s returned %d %s: %s", path, status, http.StatusText(status), truncate(string(raw), 200))
+		}
+		var page struct {
+			Metadata struct {
+				Continue string `json:"continue"`
+			} `json:"metadata"`
+			Items []json.RawMessage `json:"items"`
+		}
+		if err := json.Unmarshal(raw, &page); err != nil {
+			return fmt.Errorf("decoding kubernetes %s: %w", path, err)
+		}
+		for _, item := range page.Items {
+			if err := each(item); err != nil {
+				return fmt.Errorf("decoding kubernetes %s: %w", path, err)
+			}
+		}
+		if page.Metadata.Continue == "" {
+			return nil
+		}
+		query.Set("continue", page.Metadata.Continue)
+	}
+}
+
+// k8sClient calls the API server with the connection settings of a
+// KubernetesConfig, by default those of the pod's service account.
+type k8sClient struct {
+	conf   KubernetesConfig
+	client *http.Client
+}
+
+func newK8sClient(conf KubernetesConfig) (*k8sClient, error) {
+	tlsConf := conf.TLS
+	if tlsConf.CAFile == "" && conf.APIServer == "" {
+		if _, err := os.Stat(serviceAccountDir + "/ca.crt"); err == nil {
+			tlsConf.CAFile = serviceAccountDir + "/ca.crt"
+		}
+	}
+	tc, err := tlsConf.build()
+	if err != nil {
+		return nil, fmt.Errorf("discovery.kubernetes.tls: %w", err)
+	}
+	return &k8sClient{
+		conf:   conf,
+		client: &http.Client{Timeout: conf.Timeout.Std(), Transport: &http.Transport{TLSClientConfig: tc}},
+	}, nil
+}
+
+// token is the bearer token, read from its file on every request since
+// service account tokens are rotated.
+func (c *k8sClient) token() (string, error) {
+	if c.conf.Token != "" {
+		return c.conf.Token, nil
+	}
+	file := c.conf.TokenFile
+	if file == "" {
+		if c.conf.APIServer != "" {
+			return "", nil
+		}
+		file = serviceAccountDir + "/token"
+	}
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(raw)), nil
+}
+
+// do sends a request, with body encoded as JSON unless nil, and returns
+// the response status and body.
+func (c *k8sClient) do(ctx context.Context, method, path string, body any) (int, []byte, error) {
+	server, err := c.conf.apiServer()
+	if err != nil {
+		return 0, nil, err
+	}
+	token, err := c.token()
+	if err != nil {
+		return 0, nil, fmt.Errorf("service account token: %w", err)
+	}
+	var reqBody io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return 0, nil, err
+		}
+		reqBody = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, server+path, reqBody)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 64<<20))
+	return resp.StatusCode, raw, err
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+//////////////////////////////////////////////////
+// SQL Database Source
+//////////////////////////////////////////////////
+
+// SQLInventoryConfig reads the appliances with a query whose result has
+// ip and hostname columns, and optionally credentials and priority, like
+// the CSV, such as from a CMDB's database.
+type SQLInventoryConfig struct {
+	Driver string `yaml:"driver" json:"driver"` // postgres, mysql or sqlite
+	// DSN is in the driver's format: a postgres:// URL or key=value
+	// string, user:pass@tcp(host:3306)/db for MySQL, a file for SQLite.
+	DSN     string   `yaml:"dsn" json:"dsn" secret:"true"`
+	Query   string   `yaml:"query" json:"query"`
+	Timeout Duration `yaml:"timeout" json:"timeout"`
+}
+
+func defaultSQLInventoryConfig() SQLInventoryConfig {
+	return SQLInventoryConfig{
+		Driver:  "sqlite",
+		Query:   "SELECT ip, hostname, credentials, priority FROM appliances",
+		Timeout: Duration(30 * time.Second),
+	}
+}
+
+func (s *SQLInventoryConfig) validate() []error {
+	var errs []error
+	if _, ok := sqlDrivers[s.Driver]; !ok {
+		errs = append(errs, fmt.Errorf("discovery.sql.driver must be one of %v, got %q", slices.Sorted(maps.Keys(sqlDrivers)), s.Driver))
+	}
+	if s.DSN == "" {
+		errs = append(errs, errors.New("discovery.sql.dsn must be set"))
+	}
+	if s.Query == "" {
+		errs = append(errs, errors.New("discovery.sql.query must be set"))
+	}
+	if s.Timeout <= 0 {
+		errs = append(errs, errors.New("discovery.sql.timeout must be > 0"))
+	}
+	return errs
+}
+
+// sqlDrivers maps discovery.sql.driver to the database/sql driver name.
+var sqlDrivers = map[string]string{
+	"postgres": "pgx",
+	"mysql":    "mysql",
+	"sqlite":   "sqlite",
+}
+
+func init() {
+	registerSource("sql", func(cfg *Config) (ApplianceSource, error) {
+		conf := cfg.Discovery.SQL
+		db, err := sql.Open(sqlDrivers[conf.Driver], conf.DSN)
+		if err != nil {
+			return nil, fmt.Errorf("discovery.sql: %w", err)
+		}
+		// A daemon queries once per refresh; don't hold a connection to
+		// the inventory database in between.
+		db.SetMaxOpenConns(1)
+		db.SetMaxIdleConns(0)
+		return &sqlSource{conf: conf, db: db}, nil
+	})
+}
+
+type sqlSource struct {
+	conf SQLInventoryConfig
+	db   *sql.DB
+}
+
+func (s *sqlSource) Name() string { return "sql:" + s.conf.Driver }
+
+func (s *sqlSource) Close() error { return s.db.Close() }
+
+func (s *sqlSource) Appliances(ctx context.Context) ([]Appliance, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.conf.Timeout.Std())
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, s.conf.Query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records, err := scanApplianceRecords(rows)
+	if err != nil {
+		return nil, err
+	}
+	return toAppliances(s.Name(), records), nil
+}
+
+// scanApplianceRecords reads the rows into records by column name; other
+// columns are ignored and NULLs read as "".
+func scanApplianceRecords(rows *sql.Rows) ([]applianceRecord, error) {
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(cols, "ip") || !slices.Contains(cols, "hostname") {
+		return nil, fmt.Errorf("query returns columns %v, want ip and hostname", cols)
+	}
+
+	var records []applianceRecord
+	values := make([]sql.NullString, len(cols))
+	dest := make([]any, len(cols))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		var rec applianceRecord
+		for i, col := range cols {
+			switch col {
+			case "ip":
+				rec.IP = values[i].String
+			case "hostname":
+				rec.HostName = values[i].String
+			case "credentials":
+				rec.Credentials = values[i].String
+			case "priority":
+				rec.Priority = values[i].String
+			}
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
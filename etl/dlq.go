@@ -0,0 +1,418 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// Dead-Letter Queue
+//////////////////////////////////////////////////
+
+type DLQConfig struct {
+	Enabled bool   `yaml:"enabled" json:"enabled"`
+	Dir     string `yaml:"dir" json:"dir"`
+	// MaxReplays is how many times a spilled batch is replayed and fails
+	// again before it is dead-lettered as a poison batch; 0 replays it
+	// forever.
+	MaxReplays int `yaml:"max_replays" json:"max_replays"`
+}
+
+func defaultDLQConfig() DLQConfig {
+	return DLQConfig{
+		Enabled:    true,
+		Dir:        "dlq",
+		MaxReplays: 20,
+	}
+}
+
+func (d *DLQConfig) validate() []error {
+	var errs []error
+	if d.Enabled && d.Dir == "" {
+		errs = append(errs, errors.New("dlq.dir must be set when the DLQ is enabled"))
+	}
+	if d.MaxReplays < 0 {
+		errs = append(errs, fmt.Errorf("dlq.max_replays must be >= 0, got %d", d.MaxReplays))
+	}
+	return errs
+}
+
+// Why a batch was dead-lettered.
+const (
+	reasonRejected         = "rejected"          // the sink refused it for good
+	reasonRetriesExhausted = "retries_exhausted" // it failed transiently through all its retries
+	reasonMaxReplays       = "max_replays"       // it kept failing past dlq.max_replays
+)
+
+// DeadLetter is a batch the load API would not accept, kept with enough
+// context to decide whether to replay or discard it.
+type DeadLetter struct {
+	ID             string       `json:"id"`
+	Sink           string       `json:"sink,omitempty"`
+	WorkerID       int          `json:"worker_id"`
+	Endpoint       string       `json:"endpoint,omitempty"`
+	Reason         string       `json:"reason,omitempty"`
+	Error          string       `json:"error"`
+	StatusCode     int          `json:"status_code,omitempty"`
+	Attempts       int          `json:"attempts"`
+	Replays        int          `json:"replays"`
+	FirstAttemptAt time.Time    `json:"first_attempt_at"`
+	LastAttemptAt  time.Time    `json:"last_attempt_at"`
+	Records        []DeviceData `json:"records"`
+}
+
+// DeadLetterStore persists dead letters. Implementations must be safe for
+// concurrent use by the load workers.
+type DeadLetterStore interface {
+	Put(dl *DeadLetter) error
+	Get(id string) (*DeadLetter, error)
+	List() ([]*DeadLetter, error)
+	Delete(id string) error
+}
+
+var deadLetters DeadLetterStore
+
+func newDeadLetter(sink string, workerID int, records []DeviceData, attempts int, firstAttempt time.Time, err error) *DeadLetter {
+	dl := &DeadLetter{
+		ID:             newDeadLetterID(workerID),
+		Sink:           sink,
+		WorkerID:       workerID,
+		Error:          err.Error(),
+		Attempts:       attempts,
+		FirstAttemptAt: firstAttempt.UTC(),
+		LastAttemptAt:  time.Now().UTC(),
+		Records:        records,
+	}
+	if sink == "http" {
+		dl.Endpoint = cfg.API.Endpoint
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		dl.StatusCode = apiErr.StatusCode
+	}
+	return dl
+}
+
+// sinkName returns the sink that rejected the batch. Entries written before
+// sinks were recorded all came from the HTTP sink.
+func (dl *DeadLetter) sinkName() string {
+	if dl.Sink == "" {
+		return "http"
+	}
+	return dl.Sink
+}
+
+// failureKey is the state store key counting a batch's failed deliveries
+// to a sink.
+func failureKey(sink, batchID string) string {
+	return sink + "/" + batchID
+}
+
+// exhaustedReplays counts a failed delivery of the batch and reports
+// whether it has now failed its first flush and dlq.max_replays replays.
+// Batch IDs are content hashes, so the count follows the batch through
+// every spill and replay.
+func exhaustedReplays(sink, batchID string) bool {
+	if cfg.DLQ.MaxReplays == 0 || state == nil {
+		return false
+	}
+	n, err := state.CountFailure(failureKey(sink, batchID))
+	if err != nil {
+		slog.Error("Failed to count failed delivery", "component", "dlq", "sink", sink, "batch_id", batchID, "error", err)
+		return false
+	}
+	return n > cfg.DLQ.MaxReplays
+}
+
+// clearFailures forgets the failed deliveries of a batch that won't be
+// replayed again.
+func clearFailures(sink, batchID string) {
+	if cfg.DLQ.MaxReplays == 0 || state == nil {
+		return
+	}
+	if err := state.ForgetFailures(failureKey(sink, batchID)); err != nil {
+		slog.Error("Failed to clear failed deliveries", "component", "dlq", "sink", sink, "batch_id", batchID, "error", err)
+	}
+}
+
+func newDeadLetterID(workerID int) string {
+	var suffix [4]byte
+	rand.Read(suffix[:])
+	return fmt.Sprintf("%s-w%d-%s", time.Now().UTC().Format("20060102T150405Z"), workerID, hex.EncodeToString(suffix[:]))
+}
+
+//////////////////////////////////////////////////
+// Directory Store
+//////////////////////////////////////////////////
+
+// dirDeadLetterStore keeps one <id>.dlq.json.gz file per dead letter.
+type dirDeadLetterStore struct {
+	dir string
+}
+
+func newDirDeadLetterStore(dir string) (*dirDeadLetterStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &dirDeadLetterStore{dir: dir}, nil
+}
+
+func (s *dirDeadLetterStore) path(id string) string {
+	return filepath.Join(s.dir, id+".dlq.json.gz")
+}
+
+func (s *dirDeadLetterStore) Put(dl *DeadLetter) error {
+	// Write to a temp file and rename so a crash never leaves a truncated entry.
+	tmp, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	gz := getGzipWriter(tmp)
+	if err := json.NewEncoder(gz).Encode(dl); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		tmp.Close()
+		return err
+	}
+	putGzipWriter(gz)
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(dl.ID))
+}
+
+func (s *dirDeadLetterStore) Get(id string) (*DeadLetter, error) {
+	file, err := os.Open(s.path(id))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	var dl DeadLetter
+	if err := json.NewDecoder(gz).Decode(&dl); err != nil {
+		return nil, err
+	}
+	return &dl, nil
+}
+
+func (s *dirDeadLetterStore) List() ([]*DeadLetter, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.dlq.json.gz"))
+	if err != nil {
+		return nil, err
+	}
+
+	// One corrupt or truncated file shouldn't hide every other dead letter.
+	var entries []*DeadLetter
+	for _, f := range files {
+		dl, err := s.Get(strings.TrimSuffix(filepath.Base(f), ".dlq.json.gz"))
+		if err != nil {
+			slog.Warn("Skipping unreadable dead letter", "component", "dlq", "file", f, "error", err)
+			continue
+		}
+		entries = append(entries, dl)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	return entries, nil
+}
+
+func (s *dirDeadLetterStore) Delete(id string) error {
+	return os.Remove(s.path(id))
+}
+
+//////////////////////////////////////////////////
+// DLQ Command
+//////////////////////////////////////////////////
+
+const dlqUsage = `usage: etl [flags] dlq <command>
+
+commands:
+  list                      list dead-lettered batches
+  inspect <id>              print a batch, including its records, as JSON
+  replay (<id>... | -all)   resend batches to the sink that rejected them; delete on success
+  purge (<id>... | -all)    delete batches without sending them`
+
+func runDLQCommand(args []string) error {
+	store, err := newDirDeadLetterStore(cfg.DLQ.Dir)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return errors.New(dlqUsage)
+	}
+
+	switch args[0] {
+	case "list":
+		return dlqList(store)
+	case "inspect":
+		if len(args) != 2 {
+			return errors.New("usage: etl dlq inspect <id>")
+		}
+		dl, err := store.Get(args[1])
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(dl)
+	case "replay", "purge":
+		ids, err := dlqSelect(store, args[0], args[1:])
+		if err != nil {
+			return err
+		}
+		if args[0] == "purge" {
+			return dlqPurge(store, ids)
+		}
+		return dlqReplay(store, ids)
+	default:
+		return fmt.Errorf("unknown dlq command %q\n%s", args[0], dlqUsage)
+	}
+}
+
+func dlqSelect(store DeadLetterStore, command string, args []string) ([]string, error) {
+	fs := flag.NewFlagSet("dlq "+command, flag.ContinueOnError)
+	all := fs.Bool("all", false, "select every dead letter")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *all == (fs.NArg() > 0) {
+		return nil, fmt.Errorf("usage: etl dlq %s (<id>... | -all)", command)
+	}
+	if !*all {
+		return fs.Args(), nil
+	}
+
+	entries, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(entries))
+	for i, dl := range entries {
+		ids[i] = dl.ID
+	}
+	return ids, nil
+}
+
+func dlqList(store DeadLetterStore) error {
+	entries, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSINK\tRECORDS\tATTEMPTS\tREPLAYS\tSTATUS\tLAST ATTEMPT\tERROR")
+	for _, dl := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%s\t%s\n", dl.ID, dl.sinkName(), len(dl.Records), dl.Attempts, dl.Replays,
+			dl.StatusCode, dl.LastAttemptAt.Format(time.RFC3339), truncate(dl.Error, 60))
+	}
+	return w.Flush()
+}
+
+func dlqReplay(store DeadLetterStore, ids []string) error {
+	sinks := map[string]Sink{}
+	defer func() { closeSinks(slices.Collect(maps.Values(sinks))) }()
+	if cfg.Audit.File != "" {
+		var err error
+		if auditLog, err = openAuditLog(cfg.Audit); err != nil {
+			return fmt.Errorf("opening audit log: %w", err)
+		}
+		defer auditLog.Close()
+	}
+
+	var failed int
+	for _, id := range ids {
+		dl, err := store.Get(id)
+		if err != nil {
+			return err
+		}
+		s, ok := sinks[dl.sinkName()]
+		if !ok {
+			if s, err = newSink(dl.sinkName(), cfg); err != nil {
+				return err
+			}
+			sinks[dl.sinkName()] = s
+		}
+
+		batchID := newBatchID(dl.Records)
+		start := time.Now()
+		err = s.Load(withBatchID(withWorkerID(context.Background(), dl.WorkerID), batchID), dl.Records)
+		attempts := attemptsOf(err)
+		delivery := AuditEntry{Event: auditDelivery, BatchID: batchID, Sink: s.Name(), WorkerID: dl.WorkerID,
+			Records: len(dl.Records), Attempt: attempts, Status: statusOf(err),
+			LatencyMS: time.Since(start).Milliseconds(), Decision: outcomeDeadLettered, DeadLetterID: id}
+		if err == nil {
+			delivery.Decision, delivery.Loaded = outcomeLoaded, len(dl.Records)
+		} else {
+			delivery.Error = err.Error()
+		}
+		auditLog.write(delivery)
+		if err == nil {
+			if err := store.Delete(id); err != nil {
+				return err
+			}
+			fmt.Printf("%s: replayed %d records\n", id, len(dl.Records))
+			continue
+		}
+
+		failed++
+		dl.Replays++
+		dl.Attempts += attempts
+		dl.LastAttemptAt = time.Now().UTC()
+		dl.Error = err.Error()
+		var apiErr *APIError
+		if errors.As(err, &apiErr) {
+			dl.StatusCode = apiErr.StatusCode
+		}
+		if err := store.Put(dl); err != nil {
+			return err
+		}
+		fmt.Printf("%s: replay failed: %v\n", id, err)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d replays failed", failed, len(ids))
+	}
+	return nil
+}
+
+func dlqPurge(store DeadLetterStore, ids []string) error {
+	for _, id := range ids {
+		if err := store.Delete(id); err != nil {
+			return err
+		}
+		fmt.Printf("%s: purged\n", id)
+	}
+	return nil
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDirDeadLetterStoreList(t *testing.T) {
+	store, err := newDirDeadLetterStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for i := range 2 {
+		dl := newDeadLetter("http", i, testRecords(2), 1, time.Now(), errors.New("rejected"))
+		if err := store.Put(dl); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, dl.ID)
+	}
+	for name, content := range map[string]string{"corrupt": "not gzip", "empty": ""} {
+		if err := os.WriteFile(store.path(name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := store.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("listed %d dead letters, want %d", len(entries), len(want))
+	}
+	for _, dl := range entries {
+		if dl.ID != want[0] && dl.ID != want[1] {
+			t.Errorf("listed %s, want %v", dl.ID, want)
+		}
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+//////////////////////////////////////////////////
+// Leader Election
+//////////////////////////////////////////////////
+
+// ElectionConfig makes daemons running side by side for availability elect
+// a leader, the only one that runs scheduled cycles. The leader holds a
+// lease for TTL and renews it every RenewInterval; when it goes away a
+// standby takes the lease over once it expires.
+type ElectionConfig struct {
+	Backend string `yaml:"backend" json:"backend"` // none, redis, consul or kubernetes
+	// Name is the Redis key (after the key prefix), Consul KV key or
+	// Kubernetes Lease that instances competing for the same runs share.
+	Name string `yaml:"name" json:"name"`
+	// Identity names this instance as the holder; it defaults to the host
+	// name and process ID.
+	Identity      string           `yaml:"identity" json:"identity"`
+	TTL           Duration         `yaml:"ttl" json:"ttl"`
+	RenewInterval Duration         `yaml:"renew_interval" json:"renew_interval"`
+	Redis         RedisSpillConfig `yaml:"redis" json:"redis"`
+	// Namespace of the Lease; it defaults to the pod's. The API server is
+	// reached as configured under discovery.kubernetes, Consul as under
+	// discovery.consul.
+	Namespace string `yaml:"namespace" json:"namespace"`
+}
+
+func defaultElectionConfig() ElectionConfig {
+	return ElectionConfig{
+		Backend:       "none",
+		Name:          "etl-leader",
+		TTL:           Duration(15 * time.Second),
+		RenewInterval: Duration(5 * time.Second),
+		Redis:         defaultRedisSpillConfig(),
+	}
+}
+
+func (e *ElectionConfig) validate() []error {
+	var errs []error
+	switch e.Backend {
+	case "none":
+		return nil
+	case "redis":
+		errs = append(errs, e.Redis.validate("election.redis")...)
+	case "consul":
+		// Consul doesn't take session TTLs below 10s.
+		if e.TTL < Duration(10*time.Second) {
+			errs = append(errs, errors.New("election.ttl must be at least 10s with backend consul"))
+		}
+	case "kubernetes":
+	default:
+		errs = append(errs, fmt.Errorf("election.backend must be none, redis, consul or kubernetes, got %q", e.Backend))
+	}
+	if e.Name == "" {
+		errs = append(errs, errors.New("election.name must be set"))
+	}
+	if e.RenewInterval <= 0 {
+		errs = append(errs, errors.New("election.renew_interval must be > 0"))
+	}
+	if e.TTL <= e.RenewInterval {
+		errs = append(errs, errors.New("election.ttl must be longer than election.renew_interval"))
+	}
+	return errs
+}
+
+// LeaderLease is a lease at most one instance holds at a time.
+type LeaderLease interface {
+	// Acquire takes the lease if it is free, or renews it if this
+	// instance holds it, and reports whether this instance holds it.
+	Acquire(ctx context.Context) (bool, error)
+	// Release gives the lease up if this instance holds it.
+	Release(ctx context.Context) error
+}
+
+// Election keeps trying to hold the lease. Methods are safe on a nil
+// *Election, which is always the leader.
+type Election struct {
+	lease    LeaderLease
+	backend  string
+	identity string
+	ttl      time.Duration
+	renew    time.Duration
+
+	mu     sync.Mutex
+	until  time.Time // the lease is held until then
+	leader bool      // as last logged
+
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+// election is the daemon's election, nil without election.backend.
+var election *Election
+
+func newElection(conf ElectionConfig, c *Config) (*Election, error) {
+	identity := conf.Identity
+	if identity == "" {
+		host, _ := os.Hostname()
+		identity = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+	var lease LeaderLease
+	switch conf.Backend {
+	case "redis":
+		client, err := newRedisClient(conf.Redis)
+		if err != nil {
+			return nil, err
+		}
+		lease = &redisLease{client: client, key: conf.Redis.KeyPrefix + "leader:" + conf.Name, identity: identity, ttl: conf.TTL.Std()}
+	case "consul":
+		tlsConf, err := c.Discovery.Consul.TLS.build()
+		if err != nil {
+			return nil, fmt.Errorf("discovery.consul.tls: %w", err)
+		}
+		lease = &consulLease{
+			conf:     c.Discovery.Consul,
+			client:   &http.Client{Timeout: c.Discovery.Consul.Timeout.Std(), Transport: &http.Transport{TLSClientConfig: tlsConf}},
+			key:      conf.Name,
+			identity: identity,
+			ttl:      conf.TTL.Std(),
+		}
+	case "kubernetes":
+		api, err := newK8sClient(c.Discovery.Kubernetes)
+		if err != nil {
+			return nil, err
+		}
+		ns := conf.Namespace
+		if ns == "" {
+			raw, err := os.ReadFile(serviceAccountDir + "/namespace")
+			if err != nil {
+				return nil, errors.New("not running in a cluster: set election.namespace")
+			}
+			ns = string(raw)
+		}
+		lease = &k8sLease{api: api, namespace: ns, name: conf.Name, identity: identity, ttl: conf.TTL.Std()}
+	default:
+		return nil, fmt.Errorf("unknown election backend %q", conf.Backend)
+	}
+	return &Election{lease: lease, backend: conf.Backend, identity: identity, ttl: conf.TTL.Std(), renew: conf.RenewInterval.Std()}, nil
+}
+
+// Leader reports whether this instance holds the lease.
+func (e *Election) Leader() bool {
+	if e == nil {
+		return true
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return time.Now().Before(e.until)
+}
+
+// Start makes a first attempt at the lease, so a leader runs on startup,
+// and keeps renewing it in the background until Stop.
+func (e *Election) Start() {
+	ctx, stop := context.WithCancel(context.Background())
+	e.stop, e.done = stop, make(chan struct{})
+	e.try(ctx)
+	go func() {
+		defer close(e.done)
+		ticker := time.NewTicker(e.renew)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				e.try(ctx)
+			}
+		}
+	}()
+}
+
+// try acquires or renews the lease. The lease is counted from before the
+// request, so this instance stops leading no later than the backend
+// expires it; a failed renewal keeps the leadership until then.
+func (e *Election) try(ctx context.Context) {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, e.renew)
+	defer cancel()
+	held, err := e.lease.Acquire(ctx)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err != nil {
+		slog.Warn("Leader election failed", "component", "election", "backend", e.backend, "identity", e.identity, "error", err)
+	} else if held {
+		e.until = start.Add(e.ttl)
+	} else {
+		e.until = time.Time{}
+	}
+	if leader := time.Now().Before(e.until); leader != e.leader {
+		e.leader = leader
+		if leader {
+			slog.Info("Elected leader, running scheduled cycles", "component", "election", "backend", e.backend, "identity", e.identity)
+		} else {
+			slog.Warn("Not the leader, standing by", "component", "election", "backend", e.backend, "identity", e.identity)
+		}
+	}
+}
+
+// Stop stops renewing the lease and releases it, so a standby takes over
+// without waiting for it to expire.
+func (e *Election) Stop() {
+	if e == nil {
+		return
+	}
+	e.stop()
+	<-e.done
+	ctx, cancel := context.WithTimeout(context.Background(), e.renew)
+	defer cancel()
+	if err := e.lease.Release(ctx); err != nil {
+		slog.Warn("Failed to release the leader lease", "component", "election", "backend", e.backend, "error", err)
+	}
+}
+
+//////////////////////////////////////////////////
+// Redis Lease
+//////////////////////////////////////////////////
+
+// redisLease is a key holding the leader's identity, set with an expiry.
+type redisLease struct {
+	client   *redis.Client
+	key      string
+	identity string
+	ttl      time.Duration
+}
+
+var (
+	redisAcquire = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return 1
+end
+return 0`)
+	redisRelease = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+)
+
+func (l *redisLease) Acquire(ctx context.Context) (bool, error) {
+	n, err := redisAcquire.Run(ctx, l.client, []string{l.key}, l.identity, l.ttl.Milliseconds()).Int()
+	return n == 1, err
+}
+
+func (l *redisLease) Release(ctx context.Context) error {
+	defer l.client.Close()
+	return redisRelease.Run(ctx, l.client, []string{l.key}, l.identity).Err()
+}
+
+//////////////////////////////////////////////////
+// Consul Lease
+//////////////////////////////////////////////////
+
+// consulLease is a KV key locked with a session that has a TTL; the lock
+// is released when the session expires.
+type consulLease struct {
+	conf     ConsulConfig
+	client   *http.Client
+	key      string
+	identity string
+	ttl      time.Duration
+	session  string
+}
+
+func (l *consulLease) Acquire(ctx context.Context) (bool, error) {
+	if l.session != "" {
+		if err := consulDo(ctx, l.client, l.conf, http.MethodPut, "/v1/session/renew/"+l.session, nil, nil, nil); err != nil {
+			slog.Debug("Consul session lost, creating another", "component", "election", "session", l.session, "error", err)
+			l.session = ""
+		}
+	}
+	if l.session == "" {
+		body := map[string]string{"Name": l.key, "TTL": l.ttl.String(), "Behavior": "release", "LockDelay": "0s"}
+		var created struct{ ID string }
+		if err := consulDo(ctx, l.client, l.conf, http.MethodPut, "/v1/session/create", nil, body, &created); err != nil {
+			return false, err
+		}
+		l.session = created.ID
+	}
+	var held bool
+	err := consulDo(ctx, l.client, l.conf, http.MethodPut, "/v1/kv/"+l.key, url.Values{"acquire": {l.session}}, l.identity, &held)
+	return held, err
+}
+
+func (l *consulLease) Release(ctx context.Context) error {
+	if l.session == "" {
+		return nil
+	}
+	return errors.Join(
+		consulDo(ctx, l.client, l.conf, http.MethodPut, "/v1/kv/"+l.key, url.Values{"release": {l.session}}, l.identity, nil),
+		consulDo(ctx, l.client, l.conf, http.MethodPut, "/v1/session/destroy/"+l.session, nil, nil, nil),
+	)
+}
+
+//////////////////////////////////////////////////
+// Kubernetes Lease
+//////////////////////////////////////////////////
+
+// k8sLease is a coordination.k8s.io Lease, taken over once its holder
+// hasn't renewed it for its duration. Updates carry the resourceVersion
+// read, so of two instances racing for it only one succeeds.
+type k8sLease struct {
+	api       *k8sClient
+	namespace string
+	name      string
+	identity  string
+	ttl       time.Duration
+}
+
+type k8sLeaseObject struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string `json:"holderIdentity"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int    `json:"leaseTransitions"`
+	} `json:"spec"`
+}
+
+// k8sMicroTime is the format of the Lease's times.
+const k8sMicroTime = "2006-01-02T15:04:05.000000Z07:00"
+
+func (l *k8sLease) path() string {
+	return "/apis/coordination.k8s.io/v1/namespaces/" + url.PathEscape(l.namespace) + "/leases"
+}
+
+func (l *k8sLease) get(ctx context.Context) (*k8sLeaseObject, error) {
+	status, raw, err := l.api.do(ctx, http.MethodGet, l.path()+"/"+url.PathEscape(l.name), nil)
+	if err != nil {
+		return nil, err
+	}
+	if status == http.StatusNotFound {
+		return nil, nil
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("kubernetes lease %s returned %d %s: %s", l.name, status, http.StatusText(status), truncate(string(raw), 200))
+	}
+	var lease k8sLeaseObject
+	if err := json.Unmarshal(raw, &lease); err != nil {
+		return nil, fmt.Errorf("decoding kubernetes lease %s: %w", l.name, err)
+	}
+	return &lease, nil
+}
+
+// write creates the lease, or updates it if it has a resourceVersion. A
+// conflict means another instance got there first.
+func (l *k8sLease) write(ctx context.Context, lease *k8sLeaseObject) (bool, error) {
+	method, path := http.MethodPost, l.path()
+	if lease.Metadata.ResourceVersion != "" {
+		method, path = http.MethodPut, path+"/"+url.PathEscape(l.name)
+	}
+	status, raw, err := l.api.do(ctx, method, path, lease)
+	switch {
+	case err != nil:
+		return false, err
+	case status == http.StatusConflict:
+		return false, nil
+	case status < 200 || status > 299:
+		return false, fmt.Errorf("kubernetes lease %s returned %d %s: %s", l.name, status, http.StatusText(status), truncate(string(raw), 200))
+	}
+	return true, nil
+}
+
+func (l *k8sLease) Acquire(ctx context.Context) (bool, error) {
+	lease, err := l.get(ctx)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	if lease == nil {
+		lease = &k8sLeaseObject{APIVersion: "coordination.k8s.io/v1", Kind: "Lease"}
+		lease.Metadata.Name, lease.Metadata.Namespace = l.name, l.namespace
+	} else if lease.Spec.HolderIdentity != l.identity && lease.Spec.HolderIdentity != "" {
+		renewed, err := time.Parse(time.RFC3339Nano, lease.Spec.RenewTime)
+		if err == nil && now.Before(renewed.Add(time.Duration(lease.Spec.LeaseDurationSeconds)*time.Second)) {
+			return false, nil
+		}
+	}
+	if lease.Spec.HolderIdentity != l.identity {
+		lease.Spec.HolderIdentity = l.identity
+		lease.Spec.AcquireTime = now.UTC().Format(k8sMicroTime)
+		lease.Spec.LeaseTransitions++
+	}
+	lease.Spec.LeaseDurationSeconds = int(l.ttl.Seconds())
+	lease.Spec.RenewTime = now.UTC().Format(k8sMicroTime)
+	return l.write(ctx, lease)
+}
+
+func (l *k8sLease) Release(ctx context.Context) error {
+	lease, err := l.get(ctx)
+	if err != nil || lease == nil || lease.Spec.HolderIdentity != l.identity {
+		return err
+	}
+	lease.Spec.HolderIdentity = ""
+	_, err = l.write(ctx, lease)
+	return err
+}
+
+// electionState is the role shown by the control API.
+func electionState() string {
+	switch {
+	case election == nil:
+		return ""
+	case election.Leader():
+		return "leader"
+	default:
+		return "standby"
+	}
+}
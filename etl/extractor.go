@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// Extractor Interface & Registry
+//////////////////////////////////////////////////
+
+// Extractor pulls raw CPU statistics from a single appliance. Implementations
+// must honour ctx cancellation; the pipeline applies the per-appliance timeout.
+// Extractors that read other metric types also implement MetricExtractor.
+type Extractor interface {
+	Extract(ctx context.Context, ap Appliance) (*CpuStats, error)
+}
+
+// ExtractorFactory builds an Extractor from the run configuration.
+type ExtractorFactory func(cfg *Config) (Extractor, error)
+
+var extractorRegistry = map[string]ExtractorFactory{}
+
+// registerExtractor makes an extractor selectable via extract.type. It is
+// meant to be called from init() in the file that implements the extractor.
+func registerExtractor(name string, factory ExtractorFactory) {
+	if _, dup := extractorRegistry[name]; dup {
+		panic("extractor already registered: " + name)
+	}
+	extractorRegistry[name] = factory
+}
+
+func newExtractor(cfg *Config) (Extractor, error) {
+	factory, ok := extractorRegistry[cfg.Extract.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown extractor %q (available: %v)", cfg.Extract.Type, extractorNames())
+	}
+	ex, err := factory(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ex.(MetricExtractor); !ok && !slices.Equal(cfg.Extract.Metrics, []string{"cpu"}) {
+		return nil, fmt.Errorf("extractor %q only reads cpu, not %v", cfg.Extract.Type, cfg.Extract.Metrics)
+	}
+	if _, ok := ex.(CoreExtractor); !ok && cfg.Extract.CPURecords != "host" {
+		return nil, fmt.Errorf("extractor %q can't read CPU cores (extract.cpu_records: %s)", cfg.Extract.Type, cfg.Extract.CPURecords)
+	}
+	return ex, nil
+}
+
+// closeExtractor closes an extractor that holds connections.
+func closeExtractor(ex Extractor) {
+	closer, ok := ex.(io.Closer)
+	if !ok {
+		return
+	}
+	if err := closer.Close(); err != nil {
+		slog.Error("Error closing extractor", "component", "extract", "extractor", cfg.Extract.Type, "error", err)
+	}
+}
+
+func extractorNames() []string {
+	names := make([]string, 0, len(extractorRegistry))
+	for name := range extractorRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CoreExtractor is implemented by extractors that can read every CPU core
+// of an appliance. A row with CPUNumber "all" holds the host-level figures
+// and is optional.
+type CoreExtractor interface {
+	ExtractCores(ctx context.Context, ap Appliance) ([]CpuStats, error)
+}
+
+// extractAppliance reads every metric type in extract.metrics from one
+// appliance, within a single extract timeout. cpu holds the CPU stats
+// extract.cpu_records asks for, if cpu is among the metrics. Any failing
+// metric type fails the appliance.
+func extractAppliance(ctx context.Context, ex Extractor, ap Appliance) (cpu []*CpuStats, samples []MetricSample, err error) {
+	ctx, span := tracer.Start(ctx, "extract")
+	defer func() { endSpan(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.Extract.Timeout.Std())
+	defer cancel()
+
+	for _, metric := range cfg.Extract.Metrics {
+		if politeness != nil {
+			if err = politeness.Space(ctx, ap); err != nil {
+				return nil, nil, err
+			}
+		}
+		if metric == "cpu" {
+			if cpu, err = extractCPU(ctx, ex, ap); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		s, err := ex.(MetricExtractor).ExtractMetric(ctx, ap, metric)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", metric, err)
+		}
+		samples = append(samples, s...)
+	}
+	return cpu, samples, nil
+}
+
+// extractCPU returns the host-level stats, the stats of every core, or
+// both. Without an "all" row from the appliance the host-level stats are
+// the average of the cores.
+func extractCPU(ctx context.Context, ex Extractor, ap Appliance) ([]*CpuStats, error) {
+	if cfg.Extract.CPURecords == "host" {
+		stats, err := ex.Extract(ctx, ap)
+		if err != nil {
+			return nil, err
+		}
+		return []*CpuStats{stats}, nil
+	}
+
+	rows, err := ex.(CoreExtractor).ExtractCores(ctx, ap)
+	if err != nil {
+		return nil, err
+	}
+	var host *CpuStats
+	cores := make([]*CpuStats, 0, len(rows))
+	for i := range rows {
+		if rows[i].CPUNumber == "all" {
+			host = &rows[i]
+		} else {
+			cores = append(cores, &rows[i])
+		}
+	}
+	if len(cores) == 0 {
+		return nil, errors.New("appliance reported no CPU cores")
+	}
+	if cfg.Extract.CPURecords == "cores" {
+		return cores, nil
+	}
+	if host == nil {
+		host = averageCores(cores)
+	}
+	return append(cores, host), nil
+}
+
+// averageCores builds the host-level "all" stats from per-core stats.
+func averageCores(cores []*CpuStats) *CpuStats {
+	var idle, user, sys, irq, nice float64
+	for _, c := range cores {
+		idle += parsePercent(c.PIdle)
+		user += parsePercent(c.PUser)
+		sys += parsePercent(c.PSys)
+		irq += parsePercent(c.PIRQ)
+		nice += parsePercent(c.PNice)
+	}
+	n := float64(len(cores))
+	format := func(sum float64) string { return strconv.FormatFloat(sum/n, 'f', -1, 64) }
+	return &CpuStats{
+		Name:      cores[0].Name,
+		Timestamp: cores[0].Timestamp,
+		CPUNumber: "all",
+		PIdle:     format(idle),
+		PUser:     format(user),
+		PSys:      format(sys),
+		PIRQ:      format(irq),
+		PNice:     format(nice),
+	}
+}
+
+func parsePercent(s string) float64 {
+	v, _ := strconv.ParseFloat(s, 64)
+	return v
+}
+
+//////////////////////////////////////////////////
+// Per-Appliance Credentials
+//////////////////////////////////////////////////
+
+// ApplianceCredentials are the credentials of the appliances whose CSV line
+// names them, in place of the extractor's own. Fields left empty fall back
+// to the extractor's. The secrets are meant to be secret references, so
+// neither the CSV nor the config holds them.
+type ApplianceCredentials struct {
+	Token     string `yaml:"token" json:"token" secret:"true"`         // http: Authorization header value; grpc: authorization metadata
+	Username  string `yaml:"username" json:"username"`                 // http basic auth, ssh, SNMPv3 user
+	Password  string `yaml:"password" json:"password" secret:"true"`   // http basic auth, ssh, SNMPv3 auth passphrase
+	Community string `yaml:"community" json:"community" secret:"true"` // SNMP v1/v2c
+}
+
+func validateCredentials(creds map[string]*ApplianceCredentials) []error {
+	var errs []error
+	for name, c := range creds {
+		if c == nil || *c == (ApplianceCredentials{}) {
+			errs = append(errs, fmt.Errorf("extract.credentials.%s sets no credentials", name))
+		}
+		if strings.Contains(name, ",") {
+			errs = append(errs, fmt.Errorf("extract.credentials.%s: names can't contain a comma", name))
+		}
+	}
+	return errs
+}
+
+// applianceCredentials looks up the credentials a CSV line names. An empty
+// name is the extractor's own credentials.
+func applianceCredentials(name string) (*ApplianceCredentials, error) {
+	if name == "" {
+		return nil, nil
+	}
+	creds, ok := cfg.Extract.Credentials[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown credentials %q (not under extract.credentials)", name)
+	}
+	return creds, nil
+}
+
+//////////////////////////////////////////////////
+// Simulated Extractor
+//////////////////////////////////////////////////
+
+func init() {
+	registerExtractor("simulated", func(cfg *Config) (Extractor, error) {
+		return &simulatedExtractor{delay: cfg.Extract.SimulatedDelay.Std()}, nil
+	})
+}
+
+// simulatedExtractor returns fixed stats after a configurable delay. It stands
+// in for a real appliance API during development and load testing.
+type simulatedExtractor struct {
+	delay time.Duration
+}
+
+func (s *simulatedExtractor) Extract(ctx context.Context, ap Appliance) (*CpuStats, error) {
+	select {
+	case <-time.After(s.delay):
+		return &CpuStats{
+			Name:      ap.HostName,
+			CPUNumber: "0",
+			PIdle:     "95",
+			PUser:     "3",
+			PSys:      "1",
+			PIRQ:      "0.5",
+			PNice:     "0",
+			Timestamp: uint64(time.Now().Unix()),
+		}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// ExtractMetric returns fixed memory figures and counters for one disk and
+// one interface that grow with the clock. Only the cpu read is delayed.
+func (s *simulatedExtractor) ExtractMetric(ctx context.Context, ap Appliance, metric string) ([]MetricSample, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	now := uint64(time.Now().Unix())
+	sample := MetricSample{Metric: metric, Name: ap.HostName, Timestamp: now}
+	t := float64(now % 1e6)
+	switch metric {
+	case "memory":
+		sample.Values = map[string]float64{
+			"total_bytes":      16 << 30,
+			"used_bytes":       6 << 30,
+			"free_bytes":       2 << 30,
+			"available_bytes":  9 << 30,
+			"buffers_bytes":    1 << 30,
+			"cached_bytes":     7 << 30,
+			"swap_total_bytes": 4 << 30,
+			"swap_used_bytes":  0,
+		}
+	case "disk":
+		sample.Device = "sda"
+		sample.Values = map[string]float64{
+			"reads":       t * 20,
+			"writes":      t * 50,
+			"read_bytes":  t * 20 * 4096,
+			"write_bytes": t * 50 * 4096,
+			"io_time_ms":  t * 30,
+		}
+	case "network":
+		sample.Device = "eth0"
+		sample.Values = map[string]float64{
+			"rx_bytes":   t * 125000,
+			"tx_bytes":   t * 62500,
+			"rx_packets": t * 100,
+			"tx_packets": t * 60,
+			"rx_errors":  0,
+			"tx_errors":  0,
+			"rx_dropped": 0,
+			"tx_dropped": 0,
+		}
+	}
+	return []MetricSample{sample}, nil
+}
+
+// ExtractCores returns four cores with the fixed stats, without an "all"
+// row.
+func (s *simulatedExtractor) ExtractCores(ctx context.Context, ap Appliance) ([]CpuStats, error) {
+	stats, err := s.Extract(ctx, ap)
+	if err != nil {
+		return nil, err
+	}
+	cores := make([]CpuStats, 4)
+	for i := range cores {
+		cores[i] = *stats
+		cores[i].CPUNumber = strconv.Itoa(i)
+		cores[i].PIdle = strconv.Itoa(90 + 2*i)
+		cores[i].PUser = strconv.Itoa(8 - 2*i)
+	}
+	return cores, nil
+}
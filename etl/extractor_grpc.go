@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+//////////////////////////////////////////////////
+// gRPC Extractor
+//////////////////////////////////////////////////
+
+type GRPCExtractConfig struct {
+	Port      int       `yaml:"port" json:"port"`
+	Insecure  bool      `yaml:"insecure" json:"insecure"` // plaintext instead of TLS
+	TLS       TLSConfig `yaml:"tls" json:"tls"`
+	AuthToken string    `yaml:"auth_token" json:"auth_token" secret:"true"` // authorization metadata value
+	// RequestTimeout is the deadline of each call, within extract.timeout.
+	RequestTimeout Duration `yaml:"request_timeout" json:"request_timeout"`
+	MaxAttempts    int      `yaml:"max_attempts" json:"max_attempts"`
+	RetryDelay     Duration `yaml:"retry_delay" json:"retry_delay"`
+	// MaxConns is how many appliance connections are kept; beyond it the
+	// least recently used idle one is closed. A connection unused for
+	// IdleTimeout drops its socket until the next call.
+	MaxConns    int      `yaml:"max_conns" json:"max_conns"`
+	IdleTimeout Duration `yaml:"idle_timeout" json:"idle_timeout"`
+}
+
+func defaultGRPCExtractConfig() GRPCExtractConfig {
+	return GRPCExtractConfig{
+		Port:           50051,
+		TLS:            defaultTLSConfig(),
+		RequestTimeout: Duration(5 * time.Second),
+		MaxAttempts:    3,
+		RetryDelay:     Duration(500 * time.Millisecond),
+		MaxConns:       1000,
+		IdleTimeout:    Duration(5 * time.Minute),
+	}
+}
+
+func (g *GRPCExtractConfig) validate() []error {
+	var errs []error
+	if g.Port <= 0 || g.Port > 65535 {
+		errs = append(errs, fmt.Errorf("extract.grpc.port out of range: %d", g.Port))
+	}
+	if !g.Insecure {
+		errs = append(errs, g.TLS.validate("extract.grpc.tls")...)
+	}
+	if g.RequestTimeout <= 0 {
+		errs = append(errs, errors.New("extract.grpc.request_timeout must be > 0"))
+	}
+	if g.MaxAttempts <= 0 {
+		errs = append(errs, fmt.Errorf("extract.grpc.max_attempts must be > 0, got %d", g.MaxAttempts))
+	}
+	if g.MaxConns <= 0 {
+		errs = append(errs, fmt.Errorf("extract.grpc.max_conns must be > 0, got %d", g.MaxConns))
+	}
+	if g.IdleTimeout <= 0 {
+		errs = append(errs, errors.New("extract.grpc.idle_timeout must be > 0"))
+	}
+	return errs
+}
+
+func init() {
+	registerExtractor("grpc", newGRPCExtractor)
+}
+
+// grpcStatsMethod is the StatsService of proto/stats_service.proto.
+const grpcStatsMethod = "/concurrentetl.v1.StatsService/GetStats"
+
+// grpcExtractor calls GetStats on <IP>:<port> of every appliance, once per
+// metric type.
+type grpcExtractor struct {
+	conf GRPCExtractConfig
+	pool *grpcConnPool
+}
+
+func newGRPCExtractor(cfg *Config) (Extractor, error) {
+	conf := cfg.Extract.GRPC
+	creds := insecure.NewCredentials()
+	if !conf.Insecure {
+		tlsConf, err := conf.TLS.build()
+		if err != nil {
+			return nil, fmt.Errorf("extract.grpc.tls: %w", err)
+		}
+		creds = credentials.NewTLS(tlsConf)
+	}
+	return &grpcExtractor{
+		conf: conf,
+		pool: &grpcConnPool{
+			max:   conf.MaxConns,
+			conns: map[string]*pooledGRPCConn{},
+			opts:  []grpc.DialOption{grpc.WithTransportCredentials(creds), grpc.WithIdleTimeout(conf.IdleTimeout.Std())},
+		},
+	}, nil
+}
+
+func (g *grpcExtractor) Extract(ctx context.Context, ap Appliance) (*CpuStats, error) {
+	rows, err := g.ExtractCores(ctx, ap)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 1 {
+		return &rows[0], nil
+	}
+	cores := make([]*CpuStats, 0, len(rows))
+	for i := range rows {
+		if rows[i].CPUNumber == "all" {
+			return &rows[i], nil
+		}
+		cores = append(cores, &rows[i])
+	}
+	if len(cores) == 0 {
+		return nil, errors.New("appliance reported no CPU stats")
+	}
+	return averageCores(cores), nil
+}
+
+// ExtractCores returns a row per sample of the cpu metric, named by its
+// device; a sample without one is the host-level "all" row.
+func (g *grpcExtractor) ExtractCores(ctx context.Context, ap Appliance) ([]CpuStats, error) {
+	samples, err := g.stats(ctx, ap, "cpu")
+	if err != nil {
+		return nil, err
+	}
+	format := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	rows := make([]CpuStats, len(samples))
+	for i, s := range samples {
+		cpu := s.Device
+		if cpu == "" {
+			cpu = "all"
+		}
+		rows[i] = CpuStats{
+			Name:      s.Name,
+			Timestamp: s.Timestamp,
+			CPUNumber: cpu,
+			PIdle:     format(s.Values["idle"]),
+			PUser:     format(s.Values["user"]),
+			PSys:      format(s.Values["system"]),
+			PIRQ:      format(s.Values["irq"]),
+			PNice:     format(s.Values["nice"]),
+		}
+	}
+	return rows, nil
+}
+
+func (g *grpcExtractor) ExtractMetric(ctx context.Context, ap Appliance, metric string) ([]MetricSample, error) {
+	return g.stats(ctx, ap, metric)
+}
+
+// stats calls GetStats, retrying failures worth retrying.
+func (g *grpcExtractor) stats(ctx context.Context, ap Appliance, metric string) ([]MetricSample, error) {
+	addr := net.JoinHostPort(ap.IP, strconv.Itoa(g.conf.Port))
+	req := appendProtoString(nil, 1, metric)
+	var lastErr error
+	for attempt := 1; attempt <= g.conf.MaxAttempts; attempt++ {
+		resp, err := g.call(ctx, ap, addr, req)
+		if err == nil {
+			return decodeStatsResponse(resp, metric, ap, uint64(time.Now().Unix()))
+		}
+		lastErr = err
+		switch status.Code(err) {
+		case codes.Unavailable, codes.ResourceExhausted, codes.DeadlineExceeded, codes.Aborted:
+		default:
+			return nil, lastErr
+		}
+		if attempt == g.conf.MaxAttempts {
+			break
+		}
+
+		select {
+		case <-time.After(time.Duration(attempt) * g.conf.RetryDelay.Std()):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w (last error: %v)", ctx.Err(), lastErr)
+		}
+	}
+	return nil, lastErr
+}
+
+// call performs a single attempt within request_timeout.
+func (g *grpcExtractor) call(ctx context.Context, ap Appliance, addr string, req []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, g.conf.RequestTimeout.Std())
+	defer cancel()
+	token := g.conf.AuthToken
+	if c := ap.Credentials; c != nil && c.Token != "" {
+		token = c.Token
+	}
+	if token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", token)
+	}
+
+	conn, err := g.pool.get(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer g.pool.put(conn)
+	var resp []byte
+	if err := conn.conn.Invoke(ctx, grpcStatsMethod, req, &resp, grpc.ForceCodec(grpcRawCodec{})); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (g *grpcExtractor) Close() error {
+	return g.pool.Close()
+}
+
+// decodeStatsResponse reads the samples of a StatsResponse.
+func decodeStatsResponse(raw []byte, metric string, ap Appliance, now uint64) ([]MetricSample, error) {
+	var samples []MetricSample
+	err := walkProto(raw, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		if num != 1 || typ != protowire.BytesType {
+			return nil
+		}
+		s := MetricSample{Metric: metric, Name: ap.HostName, Timestamp: now, Values: map[string]float64{}}
+		err := walkProto(v, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+			switch {
+			case num == 1 && typ == protowire.BytesType:
+				s.Device = string(v)
+			case num == 2 && typ == protowire.BytesType:
+				var key string
+				var value float64
+				err := walkProto(v, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+					switch {
+					case num == 1 && typ == protowire.BytesType:
+						key = string(v)
+					case num == 2 && typ == protowire.Fixed64Type:
+						value = math.Float64frombits(n)
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+				s.Values[key] = value
+			case num == 3 && typ == protowire.VarintType && n > 0:
+				s.Timestamp = n
+			case num == 4 && typ == protowire.BytesType && len(v) > 0:
+				s.Name = string(v)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		samples = append(samples, s)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s stats: %w", metric, err)
+	}
+	if len(samples) == 0 {
+		return nil, fmt.Errorf("appliance returned no %s stats", metric)
+	}
+	return samples, nil
+}
+
+// grpcConnPool keeps a client connection per appliance address, so polls
+// after the first skip the TCP and TLS handshakes. Connections are shared
+// by concurrent calls; past max, the least recently used one not in use is
+// closed.
+type grpcConnPool struct {
+	max   int
+	opts  []grpc.DialOption
+	mu    sync.Mutex
+	conns map[string]*pooledGRPCConn
+}
+
+type pooledGRPCConn struct {
+	addr   string
+	conn   *grpc.ClientConn
+	active int
+	used   time.Time
+}
+
+func (p *grpcConnPool) get(addr string) (*pooledGRPCConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c, ok := p.conns[addr]
+	if !ok {
+		conn, err := grpc.NewClient(addr, p.opts...)
+		if err != nil {
+			return nil, err
+		}
+		if len(p.conns) >= p.max {
+			p.evict()
+		}
+		c = &pooledGRPCConn{addr: addr, conn: conn}
+		p.conns[addr] = c
+	}
+	c.active++
+	c.used = time.Now()
+	return c, nil
+}
+
+func (p *grpcConnPool) put(c *pooledGRPCConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c.active--
+}
+
+// evict closes the least recently used connection not in use, if any.
+func (p *grpcConnPool) evict() {
+	var oldest *pooledGRPCConn
+	for _, c := range p.conns {
+		if c.active == 0 && (oldest == nil || c.used.Before(oldest.used)) {
+			oldest = c
+		}
+	}
+	if oldest != nil {
+		oldest.conn.Close()
+		delete(p.conns, oldest.addr)
+	}
+}
+
+func (p *grpcConnPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var errs []error
+	for addr, c := range p.conns {
+		errs = append(errs, c.conn.Close())
+		delete(p.conns, addr)
+	}
+	return errors.Join(errs...)
+}
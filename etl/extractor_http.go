@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// HTTP Extractor
+//////////////////////////////////////////////////
+
+type HTTPExtractConfig struct {
+	Scheme             string   `yaml:"scheme" json:"scheme"`
+	Port               int      `yaml:"port" json:"port"`
+	Path               string   `yaml:"path" json:"path"`
+	AuthToken          string   `yaml:"auth_token" json:"auth_token" secret:"true"`
+	Username           string   `yaml:"username" json:"username"`
+	Password           string   `yaml:"password" json:"password" secret:"true"`
+	RequestTimeout     Duration `yaml:"request_timeout" json:"request_timeout"`
+	MaxAttempts        int      `yaml:"max_attempts" json:"max_attempts"`
+	RetryDelay         Duration `yaml:"retry_delay" json:"retry_delay"`
+	CAFile             string   `yaml:"ca_file" json:"ca_file"`
+	InsecureSkipVerify bool     `yaml:"insecure_skip_verify" json:"insecure_skip_verify"`
+	CertFile           string   `yaml:"cert_file" json:"cert_file"` // client certificate for appliances requiring mTLS
+	KeyFile            string   `yaml:"key_file" json:"key_file"`
+	CertEnv            string   `yaml:"cert_env" json:"cert_env"` // or env vars holding the PEM
+	KeyEnv             string   `yaml:"key_env" json:"key_env"`
+	CertPEM            string   `yaml:"cert_pem" json:"cert_pem" secret:"true"` // or the PEM itself
+	KeyPEM             string   `yaml:"key_pem" json:"key_pem" secret:"true"`
+	// MetricPaths are the paths of the metric types other than cpu.
+	MetricPaths map[string]string `yaml:"metric_paths" json:"metric_paths"`
+}
+
+func defaultHTTPExtractConfig() HTTPExtractConfig {
+	return HTTPExtractConfig{
+		Scheme: "http",
+		Path:   "/api/cpu",
+		MetricPaths: map[string]string{
+			"memory":  "/api/memory",
+			"disk":    "/api/disk",
+			"network": "/api/network",
+		},
+		RequestTimeout: Duration(5 * time.Second),
+		MaxAttempts:    3,
+		RetryDelay:     Duration(500 * time.Millisecond),
+	}
+}
+
+func (h *HTTPExtractConfig) validate() []error {
+	var errs []error
+	if h.Scheme != "http" && h.Scheme != "https" {
+		errs = append(errs, fmt.Errorf("extract.http.scheme must be http or https, got %q", h.Scheme))
+	}
+	if h.Port < 0 || h.Port > 65535 {
+		errs = append(errs, fmt.Errorf("extract.http.port out of range: %d", h.Port))
+	}
+	if !strings.HasPrefix(h.Path, "/") {
+		errs = append(errs, fmt.Errorf("extract.http.path must start with /, got %q", h.Path))
+	}
+	for metric, path := range h.MetricPaths {
+		if _, ok := metricTypes[metric]; !ok {
+			errs = append(errs, fmt.Errorf("extract.http.metric_paths: unknown metric type %q", metric))
+		}
+		if !strings.HasPrefix(path, "/") {
+			errs = append(errs, fmt.Errorf("extract.http.metric_paths.%s must start with /, got %q", metric, path))
+		}
+	}
+	if h.RequestTimeout <= 0 {
+		errs = append(errs, errors.New("extract.http.request_timeout must be > 0"))
+	}
+	if h.MaxAttempts <= 0 {
+		errs = append(errs, fmt.Errorf("extract.http.max_attempts must be > 0, got %d", h.MaxAttempts))
+	}
+	tlsConf := h.tls()
+	errs = append(errs, tlsConf.validate("extract.http")...)
+	return errs
+}
+
+// tls returns the TLS settings for talking to appliances.
+func (h *HTTPExtractConfig) tls() TLSConfig {
+	return TLSConfig{
+		CAFile:             h.CAFile,
+		InsecureSkipVerify: h.InsecureSkipVerify,
+		MinVersion:         "1.2",
+		CertFile:           h.CertFile,
+		KeyFile:            h.KeyFile,
+		CertEnv:            h.CertEnv,
+		KeyEnv:             h.KeyEnv,
+		CertPEM:            h.CertPEM,
+		KeyPEM:             h.KeyPEM,
+	}
+}
+
+func init() {
+	registerExtractor("http", newHTTPExtractor)
+}
+
+// httpExtractor fetches CpuStats as JSON from <scheme>://<IP>[:port]<path>,
+// and the other metric types from their metric_paths.
+type httpExtractor struct {
+	conf   HTTPExtractConfig
+	client *http.Client
+}
+
+func newHTTPExtractor(cfg *Config) (Extractor, error) {
+	conf := cfg.Extract.HTTP
+
+	tlsConf := conf.tls()
+	tlsConfig, err := tlsConf.build()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	// Every appliance is a different host, so a large idle pool buys nothing.
+	transport.MaxIdleConnsPerHost = 1
+
+	return &httpExtractor{
+		conf:   conf,
+		client: &http.Client{Transport: transport},
+	}, nil
+}
+
+// url returns the URL of path on the appliance. IPv6 addresses are
+// bracketed, with or without a port.
+func (h *httpExtractor) url(ap Appliance, path string) (string, error) {
+	u, err := url.Parse(path)
+	if err != nil {
+		return "", err
+	}
+	u.Scheme, u.Host = h.conf.Scheme, ap.IP
+	switch {
+	case h.conf.Port != 0:
+		u.Host = net.JoinHostPort(ap.IP, strconv.Itoa(h.conf.Port))
+	case strings.Contains(ap.IP, ":"):
+		u.Host = "[" + ap.IP + "]"
+	}
+	return u.String(), nil
+}
+
+func (h *httpExtractor) Extract(ctx context.Context, ap Appliance) (*CpuStats, error) {
+	body, err := h.get(ctx, ap, h.conf.Path)
+	if err != nil {
+		return nil, err
+	}
+	var stats CpuStats
+	if err := json.Unmarshal(body, &stats); err != nil {
+		return nil, fmt.Errorf("decoding stats: %w", err)
+	}
+	if stats.Name == "" {
+		stats.Name = ap.HostName
+	}
+	if stats.Timestamp == 0 {
+		stats.Timestamp = uint64(time.Now().Unix())
+	}
+	return &stats, nil
+}
+
+// ExtractCores reads a JSON array of CpuStats, one per core and optionally
+// an "all" row, from the cpu path. A single object is taken as one core.
+func (h *httpExtractor) ExtractCores(ctx context.Context, ap Appliance) ([]CpuStats, error) {
+	body, err := h.get(ctx, ap, h.conf.Path)
+	if err != nil {
+		return nil, err
+	}
+	var rows []CpuStats
+	if err := json.Unmarshal(body, &rows); err != nil {
+		var one CpuStats
+		if err := json.Unmarshal(body, &one); err != nil {
+			return nil, fmt.Errorf("decoding stats: %w", err)
+		}
+		rows = []CpuStats{one}
+	}
+	now := uint64(time.Now().Unix())
+	for i := range rows {
+		if rows[i].Name == "" {
+			rows[i].Name = ap.HostName
+		}
+		if rows[i].Timestamp == 0 {
+			rows[i].Timestamp = now
+		}
+	}
+	return rows, nil
+}
+
+func (h *httpExtractor) ExtractMetric(ctx context.Context, ap Appliance, metric string) ([]MetricSample, error) {
+	path, ok := h.conf.MetricPaths[metric]
+	if !ok {
+		return nil, fmt.Errorf("extract.http.metric_paths has no path for %s", metric)
+	}
+	body, err := h.get(ctx, ap, path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeMetricJSON(body, metric, ap, uint64(time.Now().Unix()))
+}
+
+// get fetches path from the appliance, retrying failures worth retrying.
+func (h *httpExtractor) get(ctx context.Context, ap Appliance, path string) ([]byte, error) {
+	var lastErr error
+	for attempt := 1; attempt <= h.conf.MaxAttempts; attempt++ {
+		body, retryable, err := h.fetch(ctx, ap, path)
+		if err == nil {
+			return body, nil
+		}
+		lastErr = err
+		if !retryable || attempt == h.conf.MaxAttempts {
+			break
+		}
+
+		select {
+		case <-time.After(time.Duration(attempt) * h.conf.RetryDelay.Std()):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w (last error: %v)", ctx.Err(), lastErr)
+		}
+	}
+	return nil, lastErr
+}
+
+// auth returns the Authorization header value, or else the basic auth
+// credentials, for ap: the appliance's own if it has any, otherwise those
+// under extract.http.
+func (h *httpExtractor) auth(ap Appliance) (token, username, password string) {
+	token, username, password = h.conf.AuthToken, h.conf.Username, h.conf.Password
+	c := ap.Credentials
+	switch {
+	case c == nil:
+	case c.Token != "":
+		token = c.Token
+	case c.Username != "" || c.Password != "":
+		token = ""
+		if c.Username != "" {
+			username = c.Username
+		}
+		if c.Password != "" {
+			password = c.Password
+		}
+	}
+	return token, username, password
+}
+
+// fetch performs a single attempt. The bool reports whether the failure is
+// worth retrying (network errors, 5xx and 429).
+func (h *httpExtractor) fetch(ctx context.Context, ap Appliance, path string) ([]byte, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.conf.RequestTimeout.Std())
+	defer cancel()
+
+	u, err := h.url(ap, path)
+	if err != nil {
+		return nil, false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if token, username, password := h.auth(ap); token != "" {
+		req.Header.Set("Authorization", token)
+	} else if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		retryable := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return nil, retryable, fmt.Errorf("appliance returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, err
+	}
+	return body, false, nil
+}
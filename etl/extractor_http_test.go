@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestHTTPExtractorURL(t *testing.T) {
+	tests := []struct {
+		ip   string
+		port int
+		path string
+		want string
+	}{
+		{"10.0.0.1", 0, "/api/cpu", "http://10.0.0.1/api/cpu"},
+		{"10.0.0.1", 8443, "/api/cpu", "http://10.0.0.1:8443/api/cpu"},
+		{"fd00::1", 0, "/api/cpu", "http://[fd00::1]/api/cpu"},
+		{"fd00::1", 8443, "/api/cpu", "http://[fd00::1]:8443/api/cpu"},
+		{"fe80::1%eth0", 0, "/api/cpu", "http://[fe80::1%25eth0]/api/cpu"},
+		{"appliance-1.example.com", 0, "/api/cpu?format=json", "http://appliance-1.example.com/api/cpu?format=json"},
+	}
+	for _, tt := range tests {
+		h := &httpExtractor{conf: HTTPExtractConfig{Scheme: "http", Port: tt.port}}
+		got, err := h.url(Appliance{IP: tt.ip}, tt.path)
+		if err != nil {
+			t.Errorf("url(%s, %d, %s): %v", tt.ip, tt.port, tt.path, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("url(%s, %d, %s) = %s, want %s", tt.ip, tt.port, tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+//////////////////////////////////////////////////
+// SNMP Extractor
+//////////////////////////////////////////////////
+
+type SNMPExtractConfig struct {
+	Port      uint16   `yaml:"port" json:"port"`
+	Version   string   `yaml:"version" json:"version"`
+	Community string   `yaml:"community" json:"community" secret:"true"`
+	Timeout   Duration `yaml:"timeout" json:"timeout"`
+	Retries   int      `yaml:"retries" json:"retries"`
+
+	// SNMPv3 user-based security.
+	Username       string `yaml:"username" json:"username"`
+	AuthProtocol   string `yaml:"auth_protocol" json:"auth_protocol"`
+	AuthPassphrase string `yaml:"auth_passphrase" json:"auth_passphrase" secret:"true"`
+	PrivProtocol   string `yaml:"priv_protocol" json:"priv_protocol"`
+	PrivPassphrase string `yaml:"priv_passphrase" json:"priv_passphrase" secret:"true"`
+
+	// OIDs maps a CpuStats field (idle, user, system, irq, nice) to the OID
+	// walked for it. Table OIDs (e.g. one row per core) are averaged.
+	OIDs map[string]string `yaml:"oids" json:"oids"`
+}
+
+func defaultSNMPExtractConfig() SNMPExtractConfig {
+	return SNMPExtractConfig{
+		Port:      161,
+		Version:   "2c",
+		Community: "public",
+		Timeout:   Duration(2 * time.Second),
+		Retries:   1,
+		// UCD-SNMP-MIB percentages, as exposed by net-snmp.
+		OIDs: map[string]string{
+			"idle":   ".1.3.6.1.4.1.2021.11.11.0",
+			"user":   ".1.3.6.1.4.1.2021.11.9.0",
+			"system": ".1.3.6.1.4.1.2021.11.10.0",
+		},
+	}
+}
+
+var snmpAuthProtocols = map[string]gosnmp.SnmpV3AuthProtocol{
+	"":       gosnmp.NoAuth,
+	"MD5":    gosnmp.MD5,
+	"SHA":    gosnmp.SHA,
+	"SHA224": gosnmp.SHA224,
+	"SHA256": gosnmp.SHA256,
+	"SHA384": gosnmp.SHA384,
+	"SHA512": gosnmp.SHA512,
+}
+
+var snmpPrivProtocols = map[string]gosnmp.SnmpV3PrivProtocol{
+	"":        gosnmp.NoPriv,
+	"DES":     gosnmp.DES,
+	"AES":     gosnmp.AES,
+	"AES192":  gosnmp.AES192,
+	"AES256":  gosnmp.AES256,
+	"AES192C": gosnmp.AES192C,
+	"AES256C": gosnmp.AES256C,
+}
+
+func (s *SNMPExtractConfig) validate() []error {
+	var errs []error
+	switch s.Version {
+	case "1", "2c":
+		if s.Community == "" {
+			errs = append(errs, errors.New("extract.snmp.community must be set for v1/v2c"))
+		}
+	case "3":
+		if s.Username == "" {
+			errs = append(errs, errors.New("extract.snmp.username must be set for v3"))
+		}
+		if _, ok := snmpAuthProtocols[strings.ToUpper(s.AuthProtocol)]; !ok {
+			errs = append(errs, fmt.Errorf("extract.snmp.auth_protocol %q is not supported", s.AuthProtocol))
+		}
+		if _, ok := snmpPrivProtocols[strings.ToUpper(s.PrivProtocol)]; !ok {
+			errs = append(errs, fmt.Errorf("extract.snmp.priv_protocol %q is not supported", s.PrivProtocol))
+		}
+		if s.PrivProtocol != "" && s.AuthProtocol == "" {
+			errs = append(errs, errors.New("extract.snmp.priv_protocol requires auth_protocol"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("extract.snmp.version must be 1, 2c or 3, got %q", s.Version))
+	}
+	if s.Timeout <= 0 {
+		errs = append(errs, errors.New("extract.snmp.timeout must be > 0"))
+	}
+	if len(s.OIDs) == 0 {
+		errs = append(errs, errors.New("extract.snmp.oids must map at least one field"))
+	}
+	for field := range s.OIDs {
+		if _, ok := snmpFieldSetters[field]; !ok {
+			errs = append(errs, fmt.Errorf("extract.snmp.oids: unknown field %q (want idle, user, system, irq or nice)", field))
+		}
+	}
+	return errs
+}
+
+var snmpFieldSetters = map[string]func(*CpuStats, string){
+	"idle":   func(c *CpuStats, v string) { c.PIdle = v },
+	"user":   func(c *CpuStats, v string) { c.PUser = v },
+	"system": func(c *CpuStats, v string) { c.PSys = v },
+	"irq":    func(c *CpuStats, v string) { c.PIRQ = v },
+	"nice":   func(c *CpuStats, v string) { c.PNice = v },
+}
+
+func init() {
+	registerExtractor("snmp", func(cfg *Config) (Extractor, error) {
+		return &snmpExtractor{conf: cfg.Extract.SNMP}, nil
+	})
+}
+
+type snmpExtractor struct {
+	conf SNMPExtractConfig
+}
+
+func (s *snmpExtractor) session(ctx context.Context, ap Appliance) *gosnmp.GoSNMP {
+	g := &gosnmp.GoSNMP{
+		Target:    ap.IP,
+		Port:      s.conf.Port,
+		Transport: "udp",
+		Community: s.conf.Community,
+		Timeout:   s.conf.Timeout.Std(),
+		Retries:   s.conf.Retries,
+		Context:   ctx,
+		MaxOids:   gosnmp.MaxOids,
+	}
+	username, authPassphrase := s.conf.Username, s.conf.AuthPassphrase
+	if c := ap.Credentials; c != nil {
+		if c.Community != "" {
+			g.Community = c.Community
+		}
+		if c.Username != "" {
+			username = c.Username
+		}
+		if c.Password != "" {
+			authPassphrase = c.Password
+		}
+	}
+
+	switch s.conf.Version {
+	case "1":
+		g.Version = gosnmp.Version1
+	case "2c":
+		g.Version = gosnmp.Version2c
+	case "3":
+		g.Version = gosnmp.Version3
+		g.SecurityModel = gosnmp.UserSecurityModel
+		auth := snmpAuthProtocols[strings.ToUpper(s.conf.AuthProtocol)]
+		priv := snmpPrivProtocols[strings.ToUpper(s.conf.PrivProtocol)]
+		switch {
+		case priv != gosnmp.NoPriv:
+			g.MsgFlags = gosnmp.AuthPriv
+		case auth != gosnmp.NoAuth:
+			g.MsgFlags = gosnmp.AuthNoPriv
+		default:
+			g.MsgFlags = gosnmp.NoAuthNoPriv
+		}
+		g.SecurityParameters = &gosnmp.UsmSecurityParameters{
+			UserName:                 username,
+			AuthenticationProtocol:   auth,
+			AuthenticationPassphrase: authPassphrase,
+			PrivacyProtocol:          priv,
+			PrivacyPassphrase:        s.conf.PrivPassphrase,
+		}
+	}
+	return g
+}
+
+func (s *snmpExtractor) Extract(ctx context.Context, ap Appliance) (*CpuStats, error) {
+	g := s.session(ctx, ap)
+	if err := g.Connect(); err != nil {
+		return nil, fmt.Errorf("snmp connect: %w", err)
+	}
+	defer g.Conn.Close()
+
+	stats := &CpuStats{
+		Name:      ap.HostName,
+		CPUNumber: "0",
+		PIdle:     "0",
+		PUser:     "0",
+		PSys:      "0",
+		PIRQ:      "0",
+		PNice:     "0",
+		Timestamp: uint64(time.Now().Unix()),
+	}
+
+	for field, oid := range s.conf.OIDs {
+		pdus, err := snmpWalk(g, oid)
+		if err != nil {
+			return nil, fmt.Errorf("snmp walk %s (%s): %w", oid, field, err)
+		}
+
+		value, err := averagePDUs(pdus)
+		if err != nil {
+			return nil, fmt.Errorf("snmp %s (%s): %w", oid, field, err)
+		}
+		snmpFieldSetters[field](stats, strconv.FormatFloat(value, 'f', -1, 64))
+	}
+	return stats, nil
+}
+
+// snmpProcessorLoad is HOST-RESOURCES-MIB hrProcessorLoad, the busy
+// percentage of each core over the last minute.
+const snmpProcessorLoad = ".1.3.6.1.2.1.25.3.3.1.2"
+
+// ExtractCores walks hrProcessorLoad. It only has overall load, so each
+// core gets idle = 100 - load and zero for the rest; cores are numbered in
+// table order.
+func (s *snmpExtractor) ExtractCores(ctx context.Context, ap Appliance) ([]CpuStats, error) {
+	g := s.session(ctx, ap)
+	if err := g.Connect(); err != nil {
+		return nil, fmt.Errorf("snmp connect: %w", err)
+	}
+	defer g.Conn.Close()
+
+	pdus, err := snmpWalk(g, snmpProcessorLoad)
+	if err != nil {
+		return nil, fmt.Errorf("snmp walk %s (hrProcessorLoad): %w", snmpProcessorLoad, err)
+	}
+	now := uint64(time.Now().Unix())
+	cores := make([]CpuStats, 0, len(pdus))
+	for i, pdu := range pdus {
+		load, _ := gosnmp.ToBigInt(pdu.Value).Float64()
+		cores = append(cores, CpuStats{
+			Name:      ap.HostName,
+			CPUNumber: strconv.Itoa(i),
+			PIdle:     strconv.FormatFloat(100-load, 'f', -1, 64),
+			PUser:     "0",
+			PSys:      "0",
+			PIRQ:      "0",
+			PNice:     "0",
+			Timestamp: now,
+		})
+	}
+	return cores, nil
+}
+
+func snmpWalk(g *gosnmp.GoSNMP, oid string) ([]gosnmp.SnmpPDU, error) {
+	if g.Version == gosnmp.Version1 {
+		return g.WalkAll(oid)
+	}
+	return g.BulkWalkAll(oid)
+}
+
+// snmpMemoryOIDs are the UCD-SNMP-MIB memory figures, in kB, by the value
+// they fill.
+var snmpMemoryOIDs = map[string]string{
+	"total_bytes":      ".1.3.6.1.4.1.2021.4.5.0",  // memTotalReal
+	"free_bytes":       ".1.3.6.1.4.1.2021.4.6.0",  // memAvailReal
+	"buffers_bytes":    ".1.3.6.1.4.1.2021.4.14.0", // memBuffer
+	"cached_bytes":     ".1.3.6.1.4.1.2021.4.15.0", // memCached
+	"swap_total_bytes": ".1.3.6.1.4.1.2021.4.3.0",  // memTotalSwap
+	"swap_free_bytes":  ".1.3.6.1.4.1.2021.4.4.0",  // memAvailSwap
+}
+
+// snmpTable is a MIB table with one row per disk or interface: the column
+// naming the device and the columns of the values.
+type snmpTable struct {
+	device  string
+	columns map[string]string
+}
+
+var snmpTables = map[string]snmpTable{
+	// UCD-DISKIO-MIB diskIOTable.
+	"disk": {
+		device: ".1.3.6.1.4.1.2021.13.15.1.1.2",
+		columns: map[string]string{
+			"reads":       ".1.3.6.1.4.1.2021.13.15.1.1.5",
+			"writes":      ".1.3.6.1.4.1.2021.13.15.1.1.6",
+			"read_bytes":  ".1.3.6.1.4.1.2021.13.15.1.1.12",
+			"write_bytes": ".1.3.6.1.4.1.2021.13.15.1.1.13",
+		},
+	},
+	// IF-MIB ifXTable and ifTable.
+	"network": {
+		device: ".1.3.6.1.2.1.31.1.1.1.1",
+		columns: map[string]string{
+			"rx_bytes":   ".1.3.6.1.2.1.31.1.1.1.6",
+			"rx_packets": ".1.3.6.1.2.1.31.1.1.1.7",
+			"tx_bytes":   ".1.3.6.1.2.1.31.1.1.1.10",
+			"tx_packets": ".1.3.6.1.2.1.31.1.1.1.11",
+			"rx_dropped": ".1.3.6.1.2.1.2.2.1.13",
+			"rx_errors":  ".1.3.6.1.2.1.2.2.1.14",
+			"tx_dropped": ".1.3.6.1.2.1.2.2.1.19",
+			"tx_errors":  ".1.3.6.1.2.1.2.2.1.20",
+		},
+	},
+}
+
+func (s *snmpExtractor) ExtractMetric(ctx context.Context, ap Appliance, metric string) ([]MetricSample, error) {
+	g := s.session(ctx, ap)
+	if err := g.Connect(); err != nil {
+		return nil, fmt.Errorf("snmp connect: %w", err)
+	}
+	defer g.Conn.Close()
+
+	now := uint64(time.Now().Unix())
+	if metric == "memory" {
+		v, err := snmpMemory(g)
+		if err != nil {
+			return nil, err
+		}
+		return []MetricSample{{Metric: metric, Name: ap.HostName, Timestamp: now, Values: v}}, nil
+	}
+
+	table, ok := snmpTables[metric]
+	if !ok {
+		return nil, fmt.Errorf("snmp can't read %s", metric)
+	}
+	names, err := snmpWalk(g, table.device)
+	if err != nil {
+		return nil, fmt.Errorf("snmp walk %s (%s devices): %w", table.device, metric, err)
+	}
+	rows := map[string]*MetricSample{}
+	var order []string
+	for _, pdu := range names {
+		raw, _ := pdu.Value.([]byte)
+		idx := strings.TrimPrefix(pdu.Name, table.device)
+		rows[idx] = &MetricSample{Metric: metric, Device: string(raw), Name: ap.HostName, Timestamp: now, Values: map[string]float64{}}
+		order = append(order, idx)
+	}
+	for value, oid := range table.columns {
+		pdus, err := snmpWalk(g, oid)
+		if err != nil {
+			return nil, fmt.Errorf("snmp walk %s (%s): %w", oid, value, err)
+		}
+		for _, pdu := range pdus {
+			if row, ok := rows[strings.TrimPrefix(pdu.Name, oid)]; ok {
+				f, _ := gosnmp.ToBigInt(pdu.Value).Float64()
+				row.Values[value] = f
+			}
+		}
+	}
+
+	samples := make([]MetricSample, 0, len(order))
+	for _, idx := range order {
+		samples = append(samples, *rows[idx])
+	}
+	return samples, nil
+}
+
+func snmpMemory(g *gosnmp.GoSNMP) (map[string]float64, error) {
+	names := make(map[string]string, len(snmpMemoryOIDs))
+	oids := make([]string, 0, len(snmpMemoryOIDs))
+	for value, oid := range snmpMemoryOIDs {
+		names[oid] = value
+		oids = append(oids, oid)
+	}
+	packet, err := g.Get(oids)
+	if err != nil {
+		return nil, fmt.Errorf("snmp get memory: %w", err)
+	}
+
+	kb := map[string]float64{}
+	for _, pdu := range packet.Variables {
+		switch pdu.Type {
+		case gosnmp.NoSuchObject, gosnmp.NoSuchInstance, gosnmp.EndOfMibView, gosnmp.Null:
+			continue
+		}
+		f, _ := gosnmp.ToBigInt(pdu.Value).Float64()
+		kb[names[pdu.Name]] = f
+	}
+	if _, ok := kb["total_bytes"]; !ok {
+		return nil, errors.New("snmp memory: agent has no memTotalReal")
+	}
+
+	v := map[string]float64{}
+	for value, n := range kb {
+		if value != "swap_free_bytes" {
+			v[value] = n * 1024
+		}
+	}
+	v["used_bytes"] = (kb["total_bytes"] - kb["free_bytes"] - kb["buffers_bytes"] - kb["cached_bytes"]) * 1024
+	if swap, ok := kb["swap_total_bytes"]; ok {
+		v["swap_used_bytes"] = (swap - kb["swap_free_bytes"]) * 1024
+	}
+	return v, nil
+}
+
+func averagePDUs(pdus []gosnmp.SnmpPDU) (float64, error) {
+	if len(pdus) == 0 {
+		return 0, errors.New("no values returned")
+	}
+
+	var sum float64
+	for _, pdu := range pdus {
+		switch pdu.Type {
+		case gosnmp.OctetString:
+			raw, _ := pdu.Value.([]byte)
+			v, err := strconv.ParseFloat(strings.TrimSpace(string(raw)), 64)
+			if err != nil {
+				return 0, fmt.Errorf("non-numeric string value %q", raw)
+			}
+			sum += v
+		case gosnmp.NoSuchObject, gosnmp.NoSuchInstance, gosnmp.EndOfMibView:
+			return 0, fmt.Errorf("%s", pdu.Type)
+		default:
+			f, _ := gosnmp.ToBigInt(pdu.Value).Float64()
+			sum += f
+		}
+	}
+	return sum / float64(len(pdus)), nil
+}
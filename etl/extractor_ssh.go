@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+//////////////////////////////////////////////////
+// SSH Extractor
+//////////////////////////////////////////////////
+
+type SSHExtractConfig struct {
+	Port                 int      `yaml:"port" json:"port"`
+	Username             string   `yaml:"username" json:"username"`
+	Password             string   `yaml:"password" json:"password" secret:"true"`
+	PrivateKeyFile       string   `yaml:"private_key_file" json:"private_key_file"`
+	PrivateKeyPassphrase string   `yaml:"private_key_passphrase" json:"private_key_passphrase" secret:"true"`
+	KnownHostsFile       string   `yaml:"known_hosts_file" json:"known_hosts_file"`
+	InsecureIgnoreHost   bool     `yaml:"insecure_ignore_host_key" json:"insecure_ignore_host_key"`
+	Command              string   `yaml:"command" json:"command"`
+	DialTimeout          Duration `yaml:"dial_timeout" json:"dial_timeout"`
+	// MetricCommands print the /proc files the metric types other than cpu
+	// are parsed from.
+	MetricCommands map[string]string `yaml:"metric_commands" json:"metric_commands"`
+}
+
+func defaultSSHExtractConfig() SSHExtractConfig {
+	return SSHExtractConfig{
+		Port:        22,
+		Command:     "LC_ALL=C mpstat -P ALL 1 1",
+		DialTimeout: Duration(5 * time.Second),
+		MetricCommands: map[string]string{
+			"memory":  "cat /proc/meminfo",
+			"disk":    "cat /proc/diskstats",
+			"network": "cat /proc/net/dev",
+		},
+	}
+}
+
+func (s *SSHExtractConfig) validate() []error {
+	var errs []error
+	if s.Username == "" {
+		errs = append(errs, errors.New("extract.ssh.username must be set"))
+	}
+	if s.Password == "" && s.PrivateKeyFile == "" {
+		errs = append(errs, errors.New("extract.ssh needs a password or private_key_file"))
+	}
+	if s.KnownHostsFile == "" && !s.InsecureIgnoreHost {
+		errs = append(errs, errors.New("extract.ssh.known_hosts_file must be set (or insecure_ignore_host_key: true)"))
+	}
+	if s.Command == "" {
+		errs = append(errs, errors.New("extract.ssh.command must be set"))
+	}
+	for metric := range s.MetricCommands {
+		if _, ok := procParsers[metric]; !ok {
+			errs = append(errs, fmt.Errorf("extract.ssh.metric_commands: unknown metric type %q", metric))
+		}
+	}
+	if s.Port <= 0 || s.Port > 65535 {
+		errs = append(errs, fmt.Errorf("extract.ssh.port out of range: %d", s.Port))
+	}
+	return errs
+}
+
+func init() {
+	registerExtractor("ssh", newSSHExtractor)
+}
+
+// sshExtractor runs an mpstat-style command on the appliance and parses the
+// per-CPU table it prints. Other metric types are parsed from the /proc
+// files their metric_commands print.
+type sshExtractor struct {
+	conf   SSHExtractConfig
+	client *ssh.ClientConfig
+	keys   ssh.AuthMethod // private key auth, nil without private_key_file
+}
+
+func newSSHExtractor(cfg *Config) (Extractor, error) {
+	conf := cfg.Extract.SSH
+
+	var auth []ssh.AuthMethod
+	var keys ssh.AuthMethod
+	if conf.PrivateKeyFile != "" {
+		pem, err := os.ReadFile(conf.PrivateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading private key: %w", err)
+		}
+		var signer ssh.Signer
+		if conf.PrivateKeyPassphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(pem, []byte(conf.PrivateKeyPassphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(pem)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parsing private key: %w", err)
+		}
+		keys = ssh.PublicKeys(signer)
+		auth = append(auth, keys)
+	}
+	if conf.Password != "" {
+		auth = append(auth, ssh.Password(conf.Password))
+	}
+
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if !conf.InsecureIgnoreHost {
+		var err error
+		hostKeyCallback, err = knownhosts.New(conf.KnownHostsFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading known_hosts: %w", err)
+		}
+	}
+
+	return &sshExtractor{
+		conf: conf,
+		keys: keys,
+		client: &ssh.ClientConfig{
+			User:            conf.Username,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         conf.DialTimeout.Std(),
+		},
+	}, nil
+}
+
+func (s *sshExtractor) Extract(ctx context.Context, ap Appliance) (*CpuStats, error) {
+	output, err := s.run(ctx, ap, s.conf.Command)
+	if err != nil {
+		return nil, err
+	}
+
+	perCPU, err := parseMpstat(output)
+	if err != nil {
+		return nil, err
+	}
+	for _, stats := range perCPU {
+		if stats.CPUNumber == "all" {
+			stats.Name = ap.HostName
+			stats.Timestamp = uint64(time.Now().Unix())
+			return &stats, nil
+		}
+	}
+	return nil, errors.New("mpstat output has no \"all\" row")
+}
+
+// ExtractCores returns every row of the mpstat table, "all" included.
+func (s *sshExtractor) ExtractCores(ctx context.Context, ap Appliance) ([]CpuStats, error) {
+	output, err := s.run(ctx, ap, s.conf.Command)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := parseMpstat(output)
+	if err != nil {
+		return nil, err
+	}
+	now := uint64(time.Now().Unix())
+	for i := range rows {
+		rows[i].Name = ap.HostName
+		rows[i].Timestamp = now
+	}
+	return rows, nil
+}
+
+func (s *sshExtractor) ExtractMetric(ctx context.Context, ap Appliance, metric string) ([]MetricSample, error) {
+	command, ok := s.conf.MetricCommands[metric]
+	if !ok {
+		return nil, fmt.Errorf("extract.ssh.metric_commands has no command for %s", metric)
+	}
+	output, err := s.run(ctx, ap, command)
+	if err != nil {
+		return nil, err
+	}
+	samples, err := procParsers[metric](output)
+	if err != nil {
+		return nil, err
+	}
+	now := uint64(time.Now().Unix())
+	for i := range samples {
+		samples[i].Metric = metric
+		samples[i].Name = ap.HostName
+		samples[i].Timestamp = now
+	}
+	return samples, nil
+}
+
+// clientConfig returns the client config for ap, with the appliance's own
+// username and password if it has them. The private key is still offered
+// first.
+func (s *sshExtractor) clientConfig(ap Appliance) *ssh.ClientConfig {
+	c := ap.Credentials
+	if c == nil || (c.Username == "" && c.Password == "") {
+		return s.client
+	}
+	conf := *s.client
+	if c.Username != "" {
+		conf.User = c.Username
+	}
+	if c.Password != "" {
+		conf.Auth = nil
+		if s.keys != nil {
+			conf.Auth = append(conf.Auth, s.keys)
+		}
+		conf.Auth = append(conf.Auth, ssh.Password(c.Password))
+	}
+	return &conf
+}
+
+func (s *sshExtractor) run(ctx context.Context, ap Appliance, command string) ([]byte, error) {
+	addr := net.JoinHostPort(ap.IP, strconv.Itoa(s.conf.Port))
+
+	dialer := net.Dialer{Timeout: s.conf.DialTimeout.Std()}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// The handshake and command don't take a context, so tear the
+	// connection down if ours expires.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, s.clientConfig(ap))
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("ssh handshake: %w", err)
+	}
+	client := ssh.NewClient(sshConn, chans, reqs)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	output, err := session.Output(command)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%q failed: %w: %s", command, err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+// parseMpstat reads `mpstat -P ALL` output and returns one CpuStats per CPU
+// column value ("all", "0", "1", ...). "Average:" rows win over interval rows
+// when both are present. Name and Timestamp are left for the caller.
+func parseMpstat(output []byte) ([]CpuStats, error) {
+	var (
+		columns []string
+		order   []string
+		rows    = map[string]CpuStats{}
+		average = map[string]bool{}
+	)
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		cpuIdx := indexOf(fields, "CPU")
+		if cpuIdx >= 0 {
+			columns = fields[cpuIdx+1:]
+			continue
+		}
+		if columns == nil || len(fields) < len(columns)+1 {
+			continue
+		}
+
+		values := fields[len(fields)-len(columns):]
+		cpu := fields[len(fields)-len(columns)-1]
+		isAverage := strings.HasPrefix(fields[0], "Average")
+		if average[cpu] && !isAverage {
+			continue
+		}
+
+		stats := CpuStats{CPUNumber: cpu, PIdle: "0", PUser: "0", PSys: "0", PIRQ: "0", PNice: "0"}
+		for i, col := range columns {
+			v := values[i]
+			if _, err := strconv.ParseFloat(v, 64); err != nil {
+				return nil, fmt.Errorf("mpstat: column %s has non-numeric value %q", col, v)
+			}
+			switch col {
+			case "%usr", "%user":
+				stats.PUser = v
+			case "%nice":
+				stats.PNice = v
+			case "%sys", "%system":
+				stats.PSys = v
+			case "%irq":
+				stats.PIRQ = v
+			case "%idle":
+				stats.PIdle = v
+			}
+		}
+
+		if _, seen := rows[cpu]; !seen {
+			order = append(order, cpu)
+		}
+		rows[cpu] = stats
+		average[cpu] = average[cpu] || isAverage
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(order) == 0 {
+		return nil, errors.New("mpstat: no CPU rows found in output")
+	}
+
+	result := make([]CpuStats, 0, len(order))
+	for _, cpu := range order {
+		result = append(result, rows[cpu])
+	}
+	return result, nil
+}
+
+func indexOf(fields []string, want string) int {
+	for i, f := range fields {
+		if f == want {
+			return i
+		}
+	}
+	return -1
+}
+
+// procParsers read the output of the metric_commands. They fill Device and
+// Values; the caller sets the rest.
+var procParsers = map[string]func([]byte) ([]MetricSample, error){
+	"memory":  parseMeminfo,
+	"disk":    parseDiskstats,
+	"network": parseNetDev,
+}
+
+// parseMeminfo reads /proc/meminfo, whose sizes are in kB. Used memory
+// excludes buffers and page cache, as in free(1).
+func parseMeminfo(output []byte) ([]MetricSample, error) {
+	kb := map[string]float64{}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		v, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			continue
+		}
+		kb[strings.TrimSuffix(fields[0], ":")] = v
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if _, ok := kb["MemTotal"]; !ok {
+		return nil, errors.New("meminfo: no MemTotal line found in output")
+	}
+
+	v := map[string]float64{
+		"total_bytes":   kb["MemTotal"] * 1024,
+		"free_bytes":    kb["MemFree"] * 1024,
+		"buffers_bytes": kb["Buffers"] * 1024,
+		"cached_bytes":  kb["Cached"] * 1024,
+		"used_bytes":    (kb["MemTotal"] - kb["MemFree"] - kb["Buffers"] - kb["Cached"]) * 1024,
+	}
+	if avail, ok := kb["MemAvailable"]; ok {
+		v["available_bytes"] = avail * 1024
+	}
+	if swap, ok := kb["SwapTotal"]; ok {
+		v["swap_total_bytes"] = swap * 1024
+		v["swap_used_bytes"] = (swap - kb["SwapFree"]) * 1024
+	}
+	return []MetricSample{{Values: v}}, nil
+}
+
+// parseDiskstats reads /proc/diskstats, one sample per block device except
+// loop and ram devices. Sector counts are in 512-byte units.
+func parseDiskstats(output []byte) ([]MetricSample, error) {
+	var samples []MetricSample
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 14 {
+			continue
+		}
+		dev := fields[2]
+		if strings.HasPrefix(dev, "loop") || strings.HasPrefix(dev, "ram") {
+			continue
+		}
+		var n [14]float64
+		for i := 3; i < 14; i++ {
+			v, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("diskstats: %s has non-numeric field %q", dev, fields[i])
+			}
+			n[i] = v
+		}
+		samples = append(samples, MetricSample{Device: dev, Values: map[string]float64{
+			"reads":       n[3],
+			"read_bytes":  n[5] * 512,
+			"writes":      n[7],
+			"write_bytes": n[9] * 512,
+			"io_time_ms":  n[12],
+		}})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(samples) == 0 {
+		return nil, errors.New("diskstats: no devices found in output")
+	}
+	return samples, nil
+}
+
+// parseNetDev reads /proc/net/dev, one sample per interface except lo.
+func parseNetDev(output []byte) ([]MetricSample, error) {
+	var samples []MetricSample
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		iface, counters, ok := strings.Cut(scanner.Text(), ":")
+		iface = strings.TrimSpace(iface)
+		fields := strings.Fields(counters)
+		if !ok || iface == "lo" || len(fields) < 12 {
+			continue
+		}
+		var n [12]float64
+		for i := range n {
+			v, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("net/dev: %s has non-numeric field %q", iface, fields[i])
+			}
+			n[i] = v
+		}
+		samples = append(samples, MetricSample{Device: iface, Values: map[string]float64{
+			"rx_bytes":   n[0],
+			"rx_packets": n[1],
+			"rx_errors":  n[2],
+			"rx_dropped": n[3],
+			"tx_bytes":   n[8],
+			"tx_packets": n[9],
+			"tx_errors":  n[10],
+			"tx_dropped": n[11],
+		}})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(samples) == 0 {
+		return nil, errors.New("net/dev: no interfaces found in output")
+	}
+	return samples, nil
+}
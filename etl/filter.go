@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// Filter Rules
+//////////////////////////////////////////////////
+
+type FilterConfig struct {
+	Rules []FilterRule `yaml:"rules" json:"rules"`
+}
+
+// FilterRule drops the records that match all of its conditions. Each rule
+// counts what it dropped, so it needs a unique name.
+type FilterRule struct {
+	Name string `yaml:"name" json:"name"`
+	// Hosts are globs matched against the appliance host name.
+	Hosts []string `yaml:"hosts" json:"hosts"`
+	// Indicator matches when its value is below Below or above Above.
+	// Records without the indicator don't match.
+	Indicator string   `yaml:"indicator" json:"indicator"`
+	Below     *float64 `yaml:"below" json:"below"`
+	Above     *float64 `yaml:"above" json:"above"`
+	// OlderThan matches records whose timestamp is further in the past.
+	OlderThan Duration `yaml:"older_than" json:"older_than"`
+}
+
+// filterRules is set by main from filter.rules.
+var filterRules []FilterRule
+
+func (f *FilterConfig) validate() []error {
+	var errs []error
+	names := map[string]bool{}
+	for i, r := range f.Rules {
+		prefix := fmt.Sprintf("filter.rules[%d]", i)
+		switch {
+		case r.Name == "":
+			errs = append(errs, fmt.Errorf("%s.name must be set", prefix))
+		case names[r.Name]:
+			errs = append(errs, fmt.Errorf("%s.name %q is used by another rule", prefix, r.Name))
+		}
+		names[r.Name] = true
+
+		if len(r.Hosts) == 0 && r.Indicator == "" && r.OlderThan == 0 {
+			errs = append(errs, fmt.Errorf("%s needs hosts, indicator or older_than", prefix))
+		}
+		for _, glob := range r.Hosts {
+			if _, err := path.Match(glob, ""); err != nil {
+				errs = append(errs, fmt.Errorf("%s.hosts: bad pattern %q", prefix, glob))
+			}
+		}
+		if r.Indicator != "" && r.Below == nil && r.Above == nil {
+			errs = append(errs, fmt.Errorf("%s.indicator needs below or above", prefix))
+		}
+		if r.Indicator == "" && (r.Below != nil || r.Above != nil) {
+			errs = append(errs, fmt.Errorf("%s.indicator must be set with below or above", prefix))
+		}
+		if r.OlderThan < 0 {
+			errs = append(errs, errors.New(prefix+".older_than must be >= 0"))
+		}
+	}
+	return errs
+}
+
+func (r *FilterRule) matches(d DeviceData, ap Appliance, now time.Time) bool {
+	if len(r.Hosts) > 0 && !matchAnyGlob(r.Hosts, ap.HostName) {
+		return false
+	}
+	if r.Indicator != "" {
+		v, ok := (&Record{Data: d}).indicator(r.Indicator)
+		if !ok || !((r.Below != nil && v < *r.Below) || (r.Above != nil && v > *r.Above)) {
+			return false
+		}
+	}
+	if r.OlderThan > 0 && !time.Unix(int64(d.Timestamp), 0).Before(now.Add(-r.OlderThan.Std())) {
+		return false
+	}
+	return true
+}
+
+func matchAnyGlob(globs []string, s string) bool {
+	for _, glob := range globs {
+		if ok, _ := path.Match(glob, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchFilterRules returns the name of the first rule that drops the
+// record, or "" to keep it.
+func matchFilterRules(d DeviceData, ap Appliance, now time.Time) string {
+	for i := range filterRules {
+		if filterRules[i].matches(d, ap, now) {
+			return filterRules[i].Name
+		}
+	}
+	return ""
+}
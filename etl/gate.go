@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// Dispatch Gate
+//////////////////////////////////////////////////
+
+// pauseGate holds back dispatch while a watched quantity is too high: the
+// heap for the memory budget, the load queues for backpressure. The zero
+// value is open.
+type pauseGate struct {
+	mu      sync.Mutex
+	over    bool
+	changed chan struct{} // closed and replaced on every state change
+}
+
+// Wait blocks while the gate is closed, or until ctx is done.
+func (g *pauseGate) Wait(ctx context.Context) error {
+	for {
+		g.mu.Lock()
+		over, changed := g.over, g.changed
+		g.mu.Unlock()
+
+		if !over {
+			return ctx.Err()
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// run checks every interval until ctx is done, then opens the gate. An open
+// gate closes once pause reports true, a closed one opens once resume does,
+// given how long it was closed; both log why.
+func (g *pauseGate) run(ctx context.Context, interval time.Duration, pause func() bool, resume func(paused time.Duration) bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var pausedAt time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			g.set(false)
+			return
+		case <-ticker.C:
+		}
+
+		switch {
+		case pausedAt.IsZero() && pause():
+			pausedAt = time.Now()
+			g.set(true)
+		case !pausedAt.IsZero() && resume(time.Since(pausedAt)):
+			pausedAt = time.Time{}
+			g.set(false)
+		}
+	}
+}
+
+func (g *pauseGate) set(over bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.over != over {
+		g.over = over
+		if g.changed != nil {
+			close(g.changed)
+		}
+		g.changed = make(chan struct{})
+	}
+}
+
+// Over reports whether dispatch is currently held back.
+func (g *pauseGate) Over() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.over
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPauseGate(t *testing.T) {
+	var g pauseGate
+	var level atomic.Int64
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		g.run(ctx, time.Millisecond, func() bool { return level.Load() >= 10 },
+			func(time.Duration) bool { return level.Load() <= 5 })
+	}()
+
+	if err := g.Wait(ctx); err != nil || g.Over() {
+		t.Fatalf("open gate: Wait() = %v, Over() = %v", err, g.Over())
+	}
+	level.Store(10)
+	waitFor(t, g.Over)
+
+	// Between the watermarks the gate stays closed.
+	level.Store(7)
+	waitCtx, cancelWait := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancelWait()
+	if err := g.Wait(waitCtx); err == nil {
+		t.Fatal("Wait() returned while the gate was closed")
+	}
+
+	level.Store(5)
+	if err := g.Wait(ctx); err != nil {
+		t.Fatalf("Wait() = %v after resuming", err)
+	}
+
+	// Stopping opens the gate.
+	level.Store(10)
+	waitFor(t, g.Over)
+	cancel()
+	<-stopped
+	if g.Over() {
+		t.Error("gate closed after run returned")
+	}
+}
+
+// waitFor polls cond until it holds, for up to 5s.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within 5s")
+		}
+	}
+}
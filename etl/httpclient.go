@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// Shared Load HTTP Client
+//////////////////////////////////////////////////
+
+type HTTPClientConfig struct {
+	// MaxIdleConnsPerHost should be at least load.workers so every worker
+	// can keep its connection to the load API open between flushes.
+	MaxIdleConns        int      `yaml:"max_idle_conns" json:"max_idle_conns"`
+	MaxIdleConnsPerHost int      `yaml:"max_idle_conns_per_host" json:"max_idle_conns_per_host"`
+	MaxConnsPerHost     int      `yaml:"max_conns_per_host" json:"max_conns_per_host"` // 0 = unlimited
+	IdleConnTimeout     Duration `yaml:"idle_conn_timeout" json:"idle_conn_timeout"`
+	DialTimeout         Duration `yaml:"dial_timeout" json:"dial_timeout"`
+	KeepAlive           Duration `yaml:"keep_alive" json:"keep_alive"` // TCP keep-alive probe interval
+	TLSHandshakeTimeout Duration `yaml:"tls_handshake_timeout" json:"tls_handshake_timeout"`
+	DisableKeepAlives   bool     `yaml:"disable_keep_alives" json:"disable_keep_alives"`
+	// HTTP2 negotiates HTTP/2 over TLS when the server offers it.
+	HTTP2 bool      `yaml:"http2" json:"http2"`
+	TLS   TLSConfig `yaml:"tls" json:"tls"`
+}
+
+func defaultHTTPClientConfig() HTTPClientConfig {
+	return HTTPClientConfig{
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 32,
+		IdleConnTimeout:     Duration(90 * time.Second),
+		DialTimeout:         Duration(5 * time.Second),
+		KeepAlive:           Duration(30 * time.Second),
+		TLSHandshakeTimeout: Duration(10 * time.Second),
+		HTTP2:               true,
+		TLS:                 defaultTLSConfig(),
+	}
+}
+
+func (h *HTTPClientConfig) validate() []error {
+	var errs []error
+	if h.MaxIdleConns < 0 || h.MaxIdleConnsPerHost < 0 || h.MaxConnsPerHost < 0 {
+		errs = append(errs, errors.New("load.http_client connection limits must be >= 0"))
+	}
+	if h.IdleConnTimeout < 0 || h.DialTimeout < 0 || h.KeepAlive < 0 || h.TLSHandshakeTimeout < 0 {
+		errs = append(errs, errors.New("load.http_client timeouts must be >= 0"))
+	}
+	errs = append(errs, h.TLS.validate("load.http_client.tls")...)
+	return errs
+}
+
+// loadTransport is the connection pool shared by the HTTP-based sinks (http,
+// prometheus, elasticsearch) and the circuit breaker's health probe, so every
+// load worker reuses kept-alive connections instead of dialing per flush.
+// Nil falls back to http.DefaultTransport.
+var loadTransport *http.Transport
+
+func newLoadTransport(conf HTTPClientConfig) (*http.Transport, error) {
+	tlsConfig, err := conf.TLS.build()
+	if err != nil {
+		return nil, fmt.Errorf("load.http_client.tls: %w", err)
+	}
+	if conf.TLS.InsecureSkipVerify {
+		slog.Warn("TLS certificate verification is disabled for the load endpoints", "component", "loader")
+	}
+	dialer := &net.Dialer{
+		Timeout:   conf.DialTimeout.Std(),
+		KeepAlive: conf.KeepAlive.Std(),
+	}
+	return &http.Transport{
+		TLSClientConfig:     tlsConfig,
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
+		MaxIdleConns:        conf.MaxIdleConns,
+		MaxIdleConnsPerHost: conf.MaxIdleConnsPerHost,
+		MaxConnsPerHost:     conf.MaxConnsPerHost,
+		IdleConnTimeout:     conf.IdleConnTimeout.Std(),
+		TLSHandshakeTimeout: conf.TLSHandshakeTimeout.Std(),
+		DisableKeepAlives:   conf.DisableKeepAlives,
+		ForceAttemptHTTP2:   conf.HTTP2,
+	}, nil
+}
+
+// loadClient returns a client on the shared load transport. Clients are
+// cheap; the transport holds the connections.
+func loadClient(timeout time.Duration) *http.Client {
+	c := &http.Client{Timeout: timeout}
+	if loadTransport != nil {
+		c.Transport = loadTransport
+	}
+	return c
+}
+
+// drainBody reads what is left of a response body so the connection can go
+// back to the pool; an unread body forces it closed.
+func drainBody(body io.Reader) {
+	io.Copy(io.Discard, io.LimitReader(body, 64<<10))
+}
@@ -1,23 +1,25 @@
 package main
 
 import (
-	"bytes"
-	"compress/gzip"
 	"context"
 	"encoding/csv"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"net/http"
+	"log/slog"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"runtime"
 	"runtime/pprof"
-	"strconv"
+	"slices"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 //////////////////////////////////////////////////
@@ -27,6 +29,16 @@ import (
 type Appliance struct {
 	IP       string
 	HostName string
+	// Credentials are named by the CSV's optional third column; nil uses
+	// the extractor's own.
+	Credentials *ApplianceCredentials
+	// Priority is the CSV's optional fourth column, else extract.priority.
+	Priority Priority
+}
+
+// key identifies the appliance in checkpoints.
+func (a Appliance) key() string {
+	return a.HostName + "|" + a.IP
 }
 
 type CpuStats struct {
@@ -50,31 +62,36 @@ type DeviceData struct {
 	CPUNumber  string      `json:"cpu_number"`
 	Timestamp  uint64      `json:"timestamp"`
 	Indicators []Indicator `json:"indicators"`
+	// Metric and Device are set on records of metric types other than
+	// cpu: the type, and the disk or interface the record is about.
+	Metric string `json:"metric,omitempty"`
+	Device string `json:"device,omitempty"`
+	// Labels carry metadata about the appliance, such as its site or owner.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// spanContext ties the record to its appliance trace so batch flushes
+	// can link back to it. Not serialized.
+	spanContext trace.SpanContext
+	// appliance is the key of the appliance the record came from, for
+	// checkpointing. Not serialized, so empty for replayed spills.
+	appliance string
 }
 
-//////////////////////////////////////////////////
-// Configuration
-//////////////////////////////////////////////////
-
-const (
-	simulatedApiDelay = 6 * time.Second
-	bufferThreshold   = 200
-	apiEndpoint       = "http://localhost:8080/load"
-	apiAuthToken      = "Bearer your-token-here"
-
-	extractWorkers = 1000
-	loadWorkers    = 10
-)
-
 //////////////////////////////////////////////////
 // Global Variables
 //////////////////////////////////////////////////
 
 var (
+	cfg       *Config
 	buffers   []*Buffer
+	extractor Extractor
+	loadSinks []Sink
 	dataChan  []chan DeviceData
-	logFile   *os.File
-	startTime time.Time
+	// urgentChan holds the records of high priority appliances, which the
+	// loaders take before those of dataChan.
+	urgentChan []chan DeviceData
+	logFile    *os.File
+	startTime  time.Time
 )
 
 type Buffer struct {
@@ -87,78 +104,557 @@ type Buffer struct {
 //////////////////////////////////////////////////
 
 func main() {
+	var err error
+	var args []string
+	cfg, args, err = loadConfig(os.Args[1:])
+	if cfg == nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	name := "run"
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	// validate-config reports what is wrong with the configuration rather
+	// than refusing it, and doesn't need logging.
+	if name == "validate-config" {
+		if err := runValidateConfigCommand(err, args); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	command, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s\n", name, usage)
+		os.Exit(2)
+	}
+
 	setupLogging()
 	defer logFile.Close()
 
-	startTime = time.Now()
+	if err := command(args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
 
+// runPipeline runs the ETL once, or with daemon until shut down.
+func runPipeline(daemon bool) {
 	startCPUProfile()
 	defer stopCPUProfile()
 
-	appliances, err := readAppliancesFromCSV("appliances.csv")
+	shutdownTracing, err := setupTracing(cfg.Tracing, cfg.Load.BufferThreshold)
+	if err != nil {
+		fatal("Error setting up tracing", "error", err)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			slog.Error("Error flushing traces", "error", err)
+		}
+	}()
+
+	if err := resolveSecrets(); err != nil {
+		fatal("Error resolving secrets", "error", err)
+	}
+	stopDebugServer := startDebugServer(cfg.Debug)
+	defer stopDebugServer()
+	extractor, err = newExtractor(cfg)
+	if err != nil {
+		fatal("Error creating extractor", "extractor", cfg.Extract.Type, "error", err)
+	}
+	defer func() { closeExtractor(extractor) }()
+	applianceSource, err = newApplianceSource(cfg)
+	if err != nil {
+		fatal("Error creating appliance source", "source", cfg.Discovery.Type, "error", err)
+	}
+	defer func() { closeSource(applianceSource) }()
+
+	transformChain, err = newTransformChain(cfg.Transform)
+	if err != nil {
+		fatal("Error creating transform chain", "error", err)
+	}
+	if cfg.Aggregate.Enabled {
+		aggregator = newAggregator(cfg.Aggregate)
+	} else if cfg.Rollup.Enabled {
+		aggregator = newRollup(cfg.Rollup)
+	}
+	filterRules = cfg.Filter.Rules
+	if cfg.Extract.Politeness.enabled() {
+		politeness = newPoliteness(cfg.Extract.Politeness)
+	}
+	if cfg.Dedup.Enabled {
+		deduper = newDeduper(cfg.Dedup)
+	}
+	if cfg.Stream.Enabled && cfg.Stream.Reorder.Enabled {
+		reorderer = newReorderer(cfg.Stream.Reorder)
+	}
+	if cfg.Validation.Enabled {
+		if validator, err = newSchemaValidator(cfg.Validation); err != nil {
+			fatal("Error setting up validation", "error", err)
+		}
+		defer validator.Close()
+	}
+	if cfg.Quality.Enabled {
+		if quality, err = newQualityChecker(cfg.Quality); err != nil {
+			fatal("Error setting up quality checks", "error", err)
+		}
+		defer quality.Close()
+	}
+
+	closeLoadStage := openLoadStage()
+	defer closeLoadStage()
+	// A stream polls appliances over and over; there is no run to resume.
+	if cfg.Checkpoint.Enabled && !cfg.Stream.Enabled {
+		checkpoint = newCheckpoint(state)
+	}
+
+	// On SIGINT/SIGTERM stop dispatching, cancel in-flight extracts and let
+	// the loaders drain and flush what is already queued. A second signal
+	// kills the process immediately.
+	shutdownCtx, requestShutdown := context.WithCancel(context.Background())
+	defer requestShutdown()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		signal.Stop(signals)
+		slog.Warn("Shutdown requested, draining queues and flushing buffers", "signal", sig.String())
+		requestShutdown()
+	}()
+
+	if cfg.Cluster.Mode != "none" {
+		if cluster, err = newCluster(cfg.Cluster); err != nil {
+			fatal("Error joining the cluster", "mode", cfg.Cluster.Mode, "error", err)
+		}
+		defer cluster.Close()
+		go cluster.Run(shutdownCtx)
+	}
+
+	if cfg.Memory.BudgetMB > 0 {
+		memoryBudget = newMemoryBudget(cfg.Memory)
+		memoryBudget.warnBelowHeap()
+		go memoryBudget.Run(shutdownCtx)
+	}
+
+	if daemon {
+		if cfg.Election.Backend != "none" {
+			if election, err = newElection(cfg.Election, cfg); err != nil {
+				fatal("Error setting up leader election", "backend", cfg.Election.Backend, "error", err)
+			}
+			election.Start()
+		}
+		runDaemon(shutdownCtx, cfg.Daemon)
+		election.Stop()
+	} else if rec := recordRun(shutdownCtx, RunRecord{ID: newRunID(), Trigger: "manual", StartedAt: time.Now().UTC()}); rec.Error != "" {
+		closeSinks(loadSinks)
+		fatal("Run failed", "error", rec.Error)
+	}
+
+	closeSinks(loadSinks)
+	writeMemoryProfile()
+}
+
+// openLoadStage sets up the sinks and everything that keeps what they fail
+// to load: the dead-letter queue, state store and spill store, and the audit
+// log of what they did load. The returned function closes the stores; sinks
+// are closed by the caller.
+func openLoadStage() (closeStores func()) {
+	var err error
+	loadTransport, err = newLoadTransport(cfg.Load.HTTPClient)
+	if err != nil {
+		fatal("Error creating load HTTP client", "error", err)
+	}
+	loadSinks, err = newSinks(cfg)
+	if err != nil {
+		fatal("Error creating sinks", "error", err)
+	}
+
+	if cfg.DLQ.Enabled {
+		deadLetters, err = newDirDeadLetterStore(cfg.DLQ.Dir)
+		if err != nil {
+			fatal("Error opening dead-letter store", "dir", cfg.DLQ.Dir, "error", err)
+		}
+	}
+
+	state, err = openStateStore(cfg.State)
+	if err != nil {
+		fatal("Error opening state store", "file", cfg.State.File, "error", err)
+	}
+
+	spills, err = newSpillStore(cfg, state)
 	if err != nil {
-		log.Fatalf("Error reading CSV: %v", err)
+		state.Close()
+		fatal("Error opening spill store", "store", cfg.Load.SpillStore, "error", err)
 	}
 
-	initBuffers(loadWorkers)
-	initChannels(loadWorkers)
+	if cfg.Audit.File != "" {
+		if auditLog, err = openAuditLog(cfg.Audit); err != nil {
+			state.Close()
+			fatal("Error opening audit log", "file", cfg.Audit.File, "error", err)
+		}
+	}
+	return func() {
+		if c, ok := spills.(io.Closer); ok {
+			c.Close()
+		}
+		state.Close()
+		if err := auditLog.Close(); err != nil {
+			slog.Error("Error closing audit log", "component", "audit", "error", err)
+		}
+	}
+}
+
+// runETL performs one full extract-transform-load cycle over the appliance
+// CSV, or with stream.enabled polls the appliances until ctx is cancelled.
+// Cancelling ctx stops dispatching and cancels in-flight extracts; whatever
+// is already queued is still flushed before it returns.
+func runETL(ctx context.Context, runID string) (*RunStats, error) {
+	prevLogger := slog.Default()
+	slog.SetDefault(prevLogger.With("run_id", runID))
+	defer slog.SetDefault(prevLogger)
+
+	// A fail_run quality check stops the run like a shutdown, and its
+	// error is the run's.
+	ctx, failRun := context.WithCancelCause(ctx)
+	defer failRun(nil)
+	quality.startRun(failRun)
+
+	appliances, err := ownedAppliances(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var done map[string]bool
+	if checkpoint != nil {
+		// -resume only applies to the first run of a daemon.
+		done, err = checkpoint.Begin(runID, applianceSource.Name(), len(appliances), cfg.Checkpoint.Resume)
+		cfg.Checkpoint.Resume = false
+		if err != nil {
+			return nil, fmt.Errorf("checkpoint: %w", err)
+		}
+	}
+
+	startTime = time.Now()
+	runStats = newRunStats(runID, loadSinks)
+	report = nil
+	if cfg.Report.File != "" {
+		report = newRunReport(runID, appliances)
+	}
+	dispatch.startRun()
+
+	initBuffers(cfg.Load.Workers)
+	initChannels(cfg.Load.Workers)
+	retries = nil
+	if cfg.Load.RetryQueue.Enabled {
+		retries = newRetryQueue(cfg.Load.RetryQueue)
+	}
+	backpressure = nil
+	if cfg.Load.Backpressure.Enabled {
+		backpressure = newBackpressure(cfg.Load.Backpressure, cfg.Load.Workers*cfg.Load.ChannelCapacity)
+	}
 
 	// Load failed buffers from previous runs
 	loadFailedBuffers()
+	pruneSpilledBatches()
+	pruneAcks()
+	replaySpilledBatches()
+	stopSpillReplay := startSpillReplay(ctx, cfg.Load.SpillReplay)
 
 	logResourceUsage("Before ETL")
 
+	// Loads outlive the run's cancellation so queued records are drained;
+	// only their retries stop.
+	loadCtx = withShutdown(context.WithoutCancel(ctx), ctx.Done())
+	defer func() { loadCtx = context.Background() }()
+
 	// Start loader workers
 	var loadWg sync.WaitGroup
-	for i := 0; i < loadWorkers; i++ {
+	for i := 0; i < cfg.Load.Workers; i++ {
 		loadWg.Add(1)
 		go loadWorker(&loadWg, i)
 	}
 
 	// Start extract workers
 	var extractWg sync.WaitGroup
-	sem := make(chan struct{}, extractWorkers)
+	pool := newExtractPool(cfg.Extract.Workers)
+	if backpressure != nil {
+		backpressureCtx, stopBackpressure := context.WithCancel(ctx)
+		defer stopBackpressure()
+		go backpressure.Run(backpressureCtx)
+	}
+	if cfg.Extract.Autoscale.Enabled {
+		autoscaleCtx, stopAutoscale := context.WithCancel(ctx)
+		defer stopAutoscale()
+		go pool.Autoscale(autoscaleCtx, cfg.Extract.Autoscale, queueFill)
+	}
+	runStats.Appliances.Store(int64(len(appliances)))
+	activeRun.Store(&runState{id: runID, started: startTime, stats: runStats, queues: dataChan, pool: pool, gate: backpressure})
+	defer activeRun.Store(nil)
+	stopProgress := func() {}
+	if progressEnabled(cfg) {
+		stopProgress = startProgress(os.Stderr, runStats, startTime)
+	}
 
-	for idx, appliance := range appliances {
-		sem <- struct{}{}
+	// dispatchOne starts the extract of an appliance once the gates let it
+	// through, calling finished when it is done; false means the run is
+	// stopping.
+	dispatchOne := func(ap Appliance, worker int, finished func()) bool {
+		if dispatch.Wait(ctx) != nil || (memoryBudget != nil && memoryBudget.Wait(ctx) != nil) ||
+			backpressure.Wait(ctx) != nil || pool.Acquire(ctx) != nil {
+			return false
+		}
 		extractWg.Add(1)
-
-		go func(ap Appliance, index int) {
+		runStats.Dispatched.Add(1)
+		go func() {
 			defer func() {
-				<-sem
+				pool.Release()
+				finished()
 				extractWg.Done()
 			}()
+			processAppliance(ctx, pool, ap, worker)
+		}()
+		return true
+	}
 
-			// log.Printf("[Extract] Starting for %s (%s)", ap.HostName, ap.IP)
-
-			cpuData, err := extractCpuData(ap)
-			if err != nil {
-				log.Printf("[Extract] Failed for %s: %v", ap.HostName, err)
-				return
+	if cfg.Stream.Enabled {
+		newStreamScheduler(cfg.Stream, appliances).Run(ctx, dispatchOne)
+	} else {
+		var pending []Appliance
+		for _, appliance := range byPriority(appliances) {
+			if done[appliance.key()] {
+				runStats.AlreadyDone.Add(1)
+				report.failed(appliance, outcomeSkipped, nil)
+				continue
 			}
-
-			// log.Printf("[Extract] Completed for %s", ap.HostName)
-
-			deviceData := transform(cpuData)
-			targetWorker := index % loadWorkers
-
-			dataChan[targetWorker] <- deviceData
-		}(appliance, idx)
+			pending = append(pending, appliance)
+		}
+		if cfg.Extract.Splay > 0 || cfg.Extract.Jitter > 0 {
+			slog.Info("Spreading dispatch", "component", "extract", "appliances", len(pending),
+				"splay", cfg.Extract.Splay.Std().String(), "jitter", cfg.Extract.Jitter.Std().String())
+		}
+		for idx, sa := range splayAppliances(pending, time.Now()) {
+			if !sleepUntil(ctx, sa.at) || !dispatchOne(sa.Appliance, idx%cfg.Load.Workers, func() {}) {
+				break
+			}
+		}
 	}
 
 	extractWg.Wait()
 
+	// Hand finished windows to the loaders. A one-shot run, or a daemon
+	// shutting down, flushes open windows too rather than losing them. A
+	// stream ending releases the records its reorder buffer still holds.
+	emitWindows(time.Now(), !cfg.Daemon.Enabled || ctx.Err() != nil)
+	emitReordered(true)
+
 	// Close channels to signal loaders to finish
-	for _, ch := range dataChan {
-		close(ch)
-	}
+	stopSpillReplay()
+	closeChannels()
 
 	loadWg.Wait()
+	retries.Close(ctx.Err() != nil)
+	stopProgress()
+	if report != nil {
+		if path, err := report.write(cfg.Report); err != nil {
+			slog.Error("Failed to write appliance report", "component", "report", "file", path, "error", err)
+		} else {
+			slog.Info("Appliance report written", "component", "report", "file", path)
+		}
+	}
 
 	logResourceUsage("After ETL")
-	log.Printf("Total execution time: %v", time.Since(startTime))
+	logPoolUsage()
+	_, drained := dispatch.State()
+	interrupted := ctx.Err() != nil || drained
+	logRunSummary(interrupted)
+
+	if checkpoint != nil {
+		if interrupted {
+			slog.Warn("Run incomplete, checkpoint kept; rerun with -resume to skip finished appliances", "component", "checkpoint")
+		} else if err := checkpoint.Complete(); err != nil {
+			slog.Error("Failed to clear checkpoint", "component", "checkpoint", "error", err)
+		}
+	}
+	return runStats, qualityFailure(ctx)
+}
 
-	writeMemoryProfile()
+// emitWindows hands the aggregation windows closed by now, or all of them
+// if final, to the loaders.
+func emitWindows(now time.Time, final bool) {
+	if aggregator == nil {
+		return
+	}
+	windows := aggregator.Flush(now, final)
+	backpressure.Queued(len(windows))
+	for i, d := range windows {
+		dataChan[i%cfg.Load.Workers] <- d
+	}
+	runStats.WindowsEmitted.Add(int64(len(windows)))
+	level := slog.LevelInfo
+	if len(windows) == 0 && !final {
+		level = slog.LevelDebug
+	}
+	slog.Log(context.Background(), level, "Aggregation windows flushed", "component", "aggregate", "emitted", len(windows), "open", aggregator.Pending())
+}
+
+// processAppliance extracts the records of an appliance, transforms and
+// filters them, and queues them for loader targetWorker, or folds them into
+// the aggregator or holds them in the reorder buffer.
+func processAppliance(ctx context.Context, pool *ExtractPool, ap Appliance, targetWorker int) {
+	ctx, span := tracer.Start(ctx, "appliance", applianceAttrs(ap))
+	release := func() {}
+	if politeness != nil {
+		var err error
+		if release, err = politeness.Acquire(ctx, ap); err != nil {
+			runStats.ExtractCancelled.Add(1)
+			report.failed(ap, outcomeCancelled, err)
+			endSpan(span, err)
+			return
+		}
+	}
+	extractStart := time.Now()
+
+	cpuData, samples, err := extractAppliance(ctx, extractor, ap)
+	release()
+	pool.Observe(time.Since(extractStart), err)
+	report.update(ap.key(), func(a *ApplianceReport) { a.ExtractMS = time.Since(extractStart).Milliseconds() })
+	if err != nil && ctx.Err() != nil {
+		runStats.ExtractCancelled.Add(1)
+		report.failed(ap, outcomeCancelled, err)
+		endSpan(span, err)
+		return
+	}
+	if err != nil {
+		runStats.ExtractFailed.Add(1)
+		report.failed(ap, outcomeExtractFailed, err)
+		slog.Warn("Extract failed", "component", "extract", "appliance", ap.HostName, "ip", ap.IP,
+			"duration_ms", time.Since(extractStart).Milliseconds(), "error", err)
+		endSpan(span, err)
+		return
+	}
+
+	runStats.Extracted.Add(1)
+	slog.Debug("Extract completed", "component", "extract", "appliance", ap.HostName,
+		"duration_ms", time.Since(extractStart).Milliseconds())
+
+	// CPU stats go through the transform chain; the other metric
+	// types are built by their own indicator sets.
+	records := make([]DeviceData, 0, len(cpuData)+len(samples))
+	rejected := 0
+	transformStart := time.Now()
+	for _, stats := range cpuData {
+		if !validator.Stats(ap, stats) {
+			rejected++
+			continue
+		}
+		_, transformSpan := tracer.Start(ctx, "transform")
+		deviceData, keep, err := transformChain.Apply(stats, ap)
+		endSpan(transformSpan, err)
+		if err != nil {
+			runStats.TransformFailed.Add(1)
+			report.failed(ap, outcomeTransformFailed, err)
+			slog.Warn("Transform failed", "component", "transform", "appliance", ap.HostName, "ip", ap.IP,
+				"cpu_number", stats.CPUNumber, "error", err)
+			endSpan(span, err)
+			return
+		}
+		if keep {
+			records = append(records, deviceData)
+		} else {
+			runStats.Filtered.Add(1)
+			slog.Debug("Record filtered out", "component", "transform", "appliance", ap.HostName, "cpu_number", stats.CPUNumber)
+		}
+	}
+	for _, s := range samples {
+		records = append(records, s.record())
+	}
+	// Quality checks may fix what validation would reject.
+	checked := records[:0]
+	for _, d := range records {
+		if !quality.Check(ap, &d) {
+			continue
+		}
+		if !validator.Record(ap, d) {
+			rejected++
+			continue
+		}
+		checked = append(checked, d)
+	}
+	records = checked
+	report.update(ap.key(), func(a *ApplianceReport) {
+		a.Outcome = ""
+		a.TransformMS = time.Since(transformStart).Milliseconds()
+		a.Records = len(cpuData) + len(samples)
+		a.Dropped = a.Records - len(records)
+		a.Rejected = rejected
+	})
+
+	// The appliance is done once each of its records reached every
+	// sink or was dropped here.
+	if checkpoint != nil {
+		if len(records) > 0 {
+			checkpoint.Expect(ap.key(), len(records))
+		} else if err := checkpoint.MarkDone([]string{ap.key()}); err != nil {
+			slog.Error("Failed to update checkpoint", "component", "checkpoint", "error", err)
+		}
+	}
+
+	queue := dataChan[targetWorker]
+	if ap.Priority == priorityHigh {
+		queue = urgentChan[targetWorker]
+	}
+	for _, deviceData := range records {
+		rule := matchFilterRules(deviceData, ap, time.Now())
+		duplicate := rule == "" && deduper != nil && deduper.Seen(deviceData)
+		if rule != "" || duplicate {
+			if rule != "" {
+				runStats.FilterRules[rule].Add(1)
+				slog.Debug("Record dropped by filter rule", "component", "filter", "appliance", ap.HostName, "rule", rule)
+			} else {
+				runStats.Duplicates.Add(1)
+				slog.Debug("Duplicate record dropped", "component", "dedup", "appliance", ap.HostName,
+					"name", deviceData.Name, "metric", deviceData.Metric, "device", deviceData.Device,
+					"cpu_number", deviceData.CPUNumber, "timestamp", deviceData.Timestamp)
+			}
+			report.update(ap.key(), func(a *ApplianceReport) { a.Dropped++ })
+			if checkpoint != nil {
+				if err := checkpoint.MarkDone([]string{ap.key()}); err != nil {
+					slog.Error("Failed to update checkpoint", "component", "checkpoint", "error", err)
+				}
+			}
+			continue
+		}
+
+		deviceData.spanContext = span.SpanContext()
+		deviceData.appliance = ap.key()
+		if aggregator != nil {
+			aggregator.Add(deviceData)
+			runStats.Aggregated.Add(1)
+			report.update(ap.key(), func(a *ApplianceReport) { a.Aggregated++ })
+			continue
+		}
+		if reorderer != nil {
+			if !reorderer.Add(deviceData, queue) {
+				report.update(ap.key(), func(a *ApplianceReport) { a.Dropped++ })
+				if checkpoint != nil {
+					if err := checkpoint.MarkDone([]string{ap.key()}); err != nil {
+						slog.Error("Failed to update checkpoint", "component", "checkpoint", "error", err)
+					}
+				}
+			}
+			continue
+		}
+
+		_, enqueueSpan := tracer.Start(ctx, "enqueue", trace.WithAttributes(attribute.Int("worker_id", targetWorker)))
+		backpressure.Queued(1)
+		queue <- deviceData
+		enqueueSpan.End()
+	}
+	span.End()
 }
 
 //////////////////////////////////////////////////
@@ -169,67 +665,25 @@ func initBuffers(count int) {
 	buffers = make([]*Buffer, count)
 	for i := 0; i < count; i++ {
 		buffers[i] = &Buffer{
-			Data: make([]DeviceData, 0, bufferThreshold),
+			Data: make([]DeviceData, 0, cfg.Load.BufferThreshold),
 		}
 	}
 }
 
 func initChannels(count int) {
 	dataChan = make([]chan DeviceData, count)
+	urgentChan = make([]chan DeviceData, count)
 	for i := 0; i < count; i++ {
-		dataChan[i] = make(chan DeviceData, 2000)
+		dataChan[i] = make(chan DeviceData, cfg.Load.ChannelCapacity)
+		urgentChan[i] = make(chan DeviceData, cfg.Load.ChannelCapacity)
 	}
 }
 
-//////////////////////////////////////////////////
-// Extract
-//////////////////////////////////////////////////
-
-func extractCpuData(ap Appliance) (*CpuStats, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), simulatedApiDelay+2*time.Second)
-	defer cancel()
-
-	select {
-	case <-time.After(simulatedApiDelay):
-		return &CpuStats{
-			Name:      ap.HostName,
-			CPUNumber: "0",
-			PIdle:     "95",
-			PUser:     "3",
-			PSys:      "1",
-			PIRQ:      "0.5",
-			PNice:     "0",
-			Timestamp: uint64(time.Now().Unix()),
-		}, nil
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	}
-}
-
-//////////////////////////////////////////////////
-// Transform
-//////////////////////////////////////////////////
-
-func transform(cpu *CpuStats) DeviceData {
-	idle, _ := strconv.ParseFloat(cpu.PIdle, 64)
-	pNice, _ := strconv.ParseFloat(cpu.PNice, 64)
-	pUser, _ := strconv.ParseFloat(cpu.PUser, 64)
-	pSys, _ := strconv.ParseFloat(cpu.PSys, 64)
-	pIRQ, _ := strconv.ParseFloat(cpu.PIRQ, 64)
-
-	indicators := []Indicator{
-		{"utilization", 100 - idle},
-		{"nice", pNice},
-		{"user", pUser},
-		{"system", pSys},
-		{"irq", pIRQ},
-	}
-
-	return DeviceData{
-		Name:       cpu.Name,
-		CPUNumber:  cpu.CPUNumber,
-		Timestamp:  cpu.Timestamp,
-		Indicators: indicators,
+// closeChannels tells the loaders that no more records are coming.
+func closeChannels() {
+	for i := range dataChan {
+		close(dataChan[i])
+		close(urgentChan[i])
 	}
 }
 
@@ -241,13 +695,56 @@ func loadWorker(wg *sync.WaitGroup, workerID int) {
 	defer wg.Done()
 
 	buffer := buffers[workerID]
-	ch := dataChan[workerID]
+	ch, urgent := dataChan[workerID], urgentChan[workerID]
+	ws := runStats.Worker(workerID)
+	// A stream flushes its buffers every stream.flush_interval, as they
+	// may take a long time to fill up.
+	var flushTick <-chan time.Time
+	if cfg.Stream.Enabled {
+		ticker := time.NewTicker(cfg.Stream.FlushInterval.Std())
+		defer ticker.Stop()
+		flushTick = ticker.C
+	}
+
+	for ch != nil || urgent != nil {
+		// Urgent records first; a closed channel is set to nil so the
+		// select stops picking it.
+		var item DeviceData
+		var ok bool
+		select {
+		case item, ok = <-urgent:
+			if !ok {
+				urgent = nil
+				continue
+			}
+		default:
+			select {
+			case item, ok = <-urgent:
+				if !ok {
+					urgent = nil
+					continue
+				}
+			case item, ok = <-ch:
+				if !ok {
+					ch = nil
+					continue
+				}
+			case <-flushTick:
+				buffer.Lock()
+				if len(buffer.Data) > 0 {
+					flushBuffer(buffer, workerID)
+				}
+				buffer.Unlock()
+				continue
+			}
+		}
 
-	for item := range ch {
+		ws.Received.Add(1)
+		backpressure.Dequeued(1)
 		buffer.Lock()
 		buffer.Data = append(buffer.Data, item)
 
-		if len(buffer.Data) >= bufferThreshold {
+		if len(buffer.Data) >= cfg.Load.BufferThreshold {
 			flushBuffer(buffer, workerID)
 		}
 		buffer.Unlock()
@@ -262,135 +759,274 @@ func loadWorker(wg *sync.WaitGroup, workerID int) {
 }
 
 func flushBuffer(buffer *Buffer, workerID int) {
-	toSend := make([]DeviceData, len(buffer.Data))
-	copy(toSend, buffer.Data)
-
-	err := sendToAPI(toSend)
-	if err != nil {
-		log.Printf("[Loader-%d] API load failed: %v. Saving buffer.", workerID, err)
-		saveBufferToFile(toSend, fmt.Sprintf("buffer_failed_worker%d", workerID))
-	} else {
-		log.Printf("[Loader-%d] Successfully flushed %d records", workerID, len(toSend))
+	batch := getBatch()
+	*batch = append(*batch, buffer.Data...)
+	toSend := *batch
+	batchID := newBatchID(toSend)
+	start := time.Now()
+
+	// Every sink gets the batch on its own, so one failing or slow sink
+	// doesn't hold back delivery to the others.
+	var wg sync.WaitGroup
+	for _, s := range loadSinks {
+		wg.Add(1)
+		go func(s Sink) {
+			defer wg.Done()
+			flushTo(s, batchID, toSend, workerID)
+		}(s)
 	}
+	wg.Wait()
 
-	buffer.Data = nil
-}
-
-//////////////////////////////////////////////////
-// Send to API
-//////////////////////////////////////////////////
-
-func sendToAPI(data []DeviceData) error {
-	payload, _ := json.Marshal(data)
+	ws := runStats.Worker(workerID)
+	ws.Flushes.Add(1)
+	ws.RecordsFlushed.Add(int64(len(toSend)))
+	ws.FlushNanos.Add(int64(time.Since(start)))
+	ws.LastFlush.Store(time.Now().UnixNano())
 
-	req, err := http.NewRequest("POST", apiEndpoint, bytes.NewReader(payload))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Authorization", apiAuthToken)
-	req.Header.Set("Content-Type", "application/json")
+	putBatch(batch)
+	clear(buffer.Data)
+	buffer.Data = buffer.Data[:0]
+}
 
-	client := http.Client{Timeout: 15 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
+// loadCtx is the context flushes run in: that of the current run, tagged
+// withShutdown, between runs context.Background().
+var loadCtx = context.Background()
+
+// flushTo loads a batch into one sink. Whatever the sink can't take is
+// dead-lettered or spilled for that sink.
+func flushTo(s Sink, batchID string, data []DeviceData, workerID int) {
+	stats := runStats.Sinks[s.Name()]
+
+	ctx, span := tracer.Start(withBatchID(withWorkerID(loadCtx, workerID), batchID), "flush",
+		trace.WithLinks(recordLinks(data)...),
+		trace.WithAttributes(
+			attribute.Int("worker_id", workerID),
+			attribute.Int("batch_size", len(data)),
+			attribute.String("sink", s.Name()),
+		),
+	)
+	// A batch the sink already took, e.g. a spill file replayed a second
+	// time, isn't sent again.
+	if acknowledged(s.Name(), batchID) {
+		endSpan(span, nil)
+		slog.Info("Batch already acknowledged, not sending it again", "component", "loader", "sink", s.Name(),
+			"worker_id", workerID, "batch_id", batchID, "batch_size", len(data))
+		stats.BatchesAlreadyAcked.Add(1)
+		stats.RecordsAlreadyAcked.Add(int64(len(data)))
+		report.recordLoad(data, outcomeLoaded, 0, nil)
+		settleCheckpoint(applianceKeys(data), workerID)
+		auditLog.write(AuditEntry{Event: auditDelivery, RunID: runStats.RunID, BatchID: batchID, Sink: s.Name(),
+			WorkerID: workerID, Records: len(data), Decision: decisionAlreadyAcked})
+		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
-		return nil
-	}
-	body, _ := io.ReadAll(resp.Body)
-	return fmt.Errorf("API error: %s", string(body))
+	flushStart := time.Now()
+	err := s.Load(ctx, data)
+	endSpan(span, err)
+	settleFlush(s, batchID, data, workerID, flushStart, err, true)
 }
 
-//////////////////////////////////////////////////
-// Failed Buffer Loader
-//////////////////////////////////////////////////
-
-func loadFailedBuffers() {
-	files, err := filepath.Glob("buffer_failed_worker*.json.gz")
+// settleFlush handles the outcome of loading a batch into a sink: what the
+// sink couldn't take is queued for another attempt in this run when
+// requeue allows, or dead-lettered or spilled for that sink.
+func settleFlush(s Sink, batchID string, data []DeviceData, workerID int, flushStart time.Time, err error, requeue bool) {
+	stats := runStats.Sinks[s.Name()]
+	attempts := attemptsOf(err)
+	// The audit log gets the delivery once the batch's fate is settled.
+	delivery := AuditEntry{Event: auditDelivery, RunID: runStats.RunID, BatchID: batchID, Sink: s.Name(),
+		WorkerID: workerID, Records: len(data), Attempt: attempts, Status: statusOf(err),
+		LatencyMS: time.Since(flushStart).Milliseconds(), Decision: outcomeLoaded}
 	if err != nil {
-		log.Printf("Error scanning failed buffer files: %v", err)
-		return
+		delivery.Error = err.Error()
 	}
-
-	for _, file := range files {
-		log.Printf("Reloading failed buffer: %s", file)
-
-		dataList, err := readBufferFromFile(file)
-		if err != nil {
-			log.Printf("Failed to read %s: %v", file, err)
-			continue
+	defer func() { auditLog.write(delivery) }()
+	logger := slog.With("component", "loader", "sink", s.Name(), "worker_id", workerID,
+		"batch_size", len(data), "duration_ms", time.Since(flushStart).Milliseconds())
+
+	// A partly delivered batch only hands its failed records on.
+	var partial *PartialError
+	if errors.As(err, &partial) {
+		notLoaded := slices.Concat(partial.Failed, partial.Rejected)
+		loaded := len(data) - len(notLoaded)
+		logger.Warn("Batch partly loaded", "loaded", loaded, "failed", len(partial.Failed),
+			"rejected", len(partial.Rejected))
+		stats.RecordsLoaded.Add(int64(loaded))
+		report.recordPartial(data, notLoaded, attempts)
+		delivery.Loaded = loaded
+		clearFailures(s.Name(), batchID)
+		settleCheckpoint(loadedKeys(data, notLoaded), workerID)
+
+		// Records the sink refused outright would fail again however often
+		// they are sent, so they go to the dead-letter queue at once. Without
+		// one, they stay with the failed records.
+		failed, failErr := partial.Failed, partial.Err
+		if len(partial.Rejected) > 0 && deadLetters != nil {
+			id := deadLetter(s, "", workerID, partial.Rejected, attemptsOf(partial.RejectErr), flushStart,
+				partial.RejectErr, reasonRejected, logger)
+			if id != "" {
+				delivery.Decision, delivery.DeadLetterID = outcomeDeadLettered, id
+			} else {
+				failed = slices.Concat(failed, partial.Rejected)
+				if failErr == nil {
+					failErr = partial.RejectErr
+				}
+			}
 		}
-
-		workerID := extractWorkerID(file)
-
-		for _, data := range dataList {
-			dataChan[workerID] <- data
+		if len(failed) == 0 {
+			return
 		}
+		// The failed records are spilled, and replayed, as a batch of
+		// their own.
+		data, batchID, err = failed, newBatchID(failed), failErr
+	}
 
-		err = os.Remove(file)
-		if err != nil {
-			log.Printf("Failed to delete %s: %v", file, err)
-		} else {
-			log.Printf("Deleted failed buffer file: %s", file)
+	// A transient failure may be over in seconds, so the batch is tried
+	// again later in the run rather than spilled straight away. Once it
+	// failed all its tries it is out of retries, unless the breaker or a
+	// shutdown cut them short.
+	exhausted := false
+	if requeue && err != nil && isRetryable(err) {
+		if n, first, ok := retries.Exhausted(s, batchID, flushStart, err); ok {
+			exhausted = !errors.Is(err, errCircuitOpen) && !shuttingDown(loadCtx)
+			attempts, flushStart = n, first
+		} else if retries.Add(s, batchID, data, workerID, flushStart, err) {
+			logger.Warn("Load failed, queued for retry", "error", err)
+			stats.BatchesRequeued.Add(1)
+			delivery.Decision = decisionQueued
+			return
 		}
 	}
-}
 
-func readBufferFromFile(filePath string) ([]DeviceData, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return nil, err
+	// Permanent rejections would fail again on every replay, so they go to
+	// the dead-letter queue instead of the auto-retried spill files. Refused
+	// credentials are the exception: the batch is fine once they are fixed.
+	// So are batches out of retries, and poison batches, spilled batches
+	// that keep failing however often they are replayed.
+	if err != nil && deadLetters != nil {
+		reason := ""
+		switch {
+		case isPermanent(err), !isRetryable(err) && !isAuthFailure(err):
+			reason = reasonRejected
+		case exhausted:
+			reason = reasonRetriesExhausted
+		case exhaustedReplays(s.Name(), batchID):
+			reason = reasonMaxReplays
+		}
+		if reason != "" {
+			if id := deadLetter(s, batchID, workerID, data, attempts, flushStart, err, reason, logger); id != "" {
+				delivery.Decision, delivery.DeadLetterID = outcomeDeadLettered, id
+				return
+			}
+		}
 	}
-	defer file.Close()
 
-	gzReader, err := gzip.NewReader(file)
 	if err != nil {
-		return nil, err
+		logger.Error("Load failed, saving buffer", "error", err)
+		batch := &SpilledBatch{
+			Sink:      s.Name(),
+			BatchID:   batchID,
+			RunID:     runStats.RunID,
+			WorkerID:  workerID,
+			SpilledAt: time.Now().UTC(),
+			Error:     err.Error(),
+			ErrorType: errorType(err),
+			Attempts:  attempts,
+			Records:   data,
+		}
+		if spillErr := spills.Put(batch); spillErr != nil {
+			logger.Error("Failed to spill batch, records lost", "error", spillErr)
+			// Lost records aren't settled, so -resume extracts their
+			// appliances again.
+			report.recordLoad(data, outcomeLost, attempts, fmt.Errorf("%w; spilling failed: %w", err, spillErr))
+			delivery.Decision = outcomeLost
+			return
+		}
+		logger.Debug("Spilled batch", "spill_id", batch.ID)
+		stats.BatchesSpilled.Add(1)
+		stats.RecordsSpilled.Add(int64(len(data)))
+		report.recordLoad(data, outcomeSpilled, attempts, err)
+		settleCheckpoint(applianceKeys(data), workerID)
+		delivery.Decision, delivery.SpillID = outcomeSpilled, batch.ID
+	} else {
+		logger.Info("Flushed batch")
+		stats.BatchesLoaded.Add(1)
+		stats.RecordsLoaded.Add(int64(len(data)))
+		report.recordLoad(data, outcomeLoaded, attempts, nil)
+		delivery.Loaded = len(data)
+		acknowledge(s.Name(), batchID)
+		clearFailures(s.Name(), batchID)
+		settleCheckpoint(applianceKeys(data), workerID)
 	}
-	defer gzReader.Close()
-
-	var data []DeviceData
-	decoder := json.NewDecoder(gzReader)
-	err = decoder.Decode(&data)
-	return data, err
 }
 
-func extractWorkerID(fileName string) int {
-	base := filepath.Base(fileName)
-	parts := strings.Split(strings.TrimSuffix(base, ".json.gz"), "worker")
-	if len(parts) != 2 {
-		return 0
+// deadLetter moves records of a batch to the dead-letter queue for reason,
+// returning the dead letter's ID, or "" if writing it failed. batchID is
+// the batch the records were sent as, if they were sent as a whole.
+func deadLetter(s Sink, batchID string, workerID int, data []DeviceData, attempts int, flushStart time.Time,
+	err error, reason string, logger *slog.Logger) string {
+	dl := newDeadLetter(s.Name(), workerID, data, attempts, flushStart, err)
+	dl.Reason = reason
+	if dlqErr := deadLetters.Put(dl); dlqErr != nil {
+		logger.Error("Failed to write dead letter, spilling instead", "error", dlqErr)
+		return ""
 	}
-	id, err := strconv.Atoi(parts[1])
-	if err != nil {
-		return 0
+	switch reason {
+	case reasonMaxReplays:
+		logger.Error("Batch failed every replay, moved to dead-letter queue", "dlq_id", dl.ID,
+			"max_replays", cfg.DLQ.MaxReplays, "error", err)
+	case reasonRetriesExhausted:
+		logger.Error("Batch ran out of retries, moved to dead-letter queue", "dlq_id", dl.ID, "attempts", attempts, "error", err)
+	default:
+		logger.Error("Sink rejected batch, moved to dead-letter queue", "dlq_id", dl.ID, "attempts", attempts, "error", err)
 	}
-	return id
+	if batchID != "" {
+		clearFailures(s.Name(), batchID)
+	}
+	stats := runStats.Sinks[s.Name()]
+	stats.BatchesDeadLettered.Add(1)
+	stats.RecordsDeadLettered.Add(int64(len(data)))
+	report.recordLoad(data, outcomeDeadLettered, attempts, err)
+	settleCheckpoint(applianceKeys(data), workerID)
+	return dl.ID
 }
 
-//////////////////////////////////////////////////
-// Buffer Save
-//////////////////////////////////////////////////
-
-func saveBufferToFile(data []DeviceData, filename string) {
-	file, err := os.Create(filename + ".json.gz")
-	if err != nil {
-		log.Printf("Failed to create file: %v", err)
+// settleCheckpoint tells the checkpoint that a sink settled the records of
+// the appliances in keys.
+func settleCheckpoint(keys []string, workerID int) {
+	if checkpoint == nil || len(keys) == 0 {
 		return
 	}
-	defer file.Close()
+	if err := checkpoint.Settled(keys); err != nil {
+		slog.Error("Failed to update checkpoint", "component", "checkpoint", "worker_id", workerID, "error", err)
+	}
+}
 
-	gzipWriter := gzip.NewWriter(file)
-	defer gzipWriter.Close()
+// applianceKeys returns the appliance of each record of this run; replayed
+// records have none.
+func applianceKeys(data []DeviceData) []string {
+	var keys []string
+	for _, d := range data {
+		if d.appliance != "" {
+			keys = append(keys, d.appliance)
+		}
+	}
+	return keys
+}
 
-	encoder := json.NewEncoder(gzipWriter)
-	err = encoder.Encode(data)
-	if err != nil {
-		log.Printf("Failed to encode buffer: %v", err)
+// loadedKeys returns the appliance keys of the records of a partly loaded
+// batch that aren't among its failed ones.
+func loadedKeys(data, failed []DeviceData) []string {
+	left := map[string]int{}
+	for _, k := range applianceKeys(failed) {
+		left[k]++
 	}
+	return slices.DeleteFunc(applianceKeys(data), func(k string) bool {
+		if left[k] > 0 {
+			left[k]--
+			return true
+		}
+		return false
+	})
 }
 
 //////////////////////////////////////////////////
@@ -405,6 +1041,7 @@ func readAppliancesFromCSV(filePath string) ([]Appliance, error) {
 	defer file.Close()
 
 	r := csv.NewReader(file)
+	r.FieldsPerRecord = -1
 	records, err := r.ReadAll()
 	if err != nil {
 		return nil, err
@@ -413,13 +1050,31 @@ func readAppliancesFromCSV(filePath string) ([]Appliance, error) {
 	var appliances []Appliance
 	for i, rec := range records {
 		if len(rec) < 2 {
-			log.Printf("Skipping invalid line %d", i+1)
+			slog.Warn("Skipping invalid CSV line", "file", filePath, "line", i+1)
 			continue
 		}
-		appliances = append(appliances, Appliance{
+		ap := Appliance{
 			IP:       rec[0],
 			HostName: rec[1],
-		})
+		}
+		ap.Priority = cfg.Extract.Priority.of(ap)
+		if len(rec) > 2 {
+			// Skipped rather than extracted with the wrong credentials,
+			// which could lock the appliance's account.
+			if ap.Credentials, err = applianceCredentials(strings.TrimSpace(rec[2])); err != nil {
+				slog.Warn("Skipping appliance", "file", filePath, "line", i+1, "host", ap.HostName, "error", err)
+				continue
+			}
+		}
+		if len(rec) > 3 && strings.TrimSpace(rec[3]) != "" {
+			// A typo only costs the appliance its place in the order.
+			if p, err := parsePriority(strings.TrimSpace(rec[3])); err != nil {
+				slog.Warn("Ignoring appliance priority", "file", filePath, "line", i+1, "host", ap.HostName, "error", err)
+			} else {
+				ap.Priority = p
+			}
+		}
+		appliances = append(appliances, ap)
 	}
 	return appliances, nil
 }
@@ -430,11 +1085,35 @@ func readAppliancesFromCSV(filePath string) ([]Appliance, error) {
 
 func setupLogging() {
 	var err error
-	logFile, err = os.OpenFile("etl.log", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	logFile, err = os.OpenFile(cfg.LogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
 	if err != nil {
 		log.Fatal("Cannot create log file:", err)
 	}
-	log.SetOutput(logFile)
+
+	opts := &slog.HandlerOptions{Level: parseLogLevel(cfg.LogLevel)}
+	var handler slog.Handler
+	if cfg.LogFormat == "json" {
+		handler = slog.NewJSONHandler(logFile, opts)
+	} else {
+		handler = slog.NewTextHandler(logFile, opts)
+	}
+	// SetDefault also routes the standard log package (used by libraries)
+	// through the handler.
+	slog.SetDefault(slog.New(handler))
+}
+
+func parseLogLevel(level string) slog.Level {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return slog.LevelInfo
+	}
+	return l
+}
+
+// fatal logs at error level and exits, like log.Fatal for structured logs.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
 
 var cpuProfile *os.File
@@ -459,7 +1138,7 @@ func writeMemoryProfile() {
 	if err == nil {
 		defer memProfile.Close()
 		pprof.WriteHeapProfile(memProfile)
-		log.Println("Memory profile written to mem.prof")
+		slog.Info("Memory profile written", "file", "mem.prof")
 	}
 }
 
@@ -470,14 +1149,16 @@ func logResourceUsage(phase string) {
 	cpuCount := runtime.NumCPU()
 	goroutines := runtime.NumGoroutine()
 
-	log.Printf("========= [%s] Resource Usage =========", phase)
-	log.Printf("CPU Cores: %d", cpuCount)
-	log.Printf("Active Goroutines: %d", goroutines)
-	log.Printf("Memory Alloc = %v MiB", bToMb(m.Alloc))
-	log.Printf("Total Memory Alloc = %v MiB", bToMb(m.TotalAlloc))
-	log.Printf("System Memory = %v MiB", bToMb(m.Sys))
-	log.Printf("NumGC = %v", m.NumGC)
-	log.Printf("========================================")
+	slog.Info("Resource usage",
+		"phase", phase,
+		"cpu_cores", cpuCount,
+		"goroutines", goroutines,
+		"alloc_mib", bToMb(m.Alloc),
+		"total_alloc_mib", bToMb(m.TotalAlloc),
+		"sys_mib", bToMb(m.Sys),
+		"num_gc", m.NumGC,
+		"mallocs", m.Mallocs,
+	)
 }
 
 func bToMb(b uint64) uint64 {
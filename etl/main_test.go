@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testConfig = flag.String("config", "", "configuration the tests and benchmarks run with; default settings if empty")
+
+// TestMain loads the configuration the code under test reads from cfg, and
+// keeps its logging off the test output.
+func TestMain(m *testing.M) {
+	flag.Parse()
+	var args []string
+	if *testConfig != "" {
+		args = []string{"-config", *testConfig}
+	}
+	c, _, err := loadConfig(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
+		os.Exit(2)
+	}
+	cfg = c
+	slog.SetDefault(slog.New(slog.DiscardHandler))
+	os.Exit(m.Run())
+}
+
+// testSink fails the attempts numbered in fail with their error, and takes
+// the others.
+type testSink struct {
+	name string
+	fail map[int]error
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (s *testSink) Name() string { return s.name }
+
+func (s *testSink) Load(ctx context.Context, data []DeviceData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	return s.fail[s.calls]
+}
+
+func (s *testSink) Calls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+// withTestLoadStage points the load stage at sinks, with spill, dead-letter
+// and state stores in a temporary directory, and restores it after t.
+func withTestLoadStage(t *testing.T, sinks ...Sink) {
+	t.Helper()
+	dir := t.TempDir()
+	store, err := openStateStore(StateConfig{File: filepath.Join(dir, "state.db"), RunHistory: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dlq, err := newDirDeadLetterStore(filepath.Join(dir, "dlq"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevSinks, prevStats, prevSpills, prevDLQ := loadSinks, runStats, spills, deadLetters
+	prevState, prevCheckpoint, prevRetries := state, checkpoint, retries
+	t.Cleanup(func() {
+		loadSinks, runStats, spills, deadLetters = prevSinks, prevStats, prevSpills, prevDLQ
+		state, checkpoint, retries = prevState, prevCheckpoint, prevRetries
+		store.Close()
+	})
+	loadSinks = sinks
+	runStats = newRunStats("test", sinks)
+	spills = &dirSpillStore{dir: filepath.Join(dir, "spill"), format: "json"}
+	deadLetters = dlq
+	state = store
+	checkpoint, retries = nil, nil
+}
+
+// holdRetries sets up a retry queue that takes a batch once and never
+// retries it within t.
+func holdRetries(t *testing.T) {
+	retries = newRetryQueue(RetryQueueConfig{MaxRecords: 100, Retry: RetryConfig{MaxAttempts: 1,
+		BaseDelay: Duration(time.Hour), MaxDelay: Duration(time.Hour)}})
+	t.Cleanup(func() {
+		retries.mu.Lock()
+		retries.items = nil
+		retries.mu.Unlock()
+		retries.Close(true)
+	})
+}
+
+// testRecords returns n records named device-0 to device-<n-1>.
+func testRecords(n int) []DeviceData {
+	data := make([]DeviceData, n)
+	for i := range data {
+		data[i] = DeviceData{Name: fmt.Sprintf("device-%d", i), CPUNumber: "0", Timestamp: 1700000000,
+			Indicators: []Indicator{{"utilization", float64(i)}}, appliance: fmt.Sprintf("device-%d|10.0.0.%d", i, i)}
+	}
+	return data
+}
+
+// sinkCounts is what settling batches left in the stats of a sink.
+type sinkCounts struct {
+	loaded, spilled, deadLettered, requeued int64
+}
+
+func countsOf(sink string) sinkCounts {
+	s := runStats.Sinks[sink]
+	return sinkCounts{s.RecordsLoaded.Load(), s.RecordsSpilled.Load(), s.RecordsDeadLettered.Load(), s.BatchesRequeued.Load()}
+}
+
+func TestSettleFlush(t *testing.T) {
+	data := testRecords(4)
+	tests := []struct {
+		name    string
+		err     error
+		requeue bool
+		want    sinkCounts
+	}{
+		{"loaded", nil, true, sinkCounts{loaded: 4}},
+		{"transient error spilled", &APIError{StatusCode: 503}, false, sinkCounts{spilled: 4}},
+		{"transient error queued", &APIError{StatusCode: 503}, true, sinkCounts{requeued: 1}},
+		{"network error spilled", errors.New("connection refused"), false, sinkCounts{spilled: 4}},
+		{"rejected batch dead-lettered", &APIError{StatusCode: 400}, true, sinkCounts{deadLettered: 4}},
+		{"refused credentials spilled", &APIError{StatusCode: 401}, true, sinkCounts{spilled: 4}},
+		{"unencodable batch dead-lettered", permanent(errors.New("json: unsupported value: NaN")), true,
+			sinkCounts{deadLettered: 4}},
+		{"refused database credentials dead-lettered", permanent(&APIError{StatusCode: 401}), true,
+			sinkCounts{deadLettered: 4}},
+		{"partly loaded, rest spilled", &PartialError{Failed: data[:1], Err: &APIError{StatusCode: 503}}, false,
+			sinkCounts{loaded: 3, spilled: 1}},
+		{"partly loaded, rest dead-lettered", &PartialError{Failed: data[:2], Err: &APIError{StatusCode: 422}}, false,
+			sinkCounts{loaded: 2, deadLettered: 2}},
+		{"partly loaded, rejected dead-lettered", &PartialError{Rejected: data[:1], RejectErr: &APIError{StatusCode: 400}}, true,
+			sinkCounts{loaded: 3, deadLettered: 1}},
+		{"failed spilled, rejected dead-lettered", &PartialError{Failed: data[:2], Err: &APIError{StatusCode: 503},
+			Rejected: data[2:3], RejectErr: &APIError{StatusCode: 400}}, false, sinkCounts{loaded: 1, spilled: 2, deadLettered: 1}},
+		{"failed queued, rejected dead-lettered", &PartialError{Failed: data[:2], Err: &APIError{StatusCode: 503},
+			Rejected: data[2:3], RejectErr: &APIError{StatusCode: 400}}, true, sinkCounts{loaded: 1, requeued: 1, deadLettered: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &testSink{name: "test"}
+			withTestLoadStage(t, s)
+			holdRetries(t)
+
+			settleFlush(s, newBatchID(data), data, 0, time.Now(), tt.err, tt.requeue)
+			if got := countsOf("test"); got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
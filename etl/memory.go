@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"runtime"
+	"runtime/metrics"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// Memory Budget
+//////////////////////////////////////////////////
+
+type MemoryConfig struct {
+	// BudgetMB caps the Go heap. Above it no new appliances are dispatched
+	// until in-flight extracts and the loaders have drained it below
+	// ResumeRatio of the budget. 0 disables the budget.
+	BudgetMB      int      `yaml:"budget_mb" json:"budget_mb"`
+	ResumeRatio   float64  `yaml:"resume_ratio" json:"resume_ratio"`
+	CheckInterval Duration `yaml:"check_interval" json:"check_interval"`
+}
+
+func defaultMemoryConfig() MemoryConfig {
+	return MemoryConfig{
+		ResumeRatio:   0.8,
+		CheckInterval: Duration(250 * time.Millisecond),
+	}
+}
+
+func (m *MemoryConfig) validate() []error {
+	var errs []error
+	if m.BudgetMB < 0 {
+		errs = append(errs, errors.New("memory.budget_mb must be >= 0"))
+	}
+	if m.ResumeRatio <= 0 || m.ResumeRatio >= 1 {
+		errs = append(errs, errors.New("memory.resume_ratio must be within (0, 1)"))
+	}
+	if m.CheckInterval <= 0 {
+		errs = append(errs, errors.New("memory.check_interval must be > 0"))
+	}
+	return errs
+}
+
+// MemoryBudget holds back dispatch while the heap is over budget, so a run
+// with thousands of extract workers and deep load queues slows down instead
+// of running out of memory. It lives across daemon runs.
+type MemoryBudget struct {
+	pauseGate
+	limit    uint64
+	resume   uint64
+	interval time.Duration
+}
+
+// memoryBudget is nil unless memory.budget_mb is set.
+var memoryBudget *MemoryBudget
+
+func newMemoryBudget(conf MemoryConfig) *MemoryBudget {
+	limit := uint64(conf.BudgetMB) << 20
+	return &MemoryBudget{
+		limit:    limit,
+		resume:   uint64(float64(limit) * conf.ResumeRatio),
+		interval: conf.CheckInterval.Std(),
+	}
+}
+
+// Run samples the heap every check interval until ctx is done, pausing
+// dispatch above the budget and resuming it below the resume threshold.
+func (b *MemoryBudget) Run(ctx context.Context) {
+	b.run(ctx, b.interval, func() bool {
+		heap, over := liveHeapOver(b.limit)
+		if over {
+			slog.Warn("Memory budget exceeded, pausing dispatch", "component", "memory",
+				"heap_mib", bToMb(heap), "budget_mib", bToMb(b.limit))
+		}
+		return over
+	}, func(paused time.Duration) bool {
+		heap, over := liveHeapOver(b.resume)
+		if !over {
+			slog.Info("Memory back under budget, resuming dispatch", "component", "memory",
+				"heap_mib", bToMb(heap), "paused_ms", paused.Milliseconds())
+		}
+		return !over
+	})
+}
+
+// warnBelowHeap warns when the heap at rest is over the resume threshold:
+// dispatch would pause at the first check and never resume.
+func (b *MemoryBudget) warnBelowHeap() {
+	if heap, over := liveHeapOver(b.resume); over {
+		slog.Warn("memory.budget_mb is below the heap at rest, dispatch would stay paused", "component", "memory",
+			"heap_mib", bToMb(heap), "budget_mib", bToMb(b.limit), "resume_mib", bToMb(b.resume))
+	}
+}
+
+// liveHeapOver returns the heap and whether it is over threshold. The
+// sample counts garbage not yet collected, so a heap over threshold is
+// sampled again after a collection; only what is live counts.
+func liveHeapOver(threshold uint64) (uint64, bool) {
+	heap := heapInUse()
+	if heap > threshold {
+		runtime.GC()
+		heap = heapInUse()
+	}
+	return heap, heap > threshold
+}
+
+// heapInUse returns the bytes of heap objects, live or not yet swept. It is
+// much cheaper to read than runtime.MemStats, which stops the world.
+func heapInUse() uint64 {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(sample)
+	return sample[0].Value.Uint64()
+}
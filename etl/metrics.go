@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+)
+
+//////////////////////////////////////////////////
+// Metric Types
+//////////////////////////////////////////////////
+
+// MetricSample is one reading of a metric type other than cpu: the memory of
+// an appliance, or the counters of one of its disks or network interfaces.
+// Extractors fill Values with the raw figures named in the metric type.
+type MetricSample struct {
+	Metric    string
+	Device    string
+	Name      string
+	Timestamp uint64
+	Values    map[string]float64
+}
+
+// MetricExtractor is implemented by extractors that can read metric types
+// besides cpu, which every extractor reads through Extract.
+type MetricExtractor interface {
+	ExtractMetric(ctx context.Context, ap Appliance, metric string) ([]MetricSample, error)
+}
+
+// metricType is the indicator set of a metric type. Values listed in
+// indicators become indicators of the same name, in that order; derive
+// adds indicators computed from them.
+type metricType struct {
+	indicators []string
+	derive     func(v map[string]float64) []Indicator
+}
+
+var metricTypes = map[string]metricType{
+	"memory": {
+		indicators: []string{"total_bytes", "used_bytes", "free_bytes", "available_bytes", "buffers_bytes", "cached_bytes", "swap_total_bytes", "swap_used_bytes"},
+		derive: func(v map[string]float64) []Indicator {
+			total := v["total_bytes"]
+			if total <= 0 {
+				return nil
+			}
+			used, ok := v["used_bytes"]
+			if avail, hasAvail := v["available_bytes"]; hasAvail {
+				used, ok = total-avail, true
+			}
+			if !ok {
+				return nil
+			}
+			return []Indicator{{"utilization", used / total * 100}}
+		},
+	},
+	"disk": {
+		indicators: []string{"reads", "writes", "read_bytes", "write_bytes", "io_time_ms"},
+	},
+	"network": {
+		indicators: []string{"rx_bytes", "tx_bytes", "rx_packets", "tx_packets", "rx_errors", "tx_errors", "rx_dropped", "tx_dropped"},
+	},
+}
+
+// metricNames lists the values of extract.metrics.
+func metricNames() []string {
+	names := []string{"cpu"}
+	for name := range metricTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names[1:])
+	return names
+}
+
+func validateMetrics(metrics []string) []error {
+	var errs []error
+	if len(metrics) == 0 {
+		errs = append(errs, errors.New("extract.metrics must list at least one metric type"))
+	}
+	for i, m := range metrics {
+		if !slices.Contains(metricNames(), m) {
+			errs = append(errs, fmt.Errorf("extract.metrics: unknown metric type %q (available: %v)", m, metricNames()))
+		}
+		if slices.Contains(metrics[:i], m) {
+			errs = append(errs, fmt.Errorf("extract.metrics: %q is listed twice", m))
+		}
+	}
+	return errs
+}
+
+// record turns a sample into the record loaded for it.
+func (s MetricSample) record() DeviceData {
+	mt := metricTypes[s.Metric]
+	d := DeviceData{Name: s.Name, Metric: s.Metric, Device: s.Device, Timestamp: s.Timestamp}
+	for _, name := range mt.indicators {
+		if v, ok := s.Values[name]; ok {
+			d.Indicators = append(d.Indicators, Indicator{name, v})
+		}
+	}
+	if mt.derive != nil {
+		d.Indicators = append(d.Indicators, mt.derive(s.Values)...)
+	}
+	return d
+}
+
+// decodeMetricJSON reads the JSON an appliance serves for a metric type:
+// one object of values (memory), or an array of objects that each name
+// their "device" (disks, interfaces). Non-numeric fields other than device
+// and name are ignored; a "timestamp" field overrides the sample time.
+func decodeMetricJSON(raw []byte, metric string, ap Appliance, now uint64) ([]MetricSample, error) {
+	var objs []map[string]any
+	if err := json.Unmarshal(raw, &objs); err != nil {
+		var obj map[string]any
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return nil, fmt.Errorf("decoding %s stats: %w", metric, err)
+		}
+		objs = []map[string]any{obj}
+	}
+
+	samples := make([]MetricSample, 0, len(objs))
+	for _, obj := range objs {
+		s := MetricSample{Metric: metric, Name: ap.HostName, Timestamp: now, Values: map[string]float64{}}
+		for k, v := range obj {
+			switch k {
+			case "device":
+				s.Device, _ = v.(string)
+			case "name":
+				if name, _ := v.(string); name != "" {
+					s.Name = name
+				}
+			case "timestamp":
+				if ts, ok := v.(float64); ok && ts > 0 {
+					s.Timestamp = uint64(ts)
+				}
+			default:
+				if f, ok := v.(float64); ok {
+					s.Values[k] = f
+				}
+			}
+		}
+		samples = append(samples, s)
+	}
+	return samples, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// OAuth2 Client Credentials
+//////////////////////////////////////////////////
+
+// OAuth2Config replaces api.auth_token with access tokens fetched from
+// TokenURL with the client credentials grant.
+type OAuth2Config struct {
+	TokenURL     string   `yaml:"token_url" json:"token_url"` // empty disables OAuth2
+	ClientID     string   `yaml:"client_id" json:"client_id"`
+	ClientSecret string   `yaml:"client_secret" json:"client_secret" secret:"true"`
+	Scopes       []string `yaml:"scopes" json:"scopes"`
+	Audience     string   `yaml:"audience" json:"audience"`     // sent if set, for providers that want one
+	AuthStyle    string   `yaml:"auth_style" json:"auth_style"` // header (HTTP Basic) or params (form body)
+	// RefreshBefore fetches a new token this long before the current one
+	// expires, so no request goes out with a token about to lapse.
+	RefreshBefore Duration `yaml:"refresh_before" json:"refresh_before"`
+	Timeout       Duration `yaml:"timeout" json:"timeout"`
+}
+
+func defaultOAuth2Config() OAuth2Config {
+	return OAuth2Config{
+		AuthStyle:     "header",
+		RefreshBefore: Duration(time.Minute),
+		Timeout:       Duration(10 * time.Second),
+	}
+}
+
+func (o *OAuth2Config) validate() []error {
+	if o.TokenURL == "" {
+		return nil
+	}
+	var errs []error
+	if !strings.HasPrefix(o.TokenURL, "http://") && !strings.HasPrefix(o.TokenURL, "https://") {
+		errs = append(errs, fmt.Errorf("api.oauth2.token_url must be an http(s) URL, got %q", o.TokenURL))
+	}
+	if o.ClientID == "" || o.ClientSecret == "" {
+		errs = append(errs, errors.New("api.oauth2.client_id and api.oauth2.client_secret must be set"))
+	}
+	switch o.AuthStyle {
+	case "header", "params":
+	default:
+		errs = append(errs, fmt.Errorf("api.oauth2.auth_style must be header or params, got %q", o.AuthStyle))
+	}
+	if o.RefreshBefore < 0 {
+		errs = append(errs, errors.New("api.oauth2.refresh_before must be >= 0"))
+	}
+	if o.Timeout <= 0 {
+		errs = append(errs, errors.New("api.oauth2.timeout must be > 0"))
+	}
+	return errs
+}
+
+// tokenSource caches an access token for all load workers. Only one worker
+// fetches a new token at a time; the others wait for it.
+type tokenSource struct {
+	conf   OAuth2Config
+	client *http.Client
+
+	mu     sync.Mutex
+	header string    // Authorization header value, "" when none is cached
+	expiry time.Time // zero when the provider gave no expiry
+}
+
+func newTokenSource(conf OAuth2Config) *tokenSource {
+	return &tokenSource{conf: conf, client: loadClient(conf.Timeout.Std())}
+}
+
+// Authorization returns the Authorization header value for a request,
+// fetching a token if none is cached or it is about to expire.
+func (t *tokenSource) Authorization(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.header != "" && (t.expiry.IsZero() || time.Now().Add(t.conf.RefreshBefore.Std()).Before(t.expiry)) {
+		return t.header, nil
+	}
+	header, expiry, err := t.fetch(ctx)
+	if err != nil {
+		return "", fmt.Errorf("oauth2 token: %w", err)
+	}
+	t.header, t.expiry = header, expiry
+	slog.Debug("Fetched OAuth2 access token", "component", "oauth2", "expires_at", expiry)
+	return header, nil
+}
+
+// Invalidate drops the cached token after the API rejected it, unless
+// another worker has already replaced it.
+func (t *tokenSource) Invalidate(header string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.header == header {
+		t.header = ""
+	}
+}
+
+func (t *tokenSource) fetch(ctx context.Context) (header string, expiry time.Time, err error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(t.conf.Scopes) > 0 {
+		form.Set("scope", strings.Join(t.conf.Scopes, " "))
+	}
+	if t.conf.Audience != "" {
+		form.Set("audience", t.conf.Audience)
+	}
+	if t.conf.AuthStyle == "params" {
+		form.Set("client_id", t.conf.ClientID)
+		form.Set("client_secret", t.conf.ClientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.conf.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if t.conf.AuthStyle == "header" {
+		req.SetBasicAuth(url.QueryEscape(t.conf.ClientID), url.QueryEscape(t.conf.ClientSecret))
+	}
+
+	requested := time.Now()
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", time.Time{}, fmt.Errorf("token endpoint returned %s: %s", resp.Status, truncate(string(raw), 200))
+	}
+
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(raw, &tok); err != nil {
+		return "", time.Time{}, fmt.Errorf("decoding token response: %w", err)
+	}
+	if tok.AccessToken == "" {
+		return "", time.Time{}, errors.New("token response has no access_token")
+	}
+	tokenType := tok.TokenType
+	if tokenType == "" || strings.EqualFold(tokenType, "bearer") {
+		tokenType = "Bearer"
+	}
+	if tok.ExpiresIn > 0 {
+		expiry = requested.Add(time.Duration(tok.ExpiresIn) * time.Second)
+	}
+	return tokenType + " " + tok.AccessToken, expiry, nil
+}
+
+func isUnauthorized(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusUnauthorized
+}
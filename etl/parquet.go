@@ -0,0 +1,795 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+//////////////////////////////////////////////////
+// Parquet Spill Files
+//////////////////////////////////////////////////
+
+// A Parquet spill holds one row per indicator of every record, with the
+// batch's context repeated on each row, so it can be queried as is:
+//
+//	SELECT name, indicator, avg(value) FROM 'spill/http/*.parquet' GROUP BY ALL
+//
+// Columns, in order (the schema is stable; new columns are only appended):
+//
+//	run_id      string     spilled_at  timestamp(ms)  error_type string
+//	error       string     attempts    int32          record     int32
+//	name        string     cpu_number  string         timestamp  int64
+//	metric      string     device      string         indicator  string, null if none
+//	value       double, null if none   labels         JSON string, null if none
+//
+// record numbers the records of the batch, so the rows of one record can
+// be put back together; a record without indicators has a single row with
+// a null indicator. The file is written with one row group of snappy
+// compressed PLAIN pages, and read back by readParquetSpill.
+
+// Parquet physical types, converted types, and the enum values used below.
+const (
+	pqInt32     = 1
+	pqInt64     = 2
+	pqDouble    = 5
+	pqByteArray = 6
+
+	pqUTF8            = 0
+	pqTimestampMillis = 9
+	pqJSON            = 19
+
+	pqRequired = 0
+	pqOptional = 1
+
+	pqPlain  = 0
+	pqRLE    = 3
+	pqSnappy = 1
+)
+
+type pqColumn struct {
+	name      string
+	typ       int32
+	converted int32 // -1 for none
+	optional  bool
+
+	rows    int
+	defined []bool // per row, optional columns only
+	values  []byte // PLAIN encoded defined values
+}
+
+func (c *pqColumn) null() {
+	c.rows++
+	c.defined = append(c.defined, false)
+}
+
+func (c *pqColumn) add(v []byte) {
+	c.rows++
+	if c.optional {
+		c.defined = append(c.defined, true)
+	}
+	c.values = append(c.values, v...)
+}
+
+func (c *pqColumn) addString(s string) {
+	c.add(binary.LittleEndian.AppendUint32(nil, uint32(len(s))))
+	c.values = append(c.values, s...)
+}
+
+func (c *pqColumn) addInt32(v int32) { c.add(binary.LittleEndian.AppendUint32(nil, uint32(v))) }
+func (c *pqColumn) addInt64(v int64) { c.add(binary.LittleEndian.AppendUint64(nil, uint64(v))) }
+func (c *pqColumn) addDouble(v float64) {
+	c.add(binary.LittleEndian.AppendUint64(nil, math.Float64bits(v)))
+}
+
+func newSpillColumns() []*pqColumn {
+	str := func(name string) *pqColumn { return &pqColumn{name: name, typ: pqByteArray, converted: pqUTF8} }
+	return []*pqColumn{
+		str("run_id"),
+		{name: "spilled_at", typ: pqInt64, converted: pqTimestampMillis},
+		str("error_type"),
+		str("error"),
+		{name: "attempts", typ: pqInt32, converted: -1},
+		{name: "record", typ: pqInt32, converted: -1},
+		str("name"),
+		str("cpu_number"),
+		{name: "timestamp", typ: pqInt64, converted: -1},
+		str("metric"),
+		str("device"),
+		{name: "indicator", typ: pqByteArray, converted: pqUTF8, optional: true},
+		{name: "value", typ: pqDouble, converted: -1, optional: true},
+		{name: "labels", typ: pqByteArray, converted: pqJSON, optional: true},
+	}
+}
+
+// marshalParquetSpill encodes a spilled batch as a Parquet file.
+func marshalParquetSpill(b *SpilledBatch) ([]byte, error) {
+	cols := newSpillColumns()
+	row := func(i int, d DeviceData, ind *Indicator, labels []byte) {
+		cols[0].addString(b.RunID)
+		cols[1].addInt64(b.SpilledAt.UnixMilli())
+		cols[2].addString(b.ErrorType)
+		cols[3].addString(b.Error)
+		cols[4].addInt32(int32(b.Attempts))
+		cols[5].addInt32(int32(i))
+		cols[6].addString(d.Name)
+		cols[7].addString(d.CPUNumber)
+		cols[8].addInt64(int64(d.Timestamp))
+		cols[9].addString(d.Metric)
+		cols[10].addString(d.Device)
+		if ind != nil {
+			cols[11].addString(ind.Name)
+			cols[12].addDouble(ind.Value)
+		} else {
+			cols[11].null()
+			cols[12].null()
+		}
+		if labels != nil {
+			cols[13].addString(string(labels))
+		} else {
+			cols[13].null()
+		}
+	}
+	for i, d := range b.Records {
+		var labels []byte
+		if len(d.Labels) > 0 {
+			var err error
+			if labels, err = json.Marshal(d.Labels); err != nil {
+				return nil, err
+			}
+		}
+		if len(d.Indicators) == 0 {
+			row(i, d, nil, labels)
+		}
+		for j := range d.Indicators {
+			row(i, d, &d.Indicators[j], labels)
+		}
+	}
+	return writeParquet(cols, map[string]string{"etl.sink": b.Sink})
+}
+
+func writeParquet(cols []*pqColumn, kv map[string]string) ([]byte, error) {
+	out := []byte("PAR1")
+	numRows := cols[0].rows
+
+	var chunks [][]byte
+	var offsets []int64
+	var totalSize int64
+	for _, c := range cols {
+		var body []byte
+		if c.optional {
+			levels := rleBoolLevels(c.defined)
+			body = binary.LittleEndian.AppendUint32(body, uint32(len(levels)))
+			body = append(body, levels...)
+		}
+		body = append(body, c.values...)
+		compressed := snappy.Encode(nil, body)
+
+		var page thriftWriter
+		page.i32(1, 0) // DATA_PAGE
+		page.i32(2, int32(len(body)))
+		page.i32(3, int32(len(compressed)))
+		page.beginStruct(5)
+		page.i32(1, int32(c.rows))
+		page.i32(2, pqPlain)
+		page.i32(3, pqRLE)
+		page.i32(4, pqRLE)
+		page.endStruct()
+		page.stop()
+
+		offset := int64(len(out))
+		out = append(out, page.b...)
+		out = append(out, compressed...)
+		size := int64(len(page.b) + len(compressed))
+		uncompressed := int64(len(page.b) + len(body))
+		totalSize += uncompressed
+
+		var meta thriftWriter
+		meta.i32(1, c.typ)
+		meta.listI32(2, []int32{pqPlain, pqRLE})
+		meta.listString(3, []string{c.name})
+		meta.i32(4, pqSnappy)
+		meta.i64(5, int64(c.rows))
+		meta.i64(6, uncompressed)
+		meta.i64(7, size)
+		meta.i64(9, offset)
+		meta.stop()
+		chunks = append(chunks, meta.b)
+		offsets = append(offsets, offset)
+	}
+
+	var fm thriftWriter
+	fm.i32(1, 1)
+	fm.listBegin(2, thriftStruct, len(cols)+1)
+	{
+		var root thriftWriter
+		root.str(4, "schema")
+		root.i32(5, int32(len(cols)))
+		root.stop()
+		fm.raw(root.b)
+		for _, c := range cols {
+			var el thriftWriter
+			el.i32(1, c.typ)
+			rep := int32(pqRequired)
+			if c.optional {
+				rep = pqOptional
+			}
+			el.i32(3, rep)
+			el.str(4, c.name)
+			if c.converted >= 0 {
+				el.i32(6, c.converted)
+			}
+			el.stop()
+			fm.raw(el.b)
+		}
+	}
+	fm.i64(3, int64(numRows))
+	fm.listBegin(4, thriftStruct, 1)
+	{
+		var rg thriftWriter
+		rg.listBegin(1, thriftStruct, len(chunks))
+		for i, meta := range chunks {
+			var cc thriftWriter
+			cc.i64(2, offsets[i])
+			cc.beginStruct(3)
+			cc.raw(meta)
+			cc.endStructNoStop()
+			cc.stop()
+			rg.raw(cc.b)
+		}
+		rg.i64(2, totalSize)
+		rg.i64(3, int64(numRows))
+		rg.stop()
+		fm.raw(rg.b)
+	}
+	if len(kv) > 0 {
+		fm.listBegin(5, thriftStruct, len(kv))
+		for k, v := range kv {
+			var e thriftWriter
+			e.str(1, k)
+			e.str(2, v)
+			e.stop()
+			fm.raw(e.b)
+		}
+	}
+	fm.str(6, "concurrent-etl-go")
+	fm.stop()
+
+	out = append(out, fm.b...)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(fm.b)))
+	return append(out, "PAR1"...), nil
+}
+
+// rleBoolLevels encodes 0/1 definition levels in the RLE/bit-packing
+// hybrid with bit width 1, as runs only.
+func rleBoolLevels(defined []bool) []byte {
+	var b []byte
+	for i := 0; i < len(defined); {
+		j := i
+		for j < len(defined) && defined[j] == defined[i] {
+			j++
+		}
+		b = binary.AppendUvarint(b, uint64(j-i)<<1)
+		if defined[i] {
+			b = append(b, 1)
+		} else {
+			b = append(b, 0)
+		}
+		i = j
+	}
+	return b
+}
+
+// readParquetSpill decodes a file written by marshalParquetSpill.
+func readParquetSpill(raw []byte) (*SpilledBatch, error) {
+	cols, kv, err := readParquet(raw)
+	if err != nil {
+		return nil, err
+	}
+	get := func(name string) *pqReadColumn {
+		for _, c := range cols {
+			if c.name == name {
+				return c
+			}
+		}
+		return nil
+	}
+	want := newSpillColumns()
+	byName := make(map[string]*pqReadColumn, len(want))
+	for _, w := range want {
+		c := get(w.name)
+		if c == nil || c.typ != w.typ {
+			return nil, fmt.Errorf("parquet spill: missing or mistyped column %q", w.name)
+		}
+		byName[w.name] = c
+	}
+
+	b := &SpilledBatch{Sink: kv["etl.sink"]}
+	rows := byName["record"].rows()
+	last := -1
+	for r := range rows {
+		if r == 0 {
+			b.RunID = byName["run_id"].str(r)
+			b.SpilledAt = time.UnixMilli(byName["spilled_at"].int64(r)).UTC()
+			b.ErrorType = byName["error_type"].str(r)
+			b.Error = byName["error"].str(r)
+			b.Attempts = int(byName["attempts"].int32(r))
+		}
+		if rec := int(byName["record"].int32(r)); rec != last {
+			last = rec
+			d := DeviceData{
+				Name:      byName["name"].str(r),
+				CPUNumber: byName["cpu_number"].str(r),
+				Timestamp: uint64(byName["timestamp"].int64(r)),
+				Metric:    byName["metric"].str(r),
+				Device:    byName["device"].str(r),
+			}
+			if l := byName["labels"]; l.isDefined(r) {
+				if err := json.Unmarshal([]byte(l.str(r)), &d.Labels); err != nil {
+					return nil, fmt.Errorf("parquet spill: labels: %w", err)
+				}
+			}
+			b.Records = append(b.Records, d)
+		}
+		if ind := byName["indicator"]; ind.isDefined(r) {
+			d := &b.Records[len(b.Records)-1]
+			d.Indicators = append(d.Indicators, Indicator{ind.str(r), byName["value"].double(r)})
+		}
+	}
+	return b, nil
+}
+
+// pqReadColumn holds a decoded column: per row, the value's bytes (nil
+// for nulls).
+type pqReadColumn struct {
+	name     string
+	typ      int32
+	optional bool
+	values   [][]byte
+}
+
+func (c *pqReadColumn) rows() int            { return len(c.values) }
+func (c *pqReadColumn) isDefined(r int) bool { return c.values[r] != nil }
+func (c *pqReadColumn) str(r int) string     { return string(c.values[r]) }
+func (c *pqReadColumn) int32(r int) int32    { return int32(binary.LittleEndian.Uint32(c.values[r])) }
+func (c *pqReadColumn) int64(r int) int64    { return int64(binary.LittleEndian.Uint64(c.values[r])) }
+func (c *pqReadColumn) double(r int) float64 {
+	return math.Float64frombits(binary.LittleEndian.Uint64(c.values[r]))
+}
+
+var errParquet = errors.New("not a parquet spill file")
+
+// readParquet reads the flat, PLAIN-encoded columns of a Parquet file, as
+// written by writeParquet, along with its key/value metadata.
+func readParquet(raw []byte) ([]*pqReadColumn, map[string]string, error) {
+	if len(raw) < 12 || string(raw[:4]) != "PAR1" || string(raw[len(raw)-4:]) != "PAR1" {
+		return nil, nil, errParquet
+	}
+	n := int(binary.LittleEndian.Uint32(raw[len(raw)-8:]))
+	if n > len(raw)-12 {
+		return nil, nil, errParquet
+	}
+	fm, err := readThriftStruct(raw[len(raw)-8-n : len(raw)-8])
+	if err != nil {
+		return nil, nil, fmt.Errorf("parquet footer: %w", err)
+	}
+
+	kv := map[string]string{}
+	for _, e := range fm.list(5) {
+		e := e.(thriftFields)
+		kv[string(e.bytes(1))] = string(e.bytes(2))
+	}
+
+	var cols []*pqReadColumn
+	for _, el := range fm.list(2)[1:] {
+		el := el.(thriftFields)
+		cols = append(cols, &pqReadColumn{
+			name:     string(el.bytes(4)),
+			typ:      int32(el.int(1)),
+			optional: el.int(3) == pqOptional,
+		})
+	}
+
+	for _, rg := range fm.list(4) {
+		chunks := rg.(thriftFields).list(1)
+		if len(chunks) != len(cols) {
+			return nil, nil, errors.New("parquet: row group doesn't match the schema")
+		}
+		for i, cc := range chunks {
+			meta := cc.(thriftFields).strct(3)
+			if err := cols[i].readChunk(raw, meta); err != nil {
+				return nil, nil, fmt.Errorf("parquet column %s: %w", cols[i].name, err)
+			}
+		}
+	}
+	return cols, kv, nil
+}
+
+func (c *pqReadColumn) readChunk(raw []byte, meta thriftFields) error {
+	if meta.int(4) != pqSnappy && meta.int(4) != 0 {
+		return fmt.Errorf("unsupported codec %d", meta.int(4))
+	}
+	pos, remaining := meta.int(9), meta.int(5)
+	for remaining > 0 {
+		if pos < 0 || pos >= int64(len(raw)) {
+			return errParquet
+		}
+		header, n, err := readThriftStructLen(raw[pos:])
+		if err != nil {
+			return err
+		}
+		pos += int64(n)
+		size := header.int(3)
+		if pos+size > int64(len(raw)) {
+			return errParquet
+		}
+		body := raw[pos : pos+size]
+		pos += size
+		if header.int(1) != 0 { // not a data page
+			continue
+		}
+		if meta.int(4) == pqSnappy {
+			if body, err = snappy.Decode(nil, body); err != nil {
+				return err
+			}
+		}
+		dp := header.strct(5)
+		count := int(dp.int(1))
+		if dp.int(2) != pqPlain {
+			return fmt.Errorf("unsupported encoding %d", dp.int(2))
+		}
+		if err := c.readPage(body, count); err != nil {
+			return err
+		}
+		remaining -= int64(count)
+	}
+	return nil
+}
+
+func (c *pqReadColumn) readPage(body []byte, count int) error {
+	defined := make([]bool, count)
+	for i := range defined {
+		defined[i] = true
+	}
+	if c.optional {
+		if len(body) < 4 {
+			return errParquet
+		}
+		n := int(binary.LittleEndian.Uint32(body))
+		if 4+n > len(body) {
+			return errParquet
+		}
+		levels := body[4 : 4+n]
+		body = body[4+n:]
+		for i := 0; i < count && len(levels) > 0; {
+			h, k := binary.Uvarint(levels)
+			if k <= 0 {
+				return errParquet
+			}
+			levels = levels[k:]
+			if h&1 == 1 {
+				// Bit-packed run of h>>1 groups of 8 levels.
+				groups := int(h >> 1)
+				if len(levels) < groups {
+					return errParquet
+				}
+				for g := 0; g < groups; g++ {
+					for bit := 0; bit < 8 && i < count; bit++ {
+						defined[i] = levels[g]>>bit&1 == 1
+						i++
+					}
+				}
+				levels = levels[groups:]
+				continue
+			}
+			if len(levels) < 1 {
+				return errParquet
+			}
+			for run := int(h >> 1); run > 0 && i < count; run-- {
+				defined[i] = levels[0] == 1
+				i++
+			}
+			levels = levels[1:]
+		}
+	}
+
+	for _, ok := range defined {
+		if !ok {
+			c.values = append(c.values, nil)
+			continue
+		}
+		var size int
+		switch c.typ {
+		case pqInt32:
+			size = 4
+		case pqInt64, pqDouble:
+			size = 8
+		case pqByteArray:
+			if len(body) < 4 {
+				return errParquet
+			}
+			size = int(binary.LittleEndian.Uint32(body))
+			body = body[4:]
+		default:
+			return fmt.Errorf("unsupported type %d", c.typ)
+		}
+		if size > len(body) {
+			return errParquet
+		}
+		// Non-nil even when empty, so empty strings aren't nulls.
+		c.values = append(c.values, append([]byte{}, body[:size]...))
+		body = body[size:]
+	}
+	return nil
+}
+
+//////////////////////////////////////////////////
+// Thrift Compact Protocol
+//////////////////////////////////////////////////
+
+// Just enough of the Thrift compact protocol for Parquet metadata.
+const (
+	thriftTrue   = 1
+	thriftFalse  = 2
+	thriftByte   = 3
+	thriftI16    = 4
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftDouble = 7
+	thriftBinary = 8
+	thriftList   = 9
+	thriftSet    = 10
+	thriftMap    = 11
+	thriftStruct = 12
+)
+
+type thriftWriter struct {
+	b     []byte
+	last  []int16 // last field ID per open struct, innermost last
+	field int16
+}
+
+func (w *thriftWriter) header(id int16, typ byte) {
+	if delta := id - w.field; delta > 0 && delta <= 15 {
+		w.b = append(w.b, byte(delta)<<4|typ)
+	} else {
+		w.b = append(w.b, typ)
+		w.b = binary.AppendVarint(w.b, int64(id))
+	}
+	w.field = id
+}
+
+func (w *thriftWriter) i32(id int16, v int32) {
+	w.header(id, thriftI32)
+	w.b = binary.AppendVarint(w.b, int64(v))
+}
+
+func (w *thriftWriter) i64(id int16, v int64) {
+	w.header(id, thriftI64)
+	w.b = binary.AppendVarint(w.b, v)
+}
+
+func (w *thriftWriter) str(id int16, s string) {
+	w.header(id, thriftBinary)
+	w.b = binary.AppendUvarint(w.b, uint64(len(s)))
+	w.b = append(w.b, s...)
+}
+
+func (w *thriftWriter) listBegin(id int16, elem byte, n int) {
+	w.header(id, thriftList)
+	if n < 15 {
+		w.b = append(w.b, byte(n)<<4|elem)
+	} else {
+		w.b = append(w.b, 0xf0|elem)
+		w.b = binary.AppendUvarint(w.b, uint64(n))
+	}
+}
+
+func (w *thriftWriter) listI32(id int16, vs []int32) {
+	w.listBegin(id, thriftI32, len(vs))
+	for _, v := range vs {
+		w.b = binary.AppendVarint(w.b, int64(v))
+	}
+}
+
+func (w *thriftWriter) listString(id int16, vs []string) {
+	w.listBegin(id, thriftBinary, len(vs))
+	for _, s := range vs {
+		w.b = binary.AppendUvarint(w.b, uint64(len(s)))
+		w.b = append(w.b, s...)
+	}
+}
+
+func (w *thriftWriter) beginStruct(id int16) {
+	w.header(id, thriftStruct)
+	w.last = append(w.last, w.field)
+	w.field = 0
+}
+
+// endStruct closes a struct opened with beginStruct.
+func (w *thriftWriter) endStruct() {
+	w.stop()
+	w.endStructNoStop()
+}
+
+// endStructNoStop restores the enclosing struct's field ID after a nested
+// struct whose fields, including the stop byte, were appended with raw.
+func (w *thriftWriter) endStructNoStop() {
+	w.field = w.last[len(w.last)-1]
+	w.last = w.last[:len(w.last)-1]
+}
+
+// raw appends an encoded list element or struct body.
+func (w *thriftWriter) raw(b []byte) { w.b = append(w.b, b...) }
+
+func (w *thriftWriter) stop() { w.b = append(w.b, 0) }
+
+// thriftFields is a decoded struct: field ID to value, where values are
+// int64, float64, bool, []byte, []any or thriftFields.
+type thriftFields map[int16]any
+
+func (f thriftFields) int(id int16) int64 {
+	v, _ := f[id].(int64)
+	return v
+}
+
+func (f thriftFields) bytes(id int16) []byte {
+	v, _ := f[id].([]byte)
+	return v
+}
+
+func (f thriftFields) list(id int16) []any {
+	v, _ := f[id].([]any)
+	return v
+}
+
+func (f thriftFields) strct(id int16) thriftFields {
+	v, _ := f[id].(thriftFields)
+	return v
+}
+
+func readThriftStruct(b []byte) (thriftFields, error) {
+	f, _, err := readThriftStructLen(b)
+	return f, err
+}
+
+// readThriftStructLen decodes a struct and returns the bytes it took.
+func readThriftStructLen(b []byte) (thriftFields, int, error) {
+	r := thriftReader{b: b}
+	f := r.readStruct()
+	return f, r.pos, r.err
+}
+
+type thriftReader struct {
+	b   []byte
+	pos int
+	err error
+}
+
+var errThrift = errors.New("malformed thrift data")
+
+func (r *thriftReader) byte() byte {
+	if r.err != nil || r.pos >= len(r.b) {
+		r.err = errThrift
+		return 0
+	}
+	c := r.b[r.pos]
+	r.pos++
+	return c
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.b[r.pos:])
+	if n <= 0 {
+		r.err = errThrift
+		return 0
+	}
+	r.pos += n
+	return v
+}
+
+func (r *thriftReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.b[r.pos:])
+	if n <= 0 {
+		r.err = errThrift
+		return 0
+	}
+	r.pos += n
+	return v
+}
+
+func (r *thriftReader) readStruct() thriftFields {
+	f := thriftFields{}
+	var id int16
+	for r.err == nil {
+		h := r.byte()
+		if h == 0 {
+			break
+		}
+		typ := h & 0x0f
+		if delta := int16(h >> 4); delta != 0 {
+			id += delta
+		} else {
+			id = int16(r.varint())
+		}
+		switch typ {
+		case thriftTrue:
+			f[id] = true
+		case thriftFalse:
+			f[id] = false
+		default:
+			f[id] = r.readValue(typ)
+		}
+	}
+	return f
+}
+
+func (r *thriftReader) readValue(typ byte) any {
+	switch typ {
+	case thriftTrue, thriftFalse: // only inside lists, where bools are a byte
+		return r.byte() == thriftTrue
+	case thriftByte:
+		return int64(int8(r.byte()))
+	case thriftI16, thriftI32, thriftI64:
+		return r.varint()
+	case thriftDouble:
+		if r.pos+8 > len(r.b) {
+			r.err = errThrift
+			return 0.0
+		}
+		v := math.Float64frombits(binary.LittleEndian.Uint64(r.b[r.pos:]))
+		r.pos += 8
+		return v
+	case thriftBinary:
+		n := int(r.uvarint())
+		if r.err != nil || n < 0 || r.pos+n > len(r.b) {
+			r.err = errThrift
+			return []byte(nil)
+		}
+		v := r.b[r.pos : r.pos+n]
+		r.pos += n
+		return v
+	case thriftList, thriftSet:
+		h := r.byte()
+		n := int(h >> 4)
+		if n == 15 {
+			n = int(r.uvarint())
+		}
+		if r.err != nil || n > len(r.b) {
+			r.err = errThrift
+			return []any(nil)
+		}
+		items := make([]any, 0, n)
+		for i := 0; i < n && r.err == nil; i++ {
+			items = append(items, r.readValue(h&0x0f))
+		}
+		return items
+	case thriftMap:
+		n := int(r.uvarint())
+		if n == 0 {
+			return nil
+		}
+		kv := r.byte()
+		for i := 0; i < n && r.err == nil; i++ {
+			r.readValue(kv >> 4)
+			r.readValue(kv & 0x0f)
+		}
+		return nil
+	case thriftStruct:
+		return r.readStruct()
+	default:
+		r.err = errThrift
+		return nil
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+//////////////////////////////////////////////////
+// MessagePack Payload
+//////////////////////////////////////////////////
+
+const contentTypeMsgpack = "application/msgpack"
+
+// appendBatchMsgpack appends a batch encoded as a MessagePack array of maps
+// with the same keys as the JSON encoding, omitting the same empty fields.
+func appendBatchMsgpack(b []byte, data []DeviceData) []byte {
+	b = slices.Grow(b, len(data)*128)
+	b = msgp.AppendArrayHeader(b, uint32(len(data)))
+	for _, d := range data {
+		fields := uint32(4)
+		for _, set := range []bool{d.Metric != "", d.Device != "", len(d.Labels) > 0} {
+			if set {
+				fields++
+			}
+		}
+		b = msgp.AppendMapHeader(b, fields)
+		b = msgp.AppendString(b, "name")
+		b = msgp.AppendString(b, d.Name)
+		b = msgp.AppendString(b, "cpu_number")
+		b = msgp.AppendString(b, d.CPUNumber)
+		b = msgp.AppendString(b, "timestamp")
+		b = msgp.AppendUint64(b, d.Timestamp)
+		b = msgp.AppendString(b, "indicators")
+		b = msgp.AppendArrayHeader(b, uint32(len(d.Indicators)))
+		for _, ind := range d.Indicators {
+			b = msgp.AppendMapHeader(b, 2)
+			b = msgp.AppendString(b, "name")
+			b = msgp.AppendString(b, ind.Name)
+			b = msgp.AppendString(b, "value")
+			b = msgp.AppendFloat64(b, ind.Value)
+		}
+		if d.Metric != "" {
+			b = msgp.AppendString(b, "metric")
+			b = msgp.AppendString(b, d.Metric)
+		}
+		if d.Device != "" {
+			b = msgp.AppendString(b, "device")
+			b = msgp.AppendString(b, d.Device)
+		}
+		if len(d.Labels) > 0 {
+			b = msgp.AppendString(b, "labels")
+			b = msgp.AppendMapStrStr(b, d.Labels)
+		}
+	}
+	return b
+}
+
+// unmarshalBatchMsgpack decodes what appendBatchMsgpack encodes. Unknown
+// keys are skipped.
+func unmarshalBatchMsgpack(b []byte) ([]DeviceData, error) {
+	n, b, err := msgp.ReadArrayHeaderBytes(b)
+	if err != nil {
+		return nil, fmt.Errorf("msgpack batch: %w", err)
+	}
+	data := make([]DeviceData, n)
+	for i := range data {
+		if b, err = readMsgpackRecord(b, &data[i]); err != nil {
+			return nil, fmt.Errorf("msgpack record %d: %w", i, err)
+		}
+	}
+	return data, nil
+}
+
+func readMsgpackRecord(b []byte, d *DeviceData) ([]byte, error) {
+	fields, b, err := msgp.ReadMapHeaderBytes(b)
+	if err != nil {
+		return nil, err
+	}
+	for ; fields > 0; fields-- {
+		var key string
+		if key, b, err = msgp.ReadStringBytes(b); err != nil {
+			return nil, err
+		}
+		switch key {
+		case "name":
+			d.Name, b, err = msgp.ReadStringBytes(b)
+		case "cpu_number":
+			d.CPUNumber, b, err = msgp.ReadStringBytes(b)
+		case "timestamp":
+			d.Timestamp, b, err = msgp.ReadUint64Bytes(b)
+		case "metric":
+			d.Metric, b, err = msgp.ReadStringBytes(b)
+		case "device":
+			d.Device, b, err = msgp.ReadStringBytes(b)
+		case "indicators":
+			b, err = readMsgpackIndicators(b, d)
+		case "labels":
+			var n uint32
+			if n, b, err = msgp.ReadMapHeaderBytes(b); err != nil {
+				return nil, err
+			}
+			d.Labels = make(map[string]string, n)
+			for ; n > 0 && err == nil; n-- {
+				var k, v string
+				if k, b, err = msgp.ReadStringBytes(b); err == nil {
+					v, b, err = msgp.ReadStringBytes(b)
+					d.Labels[k] = v
+				}
+			}
+		default:
+			b, err = msgp.Skip(b)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return b, nil
+}
+
+func readMsgpackIndicators(b []byte, d *DeviceData) ([]byte, error) {
+	n, b, err := msgp.ReadArrayHeaderBytes(b)
+	if err != nil || n == 0 {
+		return b, err
+	}
+	d.Indicators = make([]Indicator, n)
+	for i := range d.Indicators {
+		var fields uint32
+		if fields, b, err = msgp.ReadMapHeaderBytes(b); err != nil {
+			return nil, err
+		}
+		for ; fields > 0; fields-- {
+			var key string
+			if key, b, err = msgp.ReadStringBytes(b); err != nil {
+				return nil, err
+			}
+			switch key {
+			case "name":
+				d.Indicators[i].Name, b, err = msgp.ReadStringBytes(b)
+			case "value":
+				d.Indicators[i].Value, b, err = msgp.ReadFloat64Bytes(b)
+			default:
+				b, err = msgp.Skip(b)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return b, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"slices"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+//////////////////////////////////////////////////
+// Protobuf Load Payload
+//////////////////////////////////////////////////
+
+const contentTypeProtobuf = "application/x-protobuf"
+
+// appendBatchProto appends a batch encoded as the DeviceDataBatch message of
+// proto/device_data.proto. Fields holding their zero value are left out, as
+// proto3 does.
+func appendBatchProto(buf []byte, data []DeviceData) []byte {
+	buf = slices.Grow(buf, len(data)*128)
+	var rec, sub []byte
+	for _, d := range data {
+		rec = rec[:0]
+		rec = appendProtoString(rec, 1, d.Name)
+		rec = appendProtoString(rec, 2, d.CPUNumber)
+		if d.Timestamp != 0 {
+			rec = protowire.AppendTag(rec, 3, protowire.VarintType)
+			rec = protowire.AppendVarint(rec, d.Timestamp)
+		}
+		for _, ind := range d.Indicators {
+			sub = sub[:0]
+			sub = appendProtoString(sub, 1, ind.Name)
+			if ind.Value != 0 {
+				sub = protowire.AppendTag(sub, 2, protowire.Fixed64Type)
+				sub = protowire.AppendFixed64(sub, math.Float64bits(ind.Value))
+			}
+			rec = protowire.AppendTag(rec, 4, protowire.BytesType)
+			rec = protowire.AppendBytes(rec, sub)
+		}
+		rec = appendProtoString(rec, 5, d.Metric)
+		rec = appendProtoString(rec, 6, d.Device)
+		// Map entries are sorted so equal batches encode identically.
+		keys := make([]string, 0, len(d.Labels))
+		for k := range d.Labels {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			sub = sub[:0]
+			sub = appendProtoString(sub, 1, k)
+			sub = appendProtoString(sub, 2, d.Labels[k])
+			rec = protowire.AppendTag(rec, 7, protowire.BytesType)
+			rec = protowire.AppendBytes(rec, sub)
+		}
+
+		buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, rec)
+	}
+	return buf
+}
+
+func appendProtoString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// walkProto calls fn for every field of a message, with the bytes of
+// length-delimited fields or the number of varint and fixed-size fields.
+func walkProto(b []byte, fn func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var v []byte
+		var x uint64
+		switch typ {
+		case protowire.BytesType:
+			v, n = protowire.ConsumeBytes(b)
+		case protowire.VarintType:
+			x, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			x, n = protowire.ConsumeFixed64(b)
+		case protowire.Fixed32Type:
+			var x32 uint32
+			x32, n = protowire.ConsumeFixed32(b)
+			x = uint64(x32)
+		default:
+			return errors.New("unsupported wire type")
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if err := fn(num, typ, v, x); err != nil {
+			return err
+		}
+	}
+	return nil
+}
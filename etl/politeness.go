@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// Per-Appliance Politeness
+//////////////////////////////////////////////////
+
+type PolitenessConfig struct {
+	// PerHost and PerSubnet cap concurrent extracts per appliance IP and
+	// per subnet; 0 means no limit.
+	PerHost   int `yaml:"per_host" json:"per_host"`
+	PerSubnet int `yaml:"per_subnet" json:"per_subnet"`
+	// SubnetBits and SubnetBitsV6 are the prefix lengths that group IPv4
+	// and IPv6 addresses into subnets.
+	SubnetBits   int `yaml:"subnet_bits" json:"subnet_bits"`
+	SubnetBitsV6 int `yaml:"subnet_bits_v6" json:"subnet_bits_v6"`
+	// MinInterval is the minimum time between the starts of two requests
+	// to the same appliance IP.
+	MinInterval Duration `yaml:"min_interval" json:"min_interval"`
+}
+
+func defaultPolitenessConfig() PolitenessConfig {
+	return PolitenessConfig{
+		SubnetBits:   24,
+		SubnetBitsV6: 64,
+	}
+}
+
+func (p *PolitenessConfig) validate() []error {
+	var errs []error
+	if p.PerHost < 0 || p.PerSubnet < 0 {
+		errs = append(errs, errors.New("extract.politeness per_host and per_subnet must be >= 0"))
+	}
+	if p.SubnetBits < 0 || p.SubnetBits > 32 {
+		errs = append(errs, fmt.Errorf("extract.politeness.subnet_bits must be within [0, 32], got %d", p.SubnetBits))
+	}
+	if p.SubnetBitsV6 < 0 || p.SubnetBitsV6 > 128 {
+		errs = append(errs, fmt.Errorf("extract.politeness.subnet_bits_v6 must be within [0, 128], got %d", p.SubnetBitsV6))
+	}
+	if p.MinInterval < 0 {
+		errs = append(errs, errors.New("extract.politeness.min_interval must be >= 0"))
+	}
+	return errs
+}
+
+func (p *PolitenessConfig) enabled() bool {
+	return p.PerHost > 0 || p.PerSubnet > 0 || p.MinInterval > 0
+}
+
+type politeGate struct {
+	inUse     int
+	nextStart time.Time
+}
+
+// Politeness keeps the extract scheduler from overwhelming fragile
+// appliances: it bounds concurrent extracts per host and per subnet, and
+// spaces out the requests sent to each host. It lives across daemon runs,
+// so spacing also holds from one run to the next.
+type Politeness struct {
+	conf PolitenessConfig
+
+	mu      sync.Mutex
+	hosts   map[string]*politeGate
+	subnets map[string]*politeGate
+	changed chan struct{} // closed and replaced on every release
+}
+
+// politeness is nil unless a limit is configured.
+var politeness *Politeness
+
+func newPoliteness(conf PolitenessConfig) *Politeness {
+	return &Politeness{
+		conf:    conf,
+		hosts:   map[string]*politeGate{},
+		subnets: map[string]*politeGate{},
+		changed: make(chan struct{}),
+	}
+}
+
+// subnet returns the subnet ap belongs to. Addresses that don't parse,
+// such as host names, are a subnet of their own.
+func (p *Politeness) subnet(ap Appliance) string {
+	addr, err := netip.ParseAddr(ap.IP)
+	if err != nil {
+		return ap.IP
+	}
+	bits := p.conf.SubnetBits
+	if addr.Is6() && !addr.Is4In6() {
+		bits = p.conf.SubnetBitsV6
+	}
+	prefix, _ := addr.Unmap().Prefix(bits)
+	return prefix.String()
+}
+
+func gateOf(gates map[string]*politeGate, key string) *politeGate {
+	g, ok := gates[key]
+	if !ok {
+		g = &politeGate{}
+		gates[key] = g
+	}
+	return g
+}
+
+// Acquire waits until ap's host and subnet are below their concurrency
+// limits and takes a slot in both. The returned func gives them back.
+func (p *Politeness) Acquire(ctx context.Context, ap Appliance) (release func(), err error) {
+	subnet := p.subnet(ap)
+	for {
+		p.mu.Lock()
+		host, sub := gateOf(p.hosts, ap.IP), gateOf(p.subnets, subnet)
+		if (p.conf.PerHost == 0 || host.inUse < p.conf.PerHost) && (p.conf.PerSubnet == 0 || sub.inUse < p.conf.PerSubnet) {
+			host.inUse++
+			sub.inUse++
+			p.mu.Unlock()
+			return func() {
+				p.mu.Lock()
+				defer p.mu.Unlock()
+				host.inUse--
+				sub.inUse--
+				close(p.changed)
+				p.changed = make(chan struct{})
+			}, nil
+		}
+		changed := p.changed
+		p.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Space waits until a request to ap may start, so that request starts to
+// one host are at least min_interval apart, and books the next start.
+func (p *Politeness) Space(ctx context.Context, ap Appliance) error {
+	if p.conf.MinInterval == 0 {
+		return nil
+	}
+	p.mu.Lock()
+	host := gateOf(p.hosts, ap.IP)
+	start := time.Now()
+	if host.nextStart.After(start) {
+		start = host.nextStart
+	}
+	host.nextStart = start.Add(p.conf.MinInterval.Std())
+	p.mu.Unlock()
+
+	wait := time.Until(start)
+	if wait <= 0 {
+		return nil
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
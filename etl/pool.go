@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// Adaptive Extract Pool
+//////////////////////////////////////////////////
+
+type AutoscaleConfig struct {
+	Enabled          bool     `yaml:"enabled" json:"enabled"`
+	MinWorkers       int      `yaml:"min_workers" json:"min_workers"`
+	MaxWorkers       int      `yaml:"max_workers" json:"max_workers"`
+	Interval         Duration `yaml:"interval" json:"interval"`
+	Step             int      `yaml:"step" json:"step"`
+	TargetLatency    Duration `yaml:"target_latency" json:"target_latency"`
+	MaxErrorRate     float64  `yaml:"max_error_rate" json:"max_error_rate"`
+	BackpressureHigh float64  `yaml:"backpressure_high" json:"backpressure_high"`
+}
+
+func defaultAutoscaleConfig() AutoscaleConfig {
+	return AutoscaleConfig{
+		MinWorkers:       50,
+		MaxWorkers:       2000,
+		Interval:         Duration(5 * time.Second),
+		Step:             50,
+		TargetLatency:    Duration(7 * time.Second),
+		MaxErrorRate:     0.2,
+		BackpressureHigh: 0.8,
+	}
+}
+
+func (a *AutoscaleConfig) validate(initial int) []error {
+	if !a.Enabled {
+		return nil
+	}
+	var errs []error
+	if a.MinWorkers <= 0 || a.MaxWorkers < a.MinWorkers {
+		errs = append(errs, fmt.Errorf("extract.autoscale needs 0 < min_workers <= max_workers, got %d..%d", a.MinWorkers, a.MaxWorkers))
+	}
+	if initial < a.MinWorkers || initial > a.MaxWorkers {
+		errs = append(errs, fmt.Errorf("extract.workers (%d) must lie within extract.autoscale min/max", initial))
+	}
+	if a.Interval <= 0 {
+		errs = append(errs, errors.New("extract.autoscale.interval must be > 0"))
+	}
+	if a.Step <= 0 {
+		errs = append(errs, errors.New("extract.autoscale.step must be > 0"))
+	}
+	if a.MaxErrorRate < 0 || a.MaxErrorRate > 1 {
+		errs = append(errs, errors.New("extract.autoscale.max_error_rate must be within [0, 1]"))
+	}
+	if a.BackpressureHigh <= 0 || a.BackpressureHigh > 1 {
+		errs = append(errs, errors.New("extract.autoscale.backpressure_high must be within (0, 1]"))
+	}
+	return errs
+}
+
+// ExtractPool bounds extract concurrency. The limit is fixed unless the
+// autoscaler is running, in which case it moves between min and max.
+type ExtractPool struct {
+	mu    sync.Mutex
+	limit int
+	inUse int
+	wake  chan struct{}
+
+	// Observations since the last autoscale tick.
+	completed  int
+	failed     int
+	latencySum time.Duration
+}
+
+func newExtractPool(limit int) *ExtractPool {
+	return &ExtractPool{limit: limit, wake: make(chan struct{})}
+}
+
+// Acquire blocks until a slot is free or ctx is done.
+func (p *ExtractPool) Acquire(ctx context.Context) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		p.mu.Lock()
+		if p.inUse < p.limit {
+			p.inUse++
+			p.mu.Unlock()
+			return nil
+		}
+		wake := p.wake
+		p.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (p *ExtractPool) Release() {
+	p.mu.Lock()
+	p.inUse--
+	p.broadcast()
+	p.mu.Unlock()
+}
+
+// Observe records the outcome of one extract for the autoscaler.
+func (p *ExtractPool) Observe(latency time.Duration, err error) {
+	p.mu.Lock()
+	p.completed++
+	p.latencySum += latency
+	if err != nil {
+		p.failed++
+	}
+	p.mu.Unlock()
+}
+
+func (p *ExtractPool) Limit() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.limit
+}
+
+// InUse returns the number of extracts currently holding a slot.
+func (p *ExtractPool) InUse() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.inUse
+}
+
+// broadcast wakes every waiter; callers must hold p.mu.
+func (p *ExtractPool) broadcast() {
+	close(p.wake)
+	p.wake = make(chan struct{})
+}
+
+// Autoscale adjusts the limit every interval until ctx is done, using
+// additive increase / multiplicative decrease: back off by a quarter when
+// extracts are slow or failing or the load queues are backing up, and grow
+// by Step when the pool is saturated and everything downstream is healthy.
+func (p *ExtractPool) Autoscale(ctx context.Context, conf AutoscaleConfig, backpressure func() float64) {
+	ticker := time.NewTicker(conf.Interval.Std())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		queueFill := backpressure()
+
+		p.mu.Lock()
+		var avgLatency time.Duration
+		var errorRate float64
+		if p.completed > 0 {
+			avgLatency = p.latencySum / time.Duration(p.completed)
+			errorRate = float64(p.failed) / float64(p.completed)
+		}
+		saturated := p.inUse >= p.limit*9/10
+		old := p.limit
+
+		var reason string
+		switch {
+		case queueFill >= conf.BackpressureHigh:
+			reason = "backpressure"
+		case p.completed > 0 && errorRate > conf.MaxErrorRate:
+			reason = "error_rate"
+		case p.completed > 0 && conf.TargetLatency > 0 && avgLatency > conf.TargetLatency.Std():
+			reason = "latency"
+		}
+		if reason != "" {
+			p.limit = max(conf.MinWorkers, p.limit*3/4)
+		} else if saturated {
+			p.limit = min(conf.MaxWorkers, p.limit+conf.Step)
+			reason = "saturated"
+		}
+		if p.limit > old {
+			p.broadcast()
+		}
+
+		p.completed, p.failed, p.latencySum = 0, 0, 0
+		limit := p.limit
+		p.mu.Unlock()
+
+		if limit != old {
+			slog.Info("Extract pool resized", "component", "autoscale", "from", old, "to", limit, "reason", reason,
+				"avg_latency_ms", avgLatency.Milliseconds(), "error_rate", errorRate, "queue_fill", queueFill)
+		}
+	}
+}
+
+// queueFill is the fraction of total load channel capacity in use, or with
+// load.backpressure on, its fill of the same capacity.
+func queueFill() float64 {
+	if backpressure != nil {
+		return backpressure.Fill()
+	}
+	var used, capacity int
+	for _, ch := range slices.Concat(dataChan, urgentChan) {
+		used += len(ch)
+		capacity += cap(ch)
+	}
+	if capacity == 0 {
+		return 0
+	}
+	return float64(used) / float64(capacity)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+//////////////////////////////////////////////////
+// Appliance Priority
+//////////////////////////////////////////////////
+
+// Priority orders appliances within a run: high ones are dispatched first
+// and their records go to the loaders ahead of the others, low ones last.
+// A run cut short then has the critical devices loaded.
+type Priority int
+
+const (
+	priorityHigh   Priority = -1
+	priorityNormal Priority = 0
+	priorityLow    Priority = 1
+)
+
+func (p Priority) String() string {
+	switch p {
+	case priorityHigh:
+		return "high"
+	case priorityLow:
+		return "low"
+	default:
+		return "normal"
+	}
+}
+
+// parsePriority reads the CSV's fourth column; empty is normal.
+func parsePriority(s string) (Priority, error) {
+	switch strings.ToLower(s) {
+	case "high":
+		return priorityHigh, nil
+	case "", "normal":
+		return priorityNormal, nil
+	case "low":
+		return priorityLow, nil
+	}
+	return priorityNormal, fmt.Errorf("unknown priority %q (want high, normal or low)", s)
+}
+
+// PriorityConfig sets the priority of the appliances whose host name or IP
+// matches one of the glob patterns, such as "core-*" or "10.0.1.*". A
+// priority in the CSV wins over these.
+type PriorityConfig struct {
+	High []string `yaml:"high" json:"high"`
+	Low  []string `yaml:"low" json:"low"`
+}
+
+func (p *PriorityConfig) validate() []error {
+	var errs []error
+	for _, pattern := range slices.Concat(p.High, p.Low) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("extract.priority: bad pattern %q: %w", pattern, err))
+		}
+	}
+	return errs
+}
+
+// of is the priority the patterns give an appliance; high wins if both
+// match.
+func (p *PriorityConfig) of(ap Appliance) Priority {
+	matches := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, ap.HostName); ok {
+				return true
+			}
+			if ok, _ := path.Match(pattern, ap.IP); ok {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case matches(p.High):
+		return priorityHigh
+	case matches(p.Low):
+		return priorityLow
+	}
+	return priorityNormal
+}
+
+// byPriority returns the appliances in dispatch order, high first and in
+// CSV order within a class.
+func byPriority(appliances []Appliance) []Appliance {
+	sorted := slices.Clone(appliances)
+	slices.SortStableFunc(sorted, func(a, b Appliance) int {
+		return int(a.Priority - b.Priority)
+	})
+	return sorted
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// Terminal Progress
+//////////////////////////////////////////////////
+
+// progressInterval is how often the progress line is redrawn.
+const progressInterval = 500 * time.Millisecond
+
+// progressEnabled reports whether runs draw a progress line on stderr: with
+// progress: auto, only for one-shot runs on a terminal, since a daemon's
+// stderr usually ends up in a log collector.
+func progressEnabled(c *Config) bool {
+	switch c.Progress {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	if c.Daemon.Enabled {
+		return false
+	}
+	fi, err := os.Stderr.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// startProgress redraws the progress of the run on w until the returned
+// function is called, which draws it a last time and ends the line.
+func startProgress(w io.Writer, stats *RunStats, started time.Time) (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fmt.Fprintf(w, "\r\033[K%s", progressLine(stats.Summary(), time.Since(started)))
+			case <-done:
+				fmt.Fprintf(w, "\r\033[K%s\n", progressLine(stats.Summary(), time.Since(started)))
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+// progressLine renders a summary as one line, e.g.
+//
+//	appliances 120/500 (3 failed, 377 pending) | 42.1/s | batches 35 loaded, 2 spilled | 2.9s, ETA 9s
+func progressLine(sum RunSummary, elapsed time.Duration) string {
+	failed := sum.ExtractFailed + sum.TransformFailed
+	completed := sum.Extracted - sum.TransformFailed
+	finished := completed + failed + sum.ExtractCancelled + sum.AlreadyDone
+	pending := max(sum.Appliances-finished, 0)
+
+	line := fmt.Sprintf("appliances %d/%d (%d failed, %d pending)", completed, sum.Appliances, failed, pending)
+	var rate float64
+	if elapsed > 0 {
+		rate = float64(sum.Extracted+sum.ExtractFailed) / elapsed.Seconds()
+	}
+	line += fmt.Sprintf(" | %.1f/s | batches %d loaded", rate, sum.BatchesLoaded)
+	if sum.BatchesSpilled > 0 {
+		line += fmt.Sprintf(", %d spilled", sum.BatchesSpilled)
+	}
+	if sum.BatchesDeadLettered > 0 {
+		line += fmt.Sprintf(", %d dead-lettered", sum.BatchesDeadLettered)
+	}
+	line += " | " + elapsed.Round(100*time.Millisecond).String()
+	if pending > 0 && rate > 0 {
+		eta := time.Duration(float64(pending) / rate * float64(time.Second))
+		line += ", ETA " + eta.Round(time.Second).String()
+	}
+	return line
+}
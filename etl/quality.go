@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// Data Quality Checks
+//////////////////////////////////////////////////
+
+// QualityConfig holds sanity checks run on every record after the transform
+// chain. Each check has an action for the records failing it:
+//
+//   - fix: repair the record and load it
+//   - drop: don't load it
+//   - quarantine: don't load it, and append it to QuarantineFile
+//   - fail_run: stop dispatching and fail the run
+//
+// A record failing several checks gets the strictest of their actions.
+type QualityConfig struct {
+	Enabled        bool                   `yaml:"enabled" json:"enabled"`
+	Utilization    UtilizationCheckConfig `yaml:"utilization" json:"utilization"`
+	Timestamp      TimestampCheckConfig   `yaml:"timestamp" json:"timestamp"`
+	Hostname       HostnameCheckConfig    `yaml:"hostname" json:"hostname"`
+	QuarantineFile string                 `yaml:"quarantine_file" json:"quarantine_file"`
+}
+
+// UtilizationCheckConfig checks that percentage indicators are within
+// 0–100. fix clamps them; a value that isn't a number can't be fixed and is
+// dropped.
+type UtilizationCheckConfig struct {
+	Enabled    bool     `yaml:"enabled" json:"enabled"`
+	Action     string   `yaml:"action" json:"action"`
+	Indicators []string `yaml:"indicators" json:"indicators"`
+}
+
+// TimestampCheckConfig checks that record timestamps aren't more than
+// MaxSkew in the future, as when an appliance's clock is off. fix sets them
+// to the time of the check.
+type TimestampCheckConfig struct {
+	Enabled bool     `yaml:"enabled" json:"enabled"`
+	Action  string   `yaml:"action" json:"action"`
+	MaxSkew Duration `yaml:"max_skew" json:"max_skew"`
+}
+
+// HostnameCheckConfig checks that records have a name. fix uses the host
+// name of the appliance they came from.
+type HostnameCheckConfig struct {
+	Enabled bool   `yaml:"enabled" json:"enabled"`
+	Action  string `yaml:"action" json:"action"`
+}
+
+func defaultQualityConfig() QualityConfig {
+	return QualityConfig{
+		Utilization:    UtilizationCheckConfig{Enabled: true, Action: qualityFix, Indicators: []string{"utilization"}},
+		Timestamp:      TimestampCheckConfig{Enabled: true, Action: qualityFix, MaxSkew: Duration(5 * time.Minute)},
+		Hostname:       HostnameCheckConfig{Enabled: true, Action: qualityFix},
+		QuarantineFile: "quarantine.jsonl",
+	}
+}
+
+// Actions on records failing a check, from the most lenient.
+const (
+	qualityFix        = "fix"
+	qualityDrop       = "drop"
+	qualityQuarantine = "quarantine"
+	qualityFailRun    = "fail_run"
+)
+
+var qualityActions = []string{qualityFix, qualityDrop, qualityQuarantine, qualityFailRun}
+
+// Names of the checks, as counted in the run summary and report.
+const (
+	checkUtilization = "utilization"
+	checkTimestamp   = "timestamp"
+	checkHostname    = "hostname"
+)
+
+func (q *QualityConfig) validate() []error {
+	if !q.Enabled {
+		return nil
+	}
+	var errs []error
+	action := func(check, action string) {
+		if !slices.Contains(qualityActions, action) {
+			errs = append(errs, fmt.Errorf("quality.%s.action must be one of %s, got %q", check, strings.Join(qualityActions, ", "), action))
+		}
+		if action == qualityQuarantine && q.QuarantineFile == "" {
+			errs = append(errs, fmt.Errorf("quality.quarantine_file must be set when quality.%s.action is quarantine", check))
+		}
+	}
+	if q.Utilization.Enabled {
+		action(checkUtilization, q.Utilization.Action)
+		if len(q.Utilization.Indicators) == 0 {
+			errs = append(errs, errors.New("quality.utilization.indicators must list at least one indicator"))
+		}
+	}
+	if q.Timestamp.Enabled {
+		action(checkTimestamp, q.Timestamp.Action)
+		if q.Timestamp.MaxSkew < 0 {
+			errs = append(errs, errors.New("quality.timestamp.max_skew must be >= 0"))
+		}
+	}
+	if q.Hostname.Enabled {
+		action(checkHostname, q.Hostname.Action)
+	}
+	return errs
+}
+
+// checks returns the enabled checks by name, with their action.
+func (q QualityConfig) checks() map[string]string {
+	checks := make(map[string]string, 3)
+	if q.Utilization.Enabled {
+		checks[checkUtilization] = q.Utilization.Action
+	}
+	if q.Timestamp.Enabled {
+		checks[checkTimestamp] = q.Timestamp.Action
+	}
+	if q.Hostname.Enabled {
+		checks[checkHostname] = q.Hostname.Action
+	}
+	return checks
+}
+
+// QualityError fails a run on a record that failed a fail_run check.
+type QualityError struct {
+	Check     string
+	Appliance string
+	Problem   string
+}
+
+func (e *QualityError) Error() string {
+	return fmt.Sprintf("data quality check %s failed on %s: %s", e.Check, e.Appliance, e.Problem)
+}
+
+// QualityChecker runs the checks. It is safe for concurrent use by the
+// extract workers.
+type QualityChecker struct {
+	conf       QualityConfig
+	actions    map[string]string // by enabled check
+	quarantine *rejectLog        // nil unless a check quarantines
+
+	// failRun cancels the run in progress, once failing is set; both are
+	// reset by startRun.
+	failRun atomic.Pointer[context.CancelCauseFunc]
+	failing atomic.Bool
+}
+
+// quality is nil unless quality checks are enabled.
+var quality *QualityChecker
+
+func newQualityChecker(conf QualityConfig) (*QualityChecker, error) {
+	q := &QualityChecker{conf: conf, actions: conf.checks()}
+	for _, action := range q.actions {
+		if action == qualityQuarantine && q.quarantine == nil {
+			var err error
+			if q.quarantine, err = openRejectLog(conf.QuarantineFile); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return q, nil
+}
+
+func (q *QualityChecker) Close() error {
+	if q == nil || q.quarantine == nil {
+		return nil
+	}
+	return q.quarantine.Close()
+}
+
+// startRun makes a fail_run check cancel the run with fail.
+func (q *QualityChecker) startRun(fail context.CancelCauseFunc) {
+	if q != nil {
+		q.failRun.Store(&fail)
+		q.failing.Store(false)
+	}
+}
+
+// qualityProblem is a check a record failed, and whether it could be fixed.
+type qualityProblem struct {
+	check   string
+	message string
+	fixable bool
+}
+
+// Check runs the checks on d, fixing it in place where that is the action,
+// and reports whether it is to be loaded. A nil checker passes everything.
+func (q *QualityChecker) Check(ap Appliance, d *DeviceData) bool {
+	if q == nil {
+		return true
+	}
+	problems := q.problems(ap, *d)
+	if len(problems) == 0 {
+		return true
+	}
+	report.update(ap.key(), func(a *ApplianceReport) { a.QualityFailed++ })
+
+	// The strictest action of the failed checks wins; a problem that can't
+	// be fixed is dropped.
+	action := qualityFix
+	for i, p := range problems {
+		// Records are counted once per check, whatever number of their
+		// indicators failed it.
+		if !slices.ContainsFunc(problems[:i], func(o qualityProblem) bool { return o.check == p.check }) {
+			runStats.QualityChecks[p.check].Add(1)
+		}
+		a := q.actions[p.check]
+		if a == qualityFix && !p.fixable {
+			a = qualityDrop
+		}
+		if slices.Index(qualityActions, a) > slices.Index(qualityActions, action) {
+			action = a
+		}
+	}
+	messages := make([]string, len(problems))
+	for i, p := range problems {
+		messages[i] = p.check + ": " + p.message
+	}
+	logger := slog.With("component", "quality", "appliance", ap.HostName, "action", action, "problems", strings.Join(messages, "; "))
+
+	switch action {
+	case qualityFix:
+		q.fix(ap, d, problems)
+		logger.Debug("Record fixed by quality checks")
+		return true
+	case qualityQuarantine:
+		body, _ := json.Marshal(d)
+		q.quarantine.write("quality", Reject{Time: time.Now().UTC(), RunID: runStats.RunID, Appliance: ap.HostName, IP: ap.IP,
+			Stage: "quality", Errors: messages, Record: body})
+		logger.Debug("Record quarantined by quality checks")
+	case qualityFailRun:
+		var failed qualityProblem
+		for _, p := range problems {
+			if q.actions[p.check] == qualityFailRun {
+				failed = p
+				break
+			}
+		}
+		// Records extracted before the run stopped fail it again.
+		if q.failing.Swap(true) {
+			logger.Debug("Data quality check failed, run already failing", "check", failed.check)
+			break
+		}
+		logger.Error("Data quality check failed, failing the run", "check", failed.check)
+		if fail := q.failRun.Load(); fail != nil {
+			(*fail)(&QualityError{Check: failed.check, Appliance: ap.HostName, Problem: failed.message})
+		}
+	default:
+		logger.Debug("Record dropped by quality checks")
+	}
+	return false
+}
+
+// problems returns the checks d fails.
+func (q *QualityChecker) problems(ap Appliance, d DeviceData) []qualityProblem {
+	var problems []qualityProblem
+	if c := q.conf.Utilization; c.Enabled {
+		for _, ind := range d.Indicators {
+			if !slices.Contains(c.Indicators, ind.Name) {
+				continue
+			}
+			switch {
+			case math.IsNaN(ind.Value) || math.IsInf(ind.Value, 0):
+				problems = append(problems, qualityProblem{checkUtilization, fmt.Sprintf("%s is %v", ind.Name, ind.Value), false})
+			case ind.Value < 0 || ind.Value > 100:
+				problems = append(problems, qualityProblem{checkUtilization, fmt.Sprintf("%s %v outside 0-100", ind.Name, ind.Value), true})
+			}
+		}
+	}
+	if c := q.conf.Timestamp; c.Enabled {
+		limit := time.Now().Add(c.MaxSkew.Std())
+		if ts := time.Unix(int64(d.Timestamp), 0); ts.After(limit) {
+			problems = append(problems, qualityProblem{checkTimestamp,
+				fmt.Sprintf("timestamp %s is %s in the future", ts.UTC().Format(time.RFC3339), time.Until(ts).Round(time.Second)), true})
+		}
+	}
+	if c := q.conf.Hostname; c.Enabled && strings.TrimSpace(d.Name) == "" {
+		problems = append(problems, qualityProblem{checkHostname, "name is empty", strings.TrimSpace(ap.HostName) != ""})
+	}
+	return problems
+}
+
+// fix repairs the problems of d, which are all fixable.
+func (q *QualityChecker) fix(ap Appliance, d *DeviceData, problems []qualityProblem) {
+	for _, p := range problems {
+		switch p.check {
+		case checkUtilization:
+			// Indicators may be shared with the stats the record was built
+			// from, so the fixed ones go into a copy.
+			d.Indicators = slices.Clone(d.Indicators)
+			for i, ind := range d.Indicators {
+				if slices.Contains(q.conf.Utilization.Indicators, ind.Name) {
+					d.Indicators[i].Value = min(max(ind.Value, 0), 100)
+				}
+			}
+		case checkTimestamp:
+			d.Timestamp = uint64(time.Now().Unix())
+		case checkHostname:
+			d.Name = ap.HostName
+		}
+	}
+}
+
+// qualityFailure returns the error of a run that a fail_run check failed,
+// from the run's context.
+func qualityFailure(ctx context.Context) error {
+	var qerr *QualityError
+	if errors.As(context.Cause(ctx), &qerr) {
+		return qerr
+	}
+	return nil
+}
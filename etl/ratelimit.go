@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+
+	"golang.org/x/time/rate"
+)
+
+//////////////////////////////////////////////////
+// Rate Limiting
+//////////////////////////////////////////////////
+
+type RateLimitConfig struct {
+	RequestsPerSecond float64 `yaml:"requests_per_second" json:"requests_per_second"`
+	Burst             int     `yaml:"burst" json:"burst"`
+}
+
+func defaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		RequestsPerSecond: 0,
+		Burst:             10,
+	}
+}
+
+func (r *RateLimitConfig) validate() []error {
+	var errs []error
+	if r.RequestsPerSecond < 0 {
+		errs = append(errs, errors.New("api.rate_limit.requests_per_second must be >= 0 (0 disables limiting)"))
+	}
+	if r.RequestsPerSecond > 0 && r.Burst <= 0 {
+		errs = append(errs, errors.New("api.rate_limit.burst must be > 0"))
+	}
+	return errs
+}
+
+// newLoadLimiter returns the token bucket the HTTP sink shares across all
+// load workers; each request to the load API, retries included, takes one
+// token. Nil when limiting is disabled.
+func newLoadLimiter(conf RateLimitConfig) *rate.Limiter {
+	if conf.RequestsPerSecond == 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(conf.RequestsPerSecond), conf.Burst)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// Stream Reorder Buffer
+//////////////////////////////////////////////////
+
+// ReorderConfig holds the records of a stream back so they reach the sinks
+// in timestamp order per host name, even when polls finish out of order or
+// an appliance reports a backlog late. A host's watermark trails the newest
+// timestamp seen from it by Lateness; records at or behind the watermark
+// are released at every stream.flush_interval, and records arriving behind
+// it are dropped as too late. Records still held when the stream stops are
+// released then.
+//
+// It has no effect with aggregation or rollup enabled, which emit windows
+// in order already.
+type ReorderConfig struct {
+	Enabled  bool     `yaml:"enabled" json:"enabled"`
+	Lateness Duration `yaml:"lateness" json:"lateness"`
+}
+
+func defaultReorderConfig() ReorderConfig {
+	return ReorderConfig{Lateness: Duration(2 * time.Minute)}
+}
+
+func (r *ReorderConfig) validate() []error {
+	if r.Enabled && r.Lateness < Duration(time.Second) {
+		return []error{errors.New("stream.reorder.lateness must be >= 1s")}
+	}
+	return nil
+}
+
+// reorderItem is a held record and the loader queue it goes to.
+type reorderItem struct {
+	data  DeviceData
+	queue chan DeviceData
+	seq   uint64 // keeps records of the same timestamp in arrival order
+}
+
+type reorderHeap []reorderItem
+
+func (h reorderHeap) Len() int { return len(h) }
+func (h reorderHeap) Less(i, j int) bool {
+	if h[i].data.Timestamp != h[j].data.Timestamp {
+		return h[i].data.Timestamp < h[j].data.Timestamp
+	}
+	return h[i].seq < h[j].seq
+}
+func (h reorderHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *reorderHeap) Push(x any)   { *h = append(*h, x.(reorderItem)) }
+func (h *reorderHeap) Pop() any {
+	old := *h
+	it := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return it
+}
+
+// reorderHost is the buffer of one host name.
+type reorderHost struct {
+	held      reorderHeap
+	watermark uint64 // never moves back
+}
+
+// Reorderer is the reorder buffer of a stream. It is safe for concurrent
+// use by the extract workers.
+type Reorderer struct {
+	lateness uint64 // seconds
+
+	mu    sync.Mutex
+	seq   uint64
+	hosts map[string]*reorderHost
+}
+
+// reorderer is nil unless the stream reorders records.
+var reorderer *Reorderer
+
+func newReorderer(conf ReorderConfig) *Reorderer {
+	return &Reorderer{
+		lateness: uint64(conf.Lateness.Std() / time.Second),
+		hosts:    map[string]*reorderHost{},
+	}
+}
+
+// Add holds d until the watermark of its host passes it, and reports
+// whether it was in time; a record behind the watermark is dropped.
+func (r *Reorderer) Add(d DeviceData, queue chan DeviceData) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	h, ok := r.hosts[d.Name]
+	if !ok {
+		h = &reorderHost{}
+		r.hosts[d.Name] = h
+	}
+	if d.Timestamp < h.watermark {
+		runStats.TooLate.Add(1)
+		slog.Debug("Record behind watermark dropped", "component", "reorder", "name", d.Name,
+			"timestamp", d.Timestamp, "watermark", h.watermark, "behind_s", h.watermark-d.Timestamp)
+		return false
+	}
+	if d.Timestamp > r.lateness {
+		h.watermark = max(h.watermark, d.Timestamp-r.lateness)
+	}
+	r.seq++
+	heap.Push(&h.held, reorderItem{data: d, queue: queue, seq: r.seq})
+	return true
+}
+
+// Flush removes and returns the records at or behind the watermark of
+// their host, or every record if all is set, in timestamp order per host.
+func (r *Reorderer) Flush(all bool) []reorderItem {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var out []reorderItem
+	for _, h := range r.hosts {
+		for len(h.held) > 0 && (all || h.held[0].data.Timestamp <= h.watermark) {
+			out = append(out, heap.Pop(&h.held).(reorderItem))
+		}
+	}
+	return out
+}
+
+// Pending returns the number of records held.
+func (r *Reorderer) Pending() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, h := range r.hosts {
+		n += len(h.held)
+	}
+	return n
+}
+
+// emitReordered hands the records the watermarks passed, or all of them if
+// final, to the loaders.
+func emitReordered(final bool) {
+	if reorderer == nil {
+		return
+	}
+	released := reorderer.Flush(final)
+	backpressure.Queued(len(released))
+	for _, it := range released {
+		it.queue <- it.data
+	}
+	level := slog.LevelDebug
+	if final {
+		level = slog.LevelInfo
+	}
+	slog.Log(context.Background(), level, "Reorder buffer flushed", "component", "reorder", "emitted", len(released),
+		"held", reorderer.Pending(), "too_late", runStats.TooLate.Load())
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// Appliance Report
+//////////////////////////////////////////////////
+
+// ReportConfig enables the per-appliance outcome report written at the end
+// of every run, for following up on the devices that didn't make it.
+type ReportConfig struct {
+	// File is the report path, "" for none. {run_id} in it is replaced by
+	// the run's ID, so daemon runs don't overwrite each other's reports.
+	File   string `yaml:"file" json:"file"`
+	Format string `yaml:"format" json:"format"` // json or csv; "" goes by the file's extension
+}
+
+func defaultReportConfig() ReportConfig {
+	return ReportConfig{}
+}
+
+func (r *ReportConfig) validate() []error {
+	if r.Format != "" && r.Format != "json" && r.Format != "csv" {
+		return []error{fmt.Errorf("report.format must be json or csv, got %q", r.Format)}
+	}
+	return nil
+}
+
+// format is the report's format, csv for a .csv file unless set.
+func (r *ReportConfig) format() string {
+	if r.Format == "" && strings.EqualFold(filepath.Ext(r.File), ".csv") {
+		return "csv"
+	}
+	if r.Format == "" {
+		return "json"
+	}
+	return r.Format
+}
+
+// Appliance outcomes, from the stage the appliance got furthest to. The
+// load outcomes are the worst of its records over all sinks. Until the run
+// ends, appliances whose records went on to load have none.
+const (
+	outcomeNotDispatched   = "not_dispatched"
+	outcomeSkipped         = "skipped" // finished by the resumed run
+	outcomeCancelled       = "cancelled"
+	outcomeExtractFailed   = "extract_failed"
+	outcomeTransformFailed = "transform_failed"
+	outcomeFiltered        = "filtered" // every record dropped by filters, validation or dedup
+	outcomeAggregated      = "aggregated"
+	outcomePending         = "pending" // records queued but never flushed
+	outcomeLoaded          = "loaded"
+	outcomeSpilled         = "spilled"
+	outcomeDeadLettered    = "dead_lettered"
+	outcomeLost            = "lost" // failed and couldn't be spilled
+)
+
+// ApplianceReport is one appliance's line in the report. Record counts are
+// summed over the sinks, so with two sinks a fully loaded appliance has
+// twice its records as Loaded.
+type ApplianceReport struct {
+	Host        string `json:"host"`
+	IP          string `json:"ip"`
+	Outcome     string `json:"outcome"`
+	Error       string `json:"error,omitempty"`
+	ExtractMS   int64  `json:"extract_ms"`
+	TransformMS int64  `json:"transform_ms"`
+	Records     int    `json:"records"`  // extracted
+	Dropped     int    `json:"dropped"`  // by the transform chain, validation, filter rules and dedup
+	Rejected    int    `json:"rejected"` // of which failed validation
+	// QualityFailed counts the records failing quality checks, including
+	// those fixed and loaded.
+	QualityFailed int `json:"quality_failed"`
+	Aggregated    int `json:"aggregated"`
+	Loaded        int `json:"loaded"`
+	Spilled       int `json:"spilled"`
+	DeadLettered  int `json:"dead_lettered"`
+	Lost          int `json:"lost"`
+	// LoadAttempts is the most attempts any batch carrying the appliance's
+	// records took; above 1, the load was retried.
+	LoadAttempts int `json:"load_attempts"`
+}
+
+// outcome derives the appliance's outcome once the loaders are done.
+func (a *ApplianceReport) outcome() string {
+	switch {
+	case a.Outcome != "":
+		return a.Outcome
+	case a.Lost > 0:
+		return outcomeLost
+	case a.DeadLettered > 0:
+		return outcomeDeadLettered
+	case a.Spilled > 0:
+		return outcomeSpilled
+	case a.Loaded > 0:
+		return outcomeLoaded
+	case a.Aggregated > 0:
+		return outcomeAggregated
+	case a.Records > a.Dropped:
+		return outcomePending
+	default:
+		return outcomeFiltered
+	}
+}
+
+// runReport collects the outcome of every appliance of a run.
+type runReport struct {
+	mu    sync.Mutex
+	runID string
+	byKey map[string]*ApplianceReport
+	order []*ApplianceReport
+}
+
+// report is the report of the run in progress, nil when report.file is
+// unset.
+var report *runReport
+
+func newRunReport(runID string, appliances []Appliance) *runReport {
+	r := &runReport{runID: runID, byKey: make(map[string]*ApplianceReport, len(appliances))}
+	for _, ap := range appliances {
+		if _, ok := r.byKey[ap.key()]; ok {
+			continue
+		}
+		a := &ApplianceReport{Host: ap.HostName, IP: ap.IP, Outcome: outcomeNotDispatched}
+		r.byKey[ap.key()] = a
+		r.order = append(r.order, a)
+	}
+	return r
+}
+
+// update changes the entry of the appliance with key under the lock. It is
+// a no-op on a nil report and for unknown keys, such as records replayed
+// from an earlier run's spills.
+func (r *runReport) update(key string, fn func(a *ApplianceReport)) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if a, ok := r.byKey[key]; ok {
+		fn(a)
+	}
+}
+
+// failed marks an appliance that went no further than outcome.
+func (r *runReport) failed(ap Appliance, outcome string, err error) {
+	r.update(ap.key(), func(a *ApplianceReport) {
+		a.Outcome = outcome
+		if err != nil {
+			a.Error = err.Error()
+		}
+	})
+}
+
+// recordLoad counts how a sink took the records of a batch: with outcome,
+// after attempts.
+func (r *runReport) recordLoad(data []DeviceData, outcome string, attempts int, err error) {
+	if r == nil {
+		return
+	}
+	r.add(applianceCounts(data), outcome, attempts, err)
+}
+
+// recordPartial counts the records of a partly loaded batch that got in,
+// all but failed.
+func (r *runReport) recordPartial(data, failed []DeviceData, attempts int) {
+	if r == nil {
+		return
+	}
+	counts := applianceCounts(data)
+	for key, n := range applianceCounts(failed) {
+		counts[key] -= n
+	}
+	r.add(counts, outcomeLoaded, attempts, nil)
+}
+
+func applianceCounts(data []DeviceData) map[string]int {
+	counts := make(map[string]int)
+	for _, d := range data {
+		counts[d.appliance]++
+	}
+	return counts
+}
+
+func (r *runReport) add(counts map[string]int, outcome string, attempts int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, n := range counts {
+		a, ok := r.byKey[key]
+		if !ok {
+			continue
+		}
+		switch outcome {
+		case outcomeLoaded:
+			a.Loaded += n
+		case outcomeSpilled:
+			a.Spilled += n
+		case outcomeDeadLettered:
+			a.DeadLettered += n
+		case outcomeLost:
+			a.Lost += n
+		}
+		if err != nil && a.Error == "" {
+			a.Error = err.Error()
+		}
+		a.LoadAttempts = max(a.LoadAttempts, attempts)
+	}
+}
+
+// write saves the report in conf's format, replacing {run_id} in the path.
+func (r *runReport) write(conf ReportConfig) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, a := range r.order {
+		a.Outcome = a.outcome()
+	}
+
+	path := strings.ReplaceAll(conf.File, "{run_id}", r.runID)
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return path, err
+		}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return path, err
+	}
+	switch conf.format() {
+	case "csv":
+		err = r.writeCSV(f)
+	default:
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(struct {
+			RunID         string             `json:"run_id"`
+			GeneratedAt   time.Time          `json:"generated_at"`
+			QualityChecks map[string]int64   `json:"quality_checks,omitempty"`
+			Appliances    []*ApplianceReport `json:"appliances"`
+		}{r.runID, time.Now().UTC(), runStats.Summary().QualityChecks, r.order})
+	}
+	return path, errors.Join(err, f.Close())
+}
+
+func (r *runReport) writeCSV(f *os.File) error {
+	w := csv.NewWriter(f)
+	w.Write([]string{"host", "ip", "outcome", "error", "extract_ms", "transform_ms", "records", "dropped",
+		"rejected", "quality_failed", "aggregated", "loaded", "spilled", "dead_lettered", "lost", "load_attempts"})
+	for _, a := range r.order {
+		w.Write([]string{a.Host, a.IP, a.Outcome, a.Error,
+			strconv.FormatInt(a.ExtractMS, 10), strconv.FormatInt(a.TransformMS, 10),
+			strconv.Itoa(a.Records), strconv.Itoa(a.Dropped), strconv.Itoa(a.Rejected), strconv.Itoa(a.QualityFailed), strconv.Itoa(a.Aggregated),
+			strconv.Itoa(a.Loaded), strconv.Itoa(a.Spilled), strconv.Itoa(a.DeadLettered),
+			strconv.Itoa(a.Lost), strconv.Itoa(a.LoadAttempts)})
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// Retry & Backoff
+//////////////////////////////////////////////////
+
+type RetryConfig struct {
+	MaxAttempts int      `yaml:"max_attempts" json:"max_attempts"`
+	BaseDelay   Duration `yaml:"base_delay" json:"base_delay"`
+	MaxDelay    Duration `yaml:"max_delay" json:"max_delay"`
+}
+
+func defaultRetryConfig() RetryConfig {
+	return RetryConfig{
+		MaxAttempts: 4,
+		BaseDelay:   Duration(500 * time.Millisecond),
+		MaxDelay:    Duration(10 * time.Second),
+	}
+}
+
+func (r *RetryConfig) validate(prefix string) []error {
+	var errs []error
+	if r.MaxAttempts <= 0 {
+		errs = append(errs, fmt.Errorf("%s.max_attempts must be > 0, got %d", prefix, r.MaxAttempts))
+	}
+	if r.BaseDelay <= 0 {
+		errs = append(errs, fmt.Errorf("%s.base_delay must be > 0", prefix))
+	}
+	if r.MaxDelay < r.BaseDelay {
+		errs = append(errs, fmt.Errorf("%s.max_delay must be >= base_delay", prefix))
+	}
+	return errs
+}
+
+// backoff returns the wait before retry number attempt (1-based): the
+// exponential delay capped at MaxDelay, with "equal jitter" so concurrent
+// workers that failed together don't retry in lockstep.
+func (r *RetryConfig) backoff(attempt int) time.Duration {
+	d := r.BaseDelay.Std()
+	for i := 1; i < attempt && d < r.MaxDelay.Std(); i++ {
+		d *= 2
+	}
+	d = min(d, r.MaxDelay.Std())
+
+	half := d / 2
+	return half + rand.N(half+1)
+}
+
+// retryDelay returns the wait before retry number attempt after err: the
+// backoff, or longer if the server asked for it with Retry-After. That is
+// capped at MaxDelay, so a server can't park a loader for hours.
+func (r *RetryConfig) retryDelay(attempt int, err error) time.Duration {
+	delay := r.backoff(attempt)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		delay = max(delay, min(apiErr.RetryAfter, r.MaxDelay.Std()))
+	}
+	return delay
+}
+
+// waitRetry waits delay before a retry, and reports whether to make it: not
+// once ctx is done or, for a flush, shutdown was requested.
+func waitRetry(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+	case <-shutdownFrom(ctx):
+	}
+	return false
+}
+
+// withRetry runs op until it succeeds, fails with a non-retryable error or
+// runs out of attempts, waiting retryDelay in between, and stops retrying
+// once ctx is done or shutdown was requested. It returns the number of
+// attempts made alongside the final error.
+func withRetry(ctx context.Context, r RetryConfig, component string, op func(attempt int) error) (int, error) {
+	for attempt := 1; ; attempt++ {
+		err := op(attempt)
+		if err == nil || !isRetryable(err) || attempt >= r.MaxAttempts {
+			return attempt, err
+		}
+
+		delay := r.retryDelay(attempt, err)
+		slog.Warn("Attempt failed, retrying", "component", component, "attempt", attempt,
+			"max_attempts", r.MaxAttempts, "retry_in_ms", delay.Milliseconds(), "error", err)
+		if !waitRetry(ctx, delay) {
+			return attempt, err
+		}
+	}
+}
+
+// APIError is a non-2xx response from the load API. Code, Message and
+// Details are set when the body is a structured error:
+//
+//	{"error": "invalid_batch", "message": "...", "details": ["/0/name: ..."]}
+//
+// RetryAfter is the wait the response asked for in Retry-After, usually
+// with a 429 or 503.
+type APIError struct {
+	StatusCode int
+	Body       string
+	Code       string
+	Message    string
+	Details    []string
+	RetryAfter time.Duration
+}
+
+// newAPIError builds the APIError of a response, parsing its body if it is
+// a structured error.
+func newAPIError(status int, header http.Header, body []byte) *APIError {
+	e := &APIError{StatusCode: status, Body: string(body), RetryAfter: parseRetryAfter(header.Get("Retry-After"), time.Now())}
+	var structured struct {
+		Error   string   `json:"error"`
+		Message string   `json:"message"`
+		Details []string `json:"details"`
+	}
+	if json.Unmarshal(body, &structured) == nil && structured.Error != "" {
+		e.Code, e.Message, e.Details = structured.Error, structured.Message, structured.Details
+	}
+	return e
+}
+
+// parseRetryAfter returns the wait a Retry-After header asks for, in
+// seconds or until an HTTP date; 0 if it is missing, invalid or past.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return max(time.Duration(secs)*time.Second, 0)
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(t.Sub(now), 0)
+	}
+	return 0
+}
+
+func (e *APIError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("API error (%d): %s", e.StatusCode, e.Body)
+	}
+	msg := fmt.Sprintf("API error (%d %s): %s", e.StatusCode, e.Code, e.Message)
+	if len(e.Details) > 0 {
+		msg += " [" + strings.Join(e.Details, "; ") + "]"
+	}
+	return msg
+}
+
+// permanentError marks a failure no retry or replay fixes, for sinks whose
+// errors don't carry an HTTP status to tell: a batch that can't be encoded,
+// a topic that doesn't exist, refused database credentials. Such batches
+// are dead-lettered at once.
+type permanentError struct {
+	err error
+}
+
+// permanent marks err as permanent.
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+func isPermanent(err error) bool {
+	var perm *permanentError
+	return errors.As(err, &perm)
+}
+
+// isRetryable reports whether a failed send may succeed if repeated.
+// Transport errors, 5xx and 429 are transient; other API errors and
+// permanent errors are not.
+func isRetryable(err error) bool {
+	if isPermanent(err) {
+		return false
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode >= 500 || apiErr.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// isAuthFailure reports whether the API refused the credentials. That is
+// fixed by the operator rather than by changing the batch, so such batches
+// are spilled for replay instead of dead-lettered, unless the sink marked
+// the failure permanent.
+func isAuthFailure(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) &&
+		(apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden)
+}
+
+// errorType sorts a load error into a coarse class for spill records, so
+// failures can be grouped without parsing messages.
+func errorType(err error) string {
+	var apiErr *APIError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &apiErr):
+		return fmt.Sprintf("http_%d", apiErr.StatusCode)
+	case errors.Is(err, errCircuitOpen):
+		return "circuit_open"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection_refused"
+	case errors.As(err, &netErr):
+		return "network"
+	default:
+		return "other"
+	}
+}
+
+// AttemptsError annotates the final error of a retried operation with the
+// number of attempts it took.
+type AttemptsError struct {
+	Attempts int
+	Err      error
+}
+
+func (e *AttemptsError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *AttemptsError) Unwrap() error {
+	return e.Err
+}
+
+// attemptsOf returns the attempt count recorded in err, or 1 for errors
+// from operations that don't retry.
+func attemptsOf(err error) int {
+	var ae *AttemptsError
+	if errors.As(err, &ae) {
+		return ae.Attempts
+	}
+	return 1
+}
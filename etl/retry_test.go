@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/segmentio/kafka-go"
+)
+
+func TestBackoff(t *testing.T) {
+	r := RetryConfig{MaxAttempts: 10, BaseDelay: Duration(100 * time.Millisecond), MaxDelay: Duration(time.Second)}
+	tests := []struct {
+		attempt int
+		want    time.Duration // before jitter
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{50, time.Second},
+	}
+	for _, tt := range tests {
+		for range 100 {
+			if got := r.backoff(tt.attempt); got < tt.want/2 || got > tt.want {
+				t.Fatalf("backoff(%d) = %s, want within [%s, %s]", tt.attempt, got, tt.want/2, tt.want)
+			}
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&APIError{StatusCode: 500}, true},
+		{&APIError{StatusCode: 503}, true},
+		{&APIError{StatusCode: 429}, true},
+		{&APIError{StatusCode: 400}, false},
+		{&APIError{StatusCode: 401}, false},
+		{&APIError{StatusCode: 422}, false},
+		{&AttemptsError{Attempts: 3, Err: &APIError{StatusCode: 400}}, false},
+		{&AttemptsError{Attempts: 3, Err: &APIError{StatusCode: 502}}, true},
+		{fmt.Errorf("load: %w", context.DeadlineExceeded), true},
+		{errors.New("connection reset by peer"), true},
+		{permanent(errors.New("json: unsupported value: NaN")), false},
+		{&AttemptsError{Attempts: 1, Err: permanent(&APIError{StatusCode: 503})}, false},
+	}
+	for _, tt := range tests {
+		if got := isRetryable(tt.err); got != tt.want {
+			t.Errorf("isRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	transient, permanent := &APIError{StatusCode: 503}, &APIError{StatusCode: 400}
+	tests := []struct {
+		name         string
+		results      []error // of each attempt; nil past the end
+		wantAttempts int
+		wantErr      error
+	}{
+		{"first attempt", nil, 1, nil},
+		{"after transient failures", []error{transient, transient}, 3, nil},
+		{"permanent failure not retried", []error{permanent}, 1, permanent},
+		{"transient then permanent", []error{transient, permanent}, 2, permanent},
+		{"out of attempts", []error{transient, transient, transient, transient}, 3, transient},
+	}
+	r := RetryConfig{MaxAttempts: 3, BaseDelay: Duration(time.Millisecond), MaxDelay: Duration(time.Millisecond)}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			attempts, err := withRetry(context.Background(), r, "test", func(attempt int) error {
+				calls++
+				if attempt != calls {
+					t.Errorf("attempt %d on call %d", attempt, calls)
+				}
+				if attempt <= len(tt.results) {
+					return tt.results[attempt-1]
+				}
+				return nil
+			})
+			if attempts != tt.wantAttempts || calls != tt.wantAttempts {
+				t.Errorf("attempts = %d after %d calls, want %d", attempts, calls, tt.wantAttempts)
+			}
+			if err != tt.wantErr {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWithRetryCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := RetryConfig{MaxAttempts: 5, BaseDelay: Duration(time.Hour), MaxDelay: Duration(time.Hour)}
+	attempts, err := withRetry(ctx, r, "test", func(int) error { return &APIError{StatusCode: 503} })
+	if attempts != 1 || err == nil {
+		t.Errorf("got %d attempts, err %v; want 1 attempt and the error", attempts, err)
+	}
+}
+
+func TestNewAPIError(t *testing.T) {
+	tests := []struct {
+		body    string
+		wantMsg string
+	}{
+		{"upstream timeout", "API error (503): upstream timeout"},
+		{`{"error": "invalid_batch", "message": "bad record", "details": ["/0/name: missing"]}`,
+			"API error (503 invalid_batch): bad record [/0/name: missing]"},
+		{`{"message": "no code"}`, `API error (503): {"message": "no code"}`},
+	}
+	for _, tt := range tests {
+		if got := newAPIError(503, nil, []byte(tt.body)).Error(); got != tt.wantMsg {
+			t.Errorf("newAPIError(%q) = %q, want %q", tt.body, got, tt.wantMsg)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", 0},
+		{"0", 0},
+		{"2", 2 * time.Second},
+		{"-1", 0},
+		{"Thu, 15 Oct 2026 12:00:30 GMT", 30 * time.Second},
+		{"Thu, 15 Oct 2026 11:59:00 GMT", 0},
+		{"soon", 0},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.header, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", tt.header, got, tt.want)
+		}
+	}
+	h := http.Header{"Retry-After": {"3"}}
+	if got := newAPIError(429, h, nil).RetryAfter; got != 3*time.Second {
+		t.Errorf("newAPIError RetryAfter = %s, want 3s", got)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	r := RetryConfig{MaxAttempts: 3, BaseDelay: Duration(100 * time.Millisecond), MaxDelay: Duration(time.Second)}
+	tests := []struct {
+		name     string
+		err      error
+		min, max time.Duration
+	}{
+		{"backoff", &APIError{StatusCode: 503}, 50 * time.Millisecond, 100 * time.Millisecond},
+		{"shorter Retry-After", &APIError{StatusCode: 429, RetryAfter: time.Millisecond}, 50 * time.Millisecond, 100 * time.Millisecond},
+		{"longer Retry-After", &APIError{StatusCode: 429, RetryAfter: 500 * time.Millisecond}, 500 * time.Millisecond, 500 * time.Millisecond},
+		{"Retry-After capped at max_delay", &APIError{StatusCode: 429, RetryAfter: 24 * time.Hour}, time.Second, time.Second},
+		{"wrapped", &AttemptsError{Attempts: 1, Err: &APIError{StatusCode: 503, RetryAfter: 300 * time.Millisecond}},
+			300 * time.Millisecond, 300 * time.Millisecond},
+		{"network error", errors.New("connection reset"), 50 * time.Millisecond, 100 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := r.retryDelay(1, tt.err); got < tt.min || got > tt.max {
+			t.Errorf("%s: retryDelay = %s, want %s-%s", tt.name, got, tt.min, tt.max)
+		}
+	}
+}
+
+func TestWaitRetry(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	shutdown := make(chan struct{})
+	close(shutdown)
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want bool
+	}{
+		{"waited", context.Background(), true},
+		{"cancelled", cancelled, false},
+		{"shutdown requested", withShutdown(context.Background(), shutdown), false},
+		{"shutdown not requested", withShutdown(context.Background(), make(chan struct{})), true},
+	}
+	for _, tt := range tests {
+		delay := 10 * time.Millisecond
+		if !tt.want {
+			delay = time.Hour
+		}
+		if got := waitRetry(tt.ctx, delay); got != tt.want {
+			t.Errorf("%s: waitRetry = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// Sinks without HTTP statuses mark the failures no retry fixes permanent.
+func TestPermanentSinkErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		permanent bool
+		want      bool
+	}{
+		{"kafka unknown topic", isPermanentKafkaError(kafka.UnknownTopicOrPartition), true},
+		{"kafka auth", isPermanentKafkaError(fmt.Errorf("dial: %w", kafka.SASLAuthenticationFailed)), true},
+		{"kafka leader election", isPermanentKafkaError(kafka.LeaderNotAvailable), false},
+		{"kafka network", isPermanentKafkaError(errors.New("connection refused")), false},
+		{"clickhouse auth", isPermanent(clickHouseError(&clickhouse.Exception{Code: 516, Name: "AUTHENTICATION_FAILED"})), true},
+		{"clickhouse too many parts", isPermanent(clickHouseError(&clickhouse.Exception{Code: 252, Name: "TOO_MANY_PARTS"})), false},
+		{"postgres auth", isPermanent(postgresError(&pgconn.PgError{Code: "28P01"})), true},
+		{"postgres privilege", isPermanent(postgresError(&pgconn.PgError{Code: "42501"})), true},
+		{"postgres deadlock", isPermanent(postgresError(&pgconn.PgError{Code: "40P01"})), false},
+	}
+	for _, tt := range tests {
+		if tt.permanent != tt.want {
+			t.Errorf("%s: permanent = %v, want %v", tt.name, tt.permanent, tt.want)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// In-Run Retry Queue
+//////////////////////////////////////////////////
+
+// RetryQueueConfig holds batches that failed transiently in memory and
+// loads them again later in the run, so a load API that is back within
+// seconds doesn't leave them spilled until the next run.
+type RetryQueueConfig struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// MaxRecords caps the records held at once; past it, and while the
+	// heap is over memory.budget_mb, failed batches are spilled.
+	MaxRecords int `yaml:"max_records" json:"max_records"`
+	// Retry sets how often a batch is queued and the backoff between its
+	// attempts.
+	Retry RetryConfig `yaml:"retry" json:"retry"`
+	// DrainTimeout is how long the end of a run waits for queued batches
+	// to be retried before spilling what is left.
+	DrainTimeout Duration `yaml:"drain_timeout" json:"drain_timeout"`
+}
+
+func defaultRetryQueueConfig() RetryQueueConfig {
+	return RetryQueueConfig{
+		Enabled:    true,
+		MaxRecords: 50000,
+		Retry: RetryConfig{
+			MaxAttempts: 3,
+			BaseDelay:   Duration(5 * time.Second),
+			MaxDelay:    Duration(time.Minute),
+		},
+		DrainTimeout: Duration(30 * time.Second),
+	}
+}
+
+func (r *RetryQueueConfig) validate() []error {
+	if !r.Enabled {
+		return nil
+	}
+	errs := r.Retry.validate("load.retry_queue.retry")
+	if r.MaxRecords <= 0 {
+		errs = append(errs, fmt.Errorf("load.retry_queue.max_records must be > 0, got %d", r.MaxRecords))
+	}
+	if r.DrainTimeout < 0 {
+		errs = append(errs, errors.New("load.retry_queue.drain_timeout must be >= 0"))
+	}
+	return errs
+}
+
+// retryItem is a queued batch with the failure of its last attempt.
+type retryItem struct {
+	sink     Sink
+	batchID  string
+	data     []DeviceData
+	workerID int
+	due      time.Time
+	failedAt time.Time
+	err      error
+}
+
+// retryHistory is what the queue went through with a batch.
+type retryHistory struct {
+	queued       int       // times the batch was queued
+	attempts     int       // attempts of its failed flushes
+	firstAttempt time.Time // start of its first flush
+}
+
+// RetryQueue re-flushes queued batches once their backoff is over. A nil
+// queue takes nothing, so failed batches are spilled right away.
+type RetryQueue struct {
+	conf  RetryConfig
+	max   int
+	drain time.Duration
+
+	mu       sync.Mutex
+	items    []*retryItem
+	records  int
+	history  map[string]*retryHistory // by sink and batch ID
+	active   int                      // retries in flight
+	closed   bool
+	wake     chan struct{}
+	done     chan struct{}
+	stopped  chan struct{} // closed when run returns
+	inflight sync.WaitGroup
+}
+
+// retries is the queue of the run in progress, nil when disabled and
+// outside of runs.
+var retries *RetryQueue
+
+func newRetryQueue(conf RetryQueueConfig) *RetryQueue {
+	q := &RetryQueue{
+		conf:    conf.Retry,
+		max:     conf.MaxRecords,
+		drain:   conf.DrainTimeout.Std(),
+		history: make(map[string]*retryHistory),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// Add queues a copy of a batch whose flush started at flushStart failed
+// with err, and reports whether it did. It doesn't once the batch was
+// queued retry.max_attempts times (see Exhausted), the queue is full or
+// closed, or memory is over budget.
+func (q *RetryQueue) Add(s Sink, batchID string, data []DeviceData, workerID int, flushStart time.Time, err error) bool {
+	if q == nil {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	key := s.Name() + "/" + batchID
+	h := q.history[key]
+	if h == nil {
+		h = &retryHistory{firstAttempt: flushStart}
+	}
+	n := h.queued
+	if q.closed || n >= q.conf.MaxAttempts || q.records+len(data) > q.max ||
+		(memoryBudget != nil && memoryBudget.Over()) {
+		delete(q.history, key)
+		return false
+	}
+	h.queued++
+	h.attempts += attemptsOf(err)
+	q.history[key] = h
+	now := time.Now()
+	q.items = append(q.items, &retryItem{
+		sink:     s,
+		batchID:  batchID,
+		data:     slices.Clone(data),
+		workerID: workerID,
+		due:      now.Add(q.conf.backoff(n + 1)),
+		failedAt: now,
+		err:      err,
+	})
+	q.records += len(data)
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Exhausted reports whether a batch failing with err was queued
+// retry.max_attempts times already. If so it forgets the batch, and returns
+// the attempts of all its flushes and when the first of them started. A nil
+// queue retries nothing, so the sink's own retries are all a batch gets.
+func (q *RetryQueue) Exhausted(s Sink, batchID string, flushStart time.Time, err error) (attempts int, firstAttempt time.Time, ok bool) {
+	if q == nil {
+		return attemptsOf(err), flushStart, true
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	key := s.Name() + "/" + batchID
+	h := q.history[key]
+	if h == nil || h.queued < q.conf.MaxAttempts {
+		return 0, time.Time{}, false
+	}
+	delete(q.history, key)
+	return h.attempts + attemptsOf(err), h.firstAttempt, true
+}
+
+// run flushes the batches as they come due, each on its own goroutine so a
+// slow sink doesn't hold back the others.
+func (q *RetryQueue) run() {
+	defer close(q.stopped)
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		due, next := q.takeDue(time.Now())
+		for _, it := range due {
+			q.inflight.Add(1)
+			go func() {
+				defer q.inflight.Done()
+				defer q.finished()
+				slog.Info("Retrying queued batch", "component", "loader", "sink", it.sink.Name(),
+					"worker_id", it.workerID, "batch_id", it.batchID, "batch_size", len(it.data))
+				flushTo(it.sink, it.batchID, it.data, it.workerID)
+			}()
+		}
+
+		timer.Reset(next)
+		select {
+		case <-timer.C:
+		case <-q.wake:
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// takeDue removes the batches due at now from the queue. next is the wait
+// until the earliest of the others.
+func (q *RetryQueue) takeDue(now time.Time) (due []*retryItem, next time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	next = time.Hour
+	q.items = slices.DeleteFunc(q.items, func(it *retryItem) bool {
+		if !it.due.After(now) {
+			due = append(due, it)
+			q.records -= len(it.data)
+			return true
+		}
+		next = min(next, it.due.Sub(now))
+		return false
+	})
+	q.active += len(due)
+	return due, next
+}
+
+// Records is the number of records queued.
+func (q *RetryQueue) Records() int {
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.records
+}
+
+func (q *RetryQueue) finished() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.active--
+}
+
+// idle reports whether nothing is queued or being retried.
+func (q *RetryQueue) idle() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items) == 0 && q.active == 0
+}
+
+// Close stops the queue at the end of a run, once it is empty or after
+// drain_timeout; interrupted runs don't wait. Batches still waiting are
+// then spilled with the error of their last attempt, and retries in
+// flight are waited for; what they fail to load is spilled too.
+func (q *RetryQueue) Close(interrupted bool) {
+	if q == nil {
+		return
+	}
+	if !interrupted {
+		for deadline := time.Now().Add(q.drain); !q.idle() && time.Now().Before(deadline); {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	q.mu.Lock()
+	q.closed = true
+	left := q.items
+	q.items, q.records = nil, 0
+	q.mu.Unlock()
+	close(q.done)
+	<-q.stopped
+
+	for _, it := range left {
+		settleFlush(it.sink, it.batchID, it.data, it.workerID, it.failedAt, it.err, false)
+	}
+	q.inflight.Wait()
+	if len(left) > 0 {
+		slog.Warn("Run ended with batches still queued for retry, spilled them", "component", "loader", "batches", len(left))
+	}
+}
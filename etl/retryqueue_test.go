@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryQueueAdd(t *testing.T) {
+	s := &testSink{name: "test"}
+	withTestLoadStage(t, s)
+	q := newRetryQueue(RetryQueueConfig{MaxRecords: 5, Retry: RetryConfig{MaxAttempts: 2,
+		BaseDelay: Duration(time.Hour), MaxDelay: Duration(time.Hour)}})
+	retries = q
+	err := &APIError{StatusCode: 503}
+
+	steps := []struct {
+		name    string
+		batchID string
+		records int
+		want    bool
+	}{
+		{"first failure", "a", 2, true},
+		{"second failure", "a", 2, true},
+		{"out of attempts", "a", 2, false},
+		{"past max_records", "b", 2, false},
+		{"within max_records", "c", 1, true},
+	}
+	for _, st := range steps {
+		if got := q.Add(s, st.batchID, testRecords(st.records), 0, time.Now(), err); got != st.want {
+			t.Errorf("%s: Add = %v, want %v", st.name, got, st.want)
+		}
+	}
+	if got := q.Records(); got != 5 {
+		t.Errorf("Records = %d, want 5", got)
+	}
+
+	// Closing spills what is still waiting.
+	q.Close(true)
+	if got := countsOf("test"); got.spilled != 5 {
+		t.Errorf("spilled %d records on close, want 5", got.spilled)
+	}
+	if q.Add(s, "d", testRecords(1), 0, time.Now(), err) {
+		t.Error("closed queue took a batch")
+	}
+}
+
+func TestRetryQueueRetries(t *testing.T) {
+	s := &testSink{name: "test", fail: map[int]error{1: &APIError{StatusCode: 503}}}
+	withTestLoadStage(t, s)
+	retries = newRetryQueue(RetryQueueConfig{MaxRecords: 100, DrainTimeout: Duration(5 * time.Second),
+		Retry: RetryConfig{MaxAttempts: 3, BaseDelay: Duration(time.Millisecond), MaxDelay: Duration(time.Millisecond)}})
+
+	data := testRecords(3)
+	flushTo(s, newBatchID(data), data, 0)
+	retries.Close(false)
+	if got, want := countsOf("test"), (sinkCounts{loaded: 3, requeued: 1}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if s.Calls() != 2 {
+		t.Errorf("sink called %d times, want 2", s.Calls())
+	}
+}
+
+// A batch failing through all its retries is dead-lettered with the
+// attempts of every flush and the time of the first.
+func TestRetryQueueExhausted(t *testing.T) {
+	s := &testSink{name: "test", fail: map[int]error{
+		1: &APIError{StatusCode: 503}, 2: &APIError{StatusCode: 503}, 3: &APIError{StatusCode: 503}}}
+	withTestLoadStage(t, s)
+	retries = newRetryQueue(RetryQueueConfig{MaxRecords: 100, DrainTimeout: Duration(5 * time.Second),
+		Retry: RetryConfig{MaxAttempts: 2, BaseDelay: Duration(time.Millisecond), MaxDelay: Duration(time.Millisecond)}})
+
+	data := testRecords(3)
+	start := time.Now()
+	flushTo(s, newBatchID(data), data, 0)
+	retries.Close(false)
+	if got, want := countsOf("test"), (sinkCounts{deadLettered: 3, requeued: 2}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	dls, err := deadLetters.List()
+	if err != nil || len(dls) != 1 {
+		t.Fatalf("List() = %d dead letters, %v; want 1", len(dls), err)
+	}
+	dl := dls[0]
+	if dl.Reason != reasonRetriesExhausted || dl.Attempts != 3 || dl.StatusCode != 503 {
+		t.Errorf("dead letter %q after %d attempts with status %d, want %q after 3 with 503",
+			dl.Reason, dl.Attempts, dl.StatusCode, reasonRetriesExhausted)
+	}
+	if dl.FirstAttemptAt.Before(start.Add(-time.Second)) || dl.FirstAttemptAt.After(dl.LastAttemptAt) {
+		t.Errorf("attempts from %s to %s, want from the first flush at %s", dl.FirstAttemptAt, dl.LastAttemptAt, start)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// Rollup
+//////////////////////////////////////////////////
+
+// RollupConfig averages records over a tumbling window before loading, for
+// appliances polled much more often than the sinks need: a record per
+// (name, cpu_number) and window replaces one per poll. Unlike aggregation,
+// indicators keep their names, so rolled-up records look like any other.
+// Memory, disk and network records are rolled up per metric and device too.
+//
+// It is the aggregation stage with only avg, and can't be combined with it.
+type RollupConfig struct {
+	Enabled bool     `yaml:"enabled" json:"enabled"`
+	Window  Duration `yaml:"window" json:"window"`
+}
+
+func defaultRollupConfig() RollupConfig {
+	return RollupConfig{Window: Duration(time.Minute)}
+}
+
+func (r *RollupConfig) validate() []error {
+	if !r.Enabled {
+		return nil
+	}
+	if r.Window < Duration(time.Second) || r.Window.Std()%time.Second != 0 {
+		return []error{fmt.Errorf("rollup.window must be a whole number of seconds >= 1s, got %s", r.Window.Std())}
+	}
+	return nil
+}
+
+// newRollup returns an aggregator of the window averages under the names
+// of the indicators.
+func newRollup(conf RollupConfig) *Aggregator {
+	a := newAggregator(AggregateConfig{Window: conf.Window, Functions: []string{"avg"}})
+	a.keepNames = true
+	return a
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// Secrets
+//////////////////////////////////////////////////
+
+// SecretsConfig configures where the secret references in the config are
+// resolved. A credential field set to ref+<provider>://<path>[#<key>] is
+// replaced with the secret's value at startup:
+//
+//	ref+env://API_TOKEN                  the environment variable
+//	ref+file:///run/secrets/api_token    the file, without trailing newline
+//	ref+vault://secret/etl/api#token     key token of a Vault KV secret
+type SecretsConfig struct {
+	// RefreshInterval fetches the secrets again, between daemon runs, once
+	// this long has passed. 0 resolves them once at startup.
+	RefreshInterval Duration    `yaml:"refresh_interval" json:"refresh_interval"`
+	Vault           VaultConfig `yaml:"vault" json:"vault"`
+}
+
+// VaultConfig is the HashiCorp Vault server ref+vault:// secrets are read
+// from. The ETL logs in with Token, or with the AppRole RoleID and
+// SecretID; both may themselves be env or file references.
+type VaultConfig struct {
+	Address   string    `yaml:"address" json:"address"`           // default $VAULT_ADDR
+	Namespace string    `yaml:"namespace" json:"namespace"`       // Vault Enterprise namespace
+	Token     string    `yaml:"token" json:"token" secret:"true"` // default $VAULT_TOKEN
+	RoleID    string    `yaml:"role_id" json:"role_id"`
+	SecretID  string    `yaml:"secret_id" json:"secret_id" secret:"true"`
+	AuthMount string    `yaml:"auth_mount" json:"auth_mount"` // where AppRole is mounted
+	KVVersion int       `yaml:"kv_version" json:"kv_version"` // 1 or 2
+	Timeout   Duration  `yaml:"timeout" json:"timeout"`
+	TLS       TLSConfig `yaml:"tls" json:"tls"`
+}
+
+func defaultSecretsConfig() SecretsConfig {
+	return SecretsConfig{
+		Vault: VaultConfig{
+			AuthMount: "approle",
+			KVVersion: 2,
+			Timeout:   Duration(10 * time.Second),
+			TLS:       defaultTLSConfig(),
+		},
+	}
+}
+
+func (s *SecretsConfig) validate() []error {
+	var errs []error
+	if s.RefreshInterval < 0 {
+		errs = append(errs, errors.New("secrets.refresh_interval must be >= 0"))
+	}
+	v := &s.Vault
+	if v.Address != "" && !strings.HasPrefix(v.Address, "http://") && !strings.HasPrefix(v.Address, "https://") {
+		errs = append(errs, fmt.Errorf("secrets.vault.address must be an http(s) URL, got %q", v.Address))
+	}
+	if (v.RoleID == "") != (v.SecretID == "") {
+		errs = append(errs, errors.New("secrets.vault.role_id and secrets.vault.secret_id must be set together"))
+	}
+	if v.KVVersion != 1 && v.KVVersion != 2 {
+		errs = append(errs, fmt.Errorf("secrets.vault.kv_version must be 1 or 2, got %d", v.KVVersion))
+	}
+	if v.Timeout <= 0 {
+		errs = append(errs, errors.New("secrets.vault.timeout must be > 0"))
+	}
+	errs = append(errs, v.TLS.validate("secrets.vault.tls")...)
+	return errs
+}
+
+// SecretProvider looks up the secrets of one ref+<provider>:// scheme.
+type SecretProvider interface {
+	// Secret returns the value of key in the secret at path. key is empty
+	// when the reference names none.
+	Secret(ctx context.Context, path, key string) (string, error)
+}
+
+const secretRefPrefix = "ref+"
+
+// secretRef is a parsed ref+<provider>://<path>[#<key>].
+type secretRef struct {
+	provider string
+	path     string
+	key      string
+}
+
+func parseSecretRef(s string) (secretRef, error) {
+	provider, rest, ok := strings.Cut(strings.TrimPrefix(s, secretRefPrefix), "://")
+	if !ok || provider == "" || rest == "" {
+		return secretRef{}, fmt.Errorf("malformed secret reference %q (want ref+<provider>://<path>[#<key>])", s)
+	}
+	path, key, _ := strings.Cut(rest, "#")
+	return secretRef{provider: provider, path: path, key: key}, nil
+}
+
+// secretField is a config field holding a secret reference.
+type secretField struct {
+	key      string // config key, e.g. api.auth_token
+	ref      string
+	parsed   secretRef
+	field    reflect.Value // the string field in cfg
+	resolved bool
+}
+
+// secretResolver puts the values of the secret references in the config
+// into the fields that hold them, and fetches them again on refresh.
+type secretResolver struct {
+	interval   time.Duration
+	providers  map[string]SecretProvider
+	fields     []secretField
+	resolvedAt time.Time
+}
+
+// secrets resolves the config's secret references, nil when it has none.
+var secrets *secretResolver
+
+// newSecretResolver finds the secret references in c. Only fields tagged
+// secret:"true" may hold one; a reference anywhere else is an error rather
+// than a value silently used as is.
+func newSecretResolver(c *Config) (*secretResolver, error) {
+	r := &secretResolver{
+		interval: c.Secrets.RefreshInterval.Std(),
+		providers: map[string]SecretProvider{
+			"env":   envSecrets{},
+			"file":  fileSecrets{},
+			"vault": &vaultSecrets{conf: &c.Secrets.Vault},
+		},
+	}
+	var errs []error
+	walkConfigStrings(reflect.ValueOf(c).Elem(), "", func(key string, field reflect.Value, secret bool) {
+		raw := field.String()
+		if !strings.HasPrefix(raw, secretRefPrefix) {
+			return
+		}
+		if !secret {
+			errs = append(errs, fmt.Errorf("%s can't be a secret reference, only credentials can", key))
+			return
+		}
+		ref, err := parseSecretRef(raw)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+			return
+		}
+		switch {
+		case r.providers[ref.provider] == nil:
+			errs = append(errs, fmt.Errorf("%s: unknown secret provider %q (available: env, file, vault)", key, ref.provider))
+		case ref.key != "" && ref.provider != "vault":
+			errs = append(errs, fmt.Errorf("%s: %s secrets have no keys, drop #%s", key, ref.provider, ref.key))
+		case ref.provider == "vault" && strings.HasPrefix(key, "secrets."):
+			errs = append(errs, fmt.Errorf("%s: the Vault credentials can't come from Vault", key))
+		default:
+			r.fields = append(r.fields, secretField{key: key, ref: raw, parsed: ref, field: field})
+		}
+	})
+	// The Vault login is resolved before the secrets read with it.
+	slices.SortStableFunc(r.fields, func(a, b secretField) int {
+		return boolToInt(!strings.HasPrefix(a.key, "secrets.")) - boolToInt(!strings.HasPrefix(b.key, "secrets."))
+	})
+	return r, errors.Join(errs...)
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// walkConfigStrings calls fn for every string in the config value v, with
+// its key and whether it is a settable field tagged secret:"true".
+func walkConfigStrings(v reflect.Value, key string, fn func(key string, field reflect.Value, secret bool)) {
+	switch v.Kind() {
+	case reflect.String:
+		fn(key, v, false)
+	case reflect.Pointer:
+		if !v.IsNil() {
+			walkConfigStrings(v.Elem(), key, fn)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := range v.Len() {
+			walkConfigStrings(v.Index(i), fmt.Sprintf("%s[%d]", key, i), fn)
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			walkConfigStrings(iter.Value(), joinConfigPath(key, fmt.Sprint(iter.Key())), fn)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := range t.NumField() {
+			sf := t.Field(i)
+			name, _, _ := strings.Cut(sf.Tag.Get("yaml"), ",")
+			if !sf.IsExported() || name == "-" {
+				continue
+			}
+			f := v.Field(i)
+			if f.Kind() == reflect.String {
+				fn(joinConfigPath(key, name), f, sf.Tag.Get("secret") == "true" && f.CanSet())
+				continue
+			}
+			walkConfigStrings(f, joinConfigPath(key, name), fn)
+		}
+	}
+}
+
+// secretRefErrors reports the secret references in c that can't be
+// resolved whatever the providers hold.
+func secretRefErrors(c *Config) []error {
+	_, err := newSecretResolver(c)
+	return flattenErrors(err)
+}
+
+// resolve fetches every referenced secret and stores it in its field. A
+// secret that can't be fetched keeps its previous value. It returns the
+// keys whose value changed.
+func (r *secretResolver) resolve(ctx context.Context) (changed []string, err error) {
+	var errs []error
+	for i := range r.fields {
+		f := &r.fields[i]
+		val, err := r.providers[f.parsed.provider].Secret(ctx, f.parsed.path, f.parsed.key)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s: %w", f.key, f.ref, err))
+			continue
+		}
+		if f.resolved && f.field.String() == val {
+			continue
+		}
+		f.field.SetString(val)
+		f.resolved = true
+		changed = append(changed, f.key)
+	}
+	r.resolvedAt = time.Now()
+	return changed, errors.Join(errs...)
+}
+
+// resolveSecrets replaces the secret references in cfg with their values.
+// It must run before anything that uses them is built.
+func resolveSecrets() error {
+	r, err := newSecretResolver(cfg)
+	if err != nil {
+		return err
+	}
+	if len(r.fields) == 0 {
+		return nil
+	}
+	if _, err := r.resolve(context.Background()); err != nil {
+		return err
+	}
+	secrets = r
+	slog.Info("Resolved secrets", "component", "secrets", "count", len(r.fields))
+	return nil
+}
+
+// refreshSecrets fetches the secrets again if secrets.refresh_interval has
+// passed. When one changed, the extractor, the load HTTP client and the
+// sinks are rebuilt so the next run uses it. The daemon calls it between
+// runs, so nothing is using them.
+func refreshSecrets(ctx context.Context) {
+	if secrets == nil || secrets.interval <= 0 || time.Since(secrets.resolvedAt) < secrets.interval {
+		return
+	}
+	changed, err := secrets.resolve(ctx)
+	if err != nil {
+		slog.Error("Error refreshing secrets, keeping the previous values", "component", "secrets", "error", err)
+	}
+	if len(changed) == 0 {
+		return
+	}
+	slog.Info("Secrets changed, rebuilding the extractor, appliance source and sinks", "component", "secrets", "keys", changed)
+
+	ex, err := newExtractor(cfg)
+	if err != nil {
+		slog.Error("Error rebuilding extractor, keeping the previous one", "component", "secrets", "error", err)
+		return
+	}
+	src, err := newApplianceSource(cfg)
+	if err != nil {
+		slog.Error("Error rebuilding appliance source, keeping the previous one", "component", "secrets", "error", err)
+		return
+	}
+	transport, err := newLoadTransport(cfg.Load.HTTPClient)
+	if err != nil {
+		slog.Error("Error rebuilding load HTTP client, keeping the previous one", "component", "secrets", "error", err)
+		return
+	}
+	prevTransport := loadTransport
+	loadTransport = transport
+	sinks, err := newSinks(cfg)
+	if err != nil {
+		loadTransport = prevTransport
+		closeSource(src)
+		closeExtractor(ex)
+		slog.Error("Error rebuilding sinks, keeping the previous ones", "component", "secrets", "error", err)
+		return
+	}
+	closeSinks(loadSinks)
+	closeSource(applianceSource)
+	closeExtractor(extractor)
+	prevTransport.CloseIdleConnections()
+	extractor, applianceSource, loadSinks = ex, src, sinks
+}
+
+//////////////////////////////////////////////////
+// Secret Providers
+//////////////////////////////////////////////////
+
+// envSecrets reads ref+env://NAME from the environment.
+type envSecrets struct{}
+
+func (envSecrets) Secret(_ context.Context, name, _ string) (string, error) {
+	val, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return val, nil
+}
+
+// fileSecrets reads ref+file:///path, such as a mounted Kubernetes or
+// Docker secret.
+type fileSecrets struct{}
+
+func (fileSecrets) Secret(_ context.Context, path, _ string) (string, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(raw), "\r\n"), nil
+}
+
+// vaultSecrets reads ref+vault://<mount>/<path>#<key> from a KV secrets
+// engine over Vault's HTTP API.
+type vaultSecrets struct {
+	conf *VaultConfig // read on first use, once its own references are resolved
+
+	mu     sync.Mutex
+	client *http.Client
+	token  string // "" until logged in
+}
+
+func (v *vaultSecrets) Secret(ctx context.Context, path, key string) (string, error) {
+	data, err := v.read(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	if key == "" {
+		if len(data) != 1 {
+			return "", fmt.Errorf("secret has %d keys, name one with #<key>", len(data))
+		}
+		for k := range data {
+			key = k
+		}
+	}
+	val, ok := data[key]
+	if !ok {
+		return "", fmt.Errorf("secret has no key %q", key)
+	}
+	s, ok := val.(string)
+	if !ok {
+		return "", fmt.Errorf("key %q is not a string", key)
+	}
+	return s, nil
+}
+
+// read returns the data of the secret at path, logging in again once if
+// Vault rejects an AppRole token that has expired.
+func (v *vaultSecrets) read(ctx context.Context, path string) (map[string]any, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.client == nil {
+		tlsConf, err := v.conf.TLS.build()
+		if err != nil {
+			return nil, fmt.Errorf("vault tls: %w", err)
+		}
+		v.client = &http.Client{Timeout: v.conf.Timeout.Std(), Transport: &http.Transport{TLSClientConfig: tlsConf}}
+	}
+	apiPath := "/v1/" + path
+	if v.conf.KVVersion == 2 {
+		mount, rest, _ := strings.Cut(path, "/")
+		apiPath = "/v1/" + mount + "/data/" + rest
+	}
+
+	for attempt := 1; ; attempt++ {
+		token, err := v.login(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var resp struct {
+			Data map[string]any `json:"data"`
+		}
+		status, err := v.do(ctx, http.MethodGet, apiPath, token, nil, &resp)
+		if status == http.StatusForbidden && attempt == 1 && v.conf.RoleID != "" {
+			v.token = ""
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if v.conf.KVVersion == 1 {
+			return resp.Data, nil
+		}
+		data, _ := resp.Data["data"].(map[string]any)
+		if data == nil {
+			return nil, errors.New("secret has no data (deleted?)")
+		}
+		return data, nil
+	}
+}
+
+// login returns the token to read secrets with: the configured one, or
+// one from an AppRole login.
+func (v *vaultSecrets) login(ctx context.Context) (string, error) {
+	if v.token != "" {
+		return v.token, nil
+	}
+	if v.conf.RoleID == "" {
+		token := v.conf.Token
+		if token == "" {
+			token = os.Getenv("VAULT_TOKEN")
+		}
+		if token == "" {
+			return "", errors.New("no Vault token: set secrets.vault.token, VAULT_TOKEN or an AppRole")
+		}
+		v.token = token
+		return token, nil
+	}
+
+	body, _ := json.Marshal(map[string]string{"role_id": v.conf.RoleID, "secret_id": v.conf.SecretID})
+	var resp struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	if _, err := v.do(ctx, http.MethodPost, "/v1/auth/"+v.conf.AuthMount+"/login", "", body, &resp); err != nil {
+		return "", fmt.Errorf("vault approle login: %w", err)
+	}
+	if resp.Auth.ClientToken == "" {
+		return "", errors.New("vault approle login returned no token")
+	}
+	v.token = resp.Auth.ClientToken
+	slog.Debug("Logged in to Vault", "component", "secrets", "auth_mount", v.conf.AuthMount)
+	return v.token, nil
+}
+
+func (v *vaultSecrets) do(ctx context.Context, method, apiPath, token string, body []byte, out any) (int, error) {
+	addr := v.conf.Address
+	if addr == "" {
+		addr = os.Getenv("VAULT_ADDR")
+	}
+	if addr == "" {
+		return 0, errors.New("no Vault address: set secrets.vault.address or VAULT_ADDR")
+	}
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = strings.NewReader(string(body))
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(addr, "/")+apiPath, reqBody)
+	if err != nil {
+		return 0, err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if v.conf.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.conf.Namespace)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("vault returned %s: %s", resp.Status, truncate(string(raw), 200))
+	}
+	if err := json.Unmarshal(raw, out); err != nil {
+		return resp.StatusCode, fmt.Errorf("decoding vault response: %w", err)
+	}
+	return resp.StatusCode, nil
+}
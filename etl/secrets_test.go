@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestParseSecretRef(t *testing.T) {
+	tests := []struct {
+		ref     string
+		want    secretRef
+		wantErr bool
+	}{
+		{"ref+vault://secret/data/etl#api_token", secretRef{"vault", "secret/data/etl", "api_token"}, false},
+		{"ref+awssm://prod/etl", secretRef{"awssm", "prod/etl", ""}, false},
+		{"ref+file:///run/secrets/token", secretRef{"file", "/run/secrets/token", ""}, false},
+		{"ref+env://API_TOKEN", secretRef{"env", "API_TOKEN", ""}, false},
+		{"ref+vault://a#b#c", secretRef{"vault", "a", "b#c"}, false},
+		{"ref+vault://", secretRef{}, true},
+		{"ref+://path", secretRef{}, true},
+		{"ref+vault:path", secretRef{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseSecretRef(tt.ref)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseSecretRef(%q) error = %v, want error: %v", tt.ref, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseSecretRef(%q) = %+v, want %+v", tt.ref, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"slices"
+	"sort"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+//////////////////////////////////////////////////
+// Sink Interface & Registry
+//////////////////////////////////////////////////
+
+// Sink delivers a batch of records to a destination. Load is called
+// concurrently by the load workers and must not modify data: with several
+// sinks configured, each gets the same slice. Sinks holding connections may
+// also implement io.Closer; it is called once after the last flush.
+type Sink interface {
+	Name() string
+	Load(ctx context.Context, data []DeviceData) error
+}
+
+// healthReporter is implemented by sinks that know whether their
+// destination is up, e.g. from a circuit breaker or connection state.
+// Spilled batches are only replayed mid-run to a sink that reports
+// healthy; sinks without it are assumed to be.
+type healthReporter interface {
+	Healthy() bool
+}
+
+// sinkHealthy reports whether s is worth sending to.
+func sinkHealthy(s Sink) bool {
+	h, ok := s.(healthReporter)
+	return !ok || h.Healthy()
+}
+
+// PartialError reports a batch that was only partly delivered. Failed holds
+// the records that still need handling after Err. Rejected holds those the
+// sink refused outright, with RejectErr; they are dead-lettered without
+// being retried. The rest were loaded.
+type PartialError struct {
+	Failed []DeviceData
+	Err    error
+
+	Rejected  []DeviceData
+	RejectErr error
+}
+
+func (e *PartialError) Error() string {
+	if len(e.Rejected) == 0 {
+		return fmt.Sprintf("%d records not loaded: %v", len(e.Failed), e.Err)
+	}
+	if len(e.Failed) == 0 {
+		return fmt.Sprintf("%d records rejected: %v", len(e.Rejected), e.RejectErr)
+	}
+	return fmt.Sprintf("%d records not loaded: %v; %d records rejected: %v", len(e.Failed), e.Err,
+		len(e.Rejected), e.RejectErr)
+}
+
+func (e *PartialError) Unwrap() error {
+	if e.Err == nil {
+		return e.RejectErr
+	}
+	return e.Err
+}
+
+type workerIDKey struct{}
+
+// withWorkerID tags a flush context with the loader worker doing the flush,
+// for sinks that name their output after it.
+func withWorkerID(ctx context.Context, id int) context.Context {
+	return context.WithValue(ctx, workerIDKey{}, id)
+}
+
+func workerIDFrom(ctx context.Context) int {
+	id, _ := ctx.Value(workerIDKey{}).(int)
+	return id
+}
+
+type shutdownKey struct{}
+
+// withShutdown tags a flush context with a channel closed once shutdown is
+// requested. Loads already started still finish, so queued records drain
+// to the sinks, but failed attempts aren't retried after that.
+func withShutdown(ctx context.Context, done <-chan struct{}) context.Context {
+	return context.WithValue(ctx, shutdownKey{}, done)
+}
+
+// shutdownFrom returns the shutdown channel of ctx; nil, which never
+// fires, if it has none.
+func shutdownFrom(ctx context.Context) <-chan struct{} {
+	done, _ := ctx.Value(shutdownKey{}).(<-chan struct{})
+	return done
+}
+
+// shuttingDown reports whether the run of ctx is shutting down.
+func shuttingDown(ctx context.Context) bool {
+	select {
+	case <-shutdownFrom(ctx):
+		return true
+	default:
+		return false
+	}
+}
+
+type batchIDKey struct{}
+
+// withBatchID tags a flush context with the ID of the batch, for sinks that
+// pass it on for deduplication and for the audit log.
+func withBatchID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, batchIDKey{}, id)
+}
+
+func batchIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(batchIDKey{}).(string)
+	return id
+}
+
+// newBatchID derives a batch's ID from its records, so every sink sees the
+// same ID for a batch and retries and replays of it keep that ID. Only the
+// serialized fields count, labels in key order.
+func newBatchID(data []DeviceData) string {
+	h := sha256.New()
+	var b []byte
+	for _, d := range data {
+		b = msgp.AppendString(b[:0], d.Name)
+		b = msgp.AppendString(b, d.CPUNumber)
+		b = msgp.AppendUint64(b, d.Timestamp)
+		b = msgp.AppendString(b, d.Metric)
+		b = msgp.AppendString(b, d.Device)
+		b = msgp.AppendArrayHeader(b, uint32(len(d.Indicators)))
+		for _, ind := range d.Indicators {
+			b = msgp.AppendString(b, ind.Name)
+			b = msgp.AppendFloat64(b, ind.Value)
+		}
+		b = msgp.AppendMapHeader(b, uint32(len(d.Labels)))
+		for _, k := range slices.Sorted(maps.Keys(d.Labels)) {
+			b = msgp.AppendString(b, k)
+			b = msgp.AppendString(b, d.Labels[k])
+		}
+		h.Write(b)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// SinkFactory builds a Sink from the run configuration.
+type SinkFactory func(cfg *Config) (Sink, error)
+
+var sinkRegistry = map[string]SinkFactory{}
+
+// registerSink makes a sink selectable via load.sink. It is meant to be
+// called from init() in the file that implements the sink.
+func registerSink(name string, factory SinkFactory) {
+	if _, dup := sinkRegistry[name]; dup {
+		panic("sink already registered: " + name)
+	}
+	sinkRegistry[name] = factory
+}
+
+func newSink(name string, cfg *Config) (Sink, error) {
+	factory, ok := sinkRegistry[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown sink %q (available: %v)", name, sinkNames())
+	}
+	return factory(cfg)
+}
+
+// newSinks builds every sink listed in the load config, in order.
+func newSinks(cfg *Config) ([]Sink, error) {
+	var sinks []Sink
+	for _, name := range cfg.Load.sinkList() {
+		s, err := newSink(name, cfg)
+		if err != nil {
+			closeSinks(sinks)
+			return nil, fmt.Errorf("sink %s: %w", name, err)
+		}
+		sinks = append(sinks, s)
+	}
+	return sinks, nil
+}
+
+// closeSinks closes the sinks that implement io.Closer.
+func closeSinks(sinks []Sink) {
+	for _, s := range sinks {
+		if closer, ok := s.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				slog.Error("Error closing sink", "sink", s.Name(), "error", err)
+			}
+		}
+	}
+}
+
+func sinkNames() []string {
+	names := make([]string, 0, len(sinkRegistry))
+	for name := range sinkRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SinksConfig holds the settings of the non-HTTP sinks; the HTTP sink keeps
+// using the top-level api section.
+type SinksConfig struct {
+	Kafka         KafkaSinkConfig         `yaml:"kafka" json:"kafka"`
+	Prometheus    PrometheusSinkConfig    `yaml:"prometheus" json:"prometheus"`
+	Elasticsearch ElasticsearchSinkConfig `yaml:"elasticsearch" json:"elasticsearch"`
+	S3            S3SinkConfig            `yaml:"s3" json:"s3"`
+	File          FileSinkConfig          `yaml:"file" json:"file"`
+	GRPC          GRPCSinkConfig          `yaml:"grpc" json:"grpc"`
+	OTLP          OTLPSinkConfig          `yaml:"otlp" json:"otlp"`
+	ClickHouse    ClickHouseSinkConfig    `yaml:"clickhouse" json:"clickhouse"`
+	Postgres      PostgresSinkConfig      `yaml:"postgres" json:"postgres"`
+	NATS          NATSSinkConfig          `yaml:"nats" json:"nats"`
+	MQTT          MQTTSinkConfig          `yaml:"mqtt" json:"mqtt"`
+	Kinesis       KinesisSinkConfig       `yaml:"kinesis" json:"kinesis"`
+	PubSub        PubSubSinkConfig        `yaml:"pubsub" json:"pubsub"`
+}
+
+func defaultSinksConfig() SinksConfig {
+	return SinksConfig{
+		Kafka:         defaultKafkaSinkConfig(),
+		Prometheus:    defaultPrometheusSinkConfig(),
+		Elasticsearch: defaultElasticsearchSinkConfig(),
+		S3:            defaultS3SinkConfig(),
+		File:          defaultFileSinkConfig(),
+		GRPC:          defaultGRPCSinkConfig(),
+		OTLP:          defaultOTLPSinkConfig(),
+		ClickHouse:    defaultClickHouseSinkConfig(),
+		Postgres:      defaultPostgresSinkConfig(),
+		NATS:          defaultNATSSinkConfig(),
+		MQTT:          defaultMQTTSinkConfig(),
+		Kinesis:       defaultKinesisSinkConfig(),
+		PubSub:        defaultPubSubSinkConfig(),
+	}
+}
+
+func (s *SinksConfig) validate(selected string) []error {
+	switch selected {
+	case "kafka":
+		return s.Kafka.validate()
+	case "prometheus":
+		return s.Prometheus.validate()
+	case "elasticsearch":
+		return s.Elasticsearch.validate()
+	case "s3":
+		return s.S3.validate()
+	case "file":
+		return s.File.validate()
+	case "grpc":
+		return s.GRPC.validate()
+	case "otlp":
+		return s.OTLP.validate()
+	case "clickhouse":
+		return s.ClickHouse.validate()
+	case "postgres":
+		return s.Postgres.validate()
+	case "nats":
+		return s.NATS.validate()
+	case "mqtt":
+		return s.MQTT.validate()
+	case "kinesis":
+		return s.Kinesis.validate()
+	case "pubsub":
+		return s.PubSub.validate()
+	}
+	return nil
+}
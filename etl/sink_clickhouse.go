@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+//////////////////////////////////////////////////
+// ClickHouse Sink
+//////////////////////////////////////////////////
+
+type ClickHouseSinkConfig struct {
+	Addrs    []string  `yaml:"addrs" json:"addrs"` // native protocol, host:port
+	Database string    `yaml:"database" json:"database"`
+	Table    string    `yaml:"table" json:"table"`
+	Username string    `yaml:"username" json:"username"`
+	Password string    `yaml:"password" json:"password" secret:"true"`
+	Secure   bool      `yaml:"secure" json:"secure"` // TLS, usually on port 9440
+	TLS      TLSConfig `yaml:"tls" json:"tls"`
+	// Columns maps indicators to Nullable(Float64) columns, which are NULL
+	// in rows of records without that indicator. Indicators not listed, or
+	// mapped to "", go to IndicatorsColumn, a Map(String, Float64), or are
+	// dropped when it is empty.
+	Columns          map[string]string `yaml:"columns" json:"columns"`
+	IndicatorsColumn string            `yaml:"indicators_column" json:"indicators_column"`
+	LabelsColumn     string            `yaml:"labels_column" json:"labels_column"` // Map(String, String); empty drops labels
+	// AsyncInsert has the server buffer inserts and write them in larger
+	// parts. With WaitForAsyncInsert, a batch counts as loaded only once
+	// its part is written, so a failed flush is retried and spilled.
+	AsyncInsert        bool        `yaml:"async_insert" json:"async_insert"`
+	WaitForAsyncInsert bool        `yaml:"wait_for_async_insert" json:"wait_for_async_insert"`
+	Compression        string      `yaml:"compression" json:"compression"` // none, lz4 or zstd
+	MaxOpenConns       int         `yaml:"max_open_conns" json:"max_open_conns"`
+	DialTimeout        Duration    `yaml:"dial_timeout" json:"dial_timeout"`
+	Timeout            Duration    `yaml:"timeout" json:"timeout"`
+	Retry              RetryConfig `yaml:"retry" json:"retry"`
+}
+
+func defaultClickHouseSinkConfig() ClickHouseSinkConfig {
+	return ClickHouseSinkConfig{
+		Addrs:    []string{"localhost:9000"},
+		Database: "default",
+		Table:    "device_metrics",
+		Username: "default",
+		TLS:      defaultTLSConfig(),
+		Columns: map[string]string{
+			"utilization": "utilization",
+			"nice":        "nice",
+			"user":        "user",
+			"system":      "system",
+			"irq":         "irq",
+		},
+		IndicatorsColumn:   "indicators",
+		LabelsColumn:       "labels",
+		AsyncInsert:        true,
+		WaitForAsyncInsert: true,
+		Compression:        "lz4",
+		MaxOpenConns:       10,
+		DialTimeout:        Duration(10 * time.Second),
+		Timeout:            Duration(30 * time.Second),
+		Retry:              defaultRetryConfig(),
+	}
+}
+
+var clickHouseCompressions = map[string]clickhouse.CompressionMethod{
+	"none": clickhouse.CompressionNone,
+	"lz4":  clickhouse.CompressionLZ4,
+	"zstd": clickhouse.CompressionZSTD,
+}
+
+func (c *ClickHouseSinkConfig) validate() []error {
+	var errs []error
+	if len(c.Addrs) == 0 {
+		errs = append(errs, errors.New("sinks.clickhouse.addrs must list at least one server"))
+	}
+	if c.Table == "" {
+		errs = append(errs, errors.New("sinks.clickhouse.table must be set"))
+	}
+	if c.Secure {
+		errs = append(errs, c.TLS.validate("sinks.clickhouse.tls")...)
+	}
+	seen := map[string]string{}
+	for _, col := range clickHouseKeyColumns {
+		seen[col] = "a key column"
+	}
+	for _, ind := range sortedKeys(c.Columns) {
+		col := c.Columns[ind]
+		if col == "" {
+			continue
+		}
+		if prev, ok := seen[col]; ok {
+			errs = append(errs, fmt.Errorf("sinks.clickhouse.columns.%s: column %q is already %s", ind, col, prev))
+		}
+		seen[col] = "indicator " + ind
+	}
+	for key, col := range map[string]string{"indicators_column": c.IndicatorsColumn, "labels_column": c.LabelsColumn} {
+		if prev, ok := seen[col]; ok && col != "" {
+			errs = append(errs, fmt.Errorf("sinks.clickhouse.%s: column %q is already %s", key, col, prev))
+		}
+	}
+	if c.IndicatorsColumn != "" && c.IndicatorsColumn == c.LabelsColumn {
+		errs = append(errs, errors.New("sinks.clickhouse.indicators_column and labels_column must differ"))
+	}
+	if _, ok := clickHouseCompressions[c.Compression]; !ok {
+		errs = append(errs, fmt.Errorf("sinks.clickhouse.compression must be none, lz4 or zstd, got %q", c.Compression))
+	}
+	if c.MaxOpenConns <= 0 {
+		errs = append(errs, fmt.Errorf("sinks.clickhouse.max_open_conns must be > 0, got %d", c.MaxOpenConns))
+	}
+	if c.DialTimeout <= 0 {
+		errs = append(errs, errors.New("sinks.clickhouse.dial_timeout must be > 0"))
+	}
+	if c.Timeout <= 0 {
+		errs = append(errs, errors.New("sinks.clickhouse.timeout must be > 0"))
+	}
+	errs = append(errs, c.Retry.validate("sinks.clickhouse.retry")...)
+	return errs
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func init() {
+	registerSink("clickhouse", newClickHouseSink)
+}
+
+// clickHouseKeyColumns are the columns every row fills, in this order,
+// ahead of the indicator columns.
+var clickHouseKeyColumns = []string{"name", "cpu_number", "timestamp", "metric", "device"}
+
+// clickHouseSink inserts one row per record over the native protocol. A
+// batch is one INSERT, sent as a single block, that the server buffers
+// with async inserts.
+type clickHouseSink struct {
+	conf       ClickHouseSinkConfig
+	conn       driver.Conn
+	query      string
+	indicators []string // indicators with a column of their own, in column order
+	settings   clickhouse.Settings
+}
+
+func newClickHouseSink(cfg *Config) (Sink, error) {
+	conf := cfg.Sinks.ClickHouse
+	opts := &clickhouse.Options{
+		Addr: conf.Addrs,
+		Auth: clickhouse.Auth{
+			Database: conf.Database,
+			Username: conf.Username,
+			Password: conf.Password,
+		},
+		Compression:  &clickhouse.Compression{Method: clickHouseCompressions[conf.Compression]},
+		DialTimeout:  conf.DialTimeout.Std(),
+		MaxOpenConns: conf.MaxOpenConns,
+		MaxIdleConns: conf.MaxOpenConns,
+		ClientInfo: clickhouse.ClientInfo{
+			Products: []struct{ Name, Version string }{{Name: "concurrent-etl"}},
+		},
+	}
+	if conf.Secure {
+		tlsConf, err := conf.TLS.build()
+		if err != nil {
+			return nil, fmt.Errorf("sinks.clickhouse.tls: %w", err)
+		}
+		opts.TLS = tlsConf
+	}
+	conn, err := clickhouse.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &clickHouseSink{conf: conf, conn: conn}
+	cols := append([]string(nil), clickHouseKeyColumns...)
+	for _, ind := range sortedKeys(conf.Columns) {
+		if col := conf.Columns[ind]; col != "" {
+			c.indicators = append(c.indicators, ind)
+			cols = append(cols, col)
+		}
+	}
+	for _, col := range []string{conf.IndicatorsColumn, conf.LabelsColumn} {
+		if col != "" {
+			cols = append(cols, col)
+		}
+	}
+	for i, col := range cols {
+		cols[i] = quoteClickHouseIdent(col)
+	}
+	table := quoteClickHouseIdent(conf.Table)
+	if conf.Database != "" {
+		table = quoteClickHouseIdent(conf.Database) + "." + table
+	}
+	c.query = fmt.Sprintf("INSERT INTO %s (%s)", table, strings.Join(cols, ", "))
+	if conf.AsyncInsert {
+		c.settings = clickhouse.Settings{"async_insert": 1, "wait_for_async_insert": 0}
+		if conf.WaitForAsyncInsert {
+			c.settings["wait_for_async_insert"] = 1
+		}
+	}
+	return c, nil
+}
+
+func (c *clickHouseSink) Name() string {
+	return "clickhouse"
+}
+
+func (c *clickHouseSink) Load(ctx context.Context, data []DeviceData) error {
+	attempts, err := withRetry(ctx, c.conf.Retry, "clickhouse", func(int) error {
+		return clickHouseError(c.insert(ctx, data))
+	})
+	if err != nil {
+		return &AttemptsError{Attempts: attempts, Err: err}
+	}
+	return nil
+}
+
+// insert sends data as one block.
+func (c *clickHouseSink) insert(ctx context.Context, data []DeviceData) error {
+	ctx, cancel := context.WithTimeout(ctx, c.conf.Timeout.Std())
+	defer cancel()
+	if c.settings != nil {
+		ctx = clickhouse.Context(ctx, clickhouse.WithSettings(c.settings))
+	}
+	batch, err := c.conn.PrepareBatch(ctx, c.query)
+	if err != nil {
+		return err
+	}
+	defer batch.Abort()
+
+	row := make([]any, 0, len(clickHouseKeyColumns)+len(c.indicators)+2)
+	for _, d := range data {
+		values := make(map[string]float64, len(d.Indicators))
+		for _, ind := range d.Indicators {
+			values[ind.Name] = ind.Value
+		}
+		row = append(row[:0], d.Name, d.CPUNumber, time.Unix(int64(d.Timestamp), 0).UTC(), d.Metric, d.Device)
+		for _, ind := range c.indicators {
+			if v, ok := values[ind]; ok {
+				row = append(row, &v)
+				delete(values, ind)
+			} else {
+				row = append(row, (*float64)(nil))
+			}
+		}
+		if c.conf.IndicatorsColumn != "" {
+			row = append(row, values)
+		}
+		if c.conf.LabelsColumn != "" {
+			labels := d.Labels
+			if labels == nil {
+				labels = map[string]string{}
+			}
+			row = append(row, labels)
+		}
+		// Append fails on values the columns can't take, which no retry
+		// changes.
+		if err := batch.Append(row...); err != nil {
+			return &APIError{StatusCode: http.StatusBadRequest, Body: err.Error()}
+		}
+	}
+	return batch.Send()
+}
+
+func (c *clickHouseSink) Close() error {
+	return c.conn.Close()
+}
+
+func quoteClickHouseIdent(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "\\`") + "`"
+}
+
+// clickHouseHTTPStatus is the HTTP status a ClickHouse error code counts
+// as, like grpcHTTPStatus. Other server exceptions count as 500 and are
+// retried.
+var clickHouseHTTPStatus = map[int32]int{
+	16:  http.StatusBadRequest,         // NO_SUCH_COLUMN_IN_TABLE
+	27:  http.StatusBadRequest,         // CANNOT_PARSE_INPUT_ASSERTION_FAILED
+	53:  http.StatusBadRequest,         // TYPE_MISMATCH
+	60:  http.StatusBadRequest,         // UNKNOWN_TABLE
+	62:  http.StatusBadRequest,         // SYNTAX_ERROR
+	70:  http.StatusBadRequest,         // CANNOT_CONVERT_TYPE
+	81:  http.StatusBadRequest,         // UNKNOWN_DATABASE
+	159: http.StatusGatewayTimeout,     // TIMEOUT_EXCEEDED
+	202: http.StatusTooManyRequests,    // TOO_MANY_SIMULTANEOUS_QUERIES
+	241: http.StatusServiceUnavailable, // MEMORY_LIMIT_EXCEEDED
+	242: http.StatusServiceUnavailable, // TABLE_IS_READ_ONLY
+	252: http.StatusTooManyRequests,    // TOO_MANY_PARTS
+	497: http.StatusForbidden,          // ACCESS_DENIED
+	516: http.StatusUnauthorized,       // AUTHENTICATION_FAILED
+}
+
+// clickHouseError turns a server exception into an APIError, so the retry,
+// spill and dead-letter decisions made for the load API apply. Refused
+// credentials are permanent: unlike an API token they don't refresh, so
+// replays would only fail again. Network errors are left as they are.
+func clickHouseError(err error) error {
+	var ex *clickhouse.Exception
+	if !errors.As(err, &ex) {
+		return err
+	}
+	code, ok := clickHouseHTTPStatus[ex.Code]
+	if !ok {
+		code = http.StatusInternalServerError
+	}
+	apiErr := &APIError{StatusCode: code, Body: ex.Message, Code: ex.Name, Message: ex.Message}
+	if isAuthFailure(apiErr) {
+		return permanent(apiErr)
+	}
+	return apiErr
+}
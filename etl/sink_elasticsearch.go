@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// Elasticsearch Bulk Sink
+//////////////////////////////////////////////////
+
+type ElasticsearchSinkConfig struct {
+	URL        string      `yaml:"url" json:"url"`
+	Index      string      `yaml:"index" json:"index"`
+	DateFormat string      `yaml:"date_format" json:"date_format"`
+	Username   string      `yaml:"username" json:"username"`
+	Password   string      `yaml:"password" json:"password" secret:"true"`
+	APIKey     string      `yaml:"api_key" json:"api_key" secret:"true"`
+	Timeout    Duration    `yaml:"timeout" json:"timeout"`
+	Retry      RetryConfig `yaml:"retry" json:"retry"`
+}
+
+func defaultElasticsearchSinkConfig() ElasticsearchSinkConfig {
+	return ElasticsearchSinkConfig{
+		URL:        "http://localhost:9200",
+		Index:      "device-metrics-{date}",
+		DateFormat: "2006.01.02",
+		Timeout:    Duration(30 * time.Second),
+		Retry:      defaultRetryConfig(),
+	}
+}
+
+func (e *ElasticsearchSinkConfig) validate() []error {
+	var errs []error
+	if !strings.HasPrefix(e.URL, "http://") && !strings.HasPrefix(e.URL, "https://") {
+		errs = append(errs, fmt.Errorf("sinks.elasticsearch.url must be an http(s) URL, got %q", e.URL))
+	}
+	if e.Index == "" {
+		errs = append(errs, errors.New("sinks.elasticsearch.index must be set"))
+	}
+	if strings.Contains(e.Index, "{date}") && e.DateFormat == "" {
+		errs = append(errs, errors.New("sinks.elasticsearch.date_format must be set when index uses {date}"))
+	}
+	if e.Timeout <= 0 {
+		errs = append(errs, errors.New("sinks.elasticsearch.timeout must be > 0"))
+	}
+	errs = append(errs, e.Retry.validate("sinks.elasticsearch.retry")...)
+	return errs
+}
+
+func init() {
+	registerSink("elasticsearch", func(cfg *Config) (Sink, error) {
+		conf := cfg.Sinks.Elasticsearch
+		return &elasticsearchSink{
+			conf:   conf,
+			client: loadClient(conf.Timeout.Std()),
+		}, nil
+	})
+}
+
+// elasticsearchSink indexes one document per record through the _bulk API.
+// The index name is templated by the record's date, and only the items the
+// bulk response reports as failed are retried.
+type elasticsearchSink struct {
+	conf   ElasticsearchSinkConfig
+	client *http.Client
+}
+
+type esDocument struct {
+	Timestamp string `json:"@timestamp"`
+	DeviceData
+}
+
+type esBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+		Error  *struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+func (e *elasticsearchSink) Name() string {
+	return "elasticsearch"
+}
+
+func (e *elasticsearchSink) Load(ctx context.Context, data []DeviceData) error {
+	pending := data
+	var rejected []DeviceData
+	var rejectErr error
+
+	attempts, err := withRetry(ctx, e.conf.Retry, "elasticsearch", func(int) error {
+		res, err := e.bulk(ctx, pending)
+		if err != nil {
+			return err
+		}
+		rejected = append(rejected, res.reject...)
+		if rejectErr == nil {
+			rejectErr = res.rejectErr
+		}
+		pending = res.retry
+		if len(pending) > 0 {
+			return fmt.Errorf("%d bulk items failed transiently: %w", len(pending), res.retryErr)
+		}
+		return nil
+	})
+
+	if err != nil && len(pending) == len(data) {
+		return &AttemptsError{Attempts: attempts, Err: err}
+	}
+	if err == nil && len(rejected) == 0 {
+		return nil
+	}
+	// Items failing transiently keep the error of the retries, so they are
+	// queued or spilled; rejected items are dead-lettered.
+	partial := &PartialError{Rejected: rejected}
+	if err != nil {
+		partial.Failed, partial.Err = pending, &AttemptsError{Attempts: attempts, Err: err}
+	}
+	if len(rejected) > 0 {
+		partial.RejectErr = &AttemptsError{Attempts: attempts,
+			Err: &APIError{StatusCode: http.StatusBadRequest, Body: rejectErr.Error()}}
+	}
+	return partial
+}
+
+// esBulkResult splits the records a _bulk request couldn't index into those
+// worth retrying (429/5xx) and those rejected outright, each with the first
+// item error seen.
+type esBulkResult struct {
+	retry     []DeviceData
+	reject    []DeviceData
+	retryErr  error
+	rejectErr error
+}
+
+// bulk sends one _bulk request for data.
+func (e *elasticsearchSink) bulk(ctx context.Context, data []DeviceData) (esBulkResult, error) {
+	var res esBulkResult
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, d := range data {
+		ts := time.Unix(int64(d.Timestamp), 0).UTC()
+		index := strings.ReplaceAll(e.conf.Index, "{date}", ts.Format(e.conf.DateFormat))
+		action := map[string]map[string]string{"index": {"_index": index}}
+		if err := enc.Encode(action); err != nil {
+			return res, err
+		}
+		if err := enc.Encode(esDocument{Timestamp: ts.Format(time.RFC3339), DeviceData: d}); err != nil {
+			return res, err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(e.conf.URL, "/")+"/_bulk", &body)
+	if err != nil {
+		return res, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if e.conf.APIKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+e.conf.APIKey)
+	} else if e.conf.Username != "" {
+		req.SetBasicAuth(e.conf.Username, e.conf.Password)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return res, err
+	}
+	defer func() {
+		drainBody(resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return res, &APIError{StatusCode: resp.StatusCode, Body: string(msg),
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+	}
+
+	var result esBulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return res, fmt.Errorf("decoding bulk response: %w", err)
+	}
+	if !result.Errors {
+		return res, nil
+	}
+	if len(result.Items) != len(data) {
+		return res, fmt.Errorf("bulk response has %d items for %d documents", len(result.Items), len(data))
+	}
+
+	for i, item := range result.Items {
+		for _, r := range item {
+			if r.Error == nil {
+				continue
+			}
+			itemErr := fmt.Errorf("%s: %s", r.Error.Type, r.Error.Reason)
+			if r.Status == http.StatusTooManyRequests || r.Status >= 500 {
+				res.retry = append(res.retry, data[i])
+				if res.retryErr == nil {
+					res.retryErr = itemErr
+				}
+			} else {
+				res.reject = append(res.reject, data[i])
+				if res.rejectErr == nil {
+					res.rejectErr = itemErr
+				}
+			}
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// Local File Sink
+//////////////////////////////////////////////////
+
+type FileSinkConfig struct {
+	Dir       string   `yaml:"dir" json:"dir"`
+	Prefix    string   `yaml:"prefix" json:"prefix"`
+	MaxSizeMB int      `yaml:"max_size_mb" json:"max_size_mb"`
+	MaxAge    Duration `yaml:"max_age" json:"max_age"`
+	Gzip      bool     `yaml:"gzip" json:"gzip"`
+	// Format is ndjson or avro (object container files; gzip then selects
+	// the Avro deflate codec instead of compressing the whole file).
+	Format string `yaml:"format" json:"format"`
+}
+
+func defaultFileSinkConfig() FileSinkConfig {
+	return FileSinkConfig{
+		Dir:       "out",
+		Prefix:    "device-metrics",
+		MaxSizeMB: 100,
+		MaxAge:    Duration(time.Hour),
+		Format:    "ndjson",
+	}
+}
+
+func (f *FileSinkConfig) validate() []error {
+	var errs []error
+	if f.Dir == "" {
+		errs = append(errs, errors.New("sinks.file.dir must be set"))
+	}
+	if f.Prefix == "" || strings.ContainsRune(f.Prefix, filepath.Separator) {
+		errs = append(errs, fmt.Errorf("sinks.file.prefix must be a plain file name prefix, got %q", f.Prefix))
+	}
+	if f.MaxSizeMB < 0 {
+		errs = append(errs, errors.New("sinks.file.max_size_mb must be >= 0"))
+	}
+	if f.MaxAge < 0 {
+		errs = append(errs, errors.New("sinks.file.max_age must be >= 0"))
+	}
+	if f.Format != "ndjson" && f.Format != "avro" {
+		errs = append(errs, fmt.Errorf("sinks.file.format must be ndjson or avro, got %q", f.Format))
+	}
+	return errs
+}
+
+func init() {
+	registerSink("file", newFileSink)
+}
+
+// fileSink appends NDJSON records to <dir>/<prefix>-<opened>-<seq>.ndjson[.gz],
+// or Avro records, one block per batch, to <dir>/<prefix>-<opened>-<seq>.avro.
+// The active file carries a .part suffix that is dropped when it rotates
+// (by size or age) or the run ends, so a shipper can pick up every file
+// without the suffix as complete.
+type fileSink struct {
+	conf FileSinkConfig
+
+	mu      sync.Mutex
+	file    *os.File
+	counter *countingWriter
+	gz      *gzip.Writer
+	buf     *bufio.Writer
+	avro    *avroContainer
+	opened  time.Time
+	seq     int
+}
+
+func newFileSink(cfg *Config) (Sink, error) {
+	conf := cfg.Sinks.File
+	if err := os.MkdirAll(conf.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("file sink: %w", err)
+	}
+
+	// A crash leaves the active file behind; hand it over as-is.
+	parts, _ := filepath.Glob(filepath.Join(conf.Dir, conf.Prefix+"-*.part"))
+	for _, p := range parts {
+		if err := os.Rename(p, strings.TrimSuffix(p, ".part")); err != nil {
+			return nil, fmt.Errorf("file sink: finalizing %s: %w", p, err)
+		}
+		slog.Warn("Finalized file left over from a previous run", "component", "file_sink", "file", p)
+	}
+	return &fileSink{conf: conf}, nil
+}
+
+func (f *fileSink) Name() string {
+	return "file"
+}
+
+func (f *fileSink) Load(_ context.Context, data []DeviceData) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file != nil && f.due() {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+
+	if f.avro != nil {
+		if err := f.avro.WriteBlock(data); err != nil {
+			return err
+		}
+	} else {
+		enc := json.NewEncoder(f.buf)
+		for _, d := range data {
+			if err := enc.Encode(d); err != nil {
+				return err
+			}
+		}
+	}
+	// Push whole batches to disk so a crash loses at most the one in flight.
+	if err := f.buf.Flush(); err != nil {
+		return err
+	}
+	if f.gz != nil {
+		return f.gz.Flush()
+	}
+	return nil
+}
+
+func (f *fileSink) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	return f.rotate()
+}
+
+// due reports whether the active file has reached max_size_mb or max_age.
+func (f *fileSink) due() bool {
+	if f.conf.MaxSizeMB > 0 && f.counter.n >= int64(f.conf.MaxSizeMB)<<20 {
+		return true
+	}
+	return f.conf.MaxAge > 0 && time.Since(f.opened) >= f.conf.MaxAge.Std()
+}
+
+func (f *fileSink) open() error {
+	f.opened = time.Now().UTC()
+	f.seq++
+	name := fmt.Sprintf("%s-%s-%04d.%s", f.conf.Prefix, f.opened.Format("20060102T150405Z"), f.seq, f.conf.Format)
+	if f.conf.Gzip && f.conf.Format == "ndjson" {
+		name += ".gz"
+	}
+
+	file, err := os.OpenFile(filepath.Join(f.conf.Dir, name+".part"), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	f.file = file
+	f.counter = &countingWriter{w: file}
+
+	var w io.Writer = f.counter
+	if f.conf.Gzip && f.conf.Format == "ndjson" {
+		f.gz = gzip.NewWriter(f.counter)
+		w = f.gz
+	}
+	f.buf = bufio.NewWriter(w)
+	if f.conf.Format == "avro" {
+		f.avro, err = newAvroContainer(f.buf, f.conf.Gzip)
+	}
+	return err
+}
+
+// rotate closes the active file and drops its .part suffix. The next Load
+// opens a fresh one.
+func (f *fileSink) rotate() error {
+	err := f.buf.Flush()
+	if f.gz != nil {
+		err = errors.Join(err, f.gz.Close())
+	}
+	err = errors.Join(err, f.file.Sync(), f.file.Close())
+
+	part := f.file.Name()
+	f.file, f.counter, f.gz, f.buf, f.avro = nil, nil, nil, nil, nil
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(part, strings.TrimSuffix(part, ".part")); err != nil {
+		return err
+	}
+	slog.Info("Rotated output file", "component", "file_sink", "file", strings.TrimSuffix(part, ".part"))
+	return nil
+}
+
+// countingWriter tracks the bytes that reach the file, i.e. after
+// compression, for size-based rotation.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
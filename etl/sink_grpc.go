@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	_ "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+//////////////////////////////////////////////////
+// gRPC Sink
+//////////////////////////////////////////////////
+
+type GRPCSinkConfig struct {
+	// Target is host:port, or any gRPC target such as dns:///ingest:443.
+	Target   string    `yaml:"target" json:"target"`
+	Insecure bool      `yaml:"insecure" json:"insecure"` // plaintext instead of TLS
+	TLS      TLSConfig `yaml:"tls" json:"tls"`
+	Token    string    `yaml:"token" json:"token" secret:"true"` // sent as "authorization: Bearer <token>"
+	// ChunkSize is the most records sent in one LoadRequest message; a
+	// larger batch is streamed as several.
+	ChunkSize   int         `yaml:"chunk_size" json:"chunk_size"`
+	Compression string      `yaml:"compression" json:"compression"` // none or gzip
+	Timeout     Duration    `yaml:"timeout" json:"timeout"`
+	Retry       RetryConfig `yaml:"retry" json:"retry"`
+}
+
+func defaultGRPCSinkConfig() GRPCSinkConfig {
+	return GRPCSinkConfig{
+		Target:      "localhost:9090",
+		TLS:         defaultTLSConfig(),
+		ChunkSize:   1000,
+		Compression: "none",
+		Timeout:     Duration(30 * time.Second),
+		Retry:       defaultRetryConfig(),
+	}
+}
+
+func (g *GRPCSinkConfig) validate() []error {
+	var errs []error
+	if g.Target == "" {
+		errs = append(errs, errors.New("sinks.grpc.target must be set"))
+	}
+	if !g.Insecure {
+		errs = append(errs, g.TLS.validate("sinks.grpc.tls")...)
+	}
+	if g.ChunkSize <= 0 {
+		errs = append(errs, errors.New("sinks.grpc.chunk_size must be > 0"))
+	}
+	if g.Compression != "none" && g.Compression != "gzip" {
+		errs = append(errs, fmt.Errorf("sinks.grpc.compression must be none or gzip, got %q", g.Compression))
+	}
+	if g.Timeout <= 0 {
+		errs = append(errs, errors.New("sinks.grpc.timeout must be > 0"))
+	}
+	errs = append(errs, g.Retry.validate("sinks.grpc.retry")...)
+	return errs
+}
+
+func init() {
+	registerSink("grpc", newGRPCSink)
+}
+
+// grpcLoadMethod is the Load service of proto/device_data.proto. A batch is
+// streamed as LoadRequest chunks and the server answers once it has loaded
+// all of them.
+const grpcLoadMethod = "/concurrentetl.v1.Load/Load"
+
+var grpcLoadStream = grpc.StreamDesc{StreamName: "Load", ClientStreams: true}
+
+// grpcSink streams each batch to the Load service over one connection
+// shared by the load workers.
+type grpcSink struct {
+	conf  GRPCSinkConfig
+	conn  *grpc.ClientConn
+	calls []grpc.CallOption
+}
+
+func newGRPCSink(cfg *Config) (Sink, error) {
+	conf := cfg.Sinks.GRPC
+	creds := insecure.NewCredentials()
+	if !conf.Insecure {
+		tlsConf, err := conf.TLS.build()
+		if err != nil {
+			return nil, fmt.Errorf("sinks.grpc.tls: %w", err)
+		}
+		creds = credentials.NewTLS(tlsConf)
+	}
+	conn, err := grpc.NewClient(conf.Target, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	g := &grpcSink{conf: conf, conn: conn, calls: []grpc.CallOption{grpc.ForceCodec(grpcRawCodec{})}}
+	if conf.Compression == "gzip" {
+		g.calls = append(g.calls, grpc.UseCompressor("gzip"))
+	}
+	return g, nil
+}
+
+func (g *grpcSink) Name() string {
+	return "grpc"
+}
+
+func (g *grpcSink) Load(ctx context.Context, data []DeviceData) error {
+	batchID := batchIDFrom(ctx)
+	if batchID == "" {
+		batchID = newBatchID(data)
+	}
+	attempts, err := withRetry(ctx, g.conf.Retry, "grpc", func(int) error {
+		return g.send(ctx, batchID, data)
+	})
+	if err != nil {
+		return &AttemptsError{Attempts: attempts, Err: err}
+	}
+	return nil
+}
+
+// send streams one batch. Every chunk carries the batch ID, which stays
+// the same across retries so the server can drop a batch it already has.
+func (g *grpcSink) send(ctx context.Context, batchID string, data []DeviceData) error {
+	ctx, cancel := context.WithTimeout(ctx, g.conf.Timeout.Std())
+	defer cancel()
+	if g.conf.Token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+g.conf.Token)
+	}
+	stream, err := g.conn.NewStream(ctx, &grpcLoadStream, grpcLoadMethod, g.calls...)
+	if err != nil {
+		return grpcError(err)
+	}
+	for start := 0; start < len(data); start += g.conf.ChunkSize {
+		// Messages may be held after SendMsg returns, so each is a new
+		// slice.
+		msg := appendBatchProto(nil, data[start:min(start+g.conf.ChunkSize, len(data))])
+		msg = appendProtoString(msg, 2, batchID)
+		// io.EOF means the server ended the call early; its status is
+		// what RecvMsg returns.
+		if err := stream.SendMsg(msg); err == io.EOF {
+			break
+		} else if err != nil {
+			return grpcError(err)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		return grpcError(err)
+	}
+	var resp []byte
+	return grpcError(stream.RecvMsg(&resp))
+}
+
+func (g *grpcSink) Close() error {
+	return g.conn.Close()
+}
+
+// grpcRawCodec passes messages through as bytes already encoded with
+// protowire, like the HTTP sink's protobuf payloads, so no generated code
+// is needed.
+type grpcRawCodec struct{}
+
+func (grpcRawCodec) Name() string {
+	return "proto"
+}
+
+func (grpcRawCodec) Marshal(v any) ([]byte, error) {
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("grpc: cannot marshal %T", v)
+	}
+	return b, nil
+}
+
+func (grpcRawCodec) Unmarshal(data []byte, v any) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("grpc: cannot unmarshal into %T", v)
+	}
+	*b = append((*b)[:0], data...)
+	return nil
+}
+
+// grpcHTTPStatus is the HTTP status a gRPC status code counts as, so the
+// retry, spill and dead-letter decisions made for the load API apply.
+var grpcHTTPStatus = map[codes.Code]int{
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.FailedPrecondition: http.StatusBadRequest,
+	codes.OutOfRange:         http.StatusBadRequest,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.NotFound:           http.StatusNotFound,
+	codes.AlreadyExists:      http.StatusConflict,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.Unimplemented:      http.StatusNotImplemented,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+	codes.Aborted:            http.StatusServiceUnavailable,
+	codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+	codes.Internal:           http.StatusInternalServerError,
+	codes.Unknown:            http.StatusInternalServerError,
+	codes.DataLoss:           http.StatusInternalServerError,
+}
+
+// grpcError turns the status of a failed call into an APIError. Codes with
+// no counterpart, like Canceled, are left as they are.
+func grpcError(err error) error {
+	st, ok := status.FromError(err)
+	if err == nil || !ok {
+		return err
+	}
+	code, known := grpcHTTPStatus[st.Code()]
+	if !known {
+		return err
+	}
+	return &APIError{StatusCode: code, Body: st.Message(), Code: st.Code().String(), Message: st.Message()}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+)
+
+//////////////////////////////////////////////////
+// HTTP Load API Sink
+//////////////////////////////////////////////////
+
+func init() {
+	registerSink("http", newHTTPSink)
+}
+
+// httpSink posts batches as JSON, protobuf or msgpack to api.endpoint. The
+// circuit breaker and rate limiter are shared by every load worker using the
+// sink.
+type httpSink struct {
+	conf    APIConfig
+	client  *http.Client
+	breaker *CircuitBreaker
+	limiter *rate.Limiter
+	zstd    *zstd.Encoder // set with compression: zstd; EncodeAll is safe for concurrent use
+	tokens  *tokenSource  // set with api.oauth2; otherwise api.auth_token is sent
+	// protoRejected is set once the API answers 415 to protobuf with
+	// format: auto; JSON is sent from then on.
+	protoRejected atomic.Bool
+}
+
+func newHTTPSink(cfg *Config) (Sink, error) {
+	s := &httpSink{
+		conf:    cfg.API,
+		client:  loadClient(cfg.API.Timeout.Std()),
+		limiter: newLoadLimiter(cfg.API.RateLimit),
+	}
+	if cb := cfg.API.CircuitBreaker; cb.Enabled {
+		s.breaker = newCircuitBreaker(cb, probeHealth(cb.HealthEndpoint, cfg.API.Timeout.Std()))
+	}
+	if cfg.API.OAuth2.TokenURL != "" {
+		s.tokens = newTokenSource(cfg.API.OAuth2)
+	}
+	if cfg.API.Compression == "zstd" {
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		s.zstd = enc
+	}
+	return s, nil
+}
+
+func (s *httpSink) Name() string {
+	return "http"
+}
+
+// Healthy is false while the circuit breaker is open; once its cooldown
+// has passed, asking probes the health endpoint.
+func (s *httpSink) Healthy() bool {
+	return s.breaker == nil || s.breaker.Allow()
+}
+
+func (s *httpSink) Close() error {
+	if s.zstd != nil {
+		return s.zstd.Close()
+	}
+	return nil
+}
+
+func (s *httpSink) Load(ctx context.Context, data []DeviceData) error {
+	attempts, err := s.send(ctx, data)
+	if err != nil {
+		return &AttemptsError{Attempts: attempts, Err: err}
+	}
+	return nil
+}
+
+// send posts a batch, retrying transient failures. It returns the number of
+// attempts made alongside the final error.
+func (s *httpSink) send(ctx context.Context, data []DeviceData) (int, error) {
+	body, err := s.encode(data)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { body.release() }()
+
+	retry := s.conf.Retry
+	reauthorized := false
+	for attempt := 1; ; attempt++ {
+		if s.breaker != nil && !s.breaker.Allow() {
+			return attempt - 1, errCircuitOpen
+		}
+		if s.limiter != nil {
+			if err := s.limiter.Wait(ctx); err != nil {
+				return attempt - 1, err
+			}
+		}
+
+		attemptStart := time.Now()
+		auth := s.conf.AuthToken
+		err = nil
+		if s.tokens != nil {
+			auth, err = s.tokens.Authorization(ctx)
+		}
+		status := 0
+		if err == nil {
+			status, err = s.post(ctx, data, body, auth, attempt)
+		}
+		audit := func(decision string) {
+			auditLog.attempt(ctx, s.Name(), s.conf.Endpoint, len(data), attempt, status, time.Since(attemptStart), err, decision)
+		}
+		if s.breaker != nil {
+			if err != nil && isRetryable(err) {
+				s.breaker.RecordFailure()
+			} else {
+				s.breaker.RecordSuccess()
+			}
+		}
+		if body.contentType == contentTypeProtobuf && s.conf.Format == "auto" && isUnsupportedMediaType(err) {
+			audit(decisionRetry)
+			if !s.protoRejected.Swap(true) {
+				slog.Info("Load API does not accept protobuf, falling back to JSON", "component", "loader", "error", err)
+			}
+			next, err := s.encode(data)
+			if err != nil {
+				return attempt, err
+			}
+			body.release()
+			body = next
+			continue
+		}
+		// A 401 means the token was revoked or expired early; one fresh
+		// token per batch, so bad credentials don't loop.
+		if s.tokens != nil && isUnauthorized(err) && !reauthorized {
+			reauthorized = true
+			audit(decisionRetry)
+			s.tokens.Invalidate(auth)
+			slog.Info("Load API rejected the access token, fetching a new one", "component", "loader")
+			continue
+		}
+		if err == nil || !isRetryable(err) || attempt >= retry.MaxAttempts {
+			audit(decisionDone)
+			return attempt, err
+		}
+		audit(decisionRetry)
+
+		delay := retry.retryDelay(attempt, err)
+		slog.Warn("Load attempt failed, retrying", "component", "loader", "batch_size", len(data),
+			"attempt", attempt, "max_attempts", retry.MaxAttempts, "retry_in_ms", delay.Milliseconds(), "error", err)
+		if !waitRetry(ctx, delay) {
+			return attempt, err
+		}
+	}
+}
+
+// requestBody is an encoded batch with its Content-Type and
+// Content-Encoding. A streamed body has no payload; the batch is encoded
+// into the request as it is sent, once per attempt.
+type requestBody struct {
+	payload     []byte
+	stream      bool
+	contentType string
+	encoding    string
+	bufs        []*bytes.Buffer // pooled buffers backing payload
+}
+
+// release returns the body's buffers to the pool once sending is over.
+func (b *requestBody) release() {
+	for _, buf := range b.bufs {
+		putBuffer(buf)
+	}
+	b.bufs = nil
+}
+
+// encode marshals a batch in the negotiated format and compresses it. JSON
+// batches of at least api.stream_threshold records are streamed instead.
+func (s *httpSink) encode(data []DeviceData) (*requestBody, error) {
+	if s.conf.StreamThreshold > 0 && len(data) >= s.conf.StreamThreshold && s.sendsJSON() {
+		// A batch this size is well over any sensible compression_threshold.
+		b := &requestBody{stream: true, contentType: "application/json"}
+		if s.conf.Compression != "none" {
+			b.encoding = s.conf.Compression
+		}
+		return b, nil
+	}
+
+	buf := getBuffer()
+	b := &requestBody{bufs: []*bytes.Buffer{buf}}
+	switch {
+	case s.conf.Format == "msgpack":
+		buf.Write(appendBatchMsgpack(buf.AvailableBuffer(), data))
+		b.contentType = contentTypeMsgpack
+	case !s.sendsJSON():
+		buf.Write(appendBatchProto(buf.AvailableBuffer(), data))
+		b.contentType = contentTypeProtobuf
+	default:
+		if err := json.NewEncoder(buf).Encode(data); err != nil {
+			b.release()
+			return nil, permanent(err)
+		}
+		b.contentType = "application/json"
+	}
+	if err := s.compress(b, buf.Bytes()); err != nil {
+		b.release()
+		return nil, err
+	}
+	return b, nil
+}
+
+// sendsJSON reports whether batches currently go out as JSON.
+func (s *httpSink) sendsJSON() bool {
+	return s.conf.Format == "json" || (s.conf.Format == "auto" && s.protoRejected.Load())
+}
+
+func isUnsupportedMediaType(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusUnsupportedMediaType
+}
+
+// compress sets the body's payload, encoded with api.compression once it
+// reaches api.compression_threshold, and its Content-Encoding ("" when sent
+// as is). Retries reuse the compressed payload.
+func (s *httpSink) compress(b *requestBody, payload []byte) error {
+	if len(payload) < s.conf.CompressionThreshold || s.conf.Compression == "none" {
+		b.payload = payload
+		return nil
+	}
+	out := getBuffer()
+	b.bufs = append(b.bufs, out)
+	switch s.conf.Compression {
+	case "gzip":
+		zw := getGzipWriter(out)
+		if _, err := zw.Write(payload); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		putGzipWriter(zw)
+	case "zstd":
+		out.Write(s.zstd.EncodeAll(payload, out.AvailableBuffer()))
+	}
+	b.payload, b.encoding = out.Bytes(), s.conf.Compression
+	return nil
+}
+
+// streamJSON writes a batch as a JSON array one record at a time, so the
+// whole payload is never held in memory, compressing it on the way with the
+// body's Content-Encoding.
+func (s *httpSink) streamJSON(w io.Writer, data []DeviceData, encoding string) error {
+	bw := bufio.NewWriterSize(w, 32<<10)
+	var out io.Writer = bw
+	var zw io.WriteCloser
+	switch encoding {
+	case "gzip":
+		gz := getGzipWriter(bw)
+		defer putGzipWriter(gz)
+		zw = gz
+	case "zstd":
+		enc, err := zstd.NewWriter(bw, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		zw = enc
+	}
+	if zw != nil {
+		out = zw
+	}
+
+	enc := json.NewEncoder(out)
+	if _, err := out.Write([]byte("[")); err != nil {
+		return err
+	}
+	for i, d := range data {
+		if i > 0 {
+			if _, err := out.Write([]byte(",")); err != nil {
+				return err
+			}
+		}
+		if err := enc.Encode(d); err != nil {
+			return err
+		}
+	}
+	if _, err := out.Write([]byte("]")); err != nil {
+		return err
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// post sends one request, returning the response's status code, 0 when
+// there was none.
+func (s *httpSink) post(ctx context.Context, data []DeviceData, body *requestBody, auth string, attempt int) (status int, err error) {
+	ctx, span := tracer.Start(ctx, "api.post", trace.WithAttributes(attribute.Int("attempt", attempt),
+		attribute.Bool("http.request.streamed", body.stream)))
+	defer func() { endSpan(span, err) }()
+
+	var reqBody io.Reader = bytes.NewReader(body.payload)
+	if body.stream {
+		// Closing the reader, on return or by the transport when the request
+		// fails, stops the writer.
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		go func() { pw.CloseWithError(s.streamJSON(pw, data, body.encoding)) }()
+		reqBody = pr
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", s.conf.Endpoint, reqBody)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Content-Type", body.contentType)
+	if body.encoding != "" {
+		req.Header.Set("Content-Encoding", body.encoding)
+	}
+	if id := batchIDFrom(ctx); s.conf.IdempotencyKey && id != "" {
+		req.Header.Set("Idempotency-Key", id)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		drainBody(resp.Body)
+		resp.Body.Close()
+	}()
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return resp.StatusCode, nil
+	}
+	msg, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, newAPIError(resp.StatusCode, resp.Header, msg)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// faultHandler answers the requests of a test in turn with the faults in
+// script, and takes the batch once the script runs out. A status of -1
+// resets the connection without a response. 429s ask to retry after
+// retryAfter, 0 by default.
+type faultHandler struct {
+	script     []int
+	retryAfter string
+
+	mu       sync.Mutex
+	requests int
+}
+
+func (h *faultHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	n := h.requests
+	h.requests++
+	h.mu.Unlock()
+
+	status := http.StatusOK
+	if n < len(h.script) {
+		status = h.script[n]
+	}
+	switch status {
+	case -1:
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			panic(err)
+		}
+		conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+	case http.StatusTooManyRequests:
+		w.Header().Set("Retry-After", cmp.Or(h.retryAfter, "0"))
+		http.Error(w, "slow down", status)
+	default:
+		http.Error(w, http.StatusText(status), status)
+	}
+}
+
+func (h *faultHandler) Requests() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.requests
+}
+
+func TestHTTPSinkFaults(t *testing.T) {
+	const reset = -1
+	tests := []struct {
+		name         string
+		script       []int
+		wantRequests int
+		want         sinkCounts
+	}{
+		{"loaded", nil, 1, sinkCounts{loaded: 5}},
+		{"loaded after server errors", []int{500, 503}, 3, sinkCounts{loaded: 5}},
+		{"loaded after throttling", []int{429}, 2, sinkCounts{loaded: 5}},
+		{"loaded after connection reset", []int{reset}, 2, sinkCounts{loaded: 5}},
+		{"retries exhausted, dead-lettered", []int{500, 502, 503}, 3, sinkCounts{deadLettered: 5}},
+		{"connection resets exhausted, dead-lettered", []int{reset, reset, reset}, 3, sinkCounts{deadLettered: 5}},
+		{"rejected, dead-lettered", []int{400}, 1, sinkCounts{deadLettered: 5}},
+		{"rejected after a retry, dead-lettered", []int{503, 422}, 2, sinkCounts{deadLettered: 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &faultHandler{script: tt.script}
+			srv := httptest.NewServer(h)
+			defer srv.Close()
+
+			s := newTestHTTPSink(t, srv.URL, RetryConfig{MaxAttempts: 3, BaseDelay: Duration(time.Millisecond),
+				MaxDelay: Duration(time.Millisecond)})
+			withTestLoadStage(t, s)
+
+			data := testRecords(5)
+			flushTo(s, newBatchID(data), data, 0)
+			if got := countsOf("http"); got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if got := h.Requests(); got != tt.wantRequests {
+				t.Errorf("%d requests, want %d", got, tt.wantRequests)
+			}
+		})
+	}
+}
+
+// A loader draining after shutdown doesn't wait out a Retry-After.
+func TestHTTPSinkShutdown(t *testing.T) {
+	h := &faultHandler{script: []int{http.StatusTooManyRequests}, retryAfter: "3600"}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	s := newTestHTTPSink(t, srv.URL, RetryConfig{MaxAttempts: 3, BaseDelay: Duration(time.Millisecond),
+		MaxDelay: Duration(time.Hour)})
+	withTestLoadStage(t, s)
+	shutdown := make(chan struct{})
+	close(shutdown)
+	loadCtx = withShutdown(context.Background(), shutdown)
+	t.Cleanup(func() { loadCtx = context.Background() })
+
+	data := testRecords(5)
+	start := time.Now()
+	flushTo(s, newBatchID(data), data, 0)
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("flush took %s", elapsed)
+	}
+	if got, want := countsOf("http"), (sinkCounts{spilled: 5}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got := h.Requests(); got != 1 {
+		t.Errorf("%d requests, want 1", got)
+	}
+}
+
+// newTestHTTPSink returns an http sink posting JSON to endpoint, with retry
+// and without breaker or rate limit.
+func newTestHTTPSink(t *testing.T, endpoint string, retry RetryConfig) Sink {
+	t.Helper()
+	conf := *cfg
+	conf.API.Endpoint = endpoint
+	conf.API.Format, conf.API.Compression = "json", "none"
+	conf.API.OAuth2 = OAuth2Config{}
+	conf.API.CircuitBreaker.Enabled = false
+	conf.API.RateLimit = RateLimitConfig{}
+	conf.API.Retry = retry
+	s, err := newHTTPSink(&conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.(*httpSink).Close() })
+	return s
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+)
+
+//////////////////////////////////////////////////
+// Kafka Sink
+//////////////////////////////////////////////////
+
+type KafkaSinkConfig struct {
+	Brokers      []string `yaml:"brokers" json:"brokers"`
+	Topic        string   `yaml:"topic" json:"topic"`
+	Compression  string   `yaml:"compression" json:"compression"`
+	RequiredAcks string   `yaml:"required_acks" json:"required_acks"`
+	WriteTimeout Duration `yaml:"write_timeout" json:"write_timeout"`
+	MaxAttempts  int      `yaml:"max_attempts" json:"max_attempts"`
+	TLS          bool     `yaml:"tls" json:"tls"`
+	SASLUsername string   `yaml:"sasl_username" json:"sasl_username"`
+	SASLPassword string   `yaml:"sasl_password" json:"sasl_password" secret:"true"`
+	// Format is json or avro. Avro messages carry their schema as a
+	// one-record container file, or a schema_registry ID when url is set.
+	Format         string               `yaml:"format" json:"format"`
+	SchemaRegistry SchemaRegistryConfig `yaml:"schema_registry" json:"schema_registry"`
+}
+
+func defaultKafkaSinkConfig() KafkaSinkConfig {
+	return KafkaSinkConfig{
+		Brokers:        []string{"localhost:9092"},
+		Topic:          "device-metrics",
+		Compression:    "snappy",
+		RequiredAcks:   "all",
+		WriteTimeout:   Duration(10 * time.Second),
+		MaxAttempts:    3,
+		Format:         "json",
+		SchemaRegistry: defaultSchemaRegistryConfig(),
+	}
+}
+
+var kafkaCompressions = map[string]kafka.Compression{
+	"none":   0,
+	"gzip":   kafka.Gzip,
+	"snappy": kafka.Snappy,
+	"lz4":    kafka.Lz4,
+	"zstd":   kafka.Zstd,
+}
+
+var kafkaAcks = map[string]kafka.RequiredAcks{
+	"none": kafka.RequireNone,
+	"one":  kafka.RequireOne,
+	"all":  kafka.RequireAll,
+}
+
+func (k *KafkaSinkConfig) validate() []error {
+	var errs []error
+	if len(k.Brokers) == 0 {
+		errs = append(errs, errors.New("sinks.kafka.brokers must list at least one broker"))
+	}
+	if k.Topic == "" {
+		errs = append(errs, errors.New("sinks.kafka.topic must be set"))
+	}
+	if _, ok := kafkaCompressions[k.Compression]; !ok {
+		errs = append(errs, fmt.Errorf("sinks.kafka.compression must be none, gzip, snappy, lz4 or zstd, got %q", k.Compression))
+	}
+	if _, ok := kafkaAcks[k.RequiredAcks]; !ok {
+		errs = append(errs, fmt.Errorf("sinks.kafka.required_acks must be none, one or all, got %q", k.RequiredAcks))
+	}
+	if k.WriteTimeout <= 0 {
+		errs = append(errs, errors.New("sinks.kafka.write_timeout must be > 0"))
+	}
+	if k.MaxAttempts <= 0 {
+		errs = append(errs, errors.New("sinks.kafka.max_attempts must be > 0"))
+	}
+	if k.Format != "json" && k.Format != "avro" {
+		errs = append(errs, fmt.Errorf("sinks.kafka.format must be json or avro, got %q", k.Format))
+	}
+	if r := k.SchemaRegistry; r.URL != "" {
+		if !strings.HasPrefix(r.URL, "http://") && !strings.HasPrefix(r.URL, "https://") {
+			errs = append(errs, fmt.Errorf("sinks.kafka.schema_registry.url must be an http(s) URL, got %q", r.URL))
+		}
+		if r.Timeout <= 0 {
+			errs = append(errs, errors.New("sinks.kafka.schema_registry.timeout must be > 0"))
+		}
+	}
+	return errs
+}
+
+func init() {
+	registerSink("kafka", newKafkaSink)
+}
+
+// kafkaSink publishes one message per record, keyed by hostname so every
+// appliance's records land on the same partition in order.
+type kafkaSink struct {
+	writer *kafka.Writer
+	format string
+	// registry is set for Avro with a schema registry. The schema is
+	// registered on the first Load, and again after a failure.
+	registry *SchemaRegistryConfig
+
+	mu       sync.Mutex
+	schemaID uint32
+	idKnown  bool
+}
+
+func newKafkaSink(cfg *Config) (Sink, error) {
+	conf := cfg.Sinks.Kafka
+
+	transport := &kafka.Transport{}
+	if conf.TLS {
+		transport.TLS = &tls.Config{}
+	}
+	if conf.SASLUsername != "" {
+		transport.SASL = plain.Mechanism{Username: conf.SASLUsername, Password: conf.SASLPassword}
+	}
+
+	if conf.SchemaRegistry.Subject == "" {
+		conf.SchemaRegistry.Subject = conf.Topic + "-value"
+	}
+	k := &kafkaSink{
+		format: conf.Format,
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(conf.Brokers...),
+			Topic:        conf.Topic,
+			Balancer:     &kafka.Hash{},
+			Compression:  kafkaCompressions[conf.Compression],
+			RequiredAcks: kafkaAcks[conf.RequiredAcks],
+			MaxAttempts:  conf.MaxAttempts,
+			WriteTimeout: conf.WriteTimeout.Std(),
+			// Each Load is already a full buffer; don't hold it back waiting
+			// for the writer's own batch to fill.
+			BatchSize:    cfg.Load.BufferThreshold,
+			BatchTimeout: 10 * time.Millisecond,
+			Transport:    transport,
+		},
+	}
+	if conf.Format == "avro" && conf.SchemaRegistry.URL != "" {
+		k.registry = &conf.SchemaRegistry
+	}
+	return k, nil
+}
+
+func (k *kafkaSink) Name() string {
+	return "kafka"
+}
+
+func (k *kafkaSink) Load(ctx context.Context, data []DeviceData) error {
+	encode, contentType, err := k.encoder(ctx)
+	if err != nil {
+		return err
+	}
+	msgs := make([]kafka.Message, len(data))
+	for i, d := range data {
+		value, err := encode(d)
+		if err != nil {
+			return permanent(err)
+		}
+		msgs[i] = kafka.Message{
+			Key:     []byte(d.Name),
+			Value:   value,
+			Headers: []kafka.Header{{Key: "content-type", Value: []byte(contentType)}},
+		}
+	}
+
+	err = k.writer.WriteMessages(ctx, msgs...)
+	var writeErrs kafka.WriteErrors
+	if errors.As(err, &writeErrs) {
+		failed := fmt.Errorf("kafka: %d of %d messages failed: %w", writeErrs.Count(), len(msgs), firstError(writeErrs))
+		for _, err := range writeErrs {
+			if err != nil && !isPermanentKafkaError(err) {
+				return failed
+			}
+		}
+		return permanent(failed)
+	}
+	if err != nil && isPermanentKafkaError(err) {
+		return permanent(err)
+	}
+	return err
+}
+
+// isPermanentKafkaError reports whether a write failed in a way no retry
+// fixes: a missing or invalid topic, messages the brokers won't take, or
+// refused credentials. The writer already retried transient errors.
+func isPermanentKafkaError(err error) bool {
+	var kafkaErr kafka.Error
+	if !errors.As(err, &kafkaErr) {
+		return false
+	}
+	switch kafkaErr {
+	case kafka.UnknownTopicOrPartition, kafka.InvalidTopic,
+		kafka.InvalidMessage, kafka.MessageSizeTooLarge, kafka.RecordListTooLarge, kafka.InvalidRecord,
+		kafka.TopicAuthorizationFailed, kafka.ClusterAuthorizationFailed,
+		kafka.SASLAuthenticationFailed, kafka.UnsupportedSASLMechanism:
+		return true
+	}
+	return false
+}
+
+// encoder returns the message encoding for sinks.kafka.format along with
+// its content type.
+func (k *kafkaSink) encoder(ctx context.Context) (func(DeviceData) ([]byte, error), string, error) {
+	switch {
+	case k.format == "json":
+		return func(d DeviceData) ([]byte, error) { return json.Marshal(d) }, "application/json", nil
+	case k.registry == nil:
+		return func(d DeviceData) ([]byte, error) { return marshalAvroContainer([]DeviceData{d}) }, "application/avro", nil
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if !k.idKnown {
+		id, err := registerAvroSchema(ctx, *k.registry)
+		if err != nil {
+			return nil, "", err
+		}
+		k.schemaID, k.idKnown = id, true
+	}
+	id := k.schemaID
+	return func(d DeviceData) ([]byte, error) { return appendConfluentAvro(nil, id, d), nil }, "application/vnd.confluent.avro", nil
+}
+
+func (k *kafkaSink) Close() error {
+	return k.writer.Close()
+}
+
+func firstError(errs []error) error {
+	var msgs []string
+	for _, err := range errs {
+		if err != nil {
+			msgs = append(msgs, err.Error())
+			if len(msgs) == 3 {
+				break
+			}
+		}
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
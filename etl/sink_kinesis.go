@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	firehosetypes "github.com/aws/aws-sdk-go-v2/service/firehose/types"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	kinesistypes "github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/aws/smithy-go"
+)
+
+//////////////////////////////////////////////////
+// Kinesis / Firehose Sink
+//////////////////////////////////////////////////
+
+type KinesisSinkConfig struct {
+	// Service is streams (Kinesis Data Streams) or firehose (Data
+	// Firehose); Stream is the data stream or delivery stream name.
+	Service string `yaml:"service" json:"service"`
+	Stream  string `yaml:"stream" json:"stream"`
+	// Region defaults to AWS_REGION or the shared config's profile.
+	Region string `yaml:"region" json:"region"`
+	// Endpoint overrides the service endpoint, e.g. for a VPC endpoint or
+	// LocalStack.
+	Endpoint        string `yaml:"endpoint" json:"endpoint"`
+	AccessKeyID     string `yaml:"access_key_id" json:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key" json:"secret_access_key" secret:"true"`
+	SessionToken    string `yaml:"session_token" json:"session_token" secret:"true"`
+	// MaxRecords caps the records per PutRecords or PutRecordBatch call;
+	// requests are also kept under the services' size limits.
+	MaxRecords int `yaml:"max_records" json:"max_records"`
+	// ThrottleDelay is the least time between a shard throttling records
+	// and their next attempt. Shard limits are per second.
+	ThrottleDelay Duration    `yaml:"throttle_delay" json:"throttle_delay"`
+	Timeout       Duration    `yaml:"timeout" json:"timeout"`
+	Retry         RetryConfig `yaml:"retry" json:"retry"`
+}
+
+func defaultKinesisSinkConfig() KinesisSinkConfig {
+	return KinesisSinkConfig{
+		Service:       "streams",
+		MaxRecords:    500,
+		ThrottleDelay: Duration(time.Second),
+		Timeout:       Duration(30 * time.Second),
+		Retry:         defaultRetryConfig(),
+	}
+}
+
+func (k *KinesisSinkConfig) validate() []error {
+	var errs []error
+	switch k.Service {
+	case "streams", "firehose":
+	default:
+		errs = append(errs, fmt.Errorf("sinks.kinesis.service must be streams or firehose, got %q", k.Service))
+	}
+	if k.Stream == "" {
+		errs = append(errs, errors.New("sinks.kinesis.stream must be set"))
+	}
+	if (k.AccessKeyID == "") != (k.SecretAccessKey == "") {
+		errs = append(errs, errors.New("sinks.kinesis.access_key_id and secret_access_key must be set together"))
+	}
+	// Both APIs take at most 500 records per call.
+	if k.MaxRecords <= 0 || k.MaxRecords > 500 {
+		errs = append(errs, fmt.Errorf("sinks.kinesis.max_records must be between 1 and 500, got %d", k.MaxRecords))
+	}
+	if k.ThrottleDelay < 0 {
+		errs = append(errs, errors.New("sinks.kinesis.throttle_delay must be >= 0"))
+	}
+	if k.Timeout <= 0 {
+		errs = append(errs, errors.New("sinks.kinesis.timeout must be > 0"))
+	}
+	errs = append(errs, k.Retry.validate("sinks.kinesis.retry")...)
+	return errs
+}
+
+func init() {
+	registerSink("kinesis", newKinesisSink)
+}
+
+// Request size limits. A record's data and partition key count towards
+// both.
+const (
+	kinesisMaxRequestBytes  = 5 << 20
+	kinesisMaxRecordBytes   = 1 << 20
+	firehoseMaxRequestBytes = 4 << 20
+	firehoseMaxRecordBytes  = 1000 << 10
+)
+
+// kinesisSink puts one JSON record per DeviceData. Data Streams records are
+// partitioned by hostname, so each appliance's records stay in order on one
+// shard; Firehose records end with a newline, so they land as NDJSON.
+//
+// Both APIs accept a call while failing some of its records, most often
+// because their shard is over its throughput. Only those records are put
+// again, and no sooner than throttle_delay after the throttling.
+type kinesisSink struct {
+	conf     KinesisSinkConfig
+	streams  *kinesis.Client
+	firehose *firehose.Client
+
+	// shards remembers the shard each host's records went to, to name the
+	// hot shards when records are throttled.
+	mu     sync.Mutex
+	shards map[string]string
+}
+
+func newKinesisSink(cfg *Config) (Sink, error) {
+	conf := cfg.Sinks.Kinesis
+
+	// Static keys if configured, otherwise the default AWS chain:
+	// environment, shared files, SSO, then container or instance role.
+	opts := []func(*awsconfig.LoadOptions) error{
+		awsconfig.WithRegion(conf.Region),
+		// Retries are ours, per record and with the configured backoff.
+		awsconfig.WithRetryer(func() aws.Retryer { return aws.NopRetryer{} }),
+	}
+	if conf.AccessKeyID != "" {
+		opts = append(opts, awsconfig.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(conf.AccessKeyID, conf.SecretAccessKey, conf.SessionToken)))
+	}
+	awsConf, err := awsconfig.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("sinks.kinesis: %w", err)
+	}
+	if awsConf.Region == "" {
+		return nil, errors.New("sinks.kinesis.region must be set, or AWS_REGION")
+	}
+	awsConf.HTTPClient = loadClient(conf.Timeout.Std())
+
+	k := &kinesisSink{conf: conf, shards: make(map[string]string)}
+	if conf.Service == "firehose" {
+		k.firehose = firehose.NewFromConfig(awsConf, func(o *firehose.Options) {
+			if conf.Endpoint != "" {
+				o.BaseEndpoint = aws.String(conf.Endpoint)
+			}
+		})
+	} else {
+		k.streams = kinesis.NewFromConfig(awsConf, func(o *kinesis.Options) {
+			if conf.Endpoint != "" {
+				o.BaseEndpoint = aws.String(conf.Endpoint)
+			}
+		})
+	}
+	return k, nil
+}
+
+func (k *kinesisSink) Name() string {
+	return "kinesis"
+}
+
+func (k *kinesisSink) Load(ctx context.Context, data []DeviceData) error {
+	maxRecord := kinesisMaxRecordBytes
+	if k.firehose != nil {
+		maxRecord = firehoseMaxRecordBytes
+	}
+	records := make([][]byte, len(data))
+	for i, d := range data {
+		b, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		if k.firehose != nil {
+			b = append(b, '\n')
+		}
+		if len(b)+len(d.Name) > maxRecord {
+			return &APIError{StatusCode: http.StatusRequestEntityTooLarge,
+				Body: fmt.Sprintf("record of %s is %d bytes, over the %d byte limit", d.Name, len(b), maxRecord)}
+		}
+		records[i] = b
+	}
+
+	// Only the records that weren't accepted are put again.
+	pending := make([]int, len(data))
+	for i := range pending {
+		pending[i] = i
+	}
+	var throttledAt time.Time
+	attempts, err := withRetry(ctx, k.conf.Retry, "kinesis", func(int) error {
+		if wait := time.Until(throttledAt.Add(k.conf.ThrottleDelay.Std())); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		var throttled bool
+		var err error
+		pending, throttled, err = k.put(ctx, data, records, pending)
+		if throttled {
+			throttledAt = time.Now()
+		}
+		return err
+	})
+	switch {
+	case err == nil:
+		return nil
+	case len(pending) == len(data):
+		return &AttemptsError{Attempts: attempts, Err: err}
+	}
+	failed := make([]DeviceData, len(pending))
+	for i, idx := range pending {
+		failed[i] = data[idx]
+	}
+	return &PartialError{Failed: failed, Err: &AttemptsError{Attempts: attempts, Err: err}}
+}
+
+// put sends the records at the indexes in pending, in as few calls as the
+// limits allow. It returns the indexes that weren't accepted, whether any
+// were throttled, and the first error seen.
+func (k *kinesisSink) put(ctx context.Context, data []DeviceData, records [][]byte, pending []int) ([]int, bool, error) {
+	maxBytes := kinesisMaxRequestBytes
+	if k.firehose != nil {
+		maxBytes = firehoseMaxRequestBytes
+	}
+	var failed []int
+	var firstErr error
+	var throttled []string // hosts
+	for len(pending) > 0 {
+		n, size := 0, 0
+		for n < len(pending) && n < k.conf.MaxRecords {
+			s := len(records[pending[n]]) + len(data[pending[n]].Name)
+			if n > 0 && size+s > maxBytes {
+				break
+			}
+			n, size = n+1, size+s
+		}
+		chunk := pending[:n]
+		pending = pending[n:]
+
+		var codes []recordCode
+		var err error
+		if k.firehose != nil {
+			codes, err = k.putFirehose(ctx, records, chunk)
+		} else {
+			codes, err = k.putStreams(ctx, data, records, chunk)
+		}
+		if err != nil {
+			failed = append(failed, chunk...)
+			if firstErr == nil {
+				firstErr = kinesisError(err)
+			}
+			continue
+		}
+		for i, c := range codes {
+			if c.code == "" {
+				continue
+			}
+			failed = append(failed, chunk[i])
+			if kinesisHTTPStatus[c.code] == http.StatusTooManyRequests {
+				throttled = append(throttled, data[chunk[i]].Name)
+			}
+			if firstErr == nil {
+				firstErr = recordError(c)
+			}
+		}
+	}
+	if len(throttled) > 0 {
+		slog.Warn("Records throttled", "component", "load", "sink", "kinesis", "stream", k.conf.Stream,
+			"records", len(throttled), "shards", k.hotShards(throttled))
+	}
+	return failed, len(throttled) > 0, firstErr
+}
+
+// recordCode is the outcome of one record of a call: empty code if it was
+// accepted.
+type recordCode struct {
+	code, message string
+}
+
+func (k *kinesisSink) putStreams(ctx context.Context, data []DeviceData, records [][]byte, chunk []int) ([]recordCode, error) {
+	entries := make([]kinesistypes.PutRecordsRequestEntry, len(chunk))
+	for i, idx := range chunk {
+		entries[i] = kinesistypes.PutRecordsRequestEntry{
+			Data:         records[idx],
+			PartitionKey: aws.String(data[idx].Name),
+		}
+	}
+	out, err := k.streams.PutRecords(ctx, &kinesis.PutRecordsInput{
+		StreamName: aws.String(k.conf.Stream),
+		Records:    entries,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Records) != len(chunk) {
+		return nil, fmt.Errorf("PutRecords answered %d records for %d", len(out.Records), len(chunk))
+	}
+	codes := make([]recordCode, len(chunk))
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for i, r := range out.Records {
+		if r.ErrorCode != nil {
+			codes[i] = recordCode{aws.ToString(r.ErrorCode), aws.ToString(r.ErrorMessage)}
+		} else if r.ShardId != nil {
+			k.shards[data[chunk[i]].Name] = *r.ShardId
+		}
+	}
+	return codes, nil
+}
+
+func (k *kinesisSink) putFirehose(ctx context.Context, records [][]byte, chunk []int) ([]recordCode, error) {
+	entries := make([]firehosetypes.Record, len(chunk))
+	for i, idx := range chunk {
+		entries[i] = firehosetypes.Record{Data: records[idx]}
+	}
+	out, err := k.firehose.PutRecordBatch(ctx, &firehose.PutRecordBatchInput{
+		DeliveryStreamName: aws.String(k.conf.Stream),
+		Records:            entries,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.RequestResponses) != len(chunk) {
+		return nil, fmt.Errorf("PutRecordBatch answered %d records for %d", len(out.RequestResponses), len(chunk))
+	}
+	codes := make([]recordCode, len(chunk))
+	for i, r := range out.RequestResponses {
+		if r.ErrorCode != nil {
+			codes[i] = recordCode{aws.ToString(r.ErrorCode), aws.ToString(r.ErrorMessage)}
+		}
+	}
+	return codes, nil
+}
+
+// hotShards returns the shards the throttled hosts' records last went to,
+// or nil for Firehose and hosts not seen yet.
+func (k *kinesisSink) hotShards(hosts []string) []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	var shards []string
+	for _, h := range hosts {
+		if s, ok := k.shards[h]; ok && !slices.Contains(shards, s) {
+			shards = append(shards, s)
+		}
+	}
+	slices.Sort(shards)
+	return shards
+}
+
+func (k *kinesisSink) Close() error {
+	return nil
+}
+
+// kinesisHTTPStatus is the HTTP status an AWS error code counts as, like
+// grpcHTTPStatus. Unknown codes count as 500 if AWS blames itself and 400
+// otherwise.
+var kinesisHTTPStatus = map[string]int{
+	"ProvisionedThroughputExceededException": http.StatusTooManyRequests,
+	"LimitExceededException":                 http.StatusTooManyRequests,
+	"ThrottlingException":                    http.StatusTooManyRequests,
+	"KMSThrottlingException":                 http.StatusTooManyRequests,
+	"ServiceUnavailableException":            http.StatusServiceUnavailable,
+	"ResourceInUseException":                 http.StatusServiceUnavailable, // stream being updated
+	"InternalFailure":                        http.StatusInternalServerError,
+	"ResourceNotFoundException":              http.StatusNotFound,
+	"InvalidArgumentException":               http.StatusBadRequest,
+	"ValidationException":                    http.StatusBadRequest,
+	"AccessDeniedException":                  http.StatusForbidden,
+	"KMSAccessDeniedException":               http.StatusForbidden,
+	"UnrecognizedClientException":            http.StatusUnauthorized,
+	"InvalidSignatureException":              http.StatusUnauthorized,
+	"ExpiredTokenException":                  http.StatusUnauthorized,
+	"MissingAuthenticationTokenException":    http.StatusUnauthorized,
+}
+
+// kinesisError turns an AWS API error into an APIError, so the retry, spill
+// and dead-letter decisions made for the load API apply. Network and
+// credential errors are left as they are.
+func kinesisError(err error) error {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+	code, ok := kinesisHTTPStatus[apiErr.ErrorCode()]
+	if !ok {
+		code = http.StatusBadRequest
+		if apiErr.ErrorFault() == smithy.FaultServer {
+			code = http.StatusInternalServerError
+		}
+	}
+	return &APIError{StatusCode: code, Body: err.Error(), Code: apiErr.ErrorCode(), Message: apiErr.ErrorMessage()}
+}
+
+// recordError is the APIError of a record the service refused.
+func recordError(c recordCode) error {
+	code, ok := kinesisHTTPStatus[c.code]
+	if !ok {
+		code = http.StatusInternalServerError
+	}
+	return &APIError{StatusCode: code, Body: c.code + ": " + c.message, Code: c.code, Message: c.message}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+//////////////////////////////////////////////////
+// MQTT Sink
+//////////////////////////////////////////////////
+
+type MQTTSinkConfig struct {
+	// Brokers are tcp://, ssl://, ws:// or wss:// URLs; the client fails
+	// over between them in order.
+	Brokers []string `yaml:"brokers" json:"brokers"`
+	// ClientID must be unique per broker; it defaults to
+	// concurrent-etl-<hostname>.
+	ClientID string `yaml:"client_id" json:"client_id"`
+	// Topic is templated per record: {host} is the record's name and
+	// {metric} its metric type, cpu for CPU records, with /, + and #
+	// replaced by _ so each stays one topic level.
+	Topic          string      `yaml:"topic" json:"topic"`
+	QoS            int         `yaml:"qos" json:"qos"`
+	Retained       bool        `yaml:"retained" json:"retained"`
+	Username       string      `yaml:"username" json:"username"`
+	Password       string      `yaml:"password" json:"password" secret:"true"`
+	TLS            TLSConfig   `yaml:"tls" json:"tls"` // for ssl:// and wss:// brokers
+	KeepAlive      Duration    `yaml:"keep_alive" json:"keep_alive"`
+	ConnectTimeout Duration    `yaml:"connect_timeout" json:"connect_timeout"`
+	PublishTimeout Duration    `yaml:"publish_timeout" json:"publish_timeout"` // until acked (QoS 1, 2) or written (QoS 0)
+	Retry          RetryConfig `yaml:"retry" json:"retry"`
+}
+
+func defaultMQTTSinkConfig() MQTTSinkConfig {
+	return MQTTSinkConfig{
+		Brokers:        []string{"tcp://localhost:1883"},
+		Topic:          "devices/{host}/{metric}",
+		QoS:            1,
+		TLS:            defaultTLSConfig(),
+		KeepAlive:      Duration(30 * time.Second),
+		ConnectTimeout: Duration(10 * time.Second),
+		PublishTimeout: Duration(10 * time.Second),
+		Retry:          defaultRetryConfig(),
+	}
+}
+
+func (m *MQTTSinkConfig) validate() []error {
+	var errs []error
+	if len(m.Brokers) == 0 {
+		errs = append(errs, errors.New("sinks.mqtt.brokers must list at least one broker"))
+	}
+	secure := false
+	for i, b := range m.Brokers {
+		scheme, _, ok := strings.Cut(b, "://")
+		switch {
+		case !ok:
+			errs = append(errs, fmt.Errorf("sinks.mqtt.brokers[%d] must be a tcp://, ssl://, ws:// or wss:// URL, got %q", i, b))
+		case scheme == "ssl" || scheme == "tls" || scheme == "mqtts" || scheme == "wss":
+			secure = true
+		case scheme != "tcp" && scheme != "mqtt" && scheme != "ws":
+			errs = append(errs, fmt.Errorf("sinks.mqtt.brokers[%d] must be a tcp://, ssl://, ws:// or wss:// URL, got %q", i, b))
+		}
+	}
+	if secure {
+		errs = append(errs, m.TLS.validate("sinks.mqtt.tls")...)
+	}
+	if m.Topic == "" {
+		errs = append(errs, errors.New("sinks.mqtt.topic must be set"))
+	} else if strings.ContainsAny(m.Topic, "+#") {
+		errs = append(errs, fmt.Errorf("sinks.mqtt.topic must not contain wildcards, got %q", m.Topic))
+	}
+	if m.QoS < 0 || m.QoS > 2 {
+		errs = append(errs, fmt.Errorf("sinks.mqtt.qos must be 0, 1 or 2, got %d", m.QoS))
+	}
+	if m.KeepAlive <= 0 {
+		errs = append(errs, errors.New("sinks.mqtt.keep_alive must be > 0"))
+	}
+	if m.ConnectTimeout <= 0 {
+		errs = append(errs, errors.New("sinks.mqtt.connect_timeout must be > 0"))
+	}
+	if m.PublishTimeout <= 0 {
+		errs = append(errs, errors.New("sinks.mqtt.publish_timeout must be > 0"))
+	}
+	errs = append(errs, m.Retry.validate("sinks.mqtt.retry")...)
+	return errs
+}
+
+func init() {
+	registerSink("mqtt", newMQTTSink)
+}
+
+// mqttSink publishes one JSON message per record to a topic per appliance.
+// With QoS 1 or 2 a record counts as loaded once the broker acknowledged
+// it; with QoS 0, once it was written to the connection.
+type mqttSink struct {
+	conf   MQTTSinkConfig
+	client mqtt.Client
+}
+
+func newMQTTSink(cfg *Config) (Sink, error) {
+	conf := cfg.Sinks.MQTT
+	clientID := conf.ClientID
+	if clientID == "" {
+		host, _ := os.Hostname()
+		clientID = "concurrent-etl-" + host
+	}
+	opts := mqtt.NewClientOptions().
+		SetClientID(clientID).
+		SetUsername(conf.Username).
+		SetPassword(conf.Password).
+		SetKeepAlive(conf.KeepAlive.Std()).
+		SetConnectTimeout(conf.ConnectTimeout.Std()).
+		SetWriteTimeout(conf.PublishTimeout.Std()).
+		// Connect in the background and keep reconnecting, so a broker
+		// that is down only fails batches, which are spilled.
+		SetConnectRetry(true).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(time.Minute).
+		SetOnConnectHandler(func(mqtt.Client) {
+			slog.Info("Connected to MQTT broker", "component", "load", "sink", "mqtt")
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			slog.Warn("Lost connection to MQTT broker", "component", "load", "sink", "mqtt", "error", err)
+		})
+	for _, b := range conf.Brokers {
+		opts.AddBroker(b)
+	}
+	tlsConf, err := conf.TLS.build()
+	if err != nil {
+		return nil, fmt.Errorf("sinks.mqtt.tls: %w", err)
+	}
+	opts.SetTLSConfig(tlsConf)
+
+	client := mqtt.NewClient(opts)
+	client.Connect()
+	return &mqttSink{conf: conf, client: client}, nil
+}
+
+func (m *mqttSink) Name() string {
+	return "mqtt"
+}
+
+func (m *mqttSink) Load(ctx context.Context, data []DeviceData) error {
+	payloads := make([][]byte, len(data))
+	for i, d := range data {
+		b, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		payloads[i] = b
+	}
+
+	// Only the messages that weren't acknowledged are published again.
+	pending := make([]int, len(data))
+	for i := range pending {
+		pending[i] = i
+	}
+	attempts, err := withRetry(ctx, m.conf.Retry, "mqtt", func(int) error {
+		// While disconnected, publishes would only wait in the client's
+		// store until they time out; fail fast like a refused connection.
+		if !m.client.IsConnectionOpen() {
+			return errors.New("not connected to the MQTT broker")
+		}
+		var err error
+		pending, err = m.publish(ctx, data, payloads, pending)
+		return err
+	})
+	switch {
+	case err == nil:
+		return nil
+	case len(pending) == len(data):
+		return &AttemptsError{Attempts: attempts, Err: err}
+	}
+	failed := make([]DeviceData, len(pending))
+	for i, idx := range pending {
+		failed[i] = data[idx]
+	}
+	return &PartialError{Failed: failed, Err: &AttemptsError{Attempts: attempts, Err: err}}
+}
+
+func (m *mqttSink) Healthy() bool {
+	return m.client.IsConnectionOpen()
+}
+
+// publish sends the messages at the indexes in pending and waits for them
+// to complete. It returns the indexes that didn't, with the first error
+// seen.
+func (m *mqttSink) publish(ctx context.Context, data []DeviceData, payloads [][]byte, pending []int) ([]int, error) {
+	tokens := make([]mqtt.Token, len(pending))
+	for i, idx := range pending {
+		tokens[i] = m.client.Publish(m.topic(data[idx]), byte(m.conf.QoS), m.conf.Retained, payloads[idx])
+	}
+	deadline := time.NewTimer(m.conf.PublishTimeout.Std())
+	defer deadline.Stop()
+	var failed []int
+	var firstErr error
+	for i, t := range tokens {
+		var err error
+		select {
+		case <-t.Done():
+			err = t.Error()
+		case <-deadline.C:
+			// Every later token shares the expired deadline.
+			deadline.Reset(0)
+			err = fmt.Errorf("no acknowledgement within %s", m.conf.PublishTimeout)
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if err != nil {
+			failed = append(failed, pending[i])
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return failed, firstErr
+}
+
+// topic fills in the topic template for d.
+func (m *mqttSink) topic(d DeviceData) string {
+	metric := d.Metric
+	if metric == "" {
+		metric = "cpu"
+	}
+	return strings.NewReplacer("{host}", mqttLevel(d.Name), "{metric}", mqttLevel(metric)).Replace(m.conf.Topic)
+}
+
+// mqttLevel makes s a single topic level: / separates levels and + and #
+// are wildcards.
+func mqttLevel(s string) string {
+	if s == "" {
+		return "_"
+	}
+	return strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(s)
+}
+
+func (m *mqttSink) Close() error {
+	// Give in-flight publishes up to a second to complete.
+	m.client.Disconnect(1000)
+	return nil
+}
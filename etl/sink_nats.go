@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+//////////////////////////////////////////////////
+// NATS JetStream Sink
+//////////////////////////////////////////////////
+
+type NATSSinkConfig struct {
+	URLs []string `yaml:"urls" json:"urls"`
+	// Subject is templated per record: {host} is the record's name and
+	// {metric} its metric type, cpu for CPU records, each with the
+	// characters NATS gives a meaning in subjects replaced by _.
+	Subject   string            `yaml:"subject" json:"subject"`
+	Token     string            `yaml:"token" json:"token" secret:"true"`
+	Username  string            `yaml:"username" json:"username"`
+	Password  string            `yaml:"password" json:"password" secret:"true"`
+	CredsFile string            `yaml:"creds_file" json:"creds_file"` // JWT and NKey seed, e.g. from nsc
+	Secure    bool              `yaml:"secure" json:"secure"`         // TLS
+	TLS       TLSConfig         `yaml:"tls" json:"tls"`
+	Headers   map[string]string `yaml:"headers" json:"headers"` // added to every message
+	// MaxPending is how many publishes may wait for their ack at once,
+	// across the load workers.
+	MaxPending int              `yaml:"max_pending" json:"max_pending"`
+	AckTimeout Duration         `yaml:"ack_timeout" json:"ack_timeout"`
+	Stream     NATSStreamConfig `yaml:"stream" json:"stream"`
+	Retry      RetryConfig      `yaml:"retry" json:"retry"`
+}
+
+// NATSStreamConfig creates the stream the subjects are stored in, or
+// updates it to these settings, before the first publish. With no name,
+// the stream is left to the NATS operators.
+type NATSStreamConfig struct {
+	Name string `yaml:"name" json:"name"`
+	// Subjects default to the subject template with * for each
+	// placeholder.
+	Subjects  []string `yaml:"subjects" json:"subjects"`
+	Retention string   `yaml:"retention" json:"retention"` // limits, interest or workqueue
+	Storage   string   `yaml:"storage" json:"storage"`     // file or memory
+	Replicas  int      `yaml:"replicas" json:"replicas"`
+	MaxAge    Duration `yaml:"max_age" json:"max_age"`     // 0 = unlimited
+	MaxBytes  int64    `yaml:"max_bytes" json:"max_bytes"` // 0 = unlimited
+	// Duplicates is how long the stream remembers message IDs to drop
+	// repeated publishes.
+	Duplicates Duration `yaml:"duplicates" json:"duplicates"`
+}
+
+func defaultNATSSinkConfig() NATSSinkConfig {
+	return NATSSinkConfig{
+		URLs:       []string{"nats://localhost:4222"},
+		Subject:    "device-metrics.{metric}.{host}",
+		TLS:        defaultTLSConfig(),
+		MaxPending: 4096,
+		AckTimeout: Duration(10 * time.Second),
+		Stream: NATSStreamConfig{
+			Retention:  "limits",
+			Storage:    "file",
+			Replicas:   1,
+			Duplicates: Duration(2 * time.Minute),
+		},
+		Retry: defaultRetryConfig(),
+	}
+}
+
+var natsRetention = map[string]jetstream.RetentionPolicy{
+	"limits":    jetstream.LimitsPolicy,
+	"interest":  jetstream.InterestPolicy,
+	"workqueue": jetstream.WorkQueuePolicy,
+}
+
+var natsStorage = map[string]jetstream.StorageType{
+	"file":   jetstream.FileStorage,
+	"memory": jetstream.MemoryStorage,
+}
+
+func (n *NATSSinkConfig) validate() []error {
+	var errs []error
+	if len(n.URLs) == 0 {
+		errs = append(errs, errors.New("sinks.nats.urls must list at least one server"))
+	}
+	if n.Subject == "" {
+		errs = append(errs, errors.New("sinks.nats.subject must be set"))
+	} else if strings.ContainsAny(n.Subject, " \t*>") || strings.Contains(n.Subject, "..") {
+		errs = append(errs, fmt.Errorf("sinks.nats.subject is not a valid subject: %q", n.Subject))
+	}
+	if n.Secure {
+		errs = append(errs, n.TLS.validate("sinks.nats.tls")...)
+	}
+	if n.MaxPending <= 0 {
+		errs = append(errs, fmt.Errorf("sinks.nats.max_pending must be > 0, got %d", n.MaxPending))
+	}
+	if n.AckTimeout <= 0 {
+		errs = append(errs, errors.New("sinks.nats.ack_timeout must be > 0"))
+	}
+	if s := n.Stream; s.Name != "" {
+		if _, ok := natsRetention[s.Retention]; !ok {
+			errs = append(errs, fmt.Errorf("sinks.nats.stream.retention must be limits, interest or workqueue, got %q", s.Retention))
+		}
+		if _, ok := natsStorage[s.Storage]; !ok {
+			errs = append(errs, fmt.Errorf("sinks.nats.stream.storage must be file or memory, got %q", s.Storage))
+		}
+		if s.Replicas < 1 || s.Replicas > 5 {
+			errs = append(errs, fmt.Errorf("sinks.nats.stream.replicas must be within [1, 5], got %d", s.Replicas))
+		}
+		if s.MaxAge < 0 || s.Duplicates < 0 || s.MaxBytes < 0 {
+			errs = append(errs, errors.New("sinks.nats.stream.max_age, max_bytes and duplicates must be >= 0"))
+		}
+	}
+	errs = append(errs, n.Retry.validate("sinks.nats.retry")...)
+	return errs
+}
+
+func init() {
+	registerSink("nats", newNATSSink)
+}
+
+// natsSink publishes one JSON message per record to JetStream, and counts
+// a record as loaded once the stream acknowledged it. Every message has a
+// Nats-Msg-Id of its batch ID and index, so the stream drops the copies
+// that retries and replays within stream.duplicates publish again.
+type natsSink struct {
+	conf NATSSinkConfig
+	nc   *nats.Conn
+	js   jetstream.JetStream
+
+	mu          sync.Mutex
+	streamReady bool
+}
+
+func newNATSSink(cfg *Config) (Sink, error) {
+	conf := cfg.Sinks.NATS
+	opts := []nats.Option{
+		nats.Name("concurrent-etl"),
+		// Connect in the background, so a broker that is down at startup
+		// only fails batches, which are spilled.
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				slog.Warn("Disconnected from NATS", "component", "load", "sink", "nats", "error", err)
+			}
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			slog.Info("Reconnected to NATS", "component", "load", "sink", "nats", "server", nc.ConnectedUrlRedacted())
+		}),
+	}
+	switch {
+	case conf.CredsFile != "":
+		opts = append(opts, nats.UserCredentials(conf.CredsFile))
+	case conf.Token != "":
+		opts = append(opts, nats.Token(conf.Token))
+	case conf.Username != "":
+		opts = append(opts, nats.UserInfo(conf.Username, conf.Password))
+	}
+	if conf.Secure {
+		tlsConf, err := conf.TLS.build()
+		if err != nil {
+			return nil, fmt.Errorf("sinks.nats.tls: %w", err)
+		}
+		opts = append(opts, nats.Secure(tlsConf))
+	}
+	nc, err := nats.Connect(strings.Join(conf.URLs, ","), opts...)
+	if err != nil {
+		return nil, err
+	}
+	js, err := jetstream.New(nc,
+		jetstream.WithPublishAsyncMaxPending(conf.MaxPending),
+		jetstream.WithPublishAsyncTimeout(conf.AckTimeout.Std()),
+	)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return &natsSink{conf: conf, nc: nc, js: js, streamReady: conf.Stream.Name == ""}, nil
+}
+
+func (n *natsSink) Name() string {
+	return "nats"
+}
+
+func (n *natsSink) Healthy() bool {
+	return n.nc.IsConnected()
+}
+
+func (n *natsSink) Load(ctx context.Context, data []DeviceData) error {
+	batchID := batchIDFrom(ctx)
+	if batchID == "" {
+		batchID = newBatchID(data)
+	}
+	msgs := make([]*nats.Msg, len(data))
+	for i, d := range data {
+		body, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		msg := nats.NewMsg(n.subject(d))
+		msg.Data = body
+		msg.Header.Set("Content-Type", "application/json")
+		msg.Header.Set(jetstream.MsgIDHeader, batchID+"-"+strconv.Itoa(i))
+		for k, v := range n.conf.Headers {
+			msg.Header.Set(k, v)
+		}
+		msgs[i] = msg
+	}
+
+	// Only the messages that weren't acknowledged are published again.
+	pending := make([]int, len(data))
+	for i := range pending {
+		pending[i] = i
+	}
+	attempts, err := withRetry(ctx, n.conf.Retry, "nats", func(int) error {
+		// While disconnected, publishes would only sit in the reconnect
+		// buffer until their acks time out; fail fast like a refused
+		// connection instead.
+		if !n.nc.IsConnected() {
+			return fmt.Errorf("not connected to NATS (%s)", n.nc.Status())
+		}
+		if err := n.ensureStream(ctx); err != nil {
+			return natsError(err)
+		}
+		var err error
+		pending, err = n.publish(ctx, msgs, pending)
+		return natsError(err)
+	})
+	switch {
+	case err == nil:
+		return nil
+	case len(pending) == len(data):
+		return &AttemptsError{Attempts: attempts, Err: err}
+	}
+	failed := make([]DeviceData, len(pending))
+	for i, idx := range pending {
+		failed[i] = data[idx]
+	}
+	return &PartialError{Failed: failed, Err: &AttemptsError{Attempts: attempts, Err: err}}
+}
+
+// publish sends the messages at the indexes in pending and waits for their
+// acks. It returns the indexes that weren't acknowledged, with the first
+// error seen.
+func (n *natsSink) publish(ctx context.Context, msgs []*nats.Msg, pending []int) ([]int, error) {
+	type inflight struct {
+		idx    int
+		future jetstream.PubAckFuture
+	}
+	var sent []inflight
+	var failed []int
+	var firstErr error
+	for i, idx := range pending {
+		f, err := n.js.PublishMsgAsync(msgs[idx])
+		if err != nil {
+			failed = append(failed, pending[i:]...)
+			firstErr = err
+			break
+		}
+		sent = append(sent, inflight{idx, f})
+	}
+	for _, s := range sent {
+		select {
+		case <-s.future.Ok():
+			continue
+		case err := <-s.future.Err():
+			if firstErr == nil {
+				firstErr = err
+			}
+		case <-ctx.Done():
+			if firstErr == nil {
+				firstErr = ctx.Err()
+			}
+		}
+		failed = append(failed, s.idx)
+	}
+	return failed, firstErr
+}
+
+// subject fills in the subject template for d.
+func (n *natsSink) subject(d DeviceData) string {
+	metric := d.Metric
+	if metric == "" {
+		metric = "cpu"
+	}
+	return strings.NewReplacer("{host}", natsToken(d.Name), "{metric}", natsToken(metric)).Replace(n.conf.Subject)
+}
+
+// natsToken makes s a single subject token: dots separate tokens, * and >
+// are wildcards and whitespace ends the subject.
+func natsToken(s string) string {
+	if s == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '\t', '\r', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// ensureStream creates or updates sinks.nats.stream once.
+func (n *natsSink) ensureStream(ctx context.Context) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.streamReady {
+		return nil
+	}
+	s := n.conf.Stream
+	maxBytes := s.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = -1
+	}
+	subjects := s.Subjects
+	if len(subjects) == 0 {
+		subjects = []string{strings.NewReplacer("{host}", "*", "{metric}", "*").Replace(n.conf.Subject)}
+	}
+	ctx, cancel := context.WithTimeout(ctx, n.conf.AckTimeout.Std())
+	defer cancel()
+	_, err := n.js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:       s.Name,
+		Subjects:   subjects,
+		Retention:  natsRetention[s.Retention],
+		Storage:    natsStorage[s.Storage],
+		Replicas:   s.Replicas,
+		MaxAge:     s.MaxAge.Std(),
+		MaxBytes:   maxBytes,
+		Duplicates: s.Duplicates.Std(),
+	})
+	if err != nil {
+		return fmt.Errorf("creating stream %s: %w", s.Name, err)
+	}
+	slog.Info("Stream ready", "component", "load", "sink", "nats", "stream", s.Name, "subjects", subjects)
+	n.streamReady = true
+	return nil
+}
+
+func (n *natsSink) Close() error {
+	// Drain flushes what is still buffered for a broker we reconnect to.
+	if err := n.nc.Drain(); err != nil {
+		n.nc.Close()
+		return err
+	}
+	return nil
+}
+
+// natsError turns a JetStream API error into an APIError, so the retry,
+// spill and dead-letter decisions made for the load API apply; JetStream
+// answers with HTTP-like codes. Authorization violations count as 403.
+// Other errors, like ack timeouts, are left as they are and retried.
+func natsError(err error) error {
+	var apiErr *jetstream.APIError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &apiErr) && apiErr.Code > 0:
+		return &APIError{StatusCode: apiErr.Code, Body: err.Error(), Code: strconv.Itoa(int(apiErr.ErrorCode)), Message: apiErr.Description}
+	case errors.Is(err, nats.ErrAuthorization), errors.Is(err, nats.ErrPermissionViolation):
+		return &APIError{StatusCode: http.StatusForbidden, Body: err.Error()}
+	case errors.Is(err, nats.ErrMaxPayload):
+		return &APIError{StatusCode: http.StatusRequestEntityTooLarge, Body: err.Error()}
+	}
+	return err
+}
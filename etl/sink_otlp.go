@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+//////////////////////////////////////////////////
+// OTLP Metrics Sink
+//////////////////////////////////////////////////
+
+type OTLPSinkConfig struct {
+	// URL is the collector's OTLP/HTTP metrics endpoint.
+	URL          string            `yaml:"url" json:"url"`
+	MetricPrefix string            `yaml:"metric_prefix" json:"metric_prefix"`
+	ServiceName  string            `yaml:"service_name" json:"service_name"`
+	Attributes   map[string]string `yaml:"attributes" json:"attributes"` // added to every appliance's resource
+	BearerToken  string            `yaml:"bearer_token" json:"bearer_token" secret:"true"`
+	Headers      map[string]string `yaml:"headers" json:"headers"`
+	Compression  string            `yaml:"compression" json:"compression"` // none or gzip
+	Timeout      Duration          `yaml:"timeout" json:"timeout"`
+	Retry        RetryConfig       `yaml:"retry" json:"retry"`
+}
+
+func defaultOTLPSinkConfig() OTLPSinkConfig {
+	return OTLPSinkConfig{
+		URL:          "http://localhost:4318/v1/metrics",
+		MetricPrefix: "device",
+		ServiceName:  "concurrent-etl",
+		Compression:  "gzip",
+		Timeout:      Duration(15 * time.Second),
+		Retry:        defaultRetryConfig(),
+	}
+}
+
+func (o *OTLPSinkConfig) validate() []error {
+	var errs []error
+	if !strings.HasPrefix(o.URL, "http://") && !strings.HasPrefix(o.URL, "https://") {
+		errs = append(errs, fmt.Errorf("sinks.otlp.url must be an http(s) URL, got %q", o.URL))
+	}
+	if o.MetricPrefix == "" {
+		errs = append(errs, errors.New("sinks.otlp.metric_prefix must be set"))
+	}
+	if o.Compression != "none" && o.Compression != "gzip" {
+		errs = append(errs, fmt.Errorf("sinks.otlp.compression must be none or gzip, got %q", o.Compression))
+	}
+	if o.Timeout <= 0 {
+		errs = append(errs, errors.New("sinks.otlp.timeout must be > 0"))
+	}
+	errs = append(errs, o.Retry.validate("sinks.otlp.retry")...)
+	return errs
+}
+
+func init() {
+	registerSink("otlp", func(cfg *Config) (Sink, error) {
+		conf := cfg.Sinks.OTLP
+		return &otlpSink{
+			conf:   conf,
+			client: loadClient(conf.Timeout.Std()),
+		}, nil
+	})
+}
+
+// otlpSink exports every indicator as an OTLP metric data point,
+// <metric_prefix>.<metric>.<indicator> with metric "cpu" for CPU records,
+// over OTLP/HTTP with protobuf encoding. Each appliance is a resource with
+// host.name set to its name; the data points carry cpu or device and the
+// record's labels as attributes. Disk and network indicators, which are
+// counters since boot, are cumulative monotonic sums; the rest are gauges.
+type otlpSink struct {
+	conf   OTLPSinkConfig
+	client *http.Client
+}
+
+func (o *otlpSink) Name() string {
+	return "otlp"
+}
+
+func (o *otlpSink) Load(ctx context.Context, data []DeviceData) error {
+	body := o.exportRequest(data)
+	encoding := ""
+	if o.conf.Compression == "gzip" {
+		buf := getBuffer()
+		defer putBuffer(buf)
+		zw := getGzipWriter(buf)
+		if _, err := zw.Write(body); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		putGzipWriter(zw)
+		body, encoding = buf.Bytes(), "gzip"
+	}
+
+	attempts, err := withRetry(ctx, o.conf.Retry, "otlp", func(int) error {
+		return o.export(ctx, body, encoding)
+	})
+	if err != nil {
+		return &AttemptsError{Attempts: attempts, Err: err}
+	}
+	return nil
+}
+
+func (o *otlpSink) export(ctx context.Context, body []byte, encoding string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.conf.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	for k, v := range o.conf.Headers {
+		req.Header.Set(k, v)
+	}
+	if o.conf.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+o.conf.BearerToken)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		drainBody(resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &APIError{StatusCode: resp.StatusCode, Body: string(msg),
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+	}
+	// A collector that dropped some points says so in partial_success. The
+	// rest were accepted and the OTLP spec says not to send the rejected
+	// ones again, so they are only logged.
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if rejected, msg := otlpPartialSuccess(raw); rejected > 0 {
+		slog.Warn("Collector rejected data points", "component", "load", "sink", "otlp", "rejected", rejected, "error", msg)
+	}
+	return nil
+}
+
+// otlpPartialSuccess reads partial_success from an
+// ExportMetricsServiceResponse.
+//
+//	ExportMetricsServiceResponse { ExportMetricsPartialSuccess partial_success = 1; }
+//	ExportMetricsPartialSuccess  { int64 rejected_data_points = 1; string error_message = 2; }
+func otlpPartialSuccess(raw []byte) (rejected int64, msg string) {
+	walkProto(raw, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		if num != 1 || typ != protowire.BytesType {
+			return nil
+		}
+		return walkProto(v, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+			switch {
+			case num == 1 && typ == protowire.VarintType:
+				rejected = int64(n)
+			case num == 2 && typ == protowire.BytesType:
+				msg = string(v)
+			}
+			return nil
+		})
+	})
+	return rejected, msg
+}
+
+// otlpMetric collects the encoded data points of one metric of a resource.
+type otlpMetric struct {
+	name   string
+	sum    bool
+	points [][]byte
+}
+
+// exportRequest encodes ExportMetricsServiceRequest by hand, like the
+// remote-write request of the prometheus sink, so the OTLP modules aren't
+// needed for their generated types.
+//
+//	ExportMetricsServiceRequest { repeated ResourceMetrics resource_metrics = 1; }
+//	ResourceMetrics  { Resource resource = 1; repeated ScopeMetrics scope_metrics = 2; }
+//	Resource         { repeated KeyValue attributes = 1; }
+//	ScopeMetrics     { InstrumentationScope scope = 1; repeated Metric metrics = 2; }
+//	Metric           { string name = 1; string unit = 3; Gauge gauge = 5; Sum sum = 7; }
+//	Gauge            { repeated NumberDataPoint data_points = 1; }
+//	Sum              { repeated NumberDataPoint data_points = 1; AggregationTemporality aggregation_temporality = 2; bool is_monotonic = 3; }
+//	NumberDataPoint  { fixed64 time_unix_nano = 3; double as_double = 4; repeated KeyValue attributes = 7; }
+//	KeyValue         { string key = 1; AnyValue value = 2; }
+//	AnyValue         { string string_value = 1; }
+func (o *otlpSink) exportRequest(data []DeviceData) []byte {
+	// One resource per appliance, in the order they first appear, each with
+	// its metrics in the order they first appear.
+	var hosts []string
+	metrics := map[string][]*otlpMetric{}
+	for _, d := range data {
+		if _, ok := metrics[d.Name]; !ok {
+			hosts = append(hosts, d.Name)
+			metrics[d.Name] = nil
+		}
+		metric := d.Metric
+		if metric == "" {
+			metric = "cpu"
+		}
+		attrs := map[string]string{}
+		for k, v := range d.Labels {
+			attrs[k] = v
+		}
+		if d.CPUNumber != "" {
+			attrs["cpu"] = d.CPUNumber
+		}
+		if d.Device != "" {
+			attrs["device"] = d.Device
+		}
+		for _, ind := range d.Indicators {
+			name := o.conf.MetricPrefix + "." + metric + "." + ind.Name
+			i := slices.IndexFunc(metrics[d.Name], func(m *otlpMetric) bool { return m.name == name })
+			if i < 0 {
+				metrics[d.Name] = append(metrics[d.Name], &otlpMetric{name: name, sum: metric == "disk" || metric == "network"})
+				i = len(metrics[d.Name]) - 1
+			}
+			m := metrics[d.Name][i]
+			m.points = append(m.points, otlpDataPoint(d.Timestamp, ind.Value, attrs))
+		}
+	}
+
+	var req, resource, scope, metric, inner []byte
+	for _, host := range hosts {
+		if len(metrics[host]) == 0 {
+			continue
+		}
+		attrs := map[string]string{"service.name": o.conf.ServiceName, "host.name": host}
+		for k, v := range o.conf.Attributes {
+			attrs[k] = v
+		}
+		resource = resource[:0]
+		resource = protowire.AppendTag(resource, 1, protowire.BytesType)
+		resource = protowire.AppendBytes(resource, appendOTLPAttributes(nil, 1, attrs))
+
+		scope = scope[:0]
+		scope = protowire.AppendTag(scope, 1, protowire.BytesType)
+		scope = protowire.AppendBytes(scope, appendProtoString(nil, 1, "github.com/ravishankarsrrav/concurrent-etl-go/etl"))
+		for _, m := range metrics[host] {
+			inner = inner[:0]
+			for _, p := range m.points {
+				inner = protowire.AppendTag(inner, 1, protowire.BytesType)
+				inner = protowire.AppendBytes(inner, p)
+			}
+			metric = appendProtoString(metric[:0], 1, m.name)
+			if unit := otlpUnit(m.name); unit != "" {
+				metric = appendProtoString(metric, 3, unit)
+			}
+			if m.sum {
+				inner = protowire.AppendTag(inner, 2, protowire.VarintType)
+				inner = protowire.AppendVarint(inner, 2) // AGGREGATION_TEMPORALITY_CUMULATIVE
+				inner = protowire.AppendTag(inner, 3, protowire.VarintType)
+				inner = protowire.AppendVarint(inner, 1)
+				metric = protowire.AppendTag(metric, 7, protowire.BytesType)
+			} else {
+				metric = protowire.AppendTag(metric, 5, protowire.BytesType)
+			}
+			metric = protowire.AppendBytes(metric, inner)
+
+			scope = protowire.AppendTag(scope, 2, protowire.BytesType)
+			scope = protowire.AppendBytes(scope, metric)
+		}
+
+		resource = protowire.AppendTag(resource, 2, protowire.BytesType)
+		resource = protowire.AppendBytes(resource, scope)
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, resource)
+	}
+	return req
+}
+
+// otlpDataPoint encodes a NumberDataPoint.
+func otlpDataPoint(ts uint64, value float64, attrs map[string]string) []byte {
+	b := protowire.AppendTag(nil, 3, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, ts*uint64(time.Second))
+	b = protowire.AppendTag(b, 4, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, math.Float64bits(value))
+	return appendOTLPAttributes(b, 7, attrs)
+}
+
+// appendOTLPAttributes appends attrs as KeyValue fields num, sorted by key.
+func appendOTLPAttributes(b []byte, num protowire.Number, attrs map[string]string) []byte {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		kv := appendProtoString(nil, 1, k)
+		kv = protowire.AppendTag(kv, 2, protowire.BytesType)
+		kv = protowire.AppendBytes(kv, appendProtoString(nil, 1, attrs[k]))
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, kv)
+	}
+	return b
+}
+
+// otlpUnit is the UCUM unit of an indicator, going by its name.
+func otlpUnit(name string) string {
+	switch {
+	case strings.HasSuffix(name, "_bytes"):
+		return "By"
+	case strings.HasSuffix(name, "_ms"):
+		return "ms"
+	case strings.HasSuffix(name, ".utilization"), strings.HasSuffix(name, ".idle"),
+		strings.HasSuffix(name, ".user"), strings.HasSuffix(name, ".system"),
+		strings.HasSuffix(name, ".irq"), strings.HasSuffix(name, ".nice"):
+		return "%"
+	}
+	return ""
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+//////////////////////////////////////////////////
+// Postgres / TimescaleDB Sink
+//////////////////////////////////////////////////
+
+type PostgresSinkConfig struct {
+	// DSN is a postgres:// URL or key=value connection string.
+	DSN   string `yaml:"dsn" json:"dsn" secret:"true"`
+	Table string `yaml:"table" json:"table"` // optionally schema-qualified
+	// CreateTable creates the table on the first load if it doesn't exist,
+	// and with Hypertable turns it into a TimescaleDB hypertable on time.
+	CreateTable bool `yaml:"create_table" json:"create_table"`
+	Hypertable  bool `yaml:"hypertable" json:"hypertable"`
+	// OnConflict is what happens to rows whose key is already in the table:
+	// error fails the batch, ignore keeps the stored row and update
+	// replaces its indicators and labels.
+	OnConflict string      `yaml:"on_conflict" json:"on_conflict"`
+	MaxConns   int         `yaml:"max_conns" json:"max_conns"`
+	Timeout    Duration    `yaml:"timeout" json:"timeout"`
+	Retry      RetryConfig `yaml:"retry" json:"retry"`
+}
+
+func defaultPostgresSinkConfig() PostgresSinkConfig {
+	return PostgresSinkConfig{
+		Table:      "device_metrics",
+		OnConflict: "ignore",
+		MaxConns:   10,
+		Timeout:    Duration(30 * time.Second),
+		Retry:      defaultRetryConfig(),
+	}
+}
+
+func (p *PostgresSinkConfig) validate() []error {
+	var errs []error
+	if p.DSN == "" {
+		errs = append(errs, errors.New("sinks.postgres.dsn must be set"))
+	}
+	if p.Table == "" {
+		errs = append(errs, errors.New("sinks.postgres.table must be set"))
+	}
+	if p.Hypertable && !p.CreateTable {
+		errs = append(errs, errors.New("sinks.postgres.hypertable needs create_table"))
+	}
+	switch p.OnConflict {
+	case "error", "ignore", "update":
+	default:
+		errs = append(errs, fmt.Errorf("sinks.postgres.on_conflict must be error, ignore or update, got %q", p.OnConflict))
+	}
+	if p.MaxConns <= 0 {
+		errs = append(errs, fmt.Errorf("sinks.postgres.max_conns must be > 0, got %d", p.MaxConns))
+	}
+	if p.Timeout <= 0 {
+		errs = append(errs, errors.New("sinks.postgres.timeout must be > 0"))
+	}
+	errs = append(errs, p.Retry.validate("sinks.postgres.retry")...)
+	return errs
+}
+
+func init() {
+	registerSink("postgres", newPostgresSink)
+}
+
+// postgresColumns are the table's columns, in COPY order. The key is every
+// column but indicators and labels, which are jsonb objects.
+var postgresColumns = []string{"time", "name", "cpu_number", "metric", "device", "indicators", "labels"}
+
+const postgresKey = "name, metric, device, cpu_number, time"
+
+// postgresSink loads each batch with COPY. With on_conflict ignore or
+// update, rows are copied into a temporary table first and moved with
+// INSERT ... ON CONFLICT, in one transaction.
+type postgresSink struct {
+	conf  PostgresSinkConfig
+	pool  *pgxpool.Pool
+	table pgx.Identifier
+
+	mu    sync.Mutex
+	ready bool // table created, or create_table off
+}
+
+func newPostgresSink(cfg *Config) (Sink, error) {
+	conf := cfg.Sinks.Postgres
+	poolConf, err := pgxpool.ParseConfig(conf.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("sinks.postgres.dsn: %w", err)
+	}
+	poolConf.MaxConns = int32(conf.MaxConns)
+	// Connections are opened on the first load, so a database that is down
+	// at startup only fails batches, which are spilled.
+	pool, err := pgxpool.NewWithConfig(context.Background(), poolConf)
+	if err != nil {
+		return nil, err
+	}
+	return &postgresSink{
+		conf:  conf,
+		pool:  pool,
+		table: pgx.Identifier(strings.Split(conf.Table, ".")),
+		ready: !conf.CreateTable,
+	}, nil
+}
+
+func (p *postgresSink) Name() string {
+	return "postgres"
+}
+
+func (p *postgresSink) Load(ctx context.Context, data []DeviceData) error {
+	attempts, err := withRetry(ctx, p.conf.Retry, "postgres", func(int) error {
+		return postgresError(p.copy(ctx, data))
+	})
+	if err != nil {
+		return &AttemptsError{Attempts: attempts, Err: err}
+	}
+	return nil
+}
+
+// copy loads data in one transaction.
+func (p *postgresSink) copy(ctx context.Context, data []DeviceData) error {
+	ctx, cancel := context.WithTimeout(ctx, p.conf.Timeout.Std())
+	defer cancel()
+	if err := p.createTable(ctx); err != nil {
+		return err
+	}
+
+	rows := make([][]any, len(data))
+	for i, d := range data {
+		indicators := make(map[string]float64, len(d.Indicators))
+		for _, ind := range d.Indicators {
+			indicators[ind.Name] = ind.Value
+		}
+		labels := d.Labels
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		rows[i] = []any{time.Unix(int64(d.Timestamp), 0).UTC(), d.Name, d.CPUNumber, d.Metric, d.Device, indicators, labels}
+	}
+
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if p.conf.OnConflict == "error" {
+		if _, err := tx.CopyFrom(ctx, p.table, postgresColumns, pgx.CopyFromRows(rows)); err != nil {
+			return err
+		}
+		return tx.Commit(ctx)
+	}
+
+	staging := pgx.Identifier{"etl_staging"}
+	if _, err := tx.Exec(ctx, fmt.Sprintf("CREATE TEMPORARY TABLE %s (LIKE %s INCLUDING DEFAULTS) ON COMMIT DROP",
+		staging.Sanitize(), p.table.Sanitize())); err != nil {
+		return err
+	}
+	if _, err := tx.CopyFrom(ctx, staging, postgresColumns, pgx.CopyFromRows(rows)); err != nil {
+		return err
+	}
+	// A batch can hold the same key twice, e.g. after dedup is turned off;
+	// DISTINCT ON keeps one, since ON CONFLICT DO UPDATE can't touch a row
+	// twice.
+	cols := strings.Join(postgresColumns, ", ")
+	insert := fmt.Sprintf("INSERT INTO %s (%s) SELECT DISTINCT ON (%s) %s FROM %s ON CONFLICT",
+		p.table.Sanitize(), cols, postgresKey, cols, staging.Sanitize())
+	if p.conf.OnConflict == "update" {
+		insert += fmt.Sprintf(" (%s) DO UPDATE SET indicators = EXCLUDED.indicators, labels = EXCLUDED.labels", postgresKey)
+	} else {
+		insert += " DO NOTHING"
+	}
+	if _, err := tx.Exec(ctx, insert); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// createTable creates the table, and the hypertable, once.
+func (p *postgresSink) createTable(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ready {
+		return nil
+	}
+	ddl := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	time       timestamptz NOT NULL,
+	name       text NOT NULL,
+	cpu_number text NOT NULL DEFAULT '',
+	metric     text NOT NULL DEFAULT '',
+	device     text NOT NULL DEFAULT '',
+	indicators jsonb NOT NULL,
+	labels     jsonb NOT NULL DEFAULT '{}',
+	PRIMARY KEY (%s)
+)`, p.table.Sanitize(), postgresKey)
+	if _, err := p.pool.Exec(ctx, ddl); err != nil {
+		return fmt.Errorf("creating table %s: %w", p.conf.Table, err)
+	}
+	if p.conf.Hypertable {
+		if _, err := p.pool.Exec(ctx, "SELECT create_hypertable($1::regclass, 'time', if_not_exists => TRUE)", p.table.Sanitize()); err != nil {
+			return fmt.Errorf("creating hypertable %s: %w", p.conf.Table, err)
+		}
+	}
+	slog.Info("Table ready", "component", "load", "sink", "postgres", "table", p.conf.Table, "hypertable", p.conf.Hypertable)
+	p.ready = true
+	return nil
+}
+
+func (p *postgresSink) Close() error {
+	p.pool.Close()
+	return nil
+}
+
+// postgresHTTPStatus is the HTTP status an SQLSTATE class, or a whole
+// SQLSTATE, counts as, like grpcHTTPStatus. Other server errors count as
+// 500 and are retried.
+var postgresHTTPStatus = map[string]int{
+	"22":    http.StatusBadRequest,         // data exception
+	"23":    http.StatusConflict,           // integrity constraint violation
+	"28":    http.StatusUnauthorized,       // invalid authorization
+	"42":    http.StatusBadRequest,         // syntax error or access rule violation
+	"42501": http.StatusForbidden,          // insufficient_privilege
+	"40":    http.StatusServiceUnavailable, // serialization failure, deadlock
+	"53":    http.StatusServiceUnavailable, // insufficient resources
+	"57":    http.StatusServiceUnavailable, // operator intervention
+}
+
+// postgresError turns a server error into an APIError, so the retry, spill
+// and dead-letter decisions made for the load API apply. Refused
+// credentials and missing privileges are permanent, as for ClickHouse.
+// Network errors are left as they are.
+func postgresError(err error) error {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return err
+	}
+	code, ok := postgresHTTPStatus[pgErr.Code]
+	if !ok {
+		code, ok = postgresHTTPStatus[pgErr.Code[:min(2, len(pgErr.Code))]]
+	}
+	if !ok {
+		code = http.StatusInternalServerError
+	}
+	apiErr := &APIError{StatusCode: code, Body: err.Error(), Code: pgErr.Code, Message: pgErr.Message}
+	if isAuthFailure(apiErr) {
+		return permanent(apiErr)
+	}
+	return apiErr
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+//////////////////////////////////////////////////
+// Prometheus Remote-Write Sink
+//////////////////////////////////////////////////
+
+type PrometheusSinkConfig struct {
+	URL          string            `yaml:"url" json:"url"`
+	MetricPrefix string            `yaml:"metric_prefix" json:"metric_prefix"`
+	Job          string            `yaml:"job" json:"job"`
+	ExtraLabels  map[string]string `yaml:"extra_labels" json:"extra_labels"`
+	BearerToken  string            `yaml:"bearer_token" json:"bearer_token" secret:"true"`
+	Username     string            `yaml:"username" json:"username"`
+	Password     string            `yaml:"password" json:"password" secret:"true"`
+	Headers      map[string]string `yaml:"headers" json:"headers"`
+	Timeout      Duration          `yaml:"timeout" json:"timeout"`
+	Retry        RetryConfig       `yaml:"retry" json:"retry"`
+}
+
+func defaultPrometheusSinkConfig() PrometheusSinkConfig {
+	return PrometheusSinkConfig{
+		URL:          "http://localhost:9009/api/v1/push",
+		MetricPrefix: "device_cpu",
+		Job:          "concurrent-etl",
+		Timeout:      Duration(15 * time.Second),
+		Retry:        defaultRetryConfig(),
+	}
+}
+
+func (p *PrometheusSinkConfig) validate() []error {
+	var errs []error
+	if !strings.HasPrefix(p.URL, "http://") && !strings.HasPrefix(p.URL, "https://") {
+		errs = append(errs, fmt.Errorf("sinks.prometheus.url must be an http(s) URL, got %q", p.URL))
+	}
+	if p.MetricPrefix == "" {
+		errs = append(errs, errors.New("sinks.prometheus.metric_prefix must be set"))
+	}
+	if p.Timeout <= 0 {
+		errs = append(errs, errors.New("sinks.prometheus.timeout must be > 0"))
+	}
+	errs = append(errs, p.Retry.validate("sinks.prometheus.retry")...)
+	return errs
+}
+
+func init() {
+	registerSink("prometheus", func(cfg *Config) (Sink, error) {
+		conf := cfg.Sinks.Prometheus
+		return &prometheusSink{
+			conf:   conf,
+			client: loadClient(conf.Timeout.Std()),
+		}, nil
+	})
+}
+
+// prometheusSink pushes every indicator as its own series,
+// <metric_prefix>_<indicator>{instance=<hostname>, cpu=<cpu_number>, job=...},
+// or <metric_prefix>_<metric>_<indicator>{instance=..., device=...} for
+// memory, disk and network records, plus the record's labels unless they
+// clash with one of those, using the remote-write 1.0 protocol
+// (snappy-compressed protobuf).
+type prometheusSink struct {
+	conf   PrometheusSinkConfig
+	client *http.Client
+}
+
+func (p *prometheusSink) Name() string {
+	return "prometheus"
+}
+
+func (p *prometheusSink) Load(ctx context.Context, data []DeviceData) error {
+	body := snappy.Encode(nil, p.writeRequest(data))
+
+	attempts, err := withRetry(ctx, p.conf.Retry, "prometheus", func(int) error {
+		return p.push(ctx, body)
+	})
+	if err != nil {
+		return &AttemptsError{Attempts: attempts, Err: err}
+	}
+	return nil
+}
+
+func (p *prometheusSink) push(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.conf.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	for k, v := range p.conf.Headers {
+		req.Header.Set(k, v)
+	}
+	if p.conf.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+p.conf.BearerToken)
+	} else if p.conf.Username != "" {
+		req.SetBasicAuth(p.conf.Username, p.conf.Password)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		drainBody(resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return &APIError{StatusCode: resp.StatusCode, Body: string(msg),
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+}
+
+type promLabel struct {
+	name, value string
+}
+
+// writeRequest encodes prometheus.WriteRequest by hand; the message is tiny
+// and this avoids pulling in the Prometheus module for its generated types.
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label        { string name = 1; string value = 2; }
+//	Sample       { double value = 1; int64 timestamp = 2; }
+func (p *prometheusSink) writeRequest(data []DeviceData) []byte {
+	var req, series, labels, sample []byte
+
+	for _, d := range data {
+		for _, ind := range d.Indicators {
+			name := p.conf.MetricPrefix + "_" + sanitizeMetricName(ind.Name)
+			if d.Metric != "" {
+				name = p.conf.MetricPrefix + "_" + d.Metric + "_" + sanitizeMetricName(ind.Name)
+			}
+			lbls := []promLabel{
+				{"__name__", name},
+				{"instance", d.Name},
+			}
+			if d.CPUNumber != "" {
+				lbls = append(lbls, promLabel{"cpu", d.CPUNumber})
+			}
+			if d.Device != "" {
+				lbls = append(lbls, promLabel{"device", d.Device})
+			}
+			if p.conf.Job != "" {
+				lbls = append(lbls, promLabel{"job", p.conf.Job})
+			}
+			for k, v := range p.conf.ExtraLabels {
+				lbls = append(lbls, promLabel{k, v})
+			}
+			for k, v := range d.Labels {
+				k = sanitizeMetricName(k)
+				if !slices.ContainsFunc(lbls, func(l promLabel) bool { return l.name == k }) {
+					lbls = append(lbls, promLabel{k, v})
+				}
+			}
+			sort.Slice(lbls, func(i, j int) bool { return lbls[i].name < lbls[j].name })
+
+			series = series[:0]
+			for _, l := range lbls {
+				labels = labels[:0]
+				labels = protowire.AppendTag(labels, 1, protowire.BytesType)
+				labels = protowire.AppendString(labels, l.name)
+				labels = protowire.AppendTag(labels, 2, protowire.BytesType)
+				labels = protowire.AppendString(labels, l.value)
+
+				series = protowire.AppendTag(series, 1, protowire.BytesType)
+				series = protowire.AppendBytes(series, labels)
+			}
+
+			sample = sample[:0]
+			sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+			sample = protowire.AppendFixed64(sample, math.Float64bits(ind.Value))
+			sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+			sample = protowire.AppendVarint(sample, uint64(int64(d.Timestamp)*1000))
+
+			series = protowire.AppendTag(series, 2, protowire.BytesType)
+			series = protowire.AppendBytes(series, sample)
+
+			req = protowire.AppendTag(req, 1, protowire.BytesType)
+			req = protowire.AppendBytes(req, series)
+		}
+	}
+	return req
+}
+
+func sanitizeMetricName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
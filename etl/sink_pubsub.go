@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub/v2"
+	"google.golang.org/api/option"
+)
+
+//////////////////////////////////////////////////
+// Google Pub/Sub Sink
+//////////////////////////////////////////////////
+
+type PubSubSinkConfig struct {
+	// Project defaults to the one of the Application Default Credentials.
+	Project string `yaml:"project" json:"project"`
+	Topic   string `yaml:"topic" json:"topic"` // ID, or projects/<project>/topics/<id>
+	// Endpoint overrides pubsub.googleapis.com:443, e.g. with a regional
+	// endpoint, which keeps ordered messages in order across regions.
+	Endpoint string `yaml:"endpoint" json:"endpoint"`
+	// Ordering publishes each appliance's records in order, with its
+	// hostname as ordering key.
+	Ordering   bool              `yaml:"ordering" json:"ordering"`
+	Attributes map[string]string `yaml:"attributes" json:"attributes"` // added to every message
+	Batch      PubSubBatchConfig `yaml:"batch" json:"batch"`
+	Timeout    Duration          `yaml:"timeout" json:"timeout"` // per bundle, including the client's own retries
+	Retry      RetryConfig       `yaml:"retry" json:"retry"`
+}
+
+// PubSubBatchConfig is how the client bundles messages into publish
+// requests: a bundle is sent once it is DelayThreshold old or holds
+// CountThreshold messages or ByteThreshold bytes, whichever comes first.
+type PubSubBatchConfig struct {
+	DelayThreshold Duration `yaml:"delay_threshold" json:"delay_threshold"`
+	CountThreshold int      `yaml:"count_threshold" json:"count_threshold"`
+	ByteThreshold  int      `yaml:"byte_threshold" json:"byte_threshold"`
+	NumGoroutines  int      `yaml:"num_goroutines" json:"num_goroutines"` // 0 = a multiple of GOMAXPROCS
+	// MaxOutstandingMessages and MaxOutstandingBytes bound what is buffered
+	// across load workers; Publish blocks beyond them. 0 is unlimited.
+	MaxOutstandingMessages int  `yaml:"max_outstanding_messages" json:"max_outstanding_messages"`
+	MaxOutstandingBytes    int  `yaml:"max_outstanding_bytes" json:"max_outstanding_bytes"`
+	Compression            bool `yaml:"compression" json:"compression"`
+}
+
+func defaultPubSubSinkConfig() PubSubSinkConfig {
+	return PubSubSinkConfig{
+		Ordering: true,
+		Batch: PubSubBatchConfig{
+			DelayThreshold:         Duration(10 * time.Millisecond),
+			CountThreshold:         100,
+			ByteThreshold:          1_000_000,
+			MaxOutstandingMessages: 1000,
+		},
+		Timeout: Duration(60 * time.Second),
+		Retry:   defaultRetryConfig(),
+	}
+}
+
+func (p *PubSubSinkConfig) validate() []error {
+	var errs []error
+	if p.Topic == "" {
+		errs = append(errs, errors.New("sinks.pubsub.topic must be set"))
+	} else if strings.Contains(p.Topic, "/") && !strings.HasPrefix(p.Topic, "projects/") {
+		errs = append(errs, fmt.Errorf("sinks.pubsub.topic must be an ID or projects/<project>/topics/<id>, got %q", p.Topic))
+	}
+	b := p.Batch
+	if b.DelayThreshold <= 0 {
+		errs = append(errs, errors.New("sinks.pubsub.batch.delay_threshold must be > 0"))
+	}
+	if b.CountThreshold <= 0 || b.CountThreshold > pubsub.MaxPublishRequestCount {
+		errs = append(errs, fmt.Errorf("sinks.pubsub.batch.count_threshold must be between 1 and %d, got %d", pubsub.MaxPublishRequestCount, b.CountThreshold))
+	}
+	if b.ByteThreshold <= 0 || b.ByteThreshold > pubsub.MaxPublishRequestBytes {
+		errs = append(errs, fmt.Errorf("sinks.pubsub.batch.byte_threshold must be between 1 and %d, got %d", int(pubsub.MaxPublishRequestBytes), b.ByteThreshold))
+	}
+	if b.NumGoroutines < 0 {
+		errs = append(errs, fmt.Errorf("sinks.pubsub.batch.num_goroutines must be >= 0, got %d", b.NumGoroutines))
+	}
+	if b.MaxOutstandingMessages < 0 || b.MaxOutstandingBytes < 0 {
+		errs = append(errs, errors.New("sinks.pubsub.batch.max_outstanding_messages and max_outstanding_bytes must be >= 0"))
+	}
+	if p.Timeout <= 0 {
+		errs = append(errs, errors.New("sinks.pubsub.timeout must be > 0"))
+	}
+	errs = append(errs, p.Retry.validate("sinks.pubsub.retry")...)
+	return errs
+}
+
+func init() {
+	registerSink("pubsub", newPubSubSink)
+}
+
+// pubSubSink publishes one JSON message per record, with host and metric
+// attributes for subscription filters. The client bundles the messages of
+// all load workers into publish requests per the batch settings.
+type pubSubSink struct {
+	conf      PubSubSinkConfig
+	client    *pubsub.Client
+	publisher *pubsub.Publisher
+}
+
+func newPubSubSink(cfg *Config) (Sink, error) {
+	conf := cfg.Sinks.PubSub
+	project := conf.Project
+	if project == "" {
+		project = pubsub.DetectProjectID
+	}
+	// Credentials are the Application Default Credentials:
+	// GOOGLE_APPLICATION_CREDENTIALS, gcloud's, or the metadata server's
+	// service account. PUBSUB_EMULATOR_HOST points the client at an
+	// emulator instead.
+	var opts []option.ClientOption
+	if conf.Endpoint != "" {
+		opts = append(opts, option.WithEndpoint(conf.Endpoint))
+	}
+	client, err := pubsub.NewClient(context.Background(), project, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("sinks.pubsub: %w", err)
+	}
+
+	b := conf.Batch
+	publisher := client.Publisher(conf.Topic)
+	publisher.EnableMessageOrdering = conf.Ordering
+	publisher.PublishSettings = pubsub.PublishSettings{
+		DelayThreshold: b.DelayThreshold.Std(),
+		CountThreshold: b.CountThreshold,
+		ByteThreshold:  b.ByteThreshold,
+		NumGoroutines:  b.NumGoroutines,
+		Timeout:        conf.Timeout.Std(),
+		FlowControlSettings: pubsub.FlowControlSettings{
+			MaxOutstandingMessages: b.MaxOutstandingMessages,
+			MaxOutstandingBytes:    b.MaxOutstandingBytes,
+			LimitExceededBehavior:  pubsub.FlowControlBlock,
+		},
+		EnableCompression:         b.Compression,
+		CompressionBytesThreshold: pubsub.DefaultPublishSettings.CompressionBytesThreshold,
+	}
+	if b.MaxOutstandingMessages == 0 && b.MaxOutstandingBytes == 0 {
+		publisher.PublishSettings.FlowControlSettings.LimitExceededBehavior = pubsub.FlowControlIgnore
+	}
+	return &pubSubSink{conf: conf, client: client, publisher: publisher}, nil
+}
+
+func (p *pubSubSink) Name() string {
+	return "pubsub"
+}
+
+func (p *pubSubSink) Load(ctx context.Context, data []DeviceData) error {
+	msgs := make([]*pubsub.Message, len(data))
+	for i, d := range data {
+		body, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		metric := d.Metric
+		if metric == "" {
+			metric = "cpu"
+		}
+		attrs := make(map[string]string, len(p.conf.Attributes)+2)
+		for k, v := range p.conf.Attributes {
+			attrs[k] = v
+		}
+		attrs["host"] = d.Name
+		attrs["metric"] = metric
+		msgs[i] = &pubsub.Message{Data: body, Attributes: attrs}
+		if p.conf.Ordering {
+			msgs[i].OrderingKey = d.Name
+		}
+	}
+
+	// Only the messages that weren't published are published again.
+	pending := make([]int, len(data))
+	for i := range pending {
+		pending[i] = i
+	}
+	attempts, err := withRetry(ctx, p.conf.Retry, "pubsub", func(int) error {
+		var err error
+		pending, err = p.publish(ctx, msgs, pending)
+		return grpcError(err)
+	})
+	switch {
+	case err == nil:
+		return nil
+	case len(pending) == len(data):
+		return &AttemptsError{Attempts: attempts, Err: err}
+	}
+	failed := make([]DeviceData, len(pending))
+	for i, idx := range pending {
+		failed[i] = data[idx]
+	}
+	return &PartialError{Failed: failed, Err: &AttemptsError{Attempts: attempts, Err: err}}
+}
+
+// publish sends the messages at the indexes in pending and waits for their
+// results. It returns the indexes that weren't published, with the first
+// error seen.
+func (p *pubSubSink) publish(ctx context.Context, msgs []*pubsub.Message, pending []int) ([]int, error) {
+	results := make([]*pubsub.PublishResult, len(pending))
+	for i, idx := range pending {
+		results[i] = p.publisher.Publish(ctx, msgs[idx])
+	}
+	var failed []int
+	var firstErr error
+	for i, r := range results {
+		if _, err := r.Get(ctx); err != nil {
+			failed = append(failed, pending[i])
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	// A failure pauses the message's ordering key, so that later messages
+	// don't overtake it; the retry publishes them again in order.
+	if p.conf.Ordering {
+		for _, idx := range failed {
+			p.publisher.ResumePublish(msgs[idx].OrderingKey)
+		}
+	}
+	return failed, firstErr
+}
+
+func (p *pubSubSink) Close() error {
+	// Stop sends what is still bundled.
+	p.publisher.Stop()
+	return p.client.Close()
+}
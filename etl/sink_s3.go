@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+//////////////////////////////////////////////////
+// S3 / Object-Storage Sink
+//////////////////////////////////////////////////
+
+type S3SinkConfig struct {
+	Endpoint        string      `yaml:"endpoint" json:"endpoint"`
+	Region          string      `yaml:"region" json:"region"`
+	Bucket          string      `yaml:"bucket" json:"bucket"`
+	Key             string      `yaml:"key" json:"key"`
+	AccessKeyID     string      `yaml:"access_key_id" json:"access_key_id"`
+	SecretAccessKey string      `yaml:"secret_access_key" json:"secret_access_key" secret:"true"`
+	SessionToken    string      `yaml:"session_token" json:"session_token" secret:"true"`
+	Insecure        bool        `yaml:"insecure" json:"insecure"`
+	PathStyle       bool        `yaml:"path_style" json:"path_style"`
+	StorageClass    string      `yaml:"storage_class" json:"storage_class"`
+	PartSizeMB      int         `yaml:"part_size_mb" json:"part_size_mb"`
+	Timeout         Duration    `yaml:"timeout" json:"timeout"`
+	Retry           RetryConfig `yaml:"retry" json:"retry"`
+}
+
+func defaultS3SinkConfig() S3SinkConfig {
+	return S3SinkConfig{
+		Endpoint:   "s3.amazonaws.com",
+		Region:     "us-east-1",
+		Key:        "device-metrics/dt={date}/hour={hour}/worker-{worker}/{timestamp}-{id}.ndjson.gz",
+		PartSizeMB: 16,
+		Timeout:    Duration(2 * time.Minute),
+		Retry:      defaultRetryConfig(),
+	}
+}
+
+func (s *S3SinkConfig) validate() []error {
+	var errs []error
+	if s.Endpoint == "" || strings.Contains(s.Endpoint, "://") {
+		errs = append(errs, fmt.Errorf("sinks.s3.endpoint must be a host[:port] without scheme, got %q", s.Endpoint))
+	}
+	if s.Bucket == "" {
+		errs = append(errs, errors.New("sinks.s3.bucket must be set"))
+	}
+	if s.Key == "" {
+		errs = append(errs, errors.New("sinks.s3.key must be set"))
+	} else if !strings.Contains(s.Key, "{id}") && !strings.Contains(s.Key, "{timestamp}") {
+		errs = append(errs, errors.New("sinks.s3.key must contain {id} or {timestamp} so batches don't overwrite each other"))
+	}
+	if (s.AccessKeyID == "") != (s.SecretAccessKey == "") {
+		errs = append(errs, errors.New("sinks.s3.access_key_id and secret_access_key must be set together"))
+	}
+	// S3 rejects multipart parts under 5 MiB (except the last one).
+	if s.PartSizeMB < 5 {
+		errs = append(errs, fmt.Errorf("sinks.s3.part_size_mb must be >= 5, got %d", s.PartSizeMB))
+	}
+	if s.Timeout <= 0 {
+		errs = append(errs, errors.New("sinks.s3.timeout must be > 0"))
+	}
+	errs = append(errs, s.Retry.validate("sinks.s3.retry")...)
+	return errs
+}
+
+func init() {
+	registerSink("s3", newS3Sink)
+}
+
+// s3Sink writes each batch as one gzipped NDJSON object. Objects larger
+// than part_size_mb are uploaded in parts by the client.
+type s3Sink struct {
+	conf   S3SinkConfig
+	client *minio.Client
+}
+
+func newS3Sink(cfg *Config) (Sink, error) {
+	conf := cfg.Sinks.S3
+
+	lookup := minio.BucketLookupAuto
+	if conf.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+
+	client, err := minio.New(conf.Endpoint, &minio.Options{
+		Creds:        s3Credentials(conf.AccessKeyID, conf.SecretAccessKey, conf.SessionToken),
+		Secure:       !conf.Insecure,
+		Region:       conf.Region,
+		BucketLookup: lookup,
+		MaxRetries:   1, // retries are ours, with the configured backoff
+	})
+	if err != nil {
+		return nil, fmt.Errorf("s3 client: %w", err)
+	}
+	return &s3Sink{conf: conf, client: client}, nil
+}
+
+// s3Credentials returns static keys if configured, otherwise the usual AWS
+// chain: environment, shared credentials file, then instance/task role.
+func s3Credentials(accessKeyID, secretAccessKey, sessionToken string) *credentials.Credentials {
+	if accessKeyID != "" {
+		return credentials.NewStaticV4(accessKeyID, secretAccessKey, sessionToken)
+	}
+	return credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.FileAWSCredentials{},
+		&credentials.IAM{},
+	})
+}
+
+func (s *s3Sink) Name() string {
+	return "s3"
+}
+
+func (s *s3Sink) Load(ctx context.Context, data []DeviceData) error {
+	body := getBuffer()
+	defer putBuffer(body)
+	gz := getGzipWriter(body)
+	enc := json.NewEncoder(gz)
+	for _, d := range data {
+		if err := enc.Encode(d); err != nil {
+			return err
+		}
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	putGzipWriter(gz)
+	key := s.objectKey(time.Now().UTC(), workerIDFrom(ctx))
+
+	attempts, err := withRetry(ctx, s.conf.Retry, "s3", func(int) error {
+		return s.put(ctx, key, body.Bytes())
+	})
+	if err != nil {
+		return &AttemptsError{Attempts: attempts, Err: err}
+	}
+	return nil
+}
+
+func (s *s3Sink) put(ctx context.Context, key string, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, s.conf.Timeout.Std())
+	defer cancel()
+
+	_, err := s.client.PutObject(ctx, s.conf.Bucket, key, bytes.NewReader(body), int64(len(body)), minio.PutObjectOptions{
+		ContentType:     "application/x-ndjson",
+		ContentEncoding: "gzip",
+		StorageClass:    s.conf.StorageClass,
+		PartSize:        uint64(s.conf.PartSizeMB) << 20,
+	})
+	if err == nil {
+		return nil
+	}
+	// Surface S3 status codes so 4xx (bad bucket, denied) isn't retried.
+	if resp := minio.ToErrorResponse(err); resp.StatusCode != 0 {
+		return &APIError{StatusCode: resp.StatusCode, Body: resp.Code + ": " + resp.Message}
+	}
+	return err
+}
+
+// objectKey expands the key template: {date} (2006-01-02), {hour} (15),
+// {worker}, {timestamp} (unix millis) and {id} (random hex).
+func (s *s3Sink) objectKey(now time.Time, workerID int) string {
+	id := make([]byte, 4)
+	rand.Read(id)
+	return strings.NewReplacer(
+		"{date}", now.Format("2006-01-02"),
+		"{hour}", now.Format("15"),
+		"{worker}", strconv.Itoa(workerID),
+		"{timestamp}", strconv.FormatInt(now.UnixMilli(), 10),
+		"{id}", hex.EncodeToString(id),
+	).Replace(s.conf.Key)
+}
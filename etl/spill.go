@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+//////////////////////////////////////////////////
+// Spill Store
+//////////////////////////////////////////////////
+
+// SpilledBatch is a batch a sink failed to load, kept until it is replayed.
+type SpilledBatch struct {
+	ID        string       `json:"id"`
+	Sink      string       `json:"sink"`
+	BatchID   string       `json:"batch_id,omitempty"`
+	RunID     string       `json:"run_id,omitempty"`
+	WorkerID  int          `json:"worker_id"`
+	SpilledAt time.Time    `json:"spilled_at"`
+	Error     string       `json:"error,omitempty"`
+	ErrorType string       `json:"error_type,omitempty"`
+	Attempts  int          `json:"attempts,omitempty"`
+	Records   []DeviceData `json:"records"`
+}
+
+// SpillStore keeps spilled batches per sink. Put assigns the batch ID.
+// Implementations must be safe for concurrent use by the load workers and
+// may implement io.Closer.
+type SpillStore interface {
+	Put(b *SpilledBatch) error
+	List(sink string) ([]string, error)
+	Get(sink, id string) (*SpilledBatch, error)
+	Delete(sink, id string) error
+}
+
+// spills is set up by main before the first run.
+var spills SpillStore
+
+// errSpillGone is returned by stores shared between instances when another
+// instance has already taken the batch for replay.
+var errSpillGone = errors.New("spilled batch taken by another instance")
+
+func newSpillStore(cfg *Config, st *StateStore) (SpillStore, error) {
+	if err := setupSpillEncryption(&cfg.Load); err != nil {
+		return nil, err
+	}
+	switch cfg.Load.SpillStore {
+	case "bolt":
+		return &boltSpillStore{db: st.db}, nil
+	case "files":
+		return &dirSpillStore{dir: cfg.Load.SpillDir, format: cfg.Load.SpillFormat}, nil
+	case "sqlite":
+		return openSQLiteSpillStore(cfg.Load.SpillDB, cfg.Load.SpillRetention.Std())
+	case "redis":
+		return openRedisSpillStore(cfg.Load.Redis)
+	case "s3":
+		return openS3SpillStore(cfg.Load.S3)
+	case "gcs":
+		return openGCSSpillStore(cfg.Load.GCS)
+	default:
+		return nil, fmt.Errorf("unknown spill store %q", cfg.Load.SpillStore)
+	}
+}
+
+//////////////////////////////////////////////////
+// State Store Backend
+//////////////////////////////////////////////////
+
+// boltSpillStore keeps batches in the state store, one nested bucket per
+// sink, gzipped JSON values under sequence-ordered keys.
+type boltSpillStore struct {
+	db *bolt.DB
+}
+
+func (s *boltSpillStore) Put(b *SpilledBatch) error {
+	// bolt holds on to the value until the transaction commits.
+	buf := getBuffer()
+	defer putBuffer(buf)
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(stateSpillBucket).CreateBucketIfNotExists([]byte(b.Sink))
+		if err != nil {
+			return err
+		}
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		b.ID = fmt.Sprintf("%010d-w%d", seq, b.WorkerID)
+
+		gz := getGzipWriter(buf)
+		if err := json.NewEncoder(gz).Encode(b); err != nil {
+			return err
+		}
+		if err := gz.Close(); err != nil {
+			return err
+		}
+		putGzipWriter(gz)
+		return bucket.Put([]byte(b.ID), spillCrypt.seal(buf.Bytes()))
+	})
+}
+
+func (s *boltSpillStore) List(sink string) ([]string, error) {
+	var ids []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(stateSpillBucket).Bucket([]byte(sink))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, _ []byte) error {
+			ids = append(ids, string(k))
+			return nil
+		})
+	})
+	return ids, err
+}
+
+func (s *boltSpillStore) Get(sink, id string) (*SpilledBatch, error) {
+	var b SpilledBatch
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var raw []byte
+		if bucket := tx.Bucket(stateSpillBucket).Bucket([]byte(sink)); bucket != nil {
+			raw = bucket.Get([]byte(id))
+		}
+		if raw == nil {
+			return fmt.Errorf("spilled batch %s/%s not found", sink, id)
+		}
+		raw, err := spillCrypt.open(raw)
+		if err != nil {
+			return fmt.Errorf("spilled batch %s/%s: %w", sink, id, err)
+		}
+		gz, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return err
+		}
+		return json.NewDecoder(gz).Decode(&b)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func (s *boltSpillStore) Delete(sink, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(stateSpillBucket).Bucket([]byte(sink))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(id))
+	})
+}
+
+//////////////////////////////////////////////////
+// Directory Backend
+//////////////////////////////////////////////////
+
+// dirSpillStore writes each batch as <dir>/<sink>/<id>.json.gz holding the
+// JSON array of records, the format the ETL has always used, or with
+// spill_format: msgpack as a gzipped MessagePack array in <id>.msgpack.gz,
+// or with spill_format: parquet as <id>.parquet (see parquet.go). Spills of
+// any format are listed and replayed.
+//
+// The ID is buffer_failed_<time>_<seq>_<batch ID>_worker<N>, so a worker
+// failing twice in a run, or two runs in the same millisecond, never
+// overwrite a spill. Spills named buffer_failed_worker<N> by older versions
+// are still listed and replayed.
+type dirSpillStore struct {
+	dir    string
+	format string
+	mu     sync.Mutex
+	seq    uint64
+}
+
+var spillFileExts = []string{".json.gz", ".msgpack.gz", ".parquet"}
+
+func (s *dirSpillStore) Put(b *SpilledBatch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir := filepath.Join(s.dir, b.Sink)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	s.seq++
+	b.ID = spillFileID(b, s.seq)
+	switch s.format {
+	case "parquet":
+		raw, err := marshalParquetSpill(b)
+		if err != nil {
+			return err
+		}
+		return writeFileAtomic(filepath.Join(dir, b.ID+".parquet"), spillCrypt.seal(raw))
+	case "msgpack":
+		raw, out := getBuffer(), getBuffer()
+		defer putBuffer(raw)
+		defer putBuffer(out)
+		raw.Write(appendBatchMsgpack(raw.AvailableBuffer(), b.Records))
+		zw := getGzipWriter(out)
+		if _, err := zw.Write(raw.Bytes()); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		putGzipWriter(zw)
+		return writeFileAtomic(filepath.Join(dir, b.ID+".msgpack.gz"), spillCrypt.seal(out.Bytes()))
+	}
+	if spillCrypt == nil {
+		return saveBufferToFile(b.Records, filepath.Join(dir, b.ID))
+	}
+	// Encrypted, the batch is sealed whole rather than streamed to disk.
+	out := getBuffer()
+	defer putBuffer(out)
+	zw := getGzipWriter(out)
+	if err := json.NewEncoder(zw).Encode(b.Records); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	putGzipWriter(zw)
+	return writeFileAtomic(filepath.Join(dir, b.ID+".json.gz"), spillCrypt.seal(out.Bytes()))
+}
+
+// spillFileID names the spill file of b, seq being the store's count of
+// spills.
+func spillFileID(b *SpilledBatch, seq uint64) string {
+	id := fmt.Sprintf("buffer_failed_%s_%06d", b.SpilledAt.UTC().Format("20060102T150405.000Z"), seq)
+	if b.BatchID != "" {
+		id += "_" + b.BatchID
+	}
+	return id + fmt.Sprintf("_worker%d", b.WorkerID)
+}
+
+func (s *dirSpillStore) List(sink string) ([]string, error) {
+	var ids []string
+	for _, ext := range spillFileExts {
+		files, err := filepath.Glob(filepath.Join(s.dir, sink, "buffer_failed_*"+ext))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			id := strings.TrimSuffix(filepath.Base(f), ext)
+			if !slices.Contains(ids, id) {
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// path returns the file holding the spill, whichever its format.
+func (s *dirSpillStore) path(sink, id string) (string, error) {
+	var err error
+	for _, ext := range spillFileExts {
+		path := filepath.Join(s.dir, sink, id+ext)
+		if _, err = os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", err
+}
+
+func (s *dirSpillStore) Get(sink, id string) (*SpilledBatch, error) {
+	path, err := s.path(sink, id)
+	if err != nil {
+		return nil, err
+	}
+	b, err := readSpillFile(path)
+	if err != nil {
+		return nil, err
+	}
+	b.ID, b.Sink = id, sink
+	return b, nil
+}
+
+func (s *dirSpillStore) Delete(sink, id string) error {
+	path, err := s.path(sink, id)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+//////////////////////////////////////////////////
+// Failed Buffer Loader
+//////////////////////////////////////////////////
+
+// loadFailedBuffers queues spill files left in the working directory by
+// versions without per-sink spill directories, or copied there, under
+// either naming. They go to every sink.
+func loadFailedBuffers() {
+	files, err := filepath.Glob("buffer_failed_*.json.gz")
+	if err != nil {
+		slog.Error("Error scanning failed buffer files", "error", err)
+		return
+	}
+
+	for _, file := range files {
+		slog.Info("Reloading failed buffer", "file", file)
+
+		dataList, err := readBufferFromFile(file)
+		if err != nil {
+			slog.Error("Failed to read failed buffer", "file", file, "error", err)
+			continue
+		}
+
+		// The file may come from a run with more workers.
+		workerID := extractWorkerID(file) % len(dataChan)
+		if deduper != nil {
+			deduper.Remember(dataList)
+		}
+
+		backpressure.Queued(len(dataList))
+		for _, data := range dataList {
+			dataChan[workerID] <- data
+		}
+
+		err = os.Remove(file)
+		if err != nil {
+			slog.Error("Failed to delete failed buffer", "file", file, "error", err)
+		} else {
+			slog.Info("Deleted failed buffer file", "file", file, "worker_id", workerID, "batch_size", len(dataList))
+		}
+	}
+}
+
+// replaySpilledBatches re-sends what each sink failed to load in earlier
+// runs, before any new data. A sink's spilled batches go to that sink
+// only; sinks are replayed in parallel, skipping any that report
+// unhealthy, e.g. a daemon cycle's http sink whose breaker is still open.
+func replaySpilledBatches() {
+	replayHealthySinks(context.Background())
+}
+
+// replaySpilled re-sends the batches spilled for s, stopping early once ctx
+// is done.
+func replaySpilled(ctx context.Context, s Sink) {
+	ids, err := spills.List(s.Name())
+	if err != nil {
+		slog.Error("Error listing spilled batches", "sink", s.Name(), "error", err)
+		return
+	}
+
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return
+		}
+		batch, err := spills.Get(s.Name(), id)
+		if errors.Is(err, errSpillGone) {
+			continue
+		}
+		if err != nil {
+			slog.Error("Failed to read failed buffer", "sink", s.Name(), "spill_id", id, "error", err)
+			continue
+		}
+		// Delete first: a failed replay spills the batch again.
+		err = spills.Delete(s.Name(), id)
+		if errors.Is(err, errSpillGone) {
+			continue
+		}
+		if err != nil {
+			slog.Error("Failed to delete failed buffer", "sink", s.Name(), "spill_id", id, "error", err)
+			continue
+		}
+		slog.Info("Replaying failed buffer", "sink", s.Name(), "spill_id", id, "batch_size", len(batch.Records))
+		// Replayed records go out as they are; remembering them drops the
+		// same samples if this run extracts them again.
+		if deduper != nil {
+			deduper.Remember(batch.Records)
+		}
+		flushTo(s, newBatchID(batch.Records), batch.Records, batch.WorkerID)
+	}
+}
+
+// replaySpillFiles resends spill files of any format, wherever they are:
+// each to the sink its directory is named after or, if that isn't a
+// configured sink, to every sink. A file is deleted once read; a failed
+// replay spills it to the spill store. It returns how many files couldn't
+// be read.
+func replaySpillFiles(files []string) (unreadable int) {
+	for _, file := range files {
+		batch, err := readSpillFile(file)
+		if err != nil {
+			slog.Error("Failed to read failed buffer", "file", file, "error", err)
+			unreadable++
+			continue
+		}
+		if err := os.Remove(file); err != nil {
+			slog.Error("Failed to delete failed buffer", "file", file, "error", err)
+			unreadable++
+			continue
+		}
+
+		targets := loadSinks
+		for _, s := range loadSinks {
+			if s.Name() == filepath.Base(filepath.Dir(file)) {
+				targets = []Sink{s}
+			}
+		}
+		for _, s := range targets {
+			slog.Info("Replaying failed buffer", "sink", s.Name(), "file", file, "batch_size", len(batch.Records))
+			flushTo(s, newBatchID(batch.Records), batch.Records, batch.WorkerID)
+		}
+	}
+	return unreadable
+}
+
+func readBufferFromFile(filePath string) ([]DeviceData, error) {
+	raw, err := readSpillBytes(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	gzReader, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	defer gzReader.Close()
+
+	var data []DeviceData
+	decoder := json.NewDecoder(gzReader)
+	err = decoder.Decode(&data)
+	return data, err
+}
+
+// readMsgpackSpill reads a spill written with spill_format: msgpack.
+func readMsgpackSpill(path string) ([]DeviceData, error) {
+	raw, err := readSpillBytes(path)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	raw, err = io.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+	records, err := unmarshalBatchMsgpack(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return records, nil
+}
+
+// readSpillFile reads a spill file of any format. Unless the format records
+// it, SpilledAt is the file's modification time.
+func readSpillFile(path string) (*SpilledBatch, error) {
+	if strings.HasSuffix(path, ".parquet") {
+		raw, err := readSpillBytes(path)
+		if err != nil {
+			return nil, err
+		}
+		b, err := readParquetSpill(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		b.WorkerID = extractWorkerID(path)
+		return b, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	var records []DeviceData
+	if strings.HasSuffix(path, ".msgpack.gz") {
+		records, err = readMsgpackSpill(path)
+	} else {
+		records, err = readBufferFromFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &SpilledBatch{
+		WorkerID:  extractWorkerID(path),
+		SpilledAt: info.ModTime().UTC(),
+		Records:   records,
+	}, nil
+}
+
+// extractWorkerID returns the N of a spill file named ..._worker<N> or
+// buffer_failed_worker<N>, or 0.
+func extractWorkerID(fileName string) int {
+	base := filepath.Base(fileName)
+	for _, ext := range spillFileExts {
+		base = strings.TrimSuffix(base, ext)
+	}
+	i := strings.LastIndex(base, "worker")
+	if i < 0 {
+		return 0
+	}
+	id, err := strconv.Atoi(base[i+len("worker"):])
+	if err != nil || id < 0 {
+		return 0
+	}
+	return id
+}
+
+//////////////////////////////////////////////////
+// Buffer Save
+//////////////////////////////////////////////////
+
+// saveBufferToFile writes records to filename.json.gz, going through a
+// temporary file so a crash never leaves a truncated spill behind.
+func saveBufferToFile(data []DeviceData, filename string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	gzipWriter := getGzipWriter(tmp)
+	if err := json.NewEncoder(gzipWriter).Encode(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		tmp.Close()
+		return err
+	}
+	putGzipWriter(gzipWriter)
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename+".json.gz")
+}
+
+// writeFileAtomic writes raw to filename through a temporary file, like
+// saveBufferToFile.
+func writeFileAtomic(filename string, raw []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
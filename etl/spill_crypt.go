@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+)
+
+//////////////////////////////////////////////////
+// Spill Encryption
+//////////////////////////////////////////////////
+
+// spillEncMagic starts every encrypted spill, followed by the GCM nonce and
+// the sealed gzip, MessagePack or Parquet bytes. Spills without it are read
+// as plaintext, so turning encryption on doesn't strand older spills.
+var spillEncMagic = []byte("ETLAES1\x00")
+
+// spillCrypter encrypts spills with AES-GCM under load.spill_key. old is the
+// key before a rotation, only used to decrypt.
+type spillCrypter struct {
+	aead cipher.AEAD
+	old  cipher.AEAD
+}
+
+// spillCrypt encrypts the spills of the files, bolt and object stores, nil when
+// load.spill_key is unset.
+var spillCrypt *spillCrypter
+
+// newSpillCrypter builds the crypter from base64 AES keys of 16, 24 or 32
+// bytes. It returns nil when neither key is set.
+func newSpillCrypter(key, oldKey string) (*spillCrypter, error) {
+	if key == "" && oldKey == "" {
+		return nil, nil
+	}
+	c := &spillCrypter{}
+	var err error
+	if key != "" {
+		if c.aead, err = spillAEAD(key); err != nil {
+			return nil, fmt.Errorf("load.spill_key: %w", err)
+		}
+	}
+	if oldKey != "" {
+		if c.old, err = spillAEAD(oldKey); err != nil {
+			return nil, fmt.Errorf("load.spill_old_key: %w", err)
+		}
+	}
+	return c, nil
+}
+
+func spillAEAD(key string) (cipher.AEAD, error) {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("not base64: %w", err)
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, fmt.Errorf("want a 16, 24 or 32 byte AES key, got %d bytes", len(raw))
+	}
+	return cipher.NewGCM(block)
+}
+
+// setupSpillEncryption sets spillCrypt from the load config. The secrets
+// must be resolved first, as the keys are usually secret references.
+func setupSpillEncryption(l *LoadConfig) error {
+	c, err := newSpillCrypter(l.SpillKey, l.SpillOldKey)
+	if err != nil {
+		return err
+	}
+	spillCrypt = c
+	return nil
+}
+
+// seal encrypts a spill, or returns it as is without a current key.
+func (c *spillCrypter) seal(plain []byte) []byte {
+	if c == nil || c.aead == nil {
+		return plain
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	rand.Read(nonce)
+	out := make([]byte, 0, len(spillEncMagic)+len(nonce)+len(plain)+c.aead.Overhead())
+	out = append(out, spillEncMagic...)
+	out = append(out, nonce...)
+	return c.aead.Seal(out, nonce, plain, nil)
+}
+
+// open decrypts a spill sealed under the current or the old key. Spills
+// that aren't encrypted are returned as they are.
+func (c *spillCrypter) open(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, spillEncMagic) {
+		return data, nil
+	}
+	if c == nil {
+		return nil, errors.New("spill is encrypted and load.spill_key is not set")
+	}
+	data = data[len(spillEncMagic):]
+	for _, aead := range []cipher.AEAD{c.aead, c.old} {
+		if aead == nil || len(data) < aead.NonceSize() {
+			continue
+		}
+		nonce, sealed := data[:aead.NonceSize()], data[aead.NonceSize():]
+		if plain, err := aead.Open(nil, nonce, sealed, nil); err == nil {
+			return plain, nil
+		}
+	}
+	return nil, errors.New("spill can't be decrypted with load.spill_key or load.spill_old_key")
+}
+
+// readSpillBytes reads a spill file, decrypting it if it is encrypted.
+func readSpillBytes(path string) ([]byte, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := spillCrypt.open(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return plain, nil
+}
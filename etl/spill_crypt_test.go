@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestSpillCrypter(t *testing.T) {
+	key := func(b byte, n int) string { return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, n)) }
+	oldKey, newKey, otherKey := key(1, 32), key(2, 16), key(3, 24)
+	plain := []byte("gzipped records")
+
+	crypter := func(key, old string) *spillCrypter {
+		t.Helper()
+		c, err := newSpillCrypter(key, old)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	sealedOld := crypter(oldKey, "").seal(plain)
+	sealedNew := crypter(newKey, "").seal(plain)
+
+	tests := []struct {
+		name    string
+		c       *spillCrypter
+		data    []byte
+		wantErr string
+	}{
+		{"round trip", crypter(newKey, ""), sealedNew, ""},
+		{"old spill after rotation", crypter(newKey, oldKey), sealedOld, ""},
+		{"new spill after rotation", crypter(newKey, oldKey), sealedNew, ""},
+		{"decrypt only, key removed", crypter("", oldKey), sealedOld, ""},
+		{"plaintext spill", crypter(newKey, ""), plain, ""},
+		{"plaintext without key", nil, plain, ""},
+		{"wrong key", crypter(otherKey, ""), sealedNew, "can't be decrypted"},
+		{"rotated out", crypter(otherKey, newKey), sealedOld, "can't be decrypted"},
+		{"encrypted without key", nil, sealedNew, "not set"},
+	}
+	for _, tt := range tests {
+		got, err := tt.c.open(tt.data)
+		switch {
+		case tt.wantErr != "":
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: err = %v, want %q", tt.name, err, tt.wantErr)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case !bytes.Equal(got, plain):
+			t.Errorf("%s: opened %q, want %q", tt.name, got, plain)
+		}
+	}
+
+	if bytes.Contains(sealedNew, plain) {
+		t.Error("sealed spill contains the plaintext")
+	}
+	if got := crypter("", oldKey).seal(plain); !bytes.Equal(got, plain) {
+		t.Error("crypter without a current key encrypted")
+	}
+}
+
+func TestNewSpillCrypter(t *testing.T) {
+	tests := []struct {
+		key, old string
+		wantErr  string
+	}{
+		{"", "", ""},
+		{base64.StdEncoding.EncodeToString(make([]byte, 32)), "", ""},
+		{"not base64!", "", "load.spill_key: not base64"},
+		{base64.StdEncoding.EncodeToString(make([]byte, 20)), "", "load.spill_key: want a 16, 24 or 32 byte AES key, got 20 bytes"},
+		{"", base64.StdEncoding.EncodeToString(make([]byte, 8)), "load.spill_old_key"},
+	}
+	for _, tt := range tests {
+		_, err := newSpillCrypter(tt.key, tt.old)
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("newSpillCrypter(%q, %q) error = %v, want %q", tt.key, tt.old, err, tt.wantErr)
+		}
+	}
+}
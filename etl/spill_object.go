@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/minio/minio-go/v7"
+	"google.golang.org/api/iterator"
+)
+
+//////////////////////////////////////////////////
+// Object Storage Spill Store
+//////////////////////////////////////////////////
+
+// S3SpillConfig is the bucket of spill_store: s3, on AWS or any
+// S3-compatible service, with the same settings as the s3 sink.
+type S3SpillConfig struct {
+	Endpoint        string   `yaml:"endpoint" json:"endpoint"`
+	Region          string   `yaml:"region" json:"region"`
+	Bucket          string   `yaml:"bucket" json:"bucket"`
+	Prefix          string   `yaml:"prefix" json:"prefix"`
+	AccessKeyID     string   `yaml:"access_key_id" json:"access_key_id"`
+	SecretAccessKey string   `yaml:"secret_access_key" json:"secret_access_key" secret:"true"`
+	SessionToken    string   `yaml:"session_token" json:"session_token" secret:"true"`
+	Insecure        bool     `yaml:"insecure" json:"insecure"`
+	PathStyle       bool     `yaml:"path_style" json:"path_style"`
+	Timeout         Duration `yaml:"timeout" json:"timeout"`
+}
+
+func defaultS3SpillConfig() S3SpillConfig {
+	return S3SpillConfig{
+		Endpoint: "s3.amazonaws.com",
+		Region:   "us-east-1",
+		Prefix:   "etl-spill/",
+		Timeout:  Duration(30 * time.Second),
+	}
+}
+
+// validate checks the settings found under prefix, such as load.s3.
+func (s *S3SpillConfig) validate(prefix string) []error {
+	var errs []error
+	if s.Endpoint == "" || strings.Contains(s.Endpoint, "://") {
+		errs = append(errs, fmt.Errorf("%s.endpoint must be a host[:port] without scheme, got %q", prefix, s.Endpoint))
+	}
+	if s.Bucket == "" {
+		errs = append(errs, fmt.Errorf("%s.bucket must be set", prefix))
+	}
+	if (s.AccessKeyID == "") != (s.SecretAccessKey == "") {
+		errs = append(errs, fmt.Errorf("%s.access_key_id and secret_access_key must be set together", prefix))
+	}
+	if s.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("%s.timeout must be > 0", prefix))
+	}
+	return errs
+}
+
+// GCSSpillConfig is the bucket of spill_store: gcs. Credentials are the
+// Application Default Credentials.
+type GCSSpillConfig struct {
+	Bucket  string   `yaml:"bucket" json:"bucket"`
+	Prefix  string   `yaml:"prefix" json:"prefix"`
+	Timeout Duration `yaml:"timeout" json:"timeout"`
+}
+
+func defaultGCSSpillConfig() GCSSpillConfig {
+	return GCSSpillConfig{
+		Prefix:  "etl-spill/",
+		Timeout: Duration(30 * time.Second),
+	}
+}
+
+// validate checks the settings found under prefix, such as load.gcs.
+func (g *GCSSpillConfig) validate(prefix string) []error {
+	var errs []error
+	if g.Bucket == "" {
+		errs = append(errs, fmt.Errorf("%s.bucket must be set", prefix))
+	}
+	if g.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("%s.timeout must be > 0", prefix))
+	}
+	return errs
+}
+
+// objectBucket is the little of a bucket that objectSpillStore needs.
+// get, size and delete return errSpillGone for objects that don't exist.
+type objectBucket interface {
+	put(ctx context.Context, key string, data []byte) error
+	list(ctx context.Context, prefix string) ([]string, error) // keys, in lexical order
+	get(ctx context.Context, key string) ([]byte, error)
+	size(ctx context.Context, key string) (int64, error)
+	delete(ctx context.Context, key string) error
+	close() error
+}
+
+// objectSpillStore keeps each spilled batch as the object
+// <prefix><sink>/<id>.json.gz holding the gzipped JSON batch, encrypted
+// with load.spill_key if set, so spills outlive the container that made
+// them. IDs start with the spill time, so listing returns them oldest
+// first.
+type objectSpillStore struct {
+	bucket  objectBucket
+	prefix  string
+	timeout time.Duration
+}
+
+const objectSpillExt = ".json.gz"
+
+func (s *objectSpillStore) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), s.timeout)
+}
+
+func (s *objectSpillStore) key(sink, id string) string {
+	return s.prefix + sink + "/" + id + objectSpillExt
+}
+
+// check lists the prefix, failing at startup rather than at the first
+// spill if the bucket is missing or the credentials can't reach it.
+func (s *objectSpillStore) check() error {
+	ctx, cancel := s.context()
+	defer cancel()
+	_, err := s.bucket.list(ctx, s.prefix+".etl-check")
+	return err
+}
+
+func (s *objectSpillStore) Close() error {
+	return s.bucket.close()
+}
+
+func (s *objectSpillStore) Put(b *SpilledBatch) error {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	b.ID = fmt.Sprintf("%s-w%d-%s", b.SpilledAt.UTC().Format("20060102T150405.000000000Z"), b.WorkerID, hex.EncodeToString(suffix))
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	gz := getGzipWriter(buf)
+	if err := json.NewEncoder(gz).Encode(b); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	putGzipWriter(gz)
+
+	ctx, cancel := s.context()
+	defer cancel()
+	return s.bucket.put(ctx, s.key(b.Sink, b.ID), spillCrypt.seal(buf.Bytes()))
+}
+
+func (s *objectSpillStore) List(sink string) ([]string, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+	dir := s.prefix + sink + "/"
+	keys, err := s.bucket.list(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, k := range keys {
+		id, ok := strings.CutSuffix(strings.TrimPrefix(k, dir), objectSpillExt)
+		if ok && !strings.Contains(id, "/") {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (s *objectSpillStore) Get(sink, id string) (*SpilledBatch, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+	raw, err := s.bucket.get(ctx, s.key(sink, id))
+	if err != nil {
+		return nil, err
+	}
+	raw, err = spillCrypt.open(raw)
+	if err != nil {
+		return nil, fmt.Errorf("spilled batch %s/%s: %w", sink, id, err)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	var b SpilledBatch
+	if err := json.NewDecoder(gz).Decode(&b); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func (s *objectSpillStore) Size(sink, id string) (int64, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+	return s.bucket.size(ctx, s.key(sink, id))
+}
+
+func (s *objectSpillStore) Delete(sink, id string) error {
+	ctx, cancel := s.context()
+	defer cancel()
+	return s.bucket.delete(ctx, s.key(sink, id))
+}
+
+//////////////////////////////////////////////////
+// S3 Backend
+//////////////////////////////////////////////////
+
+// s3Bucket deletes without a precondition, since S3 reports success for
+// keys that are already gone: instances sharing a bucket and prefix may
+// both replay a batch.
+type s3Bucket struct {
+	client *minio.Client
+	bucket string
+}
+
+func openS3SpillStore(conf S3SpillConfig) (*objectSpillStore, error) {
+	lookup := minio.BucketLookupAuto
+	if conf.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+	client, err := minio.New(conf.Endpoint, &minio.Options{
+		Creds:        s3Credentials(conf.AccessKeyID, conf.SecretAccessKey, conf.SessionToken),
+		Secure:       !conf.Insecure,
+		Region:       conf.Region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("s3 spill store: %w", err)
+	}
+	s := &objectSpillStore{bucket: &s3Bucket{client: client, bucket: conf.Bucket}, prefix: conf.Prefix, timeout: conf.Timeout.Std()}
+	if err := s.check(); err != nil {
+		return nil, fmt.Errorf("s3 spill bucket %s: %w", conf.Bucket, err)
+	}
+	return s, nil
+}
+
+func (b *s3Bucket) put(ctx context.Context, key string, data []byte) error {
+	_, err := b.client.PutObject(ctx, b.bucket, key, bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{ContentType: "application/octet-stream"})
+	return err
+}
+
+func (b *s3Bucket) list(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	for obj := range b.client.ListObjects(ctx, b.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		keys = append(keys, obj.Key)
+	}
+	return keys, nil
+}
+
+func (b *s3Bucket) get(ctx context.Context, key string) ([]byte, error) {
+	obj, err := b.client.GetObject(ctx, b.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s3NotFound(err)
+	}
+	defer obj.Close()
+	raw, err := io.ReadAll(obj)
+	if err != nil {
+		return nil, s3NotFound(err)
+	}
+	return raw, nil
+}
+
+func (b *s3Bucket) size(ctx context.Context, key string) (int64, error) {
+	info, err := b.client.StatObject(ctx, b.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return 0, s3NotFound(err)
+	}
+	return info.Size, nil
+}
+
+func (b *s3Bucket) delete(ctx context.Context, key string) error {
+	return b.client.RemoveObject(ctx, b.bucket, key, minio.RemoveObjectOptions{})
+}
+
+func (b *s3Bucket) close() error {
+	return nil
+}
+
+// s3NotFound turns a missing key into errSpillGone.
+func s3NotFound(err error) error {
+	if resp := minio.ToErrorResponse(err); resp.Code == "NoSuchKey" || resp.StatusCode == http.StatusNotFound {
+		return errSpillGone
+	}
+	return err
+}
+
+//////////////////////////////////////////////////
+// GCS Backend
+//////////////////////////////////////////////////
+
+// gcsBucket deletes objects only while they exist, so among instances
+// sharing a bucket and prefix only one claims each batch, as with Redis.
+type gcsBucket struct {
+	client *storage.Client
+	bucket *storage.BucketHandle
+}
+
+func openGCSSpillStore(conf GCSSpillConfig) (*objectSpillStore, error) {
+	// STORAGE_EMULATOR_HOST points the client at an emulator instead.
+	client, err := storage.NewClient(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("gcs spill store: %w", err)
+	}
+	s := &objectSpillStore{bucket: &gcsBucket{client: client, bucket: client.Bucket(conf.Bucket)}, prefix: conf.Prefix, timeout: conf.Timeout.Std()}
+	if err := s.check(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("gcs spill bucket %s: %w", conf.Bucket, err)
+	}
+	return s, nil
+}
+
+func (b *gcsBucket) put(ctx context.Context, key string, data []byte) error {
+	w := b.bucket.Object(key).NewWriter(ctx)
+	w.ContentType = "application/octet-stream"
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (b *gcsBucket) list(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	it := b.bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return keys, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, attrs.Name)
+	}
+}
+
+func (b *gcsBucket) get(ctx context.Context, key string) ([]byte, error) {
+	r, err := b.bucket.Object(key).NewReader(ctx)
+	if err != nil {
+		return nil, gcsNotFound(err)
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func (b *gcsBucket) size(ctx context.Context, key string) (int64, error) {
+	attrs, err := b.bucket.Object(key).Attrs(ctx)
+	if err != nil {
+		return 0, gcsNotFound(err)
+	}
+	return attrs.Size, nil
+}
+
+func (b *gcsBucket) delete(ctx context.Context, key string) error {
+	return gcsNotFound(b.bucket.Object(key).Delete(ctx))
+}
+
+func (b *gcsBucket) close() error {
+	return b.client.Close()
+}
+
+// gcsNotFound turns a missing object into errSpillGone.
+func gcsNotFound(err error) error {
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return errSpillGone
+	}
+	return err
+}
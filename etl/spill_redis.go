@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+//////////////////////////////////////////////////
+// Redis Spill Store
+//////////////////////////////////////////////////
+
+type RedisSpillConfig struct {
+	Addr     string `yaml:"addr" json:"addr"`
+	Username string `yaml:"username" json:"username"`
+	Password string `yaml:"password" json:"password" secret:"true"`
+	DB       int    `yaml:"db" json:"db"`
+	// KeyPrefix namespaces the keys, so instances that should share spilled
+	// batches use the same prefix.
+	KeyPrefix string   `yaml:"key_prefix" json:"key_prefix"`
+	Timeout   Duration `yaml:"timeout" json:"timeout"`
+}
+
+func defaultRedisSpillConfig() RedisSpillConfig {
+	return RedisSpillConfig{
+		Addr:      "127.0.0.1:6379",
+		KeyPrefix: "etl:",
+		Timeout:   Duration(5 * time.Second),
+	}
+}
+
+// validate checks the settings found under prefix, such as load.redis.
+func (r *RedisSpillConfig) validate(prefix string) []error {
+	var errs []error
+	if r.Addr == "" {
+		errs = append(errs, fmt.Errorf("%s.addr must be set", prefix))
+	}
+	if r.DB < 0 {
+		errs = append(errs, fmt.Errorf("%s.db must be >= 0, got %d", prefix, r.DB))
+	}
+	if r.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("%s.timeout must be > 0", prefix))
+	}
+	return errs
+}
+
+// newRedisClient connects to the server and checks that it answers.
+func newRedisClient(conf RedisSpillConfig) (*redis.Client, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:         conf.Addr,
+		Username:     conf.Username,
+		Password:     conf.Password,
+		DB:           conf.DB,
+		DialTimeout:  conf.Timeout.Std(),
+		ReadTimeout:  conf.Timeout.Std(),
+		WriteTimeout: conf.Timeout.Std(),
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), conf.Timeout.Std())
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("redis %s: %w", conf.Addr, err)
+	}
+	return client, nil
+}
+
+// redisSpillStore keeps spilled batches in Redis so every ETL instance
+// pointed at the same server and key prefix replays any instance's
+// failures. Per sink, a sorted set <prefix>spill:<sink> orders the batch
+// IDs and <prefix>spill:<sink>:<id> holds the gzipped JSON batch.
+//
+// Instances claim a batch by removing its ID from the sorted set; only the
+// one whose ZREM succeeds replays it.
+type redisSpillStore struct {
+	client  *redis.Client
+	prefix  string
+	timeout time.Duration
+}
+
+func openRedisSpillStore(conf RedisSpillConfig) (*redisSpillStore, error) {
+	client, err := newRedisClient(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &redisSpillStore{client: client, prefix: conf.KeyPrefix, timeout: conf.Timeout.Std()}, nil
+}
+
+func (s *redisSpillStore) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), s.timeout)
+}
+
+func (s *redisSpillStore) queueKey(sink string) string {
+	return s.prefix + "spill:" + sink
+}
+
+func (s *redisSpillStore) batchKey(sink, id string) string {
+	return s.prefix + "spill:" + sink + ":" + id
+}
+
+func (s *redisSpillStore) Close() error {
+	return s.client.Close()
+}
+
+func (s *redisSpillStore) Put(b *SpilledBatch) error {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	seq, err := s.client.Incr(ctx, s.prefix+"spill:seq").Result()
+	if err != nil {
+		return err
+	}
+	b.ID = fmt.Sprintf("%010d-w%d", seq, b.WorkerID)
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	gz := getGzipWriter(buf)
+	if err := json.NewEncoder(gz).Encode(b); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	putGzipWriter(gz)
+
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, s.batchKey(b.Sink, b.ID), buf.Bytes(), 0)
+		pipe.ZAdd(ctx, s.queueKey(b.Sink), redis.Z{Score: float64(seq), Member: b.ID})
+		return nil
+	})
+	return err
+}
+
+func (s *redisSpillStore) List(sink string) ([]string, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+	return s.client.ZRange(ctx, s.queueKey(sink), 0, -1).Result()
+}
+
+func (s *redisSpillStore) Get(sink, id string) (*SpilledBatch, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	raw, err := s.client.Get(ctx, s.batchKey(sink, id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, errSpillGone
+	}
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	var b SpilledBatch
+	if err := json.NewDecoder(gz).Decode(&b); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// Delete claims the batch. It returns errSpillGone if another instance
+// claimed it first.
+func (s *redisSpillStore) Delete(sink, id string) error {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	removed, err := s.client.ZRem(ctx, s.queueKey(sink), id).Result()
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return errSpillGone
+	}
+	return s.client.Del(ctx, s.batchKey(sink, id)).Err()
+}
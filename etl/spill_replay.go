@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// Background Spill Replay
+//////////////////////////////////////////////////
+
+// SpillReplayConfig replays spilled batches while a run is going, not just
+// when it starts, so batches spilled during an outage are loaded once the
+// sink is back rather than on the next run. In daemon mode every cycle
+// replays at its start and then every Interval until it ends.
+type SpillReplayConfig struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// Interval is how often the spill store is scanned. A sink is only
+	// replayed to while it reports healthy: for the http sink, while its
+	// circuit breaker is closed.
+	Interval Duration `yaml:"interval" json:"interval"`
+}
+
+func defaultSpillReplayConfig() SpillReplayConfig {
+	return SpillReplayConfig{
+		Enabled:  true,
+		Interval: Duration(time.Minute),
+	}
+}
+
+func (r *SpillReplayConfig) validate() []error {
+	if r.Enabled && r.Interval <= 0 {
+		return []error{errors.New("load.spill_replay.interval must be > 0")}
+	}
+	return nil
+}
+
+// startSpillReplay replays spilled batches every interval until the
+// returned function is called, which waits for a replay in progress to
+// finish.
+func startSpillReplay(ctx context.Context, conf SpillReplayConfig) (stop func()) {
+	if !conf.Enabled {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(conf.Interval.Std())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				replayHealthySinks(ctx)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// replayHealthySinks replays the spilled batches of every sink that
+// reports healthy, in parallel.
+func replayHealthySinks(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, s := range loadSinks {
+		if ctx.Err() != nil {
+			break
+		}
+		if !sinkHealthy(s) {
+			slog.Debug("Sink unhealthy, not replaying spilled batches", "component", "spill", "sink", s.Name())
+			continue
+		}
+		wg.Add(1)
+		go func(s Sink) {
+			defer wg.Done()
+			replaySpilled(ctx, s)
+		}(s)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+//////////////////////////////////////////////////
+// Spill Retention
+//////////////////////////////////////////////////
+
+// spillRetention bounds what the spill store keeps while a sink stays
+// down: batches older than maxAge are discarded, then the oldest until the
+// rest fit in maxBytes. A zero limit is no limit.
+type spillRetention struct {
+	maxAge   time.Duration
+	maxBytes int64
+}
+
+func (r spillRetention) enabled() bool {
+	return r.maxAge > 0 || r.maxBytes > 0
+}
+
+// spillEntry is a spilled batch as retention sees it.
+type spillEntry struct {
+	sink      string
+	id        string
+	spilledAt time.Time
+	records   int
+	bytes     int64
+}
+
+// spillSizer is implemented by spill stores that know how much space a
+// batch takes. For the others, the size of its JSON encoding is used.
+type spillSizer interface {
+	Size(sink, id string) (int64, error)
+}
+
+func (s *dirSpillStore) Size(sink, id string) (int64, error) {
+	path, err := s.path(sink, id)
+	if err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s *boltSpillStore) Size(sink, id string) (int64, error) {
+	var size int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket(stateSpillBucket).Bucket([]byte(sink)); bucket != nil {
+			size = int64(len(bucket.Get([]byte(id))))
+		}
+		return nil
+	})
+	return size, err
+}
+
+// listSpills returns the spilled batches of the sinks, oldest first.
+func listSpills(store SpillStore, sinks []string) ([]spillEntry, error) {
+	var entries []spillEntry
+	for _, sink := range sinks {
+		ids, err := store.List(sink)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			b, err := store.Get(sink, id)
+			if errors.Is(err, errSpillGone) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			e := spillEntry{sink: sink, id: id, spilledAt: b.SpilledAt, records: len(b.Records)}
+			if sizer, ok := store.(spillSizer); ok {
+				e.bytes, err = sizer.Size(sink, id)
+			} else {
+				var raw []byte
+				raw, err = json.Marshal(b.Records)
+				e.bytes = int64(len(raw))
+			}
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, e)
+		}
+	}
+	slices.SortStableFunc(entries, func(a, b spillEntry) int { return a.spilledAt.Compare(b.spilledAt) })
+	return entries, nil
+}
+
+// prune deletes the spilled batches of the sinks that retention no longer
+// allows, logging each, and returns them.
+func (r spillRetention) prune(store SpillStore, sinks []string, now time.Time) ([]spillEntry, error) {
+	entries, err := listSpills(store, sinks)
+	if err != nil {
+		return nil, err
+	}
+	var total int64
+	for _, e := range entries {
+		total += e.bytes
+	}
+
+	var pruned []spillEntry
+	for _, e := range entries {
+		var reason string
+		switch {
+		case r.maxAge > 0 && now.Sub(e.spilledAt) > r.maxAge:
+			reason = fmt.Sprintf("older than %s", r.maxAge)
+		case r.maxBytes > 0 && total > r.maxBytes:
+			reason = fmt.Sprintf("spills total over %d MiB", bToMb(uint64(r.maxBytes)))
+		default:
+			continue
+		}
+		err := store.Delete(e.sink, e.id)
+		if errors.Is(err, errSpillGone) {
+			continue
+		}
+		if err != nil {
+			return pruned, err
+		}
+		total -= e.bytes
+		pruned = append(pruned, e)
+		slog.Warn("Discarded spilled batch", "component", "retention", "sink", e.sink, "spill_id", e.id,
+			"reason", reason, "spilled_at", e.spilledAt, "records", e.records, "bytes", e.bytes)
+	}
+	return pruned, nil
+}
+
+// pruneSpilledBatches applies load.spill_max_age and load.spill_max_size_mb
+// to the spill store before a run replays it.
+func pruneSpilledBatches() {
+	r := spillRetention{
+		maxAge:   cfg.Load.SpillMaxAge.Std(),
+		maxBytes: int64(cfg.Load.SpillMaxSizeMB) << 20,
+	}
+	if !r.enabled() {
+		return
+	}
+	pruned, err := r.prune(spills, cfg.Load.sinkList(), time.Now())
+	if err != nil {
+		slog.Error("Error applying spill retention", "component", "retention", "error", err)
+	}
+	if len(pruned) > 0 {
+		records := 0
+		for _, e := range pruned {
+			records += e.records
+		}
+		slog.Warn("Spill retention discarded batches", "component", "retention", "batches", len(pruned), "records", records)
+	}
+}
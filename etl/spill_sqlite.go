@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+//////////////////////////////////////////////////
+// SQLite Spill Store
+//////////////////////////////////////////////////
+
+// sqliteTimeFormat is fixed-width so stored timestamps compare as text.
+const sqliteTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+const sqliteSpillSchema = `
+CREATE TABLE IF NOT EXISTS spilled_batches (
+	id           INTEGER PRIMARY KEY AUTOINCREMENT,
+	sink         TEXT    NOT NULL,
+	run_id       TEXT    NOT NULL DEFAULT '',
+	worker_id    INTEGER NOT NULL,
+	spilled_at   TEXT    NOT NULL,
+	error        TEXT    NOT NULL DEFAULT '',
+	error_type   TEXT    NOT NULL DEFAULT '',
+	attempts     INTEGER NOT NULL DEFAULT 0,
+	record_count INTEGER NOT NULL,
+	records      TEXT    NOT NULL,
+	replayed_at  TEXT
+);
+CREATE INDEX IF NOT EXISTS spilled_batches_pending ON spilled_batches (sink, replayed_at);
+CREATE INDEX IF NOT EXISTS spilled_batches_run ON spilled_batches (run_id);
+`
+
+// sqliteSpillStore keeps one row per spilled batch, records as a JSON
+// array, so failures can be queried with plain SQL. Replayed batches are
+// marked rather than deleted and kept for the retention period.
+type sqliteSpillStore struct {
+	db        *sql.DB
+	retention time.Duration
+}
+
+func openSQLiteSpillStore(path string, retention time.Duration) (*sqliteSpillStore, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	// Loaders spill concurrently; one connection serializes the writes
+	// instead of failing them with SQLITE_BUSY.
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sqliteSpillSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("spill database %s: %w", path, err)
+	}
+	cutoff := time.Now().UTC().Add(-retention).Format(sqliteTimeFormat)
+	if _, err := db.Exec(`DELETE FROM spilled_batches WHERE replayed_at IS NOT NULL AND replayed_at < ?`, cutoff); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("spill database %s: %w", path, err)
+	}
+	return &sqliteSpillStore{db: db, retention: retention}, nil
+}
+
+func (s *sqliteSpillStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqliteSpillStore) Put(b *SpilledBatch) error {
+	records, err := json.Marshal(b.Records)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.Exec(`INSERT INTO spilled_batches
+		(sink, run_id, worker_id, spilled_at, error, error_type, attempts, record_count, records)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		b.Sink, b.RunID, b.WorkerID, b.SpilledAt.UTC().Format(sqliteTimeFormat),
+		b.Error, b.ErrorType, b.Attempts, len(b.Records), string(records))
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	b.ID = strconv.FormatInt(id, 10)
+	return nil
+}
+
+func (s *sqliteSpillStore) List(sink string) ([]string, error) {
+	rows, err := s.db.Query(`SELECT id FROM spilled_batches WHERE sink = ? AND replayed_at IS NULL ORDER BY id`, sink)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, strconv.FormatInt(id, 10))
+	}
+	return ids, rows.Err()
+}
+
+func (s *sqliteSpillStore) Get(sink, id string) (*SpilledBatch, error) {
+	var b SpilledBatch
+	var spilledAt, records string
+	err := s.db.QueryRow(`SELECT id, sink, run_id, worker_id, spilled_at, error, error_type, attempts, records
+		FROM spilled_batches WHERE sink = ? AND id = ?`, sink, id).
+		Scan(&b.ID, &b.Sink, &b.RunID, &b.WorkerID, &spilledAt, &b.Error, &b.ErrorType, &b.Attempts, &records)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("spilled batch %s/%s not found", sink, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if b.SpilledAt, err = time.Parse(sqliteTimeFormat, spilledAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(records), &b.Records); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// Delete takes the batch off the replay queue. It stays queryable until
+// the retention period has passed, unless retention is zero.
+func (s *sqliteSpillStore) Delete(sink, id string) error {
+	if s.retention == 0 {
+		_, err := s.db.Exec(`DELETE FROM spilled_batches WHERE sink = ? AND id = ?`, sink, id)
+		return err
+	}
+	_, err := s.db.Exec(`UPDATE spilled_batches SET replayed_at = ? WHERE sink = ? AND id = ?`,
+		time.Now().UTC().Format(sqliteTimeFormat), sink, id)
+	return err
+}
+
+//////////////////////////////////////////////////
+// Spill Command
+//////////////////////////////////////////////////
+
+const spillUsage = `usage: etl [flags] spill <command>
+
+commands:
+  list [-sink <name>] [-run <id>|last] [-replayed]
+        list spilled batches; pending only unless -replayed
+  failures [-by error_type|sink|worker|run] [-run <id>|last] [-since <duration>]
+        count spilled batches and records per group, replayed ones included
+  query <sql>
+        run a read-only SQL query against the spilled_batches table
+
+-run last selects the most recent run that spilled anything.
+Needs load.spill_store: sqlite.`
+
+func runSpillCommand(args []string) error {
+	if cfg.Load.SpillStore != "sqlite" {
+		return errors.New("etl spill needs load.spill_store: sqlite")
+	}
+	if len(args) == 0 {
+		return errors.New(spillUsage)
+	}
+	store, err := openSQLiteSpillStore(cfg.Load.SpillDB, cfg.Load.SpillRetention.Std())
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	switch args[0] {
+	case "list":
+		return spillList(store, args[1:])
+	case "failures":
+		return spillFailures(store, args[1:])
+	case "query":
+		if len(args) != 2 {
+			return errors.New("usage: etl spill query <sql>")
+		}
+		return spillQuery(store, args[1])
+	default:
+		return fmt.Errorf("unknown spill command %q\n%s", args[0], spillUsage)
+	}
+}
+
+// spillRunFilter turns a -run value into a WHERE clause fragment and its
+// arguments. "last" is the most recent run with a spilled batch.
+func spillRunFilter(store *sqliteSpillStore, run string) (string, []any, error) {
+	switch run {
+	case "":
+		return "", nil, nil
+	case "last":
+		err := store.db.QueryRow(`SELECT run_id FROM spilled_batches ORDER BY id DESC LIMIT 1`).Scan(&run)
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil, errors.New("no spilled batches")
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		fmt.Printf("run %s\n\n", run)
+	}
+	return " AND run_id = ?", []any{run}, nil
+}
+
+func spillList(store *sqliteSpillStore, args []string) error {
+	fs := flag.NewFlagSet("spill list", flag.ContinueOnError)
+	sink := fs.String("sink", "", "only batches spilled for this sink")
+	run := fs.String("run", "", "only batches spilled by this run (or last)")
+	replayed := fs.Bool("replayed", false, "include batches that have been replayed")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	query := `SELECT id, sink, run_id, worker_id, record_count, attempts, error_type, spilled_at, replayed_at, error
+		FROM spilled_batches WHERE 1 = 1`
+	var qargs []any
+	if *sink != "" {
+		query += " AND sink = ?"
+		qargs = append(qargs, *sink)
+	}
+	if !*replayed {
+		query += " AND replayed_at IS NULL"
+	}
+	runClause, runArgs, err := spillRunFilter(store, *run)
+	if err != nil {
+		return err
+	}
+	query += runClause + " ORDER BY id"
+
+	rows, err := store.db.Query(query, append(qargs, runArgs...)...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSINK\tRUN\tWORKER\tRECORDS\tATTEMPTS\tTYPE\tSPILLED AT\tREPLAYED AT\tERROR")
+	for rows.Next() {
+		var id, worker, count, attempts int64
+		var sinkName, runID, errType, spilledAt, errMsg string
+		var replayedAt sql.NullString
+		if err := rows.Scan(&id, &sinkName, &runID, &worker, &count, &attempts, &errType, &spilledAt, &replayedAt, &errMsg); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%d\t%d\t%s\t%s\t%s\t%s\n", id, sinkName, runID, worker, count, attempts, errType,
+			spillTime(spilledAt), spillTime(replayedAt.String), truncate(errMsg, 60))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func spillFailures(store *sqliteSpillStore, args []string) error {
+	fs := flag.NewFlagSet("spill failures", flag.ContinueOnError)
+	by := fs.String("by", "error_type", "group by error_type, sink, worker or run")
+	run := fs.String("run", "", "only batches spilled by this run (or last)")
+	since := fs.Duration("since", 0, "only batches spilled within this duration")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	columns := map[string]string{"error_type": "error_type", "sink": "sink", "worker": "worker_id", "run": "run_id"}
+	column, ok := columns[*by]
+	if !ok {
+		return fmt.Errorf("-by must be error_type, sink, worker or run, got %q", *by)
+	}
+
+	query := `SELECT ` + column + `, COUNT(*), SUM(record_count), MIN(spilled_at), MAX(spilled_at)
+		FROM spilled_batches WHERE 1 = 1`
+	var qargs []any
+	if *since > 0 {
+		query += " AND spilled_at >= ?"
+		qargs = append(qargs, time.Now().UTC().Add(-*since).Format(sqliteTimeFormat))
+	}
+	runClause, runArgs, err := spillRunFilter(store, *run)
+	if err != nil {
+		return err
+	}
+	query += runClause + " GROUP BY 1 ORDER BY 3 DESC"
+
+	rows, err := store.db.Query(query, append(qargs, runArgs...)...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "%s\tBATCHES\tRECORDS\tFIRST\tLAST\n", strings.ToUpper(*by))
+	for rows.Next() {
+		var key string
+		var batches, records int64
+		var first, last string
+		if err := rows.Scan(&key, &batches, &records, &first, &last); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n", key, batches, records, spillTime(first), spillTime(last))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func spillQuery(store *sqliteSpillStore, query string) error {
+	ctx := context.Background()
+	conn, err := store.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "PRAGMA query_only = ON"); err != nil {
+		return err
+	}
+
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.ToUpper(strings.Join(columns, "\t")))
+
+	values := make([]any, len(columns))
+	ptrs := make([]any, len(columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return err
+		}
+		fields := make([]string, len(values))
+		for i, v := range values {
+			switch v := v.(type) {
+			case nil:
+				fields[i] = "NULL"
+			case []byte:
+				fields[i] = string(v)
+			default:
+				fields[i] = fmt.Sprint(v)
+			}
+		}
+		fmt.Fprintln(w, strings.Join(fields, "\t"))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// spillTime shortens a stored timestamp for table output.
+func spillTime(s string) string {
+	t, err := time.Parse(sqliteTimeFormat, s)
+	if err != nil {
+		return s
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSpillFileID(t *testing.T) {
+	at := time.Date(2026, 3, 4, 5, 6, 7, 890_000_000, time.UTC)
+	tests := []struct {
+		batch *SpilledBatch
+		seq   uint64
+		want  string
+	}{
+		{&SpilledBatch{SpilledAt: at, BatchID: "abc123", WorkerID: 4}, 7, "buffer_failed_20260304T050607.890Z_000007_abc123_worker4"},
+		{&SpilledBatch{SpilledAt: at, WorkerID: 0}, 1, "buffer_failed_20260304T050607.890Z_000001_worker0"},
+		{&SpilledBatch{SpilledAt: at.In(time.FixedZone("CET", 3600)), WorkerID: 12}, 2, "buffer_failed_20260304T050607.890Z_000002_worker12"},
+	}
+	for _, tt := range tests {
+		if got := spillFileID(tt.batch, tt.seq); got != tt.want {
+			t.Errorf("spillFileID = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestExtractWorkerID(t *testing.T) {
+	tests := []struct {
+		file string
+		want int
+	}{
+		{"buffer_failed_20260304T050607.890Z_000007_abc123_worker4.json.gz", 4},
+		{"spill/http/buffer_failed_20260304T050607.890Z_000001_worker12.msgpack.gz", 12},
+		{"buffer_failed_20260304T050607.890Z_000001_worker3.parquet", 3},
+		{"buffer_failed_worker7.json.gz", 7}, // legacy name
+		{"buffer_failed_worker.json.gz", 0},
+		{"buffer_failed_workerx.json.gz", 0},
+		{"something_else.json.gz", 0},
+	}
+	for _, tt := range tests {
+		if got := extractWorkerID(tt.file); got != tt.want {
+			t.Errorf("extractWorkerID(%q) = %d, want %d", tt.file, got, tt.want)
+		}
+	}
+}
+
+func TestDirSpillStore(t *testing.T) {
+	for _, format := range []string{"json", "msgpack", "parquet"} {
+		t.Run(format, func(t *testing.T) {
+			dir := t.TempDir()
+			s := &dirSpillStore{dir: dir, format: format}
+			at := time.Now().UTC()
+			data := testRecords(3)
+			// Two spills of the same worker in the same millisecond.
+			first := &SpilledBatch{Sink: "http", BatchID: "b1", WorkerID: 2, SpilledAt: at, Records: data}
+			second := &SpilledBatch{Sink: "http", BatchID: "b1", WorkerID: 2, SpilledAt: at, Records: data[:1]}
+			for _, b := range []*SpilledBatch{first, second} {
+				if err := s.Put(b); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if first.ID == second.ID {
+				t.Fatalf("both spills got ID %s", first.ID)
+			}
+			// A spill named by older versions is listed too.
+			if err := saveBufferToFile(data[:2], filepath.Join(dir, "http", "buffer_failed_worker5")); err != nil {
+				t.Fatal(err)
+			}
+
+			ids, err := s.List("http")
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []string{first.ID, second.ID, "buffer_failed_worker5"}
+			if len(ids) != len(want) {
+				t.Fatalf("List = %v, want %v", ids, want)
+			}
+			for i, id := range want {
+				b, err := s.Get("http", id)
+				if err != nil {
+					t.Fatalf("Get(%s): %v", id, err)
+				}
+				if ids[i] != id {
+					t.Errorf("List[%d] = %s, want %s", i, ids[i], id)
+				}
+				wantRecords, wantWorker := []int{3, 1, 2}[i], []int{2, 2, 5}[i]
+				if len(b.Records) != wantRecords || b.WorkerID != wantWorker {
+					t.Errorf("Get(%s) = %d records of worker %d, want %d of worker %d", id, len(b.Records), b.WorkerID,
+						wantRecords, wantWorker)
+				}
+			}
+
+			if err := s.Delete("http", first.ID); err != nil {
+				t.Fatal(err)
+			}
+			if ids, _ := s.List("http"); len(ids) != 2 {
+				t.Errorf("List after Delete = %v", ids)
+			}
+		})
+	}
+}
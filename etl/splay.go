@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"slices"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// Dispatch Splay & Jitter
+//////////////////////////////////////////////////
+
+// scheduledAppliance is an appliance with when a run may dispatch it.
+type scheduledAppliance struct {
+	Appliance
+	at time.Time
+}
+
+// splayAppliances sets when each appliance of a run starting at start may
+// be dispatched: extract.splay spreads them evenly, in order, over that
+// long, and extract.jitter delays each by up to that much at random. The
+// result is in dispatch order. Without either all are due at start.
+func splayAppliances(appliances []Appliance, start time.Time) []scheduledAppliance {
+	scheduled := make([]scheduledAppliance, len(appliances))
+	splay := cfg.Extract.Splay.Std()
+	for i, ap := range appliances {
+		at := start.Add(pollJitter())
+		if splay > 0 {
+			at = at.Add(splay * time.Duration(i) / time.Duration(len(appliances)))
+		}
+		scheduled[i] = scheduledAppliance{Appliance: ap, at: at}
+	}
+	slices.SortStableFunc(scheduled, func(a, b scheduledAppliance) int { return a.at.Compare(b.at) })
+	return scheduled
+}
+
+// pollJitter is a random delay of up to extract.jitter.
+func pollJitter() time.Duration {
+	if cfg.Extract.Jitter <= 0 {
+		return 0
+	}
+	return rand.N(cfg.Extract.Jitter.Std())
+}
+
+// sleepUntil waits until t. It returns false if ctx is done first.
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	d := time.Until(t)
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+//////////////////////////////////////////////////
+// Persistent State Store
+//////////////////////////////////////////////////
+
+type StateConfig struct {
+	File string `yaml:"file" json:"file"`
+	// RunHistory is the number of finished runs kept.
+	RunHistory int `yaml:"run_history" json:"run_history"`
+}
+
+func defaultStateConfig() StateConfig {
+	return StateConfig{
+		File:       "state.db",
+		RunHistory: 500,
+	}
+}
+
+func (s *StateConfig) validate() []error {
+	var errs []error
+	if s.File == "" {
+		errs = append(errs, errors.New("state.file must be set"))
+	}
+	if s.RunHistory <= 0 {
+		errs = append(errs, errors.New("state.run_history must be > 0"))
+	}
+	return errs
+}
+
+// Top-level buckets of the state file. Each feature owns its bucket(s).
+var (
+	stateCheckpointBucket  = []byte("checkpoint")
+	stateSpillBucket       = []byte("spill")
+	stateRunsBucket        = []byte("runs")
+	stateIdempotencyBucket = []byte("idempotency")
+	stateFailuresBucket    = []byte("failures")
+)
+
+// StateStore is the single BoltDB file holding what the ETL keeps between
+// runs: spilled batches, the run checkpoint, idempotency keys, failed
+// delivery counts and run history. Writes are transactional, so a crash mid-write can't leave a
+// half-written entry behind.
+type StateStore struct {
+	db         *bolt.DB
+	runHistory int
+}
+
+// state is opened by main before the first run.
+var state *StateStore
+
+func openStateStore(conf StateConfig) (*StateStore, error) {
+	db, err := bolt.Open(conf.File, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		if errors.Is(err, bolt.ErrTimeout) {
+			return nil, errors.New("state file is locked by another etl process")
+		}
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{stateCheckpointBucket, stateSpillBucket, stateRunsBucket, stateIdempotencyBucket, stateFailuresBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &StateStore{db: db, runHistory: conf.RunHistory}, nil
+}
+
+func (s *StateStore) Close() error {
+	return s.db.Close()
+}
+
+// SaveRun stores a finished run, dropping the oldest beyond the configured
+// history size. Run IDs start with their UTC start time, so key order is
+// start order.
+func (s *StateStore) SaveRun(rec RunRecord) error {
+	raw, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(stateRunsBucket)
+		if err := b.Put([]byte(rec.ID), raw); err != nil {
+			return err
+		}
+		var keys [][]byte
+		b.ForEach(func(k, _ []byte) error {
+			keys = append(keys, slices.Clone(k))
+			return nil
+		})
+		for _, k := range keys[:max(len(keys)-s.runHistory, 0)] {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Runs returns up to limit of the most recent runs, oldest first.
+func (s *StateStore) Runs(limit int) ([]RunRecord, error) {
+	var runs []RunRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(stateRunsBucket).Cursor()
+		for k, v := c.Last(); k != nil && len(runs) < limit; k, v = c.Prev() {
+			var rec RunRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			runs = append(runs, rec)
+		}
+		return nil
+	})
+	for i, j := 0, len(runs)-1; i < j; i, j = i+1, j-1 {
+		runs[i], runs[j] = runs[j], runs[i]
+	}
+	return runs, err
+}
+
+// RememberKeys records idempotency keys with the time they were seen.
+func (s *StateStore) RememberKeys(keys []string) error {
+	now, err := time.Now().UTC().MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(stateIdempotencyBucket)
+		for _, k := range keys {
+			if err := b.Put([]byte(k), now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// HasKey reports whether an idempotency key has been remembered.
+func (s *StateStore) HasKey(key string) bool {
+	var found bool
+	s.db.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket(stateIdempotencyBucket).Get([]byte(key)) != nil
+		return nil
+	})
+	return found
+}
+
+// ForgetKeysBefore drops idempotency keys remembered before cutoff and
+// returns how many were removed.
+func (s *StateStore) ForgetKeysBefore(cutoff time.Time) (int, error) {
+	var removed int
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(stateIdempotencyBucket)
+		var stale [][]byte
+		b.ForEach(func(k, v []byte) error {
+			var seen time.Time
+			if err := seen.UnmarshalBinary(v); err != nil || seen.Before(cutoff) {
+				stale = append(stale, slices.Clone(k))
+			}
+			return nil
+		})
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		removed = len(stale)
+		return nil
+	})
+	return removed, err
+}
+
+// CountFailure adds one to the failed deliveries recorded under key and
+// returns the new count.
+func (s *StateStore) CountFailure(key string) (int, error) {
+	var n int
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(stateFailuresBucket)
+		n, _ = strconv.Atoi(string(b.Get([]byte(key))))
+		n++
+		return b.Put([]byte(key), []byte(strconv.Itoa(n)))
+	})
+	return n, err
+}
+
+// ForgetFailures drops the failed deliveries recorded under key, if any.
+func (s *StateStore) ForgetFailures(key string) error {
+	var found bool
+	s.db.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket(stateFailuresBucket).Get([]byte(key)) != nil
+		return nil
+	})
+	if !found {
+		return nil
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(stateFailuresBucket).Delete([]byte(key))
+	})
+}
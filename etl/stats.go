@@ -0,0 +1,305 @@
+package main
+
+import (
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// Run Statistics
+//////////////////////////////////////////////////
+
+// RunStats counts what happened to every appliance and record in a run.
+// Fields are updated concurrently by extract and load workers.
+type RunStats struct {
+	// RunID identifies the run the counts belong to.
+	RunID string
+
+	Appliances       atomic.Int64
+	Dispatched       atomic.Int64
+	Extracted        atomic.Int64
+	ExtractFailed    atomic.Int64
+	ExtractCancelled atomic.Int64
+	TransformFailed  atomic.Int64
+	// Filtered counts records a transform step dropped.
+	Filtered atomic.Int64
+	// FilterRules counts the records each filter rule dropped, by rule
+	// name. Like Sinks it is filled by newRunStats.
+	FilterRules map[string]*atomic.Int64
+	// Duplicates counts records the dedup stage dropped.
+	Duplicates atomic.Int64
+	// Rejected counts CPU stats and records that failed schema validation.
+	Rejected atomic.Int64
+	// QualityChecks counts the records failing each enabled quality check,
+	// whatever its action. Like FilterRules it is filled by newRunStats.
+	QualityChecks map[string]*atomic.Int64
+	// Aggregated counts records folded into aggregation windows, and
+	// WindowsEmitted the window records queued for loading in their place.
+	Aggregated     atomic.Int64
+	WindowsEmitted atomic.Int64
+	// TooLate counts records the stream reorder buffer dropped for arriving
+	// behind the watermark of their host.
+	TooLate atomic.Int64
+	// AlreadyDone counts appliances skipped because the checkpoint of a
+	// resumed run has them as finished.
+	AlreadyDone atomic.Int64
+
+	// Sinks holds the delivery counts per sink. It is filled by
+	// newRunStats before the loaders start and only read afterwards.
+	Sinks map[string]*SinkStats
+
+	workersMu sync.Mutex
+	workers   map[int]*WorkerStats
+}
+
+// WorkerStats counts what one loader worker took off its queue and
+// flushed, whatever the sinks then made of it.
+type WorkerStats struct {
+	Received       atomic.Int64
+	Flushes        atomic.Int64
+	RecordsFlushed atomic.Int64
+	FlushNanos     atomic.Int64 // time spent flushing, over all sinks
+	LastFlush      atomic.Int64 // unix nanoseconds, 0 before the first flush
+}
+
+// Worker returns the counters of a loader worker, creating them on first
+// use. Replayed spills keep the worker ID they were spilled by, so IDs
+// aren't bounded by load.workers.
+func (s *RunStats) Worker(id int) *WorkerStats {
+	s.workersMu.Lock()
+	defer s.workersMu.Unlock()
+	if s.workers == nil {
+		s.workers = make(map[int]*WorkerStats)
+	}
+	w, ok := s.workers[id]
+	if !ok {
+		w = &WorkerStats{}
+		s.workers[id] = w
+	}
+	return w
+}
+
+// SinkStats counts the batches and records delivered to one sink.
+type SinkStats struct {
+	RecordsLoaded       atomic.Int64
+	RecordsSpilled      atomic.Int64
+	RecordsDeadLettered atomic.Int64
+	BatchesLoaded       atomic.Int64
+	BatchesSpilled      atomic.Int64
+	BatchesDeadLettered atomic.Int64
+	// AlreadyAcked counts the batches not sent because the sink had
+	// acknowledged them before, and their records.
+	RecordsAlreadyAcked atomic.Int64
+	BatchesAlreadyAcked atomic.Int64
+	// BatchesRequeued counts failed flushes queued for another attempt
+	// within the run.
+	BatchesRequeued atomic.Int64
+}
+
+// runStats belongs to the run in progress; runETL replaces it at the start
+// of every run.
+var runStats = newRunStats("", nil)
+
+func newRunStats(runID string, sinks []Sink) *RunStats {
+	stats := &RunStats{
+		RunID:         runID,
+		Sinks:         make(map[string]*SinkStats, len(sinks)),
+		FilterRules:   make(map[string]*atomic.Int64, len(filterRules)),
+		QualityChecks: make(map[string]*atomic.Int64),
+	}
+	for _, s := range sinks {
+		stats.Sinks[s.Name()] = &SinkStats{}
+	}
+	for _, r := range filterRules {
+		stats.FilterRules[r.Name] = new(atomic.Int64)
+	}
+	if quality != nil {
+		for check := range quality.actions {
+			stats.QualityChecks[check] = new(atomic.Int64)
+		}
+	}
+	return stats
+}
+
+// RunSummary is a point-in-time copy of RunStats for reporting.
+type RunSummary struct {
+	Appliances       int64 `json:"appliances"`
+	Dispatched       int64 `json:"dispatched"`
+	Extracted        int64 `json:"extracted"`
+	ExtractFailed    int64 `json:"extract_failed"`
+	ExtractCancelled int64 `json:"extract_cancelled"`
+	TransformFailed  int64 `json:"transform_failed"`
+	Filtered         int64 `json:"filtered"`
+	// FilterRules holds the records dropped per filter rule.
+	FilterRules map[string]int64 `json:"filter_rules,omitempty"`
+	Duplicates  int64            `json:"duplicates"`
+	Rejected    int64            `json:"rejected"`
+	// QualityChecks holds the records failing each quality check.
+	QualityChecks  map[string]int64 `json:"quality_checks,omitempty"`
+	Aggregated     int64            `json:"aggregated"`
+	WindowsEmitted int64            `json:"windows_emitted"`
+	TooLate        int64            `json:"too_late"`
+	AlreadyDone    int64            `json:"already_done"`
+
+	SinkSummary
+	Sinks map[string]SinkSummary `json:"sinks"`
+}
+
+// SinkSummary is a point-in-time copy of SinkStats. In RunSummary it holds
+// the totals over all sinks.
+type SinkSummary struct {
+	RecordsLoaded       int64 `json:"records_loaded"`
+	RecordsSpilled      int64 `json:"records_spilled"`
+	RecordsDeadLettered int64 `json:"records_dead_lettered"`
+	BatchesLoaded       int64 `json:"batches_loaded"`
+	BatchesSpilled      int64 `json:"batches_spilled"`
+	BatchesDeadLettered int64 `json:"batches_dead_lettered"`
+	RecordsAlreadyAcked int64 `json:"records_already_acked"`
+	BatchesAlreadyAcked int64 `json:"batches_already_acked"`
+	BatchesRequeued     int64 `json:"batches_requeued"`
+}
+
+func (s *RunStats) Summary() RunSummary {
+	sum := RunSummary{
+		Appliances:       s.Appliances.Load(),
+		Dispatched:       s.Dispatched.Load(),
+		Extracted:        s.Extracted.Load(),
+		ExtractFailed:    s.ExtractFailed.Load(),
+		ExtractCancelled: s.ExtractCancelled.Load(),
+		TransformFailed:  s.TransformFailed.Load(),
+		Filtered:         s.Filtered.Load(),
+		Duplicates:       s.Duplicates.Load(),
+		Rejected:         s.Rejected.Load(),
+		Aggregated:       s.Aggregated.Load(),
+		WindowsEmitted:   s.WindowsEmitted.Load(),
+		TooLate:          s.TooLate.Load(),
+		AlreadyDone:      s.AlreadyDone.Load(),
+		Sinks:            make(map[string]SinkSummary, len(s.Sinks)),
+	}
+	if len(s.FilterRules) > 0 {
+		sum.FilterRules = make(map[string]int64, len(s.FilterRules))
+		for name, n := range s.FilterRules {
+			sum.FilterRules[name] = n.Load()
+		}
+	}
+	if len(s.QualityChecks) > 0 {
+		sum.QualityChecks = make(map[string]int64, len(s.QualityChecks))
+		for check, n := range s.QualityChecks {
+			sum.QualityChecks[check] = n.Load()
+		}
+	}
+	for name, ss := range s.Sinks {
+		one := ss.Summary()
+		sum.Sinks[name] = one
+		sum.RecordsLoaded += one.RecordsLoaded
+		sum.RecordsSpilled += one.RecordsSpilled
+		sum.RecordsDeadLettered += one.RecordsDeadLettered
+		sum.BatchesLoaded += one.BatchesLoaded
+		sum.BatchesSpilled += one.BatchesSpilled
+		sum.BatchesDeadLettered += one.BatchesDeadLettered
+		sum.RecordsAlreadyAcked += one.RecordsAlreadyAcked
+		sum.BatchesAlreadyAcked += one.BatchesAlreadyAcked
+		sum.BatchesRequeued += one.BatchesRequeued
+	}
+	return sum
+}
+
+func (s *SinkStats) Summary() SinkSummary {
+	return SinkSummary{
+		RecordsLoaded:       s.RecordsLoaded.Load(),
+		RecordsSpilled:      s.RecordsSpilled.Load(),
+		RecordsDeadLettered: s.RecordsDeadLettered.Load(),
+		BatchesLoaded:       s.BatchesLoaded.Load(),
+		BatchesSpilled:      s.BatchesSpilled.Load(),
+		BatchesDeadLettered: s.BatchesDeadLettered.Load(),
+		RecordsAlreadyAcked: s.RecordsAlreadyAcked.Load(),
+		BatchesAlreadyAcked: s.BatchesAlreadyAcked.Load(),
+		BatchesRequeued:     s.BatchesRequeued.Load(),
+	}
+}
+
+// ruleDropped returns the records dropped by all filter rules.
+func (s RunSummary) ruleDropped() int64 {
+	var n int64
+	for _, c := range s.FilterRules {
+		n += c
+	}
+	return n
+}
+
+// qualityFailed returns the failures of all quality checks; a record
+// failing two checks counts twice.
+func (s RunSummary) qualityFailed() int64 {
+	var n int64
+	for _, c := range s.QualityChecks {
+		n += c
+	}
+	return n
+}
+
+func (s SinkSummary) logAttrs() []any {
+	return []any{
+		"records_loaded", s.RecordsLoaded,
+		"records_spilled", s.RecordsSpilled,
+		"batches_loaded", s.BatchesLoaded,
+		"batches_spilled", s.BatchesSpilled,
+		"records_dead_lettered", s.RecordsDeadLettered,
+		"batches_dead_lettered", s.BatchesDeadLettered,
+		"records_already_acked", s.RecordsAlreadyAcked,
+		"batches_already_acked", s.BatchesAlreadyAcked,
+		"batches_requeued", s.BatchesRequeued,
+	}
+}
+
+// logRunSummary writes the end-of-run totals. interrupted marks runs cut
+// short by a shutdown signal, where some appliances were never dispatched.
+// Load counts are summed over all sinks; with more than one sink each also
+// gets its own summary line.
+func logRunSummary(interrupted bool) {
+	msg := "Run summary"
+	if interrupted {
+		msg = "Shutdown summary"
+	}
+
+	sum := runStats.Summary()
+	args := []any{
+		"interrupted", interrupted,
+		"appliances", sum.Appliances,
+		"dispatched", sum.Dispatched,
+		"already_done", sum.AlreadyDone,
+		"not_dispatched", max(0, sum.Appliances-sum.AlreadyDone-sum.Dispatched), // a stream polls appliances many times
+		"extracted", sum.Extracted,
+		"extract_failed", sum.ExtractFailed,
+		"extract_cancelled", sum.ExtractCancelled,
+		"transform_failed", sum.TransformFailed,
+		"filtered", sum.Filtered,
+		"filter_rules", sum.ruleDropped(),
+		"duplicates", sum.Duplicates,
+		"rejected", sum.Rejected,
+		"quality_failed", sum.qualityFailed(),
+		"aggregated", sum.Aggregated,
+		"windows_emitted", sum.WindowsEmitted,
+		"too_late", sum.TooLate,
+	}
+	args = append(args, sum.SinkSummary.logAttrs()...)
+	args = append(args, "duration_ms", time.Since(startTime).Milliseconds())
+	slog.Info(msg, args...)
+
+	for _, r := range filterRules {
+		slog.Info("Filter rule summary", "rule", r.Name, "dropped", sum.FilterRules[r.Name])
+	}
+	if quality != nil {
+		for _, check := range slices.Sorted(maps.Keys(quality.actions)) {
+			slog.Info("Quality check summary", "check", check, "action", quality.actions[check], "failed", sum.QualityChecks[check])
+		}
+	}
+	if len(sum.Sinks) > 1 {
+		for _, name := range cfg.Load.sinkList() {
+			slog.Info("Sink summary", append([]any{"sink", name}, sum.Sinks[name].logAttrs()...)...)
+		}
+	}
+}
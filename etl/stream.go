@@ -0,0 +1,269 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"path"
+	"sync"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// Stream Mode
+//////////////////////////////////////////////////
+
+// StreamConfig turns a run into a stream that lasts until shutdown: each
+// appliance is polled every Interval, or the interval of the first entry of
+// Intervals that matches it, rather than all of them once per run. Polls
+// are spread over the interval so the extractors aren't hit all at once.
+type StreamConfig struct {
+	Enabled   bool             `yaml:"enabled" json:"enabled"`
+	Interval  Duration         `yaml:"interval" json:"interval"`
+	Intervals []StreamInterval `yaml:"intervals" json:"intervals"`
+	// FlushInterval is how long records may wait in a loader's buffer
+	// before it is flushed short of load.buffer_threshold.
+	FlushInterval Duration `yaml:"flush_interval" json:"flush_interval"`
+	// Reorder releases records to the loaders in timestamp order per host.
+	Reorder ReorderConfig `yaml:"reorder" json:"reorder"`
+}
+
+// StreamInterval polls the appliances whose host name or IP matches one of
+// the glob patterns every Interval.
+type StreamInterval struct {
+	Match    []string `yaml:"match" json:"match"`
+	Interval Duration `yaml:"interval" json:"interval"`
+}
+
+func defaultStreamConfig() StreamConfig {
+	return StreamConfig{
+		Interval:      Duration(time.Minute),
+		FlushInterval: Duration(10 * time.Second),
+		Reorder:       defaultReorderConfig(),
+	}
+}
+
+func (s *StreamConfig) validate() []error {
+	var errs []error
+	if s.Interval <= 0 {
+		errs = append(errs, errors.New("stream.interval must be > 0"))
+	}
+	if s.FlushInterval <= 0 {
+		errs = append(errs, errors.New("stream.flush_interval must be > 0"))
+	}
+	errs = append(errs, s.Reorder.validate()...)
+	for i, iv := range s.Intervals {
+		if len(iv.Match) == 0 {
+			errs = append(errs, fmt.Errorf("stream.intervals[%d].match must list at least one pattern", i))
+		}
+		for _, pattern := range iv.Match {
+			if _, err := path.Match(pattern, ""); err != nil {
+				errs = append(errs, fmt.Errorf("stream.intervals[%d]: bad pattern %q: %w", i, pattern, err))
+			}
+		}
+		if iv.Interval <= 0 {
+			errs = append(errs, fmt.Errorf("stream.intervals[%d].interval must be > 0", i))
+		}
+	}
+	return errs
+}
+
+// of is the poll interval of an appliance.
+func (s *StreamConfig) of(ap Appliance) time.Duration {
+	for _, iv := range s.Intervals {
+		for _, pattern := range iv.Match {
+			if ok, _ := path.Match(pattern, ap.HostName); ok {
+				return iv.Interval.Std()
+			}
+			if ok, _ := path.Match(pattern, ap.IP); ok {
+				return iv.Interval.Std()
+			}
+		}
+	}
+	return s.Interval.Std()
+}
+
+// streamReloadInterval is how often a stream checks the appliance source
+// for added and removed appliances, and the cluster for its share. Files are only read again when they
+// changed and other sources once discovery.refresh_interval has passed.
+const streamReloadInterval = 30 * time.Second
+
+// streamPoll is an appliance in the schedule. It is due at its slot,
+// delayed by extract.jitter.
+type streamPoll struct {
+	ap       Appliance
+	interval time.Duration
+	slot     time.Time
+	due      time.Time
+	worker   int
+	index    int // in the heap; -1 once removed
+}
+
+// pollQueue orders polls by due time, high priority appliances first among
+// those due at the same time.
+type pollQueue []*streamPoll
+
+func (q pollQueue) Len() int { return len(q) }
+func (q pollQueue) Less(i, j int) bool {
+	if !q[i].due.Equal(q[j].due) {
+		return q[i].due.Before(q[j].due)
+	}
+	return q[i].ap.Priority < q[j].ap.Priority
+}
+func (q pollQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index, q[j].index = i, j
+}
+func (q *pollQueue) Push(x any) {
+	p := x.(*streamPoll)
+	p.index = len(*q)
+	*q = append(*q, p)
+}
+func (q *pollQueue) Pop() any {
+	old := *q
+	p := old[len(old)-1]
+	old[len(old)-1] = nil
+	p.index = -1
+	*q = old[:len(old)-1]
+	return p
+}
+
+// streamScheduler polls each appliance on its interval. An appliance whose
+// previous poll is still running when it is due again is skipped until the
+// next interval.
+type streamScheduler struct {
+	conf     StreamConfig
+	queue    pollQueue
+	byKey    map[string]*streamPoll
+	next     int // worker of the next appliance added
+	mu       sync.Mutex
+	inFlight map[string]bool
+	skipped  int64
+}
+
+func newStreamScheduler(conf StreamConfig, appliances []Appliance) *streamScheduler {
+	s := &streamScheduler{conf: conf, byKey: map[string]*streamPoll{}, inFlight: map[string]bool{}}
+	s.update(appliances, time.Now())
+	return s
+}
+
+// firstPoll spreads the polls over the interval: each appliance gets a
+// slot in it derived from its key, so it keeps the slot across restarts.
+func firstPoll(ap Appliance, interval time.Duration, now time.Time) time.Time {
+	h := fnv.New64a()
+	h.Write([]byte(ap.key()))
+	due := now.Truncate(interval).Add(time.Duration(h.Sum64() % uint64(interval)))
+	if due.Before(now) {
+		due = due.Add(interval)
+	}
+	return due
+}
+
+// update schedules the appliances not scheduled yet, drops the ones no
+// longer listed and takes the new interval, priority and credentials of
+// the others.
+func (s *streamScheduler) update(appliances []Appliance, now time.Time) {
+	listed := make(map[string]bool, len(appliances))
+	for _, ap := range appliances {
+		key := ap.key()
+		listed[key] = true
+		interval := s.conf.of(ap)
+		if p, ok := s.byKey[key]; ok {
+			p.ap = ap
+			if interval != p.interval {
+				p.slot = p.slot.Add(interval - p.interval)
+				p.due = p.due.Add(interval - p.interval)
+				p.interval = interval
+				heap.Fix(&s.queue, p.index)
+			}
+			continue
+		}
+		slot := firstPoll(ap, interval, now)
+		p := &streamPoll{ap: ap, interval: interval, slot: slot, due: slot.Add(pollJitter()), worker: s.next % cfg.Load.Workers}
+		s.next++
+		s.byKey[key] = p
+		heap.Push(&s.queue, p)
+	}
+	for key, p := range s.byKey {
+		if !listed[key] {
+			heap.Remove(&s.queue, p.index)
+			delete(s.byKey, key)
+		}
+	}
+}
+
+// Run polls the appliances as they come due until ctx is done or dispatch
+// stops, checking the source for changes every streamReloadInterval.
+func (s *streamScheduler) Run(ctx context.Context, dispatchOne func(ap Appliance, worker int, finished func()) bool) {
+	slog.Info("Streaming", "component", "stream", "appliances", len(s.byKey), "interval", s.conf.Interval.Std().String(),
+		"overrides", len(s.conf.Intervals))
+	reload := time.NewTicker(streamReloadInterval)
+	defer reload.Stop()
+	flush := time.NewTicker(s.conf.FlushInterval.Std())
+	defer flush.Stop()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		if len(s.queue) > 0 {
+			timer.Reset(time.Until(s.queue[0].due))
+		}
+		select {
+		case <-ctx.Done():
+			s.stopped()
+			return
+		case <-reload.C:
+			appliances, err := ownedAppliances(ctx)
+			if err != nil {
+				slog.Warn("Failed to reload appliances", "component", "stream", "error", err)
+				continue
+			}
+			s.update(appliances, time.Now())
+			runStats.Appliances.Store(int64(len(s.byKey)))
+		case <-flush.C:
+			emitWindows(time.Now(), false)
+			emitReordered(false)
+		case <-timer.C:
+			if len(s.queue) == 0 || time.Now().Before(s.queue[0].due) {
+				continue
+			}
+			p := s.queue[0]
+			// Skip the polls missed while a gate held dispatch back
+			// rather than catching up with a burst.
+			now := time.Now()
+			for !p.slot.After(now) {
+				p.slot = p.slot.Add(p.interval)
+			}
+			p.due = p.slot.Add(pollJitter())
+			heap.Fix(&s.queue, 0)
+
+			key := p.ap.key()
+			s.mu.Lock()
+			busy := s.inFlight[key]
+			s.inFlight[key] = true
+			s.mu.Unlock()
+			if busy {
+				s.skipped++
+				slog.Debug("Previous poll still running, skipping", "component", "stream", "appliance", p.ap.HostName)
+				continue
+			}
+			finished := func() {
+				s.mu.Lock()
+				delete(s.inFlight, key)
+				s.mu.Unlock()
+			}
+			if !dispatchOne(p.ap, p.worker, finished) {
+				finished()
+				s.stopped()
+				return
+			}
+		}
+	}
+}
+
+func (s *streamScheduler) stopped() {
+	slog.Info("Stream stopped", "component", "stream", "appliances", len(s.byKey), "polls_skipped", s.skipped)
+}
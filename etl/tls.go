@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+//////////////////////////////////////////////////
+// TLS
+//////////////////////////////////////////////////
+
+// TLSConfig is the client side of TLS connections the ETL makes.
+type TLSConfig struct {
+	// CAFile is a PEM bundle of the CAs to trust instead of the system
+	// roots, for endpoints with certificates from a private CA.
+	CAFile             string `yaml:"ca_file" json:"ca_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify" json:"insecure_skip_verify"` // lab use only
+	MinVersion         string `yaml:"min_version" json:"min_version"`                   // 1.0, 1.1, 1.2 or 1.3
+	// The client certificate for mutual TLS, as PEM files, or as PEM in
+	// the environment variables named by CertEnv and KeyEnv so it doesn't
+	// have to be written to disk, or as PEM in CertPEM and KeyPEM, which
+	// are meant to be secret references.
+	CertFile string `yaml:"cert_file" json:"cert_file"`
+	KeyFile  string `yaml:"key_file" json:"key_file"`
+	CertEnv  string `yaml:"cert_env" json:"cert_env"`
+	KeyEnv   string `yaml:"key_env" json:"key_env"`
+	CertPEM  string `yaml:"cert_pem" json:"cert_pem" secret:"true"`
+	KeyPEM   string `yaml:"key_pem" json:"key_pem" secret:"true"`
+}
+
+func defaultTLSConfig() TLSConfig {
+	return TLSConfig{MinVersion: "1.2"}
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func (t *TLSConfig) validate(prefix string) []error {
+	var errs []error
+	if _, ok := tlsVersions[t.MinVersion]; !ok {
+		errs = append(errs, fmt.Errorf("%s.min_version must be 1.0, 1.1, 1.2 or 1.3, got %q", prefix, t.MinVersion))
+	}
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		errs = append(errs, fmt.Errorf("%s.cert_file and %s.key_file must be set together", prefix, prefix))
+	}
+	if (t.CertEnv == "") != (t.KeyEnv == "") {
+		errs = append(errs, fmt.Errorf("%s.cert_env and %s.key_env must be set together", prefix, prefix))
+	}
+	if (t.CertPEM == "") != (t.KeyPEM == "") {
+		errs = append(errs, fmt.Errorf("%s.cert_pem and %s.key_pem must be set together", prefix, prefix))
+	}
+	if boolToInt(t.CertFile != "")+boolToInt(t.CertEnv != "")+boolToInt(t.CertPEM != "") > 1 {
+		errs = append(errs, fmt.Errorf("%s: set only one of cert_file/key_file, cert_env/key_env or cert_pem/key_pem", prefix))
+	}
+	return errs
+}
+
+// build returns the crypto/tls configuration, reading the CA bundle and
+// the client certificate.
+func (t *TLSConfig) build() (*tls.Config, error) {
+	conf := &tls.Config{
+		InsecureSkipVerify: t.InsecureSkipVerify,
+		MinVersion:         tlsVersions[t.MinVersion],
+	}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", t.CAFile)
+		}
+		conf.RootCAs = pool
+	}
+
+	var cert tls.Certificate
+	var err error
+	switch {
+	case t.CertFile != "":
+		cert, err = tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	case t.CertEnv != "":
+		certPEM, keyPEM := os.Getenv(t.CertEnv), os.Getenv(t.KeyEnv)
+		if certPEM == "" || keyPEM == "" {
+			return nil, fmt.Errorf("client certificate: %s and %s must both be set in the environment", t.CertEnv, t.KeyEnv)
+		}
+		cert, err = tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	case t.CertPEM != "":
+		cert, err = tls.X509KeyPair([]byte(t.CertPEM), []byte(t.KeyPEM))
+	default:
+		return conf, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("client certificate: %w", err)
+	}
+	conf.Certificates = []tls.Certificate{cert}
+	return conf, nil
+}
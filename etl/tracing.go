@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+//////////////////////////////////////////////////
+// Tracing
+//////////////////////////////////////////////////
+
+type TracingConfig struct {
+	Enabled     bool              `yaml:"enabled" json:"enabled"`
+	Endpoint    string            `yaml:"endpoint" json:"endpoint"`
+	Insecure    bool              `yaml:"insecure" json:"insecure"`
+	Headers     map[string]string `yaml:"headers" json:"headers"`
+	ServiceName string            `yaml:"service_name" json:"service_name"`
+	SampleRatio float64           `yaml:"sample_ratio" json:"sample_ratio"`
+}
+
+func defaultTracingConfig() TracingConfig {
+	return TracingConfig{
+		Endpoint:    "localhost:4318",
+		Insecure:    true,
+		ServiceName: "concurrent-etl",
+		SampleRatio: 1,
+	}
+}
+
+func (t *TracingConfig) validate() []error {
+	if !t.Enabled {
+		return nil
+	}
+	var errs []error
+	if t.Endpoint == "" {
+		errs = append(errs, errors.New("tracing.endpoint must be set"))
+	}
+	if t.SampleRatio < 0 || t.SampleRatio > 1 {
+		errs = append(errs, fmt.Errorf("tracing.sample_ratio must be within [0, 1], got %v", t.SampleRatio))
+	}
+	return errs
+}
+
+// tracer delegates to the global provider, so it is a no-op until
+// setupTracing installs an exporter.
+var tracer = otel.Tracer("github.com/ravishankarsrrav/concurrent-etl-go/etl")
+
+// setupTracing installs an OTLP/HTTP exporter as the global tracer provider.
+// The returned function flushes pending spans and must be called on exit.
+func setupTracing(conf TracingConfig, linksPerBatch int) (func(context.Context) error, error) {
+	if !conf.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(conf.Endpoint)}
+	if conf.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if len(conf.Headers) > 0 {
+		opts = append(opts, otlptracehttp.WithHeaders(conf.Headers))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("creating OTLP exporter: %w", err)
+	}
+
+	res, err := resource.New(context.Background(),
+		resource.WithAttributes(semconv.ServiceName(conf.ServiceName)),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Flush spans link every record in the batch; the SDK default of 128
+	// links would silently drop the rest.
+	limits := sdktrace.NewSpanLimits()
+	limits.LinkCountLimit = max(limits.LinkCountLimit, linksPerBatch)
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(conf.SampleRatio))),
+		sdktrace.WithRawSpanLimits(limits),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return provider.Shutdown, nil
+}
+
+// recordLinks turns the per-record span contexts of a batch into links for
+// the flush span, skipping records that were never traced (e.g. reloaded
+// from a spill file).
+func recordLinks(data []DeviceData) []trace.Link {
+	links := make([]trace.Link, 0, len(data))
+	for _, d := range data {
+		if d.spanContext.IsValid() {
+			links = append(links, trace.Link{SpanContext: d.spanContext})
+		}
+	}
+	return links
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func applianceAttrs(ap Appliance) trace.SpanStartEventOption {
+	return trace.WithAttributes(
+		attribute.String("appliance.hostname", ap.HostName),
+		attribute.String("appliance.ip", ap.IP),
+	)
+}
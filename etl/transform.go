@@ -0,0 +1,366 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//////////////////////////////////////////////////
+// Transformer Interface & Chain
+//////////////////////////////////////////////////
+
+// Record is what moves through the transform chain: the stats as extracted,
+// the appliance they came from and the DeviceData built so far.
+type Record struct {
+	Raw       *CpuStats
+	Appliance Appliance
+	Data      DeviceData
+}
+
+// Transformer is one step of the transform chain. It updates the record in
+// place and returns false to drop it.
+type Transformer interface {
+	Transform(r *Record) (keep bool, err error)
+}
+
+// TransformerFactory builds a transformer from its step configuration,
+// which has already been validated.
+type TransformerFactory func(step TransformStep) (Transformer, error)
+
+var transformerRegistry = map[string]TransformerFactory{}
+
+// registerTransformer makes a transformer usable as a transform.chain step
+// type. It is meant to be called from init().
+func registerTransformer(name string, factory TransformerFactory) {
+	if _, dup := transformerRegistry[name]; dup {
+		panic("transformer already registered: " + name)
+	}
+	transformerRegistry[name] = factory
+}
+
+func transformerNames() []string {
+	names := make([]string, 0, len(transformerRegistry))
+	for name := range transformerRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type TransformConfig struct {
+	Chain []TransformStep `yaml:"chain" json:"chain"`
+}
+
+// TransformStep configures one chain step. Type selects the transformer;
+// the other fields are options and only apply to the types noted.
+type TransformStep struct {
+	Type string `yaml:"type" json:"type"`
+
+	// derive: Name = (sum of the Sum indicators) * Scale + Offset.
+	Name   string   `yaml:"name" json:"name"`
+	Sum    []string `yaml:"sum" json:"sum"`
+	Scale  *float64 `yaml:"scale" json:"scale"`
+	Offset float64  `yaml:"offset" json:"offset"`
+
+	// filter: Keep/Drop select indicators by name; records whose Indicator
+	// is outside [Min, Max] are dropped.
+	Keep      []string `yaml:"keep" json:"keep"`
+	Drop      []string `yaml:"drop" json:"drop"`
+	Indicator string   `yaml:"indicator" json:"indicator"`
+	Min       *float64 `yaml:"min" json:"min"`
+	Max       *float64 `yaml:"max" json:"max"`
+
+	// relabel: Rename maps old to new indicator names; RecordName replaces
+	// the record name, with {name}, {host}, {ip} and {cpu} expanded.
+	Rename     map[string]string `yaml:"rename" json:"rename"`
+	RecordName string            `yaml:"record_name" json:"record_name"`
+
+	// cel: Set maps indicator names to CEL expressions; records for which
+	// the DropIf expression is true are dropped.
+	Set    map[string]string `yaml:"set" json:"set"`
+	DropIf string            `yaml:"drop_if" json:"drop_if"`
+
+	// lua: Script is the file defining Function (default transform).
+	Script   string `yaml:"script" json:"script"`
+	Function string `yaml:"function" json:"function"`
+
+	// wasm: Module is the plugin's .wasm file.
+	Module string `yaml:"module" json:"module"`
+
+	// enrich: Lookup is a CSV or JSON table keyed by Key (host or ip) whose
+	// Fields (default all) become record labels.
+	Lookup string   `yaml:"lookup" json:"lookup"`
+	Key    string   `yaml:"key" json:"key"`
+	Fields []string `yaml:"fields" json:"fields"`
+
+	// timestamp: Unit is that of the timestamps as reported, s, ms, us, ns
+	// or auto (default); Timezones maps host names, or * for the rest, to
+	// the IANA zone or UTC offset of appliances reporting local time;
+	// records more than MaxSkew (0 = off) from now are flagged.
+	Unit      string            `yaml:"unit" json:"unit"`
+	Timezones map[string]string `yaml:"timezones" json:"timezones"`
+	MaxSkew   Duration          `yaml:"max_skew" json:"max_skew"`
+
+	// lua, wasm: Timeout bounds each call (default 1s).
+	Timeout Duration `yaml:"timeout" json:"timeout"`
+}
+
+func defaultTransformConfig() TransformConfig {
+	return TransformConfig{Chain: []TransformStep{{Type: "cpu"}}}
+}
+
+func (t *TransformConfig) validate() []error {
+	if len(t.Chain) == 0 {
+		return []error{errors.New("transform.chain must have at least one step")}
+	}
+	var errs []error
+	for i, step := range t.Chain {
+		errs = append(errs, step.validate(fmt.Sprintf("transform.chain[%d]", i))...)
+	}
+	return errs
+}
+
+func (s *TransformStep) validate(prefix string) []error {
+	var errs []error
+	switch s.Type {
+	case "cpu":
+	case "derive":
+		if s.Name == "" {
+			errs = append(errs, fmt.Errorf("%s.name must be set", prefix))
+		}
+		if len(s.Sum) == 0 {
+			errs = append(errs, fmt.Errorf("%s.sum must list at least one indicator", prefix))
+		}
+	case "filter":
+		if len(s.Keep) > 0 && len(s.Drop) > 0 {
+			errs = append(errs, fmt.Errorf("%s: set keep or drop, not both", prefix))
+		}
+		if (s.Min != nil || s.Max != nil) && s.Indicator == "" {
+			errs = append(errs, fmt.Errorf("%s.indicator must be set with min or max", prefix))
+		}
+		if s.Min != nil && s.Max != nil && *s.Min > *s.Max {
+			errs = append(errs, fmt.Errorf("%s.min must be <= max", prefix))
+		}
+	case "relabel":
+		if len(s.Rename) == 0 && s.RecordName == "" {
+			errs = append(errs, fmt.Errorf("%s needs rename or record_name", prefix))
+		}
+	case "cel":
+		if len(s.Set) == 0 && s.DropIf == "" {
+			errs = append(errs, fmt.Errorf("%s needs set or drop_if", prefix))
+		}
+	case "enrich":
+		if s.Lookup == "" {
+			errs = append(errs, fmt.Errorf("%s.lookup must be set", prefix))
+		}
+		if s.Key != "" && s.Key != "host" && s.Key != "ip" {
+			errs = append(errs, fmt.Errorf("%s.key must be host or ip, got %q", prefix, s.Key))
+		}
+	case "timestamp":
+		if _, ok := timestampUnits[s.Unit]; !ok && s.Unit != "" && s.Unit != "auto" {
+			errs = append(errs, fmt.Errorf("%s.unit must be auto, s, ms, us or ns, got %q", prefix, s.Unit))
+		}
+		for host, zone := range s.Timezones {
+			if _, err := parseTimezone(zone); err != nil {
+				errs = append(errs, fmt.Errorf("%s.timezones[%s]: %w", prefix, host, err))
+			}
+		}
+		if s.MaxSkew < 0 {
+			errs = append(errs, fmt.Errorf("%s.max_skew must be >= 0", prefix))
+		}
+	case "lua", "wasm":
+		if s.Type == "lua" && s.Script == "" {
+			errs = append(errs, fmt.Errorf("%s.script must be set", prefix))
+		}
+		if s.Type == "wasm" && s.Module == "" {
+			errs = append(errs, fmt.Errorf("%s.module must be set", prefix))
+		}
+		if s.Timeout < 0 {
+			errs = append(errs, fmt.Errorf("%s.timeout must be >= 0", prefix))
+		}
+	default:
+		if _, ok := transformerRegistry[s.Type]; !ok {
+			errs = append(errs, fmt.Errorf("%s.type %q is unknown (available: %v)", prefix, s.Type, transformerNames()))
+		}
+	}
+	return errs
+}
+
+// TransformChain runs its transformers in order.
+type TransformChain []Transformer
+
+// transformChain is built by main from transform.chain.
+var transformChain TransformChain
+
+func newTransformChain(conf TransformConfig) (TransformChain, error) {
+	chain := make(TransformChain, 0, len(conf.Chain))
+	for i, step := range conf.Chain {
+		t, err := transformerRegistry[step.Type](step)
+		if err != nil {
+			return nil, fmt.Errorf("transform.chain[%d] (%s): %w", i, step.Type, err)
+		}
+		chain = append(chain, t)
+	}
+	return chain, nil
+}
+
+// Apply turns extracted stats into a record. keep is false if a step
+// dropped it.
+func (c TransformChain) Apply(raw *CpuStats, ap Appliance) (data DeviceData, keep bool, err error) {
+	r := &Record{Raw: raw, Appliance: ap}
+	for _, t := range c {
+		if keep, err = t.Transform(r); err != nil || !keep {
+			return DeviceData{}, keep, err
+		}
+	}
+	return r.Data, true, nil
+}
+
+func (r *Record) indicator(name string) (float64, bool) {
+	for _, ind := range r.Data.Indicators {
+		if ind.Name == name {
+			return ind.Value, true
+		}
+	}
+	return 0, false
+}
+
+// setIndicator replaces the named indicator, or appends it if the record
+// doesn't have it yet.
+func (r *Record) setIndicator(name string, v float64) {
+	for i := range r.Data.Indicators {
+		if r.Data.Indicators[i].Name == name {
+			r.Data.Indicators[i].Value = v
+			return
+		}
+	}
+	r.Data.Indicators = append(r.Data.Indicators, Indicator{name, v})
+}
+
+//////////////////////////////////////////////////
+// Built-in Transformers
+//////////////////////////////////////////////////
+
+func init() {
+	registerTransformer("cpu", func(TransformStep) (Transformer, error) {
+		return cpuTransformer{}, nil
+	})
+	registerTransformer("derive", func(step TransformStep) (Transformer, error) {
+		t := &deriveTransformer{name: step.Name, sum: step.Sum, scale: 1, offset: step.Offset}
+		if step.Scale != nil {
+			t.scale = *step.Scale
+		}
+		return t, nil
+	})
+	registerTransformer("filter", func(step TransformStep) (Transformer, error) {
+		return &filterTransformer{keep: step.Keep, drop: step.Drop, indicator: step.Indicator, min: step.Min, max: step.Max}, nil
+	})
+	registerTransformer("relabel", func(step TransformStep) (Transformer, error) {
+		return &relabelTransformer{rename: step.Rename, recordName: step.RecordName}, nil
+	})
+}
+
+// cpuTransformer parses the mpstat-style percentages into the utilization,
+// nice, user, system and irq indicators. It replaces whatever the record
+// held, so it normally comes first.
+type cpuTransformer struct{}
+
+func (cpuTransformer) Transform(r *Record) (bool, error) {
+	cpu := r.Raw
+	idle, _ := strconv.ParseFloat(cpu.PIdle, 64)
+	pNice, _ := strconv.ParseFloat(cpu.PNice, 64)
+	pUser, _ := strconv.ParseFloat(cpu.PUser, 64)
+	pSys, _ := strconv.ParseFloat(cpu.PSys, 64)
+	pIRQ, _ := strconv.ParseFloat(cpu.PIRQ, 64)
+
+	indicators := []Indicator{
+		{"utilization", 100 - idle},
+		{"nice", pNice},
+		{"user", pUser},
+		{"system", pSys},
+		{"irq", pIRQ},
+	}
+
+	r.Data = DeviceData{
+		Name:       cpu.Name,
+		CPUNumber:  cpu.CPUNumber,
+		Timestamp:  cpu.Timestamp,
+		Indicators: indicators,
+	}
+	return true, nil
+}
+
+// deriveTransformer adds an indicator computed from existing ones. Missing
+// inputs are an error rather than silently counting as zero.
+type deriveTransformer struct {
+	name   string
+	sum    []string
+	scale  float64
+	offset float64
+}
+
+func (d *deriveTransformer) Transform(r *Record) (bool, error) {
+	var total float64
+	for _, name := range d.sum {
+		v, ok := r.indicator(name)
+		if !ok {
+			return false, fmt.Errorf("derive %s: record has no indicator %q", d.name, name)
+		}
+		total += v
+	}
+	r.Data.Indicators = append(r.Data.Indicators, Indicator{d.name, total*d.scale + d.offset})
+	return true, nil
+}
+
+// filterTransformer narrows the indicators of a record and drops records
+// whose selected indicator is out of range.
+type filterTransformer struct {
+	keep, drop []string
+	indicator  string
+	min, max   *float64
+}
+
+func (f *filterTransformer) Transform(r *Record) (bool, error) {
+	if f.indicator != "" {
+		v, ok := r.indicator(f.indicator)
+		if !ok || (f.min != nil && v < *f.min) || (f.max != nil && v > *f.max) {
+			return false, nil
+		}
+	}
+	if len(f.keep) > 0 || len(f.drop) > 0 {
+		r.Data.Indicators = slices.DeleteFunc(r.Data.Indicators, func(ind Indicator) bool {
+			if len(f.keep) > 0 {
+				return !slices.Contains(f.keep, ind.Name)
+			}
+			return slices.Contains(f.drop, ind.Name)
+		})
+	}
+	return true, nil
+}
+
+// relabelTransformer renames indicators and the record.
+type relabelTransformer struct {
+	rename     map[string]string
+	recordName string
+}
+
+func (l *relabelTransformer) Transform(r *Record) (bool, error) {
+	for i, ind := range r.Data.Indicators {
+		if to, ok := l.rename[ind.Name]; ok {
+			r.Data.Indicators[i].Name = to
+		}
+	}
+	if l.recordName != "" {
+		r.Data.Name = strings.NewReplacer(
+			"{name}", r.Data.Name,
+			"{host}", r.Appliance.HostName,
+			"{ip}", r.Appliance.IP,
+			"{cpu}", r.Data.CPUNumber,
+		).Replace(l.recordName)
+	}
+	return true, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/google/cel-go/cel"
+	celast "github.com/google/cel-go/common/ast"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+//////////////////////////////////////////////////
+// CEL Transformer
+//////////////////////////////////////////////////
+
+func init() {
+	registerTransformer("cel", newCELTransformer)
+}
+
+// celEnv declares what expressions can refer to: the raw percentages as
+// doubles, the record and appliance identity, and the indicators built by
+// earlier steps as the map ind.
+var celEnv, celEnvErr = cel.NewEnv(
+	cel.CrossTypeNumericComparisons(true),
+	cel.Variable("pIdle", cel.DoubleType),
+	cel.Variable("pUser", cel.DoubleType),
+	cel.Variable("pSys", cel.DoubleType),
+	cel.Variable("pIRQ", cel.DoubleType),
+	cel.Variable("pNice", cel.DoubleType),
+	cel.Variable("name", cel.StringType),
+	cel.Variable("cpu", cel.StringType),
+	cel.Variable("timestamp", cel.UintType),
+	cel.Variable("host", cel.StringType),
+	cel.Variable("ip", cel.StringType),
+	cel.Variable("ind", cel.MapType(cel.StringType, cel.DoubleType)),
+)
+
+// celFloat converts a numeric result to float64.
+func celFloat(v ref.Val) float64 {
+	switch n := v.Value().(type) {
+	case int64:
+		return float64(n)
+	case uint64:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return 0
+}
+
+type celIndicator struct {
+	name string
+	prg  cel.Program
+}
+
+// celTransformer sets indicators from CEL expressions and drops records
+// matching drop_if. All expressions of a step see the record as it was
+// before the step; chain another step to build on its results.
+type celTransformer struct {
+	set    []celIndicator
+	dropIf cel.Program
+}
+
+func newCELTransformer(step TransformStep) (Transformer, error) {
+	if celEnvErr != nil {
+		return nil, celEnvErr
+	}
+
+	t := &celTransformer{}
+	names := make([]string, 0, len(step.Set))
+	for name := range step.Set {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		prg, err := compileCEL(step.Set[name], cel.DoubleType, cel.IntType, cel.UintType)
+		if err != nil {
+			return nil, fmt.Errorf("set.%s: %w", name, err)
+		}
+		t.set = append(t.set, celIndicator{name: name, prg: prg})
+	}
+	if step.DropIf != "" {
+		prg, err := compileCEL(step.DropIf, cel.BoolType)
+		if err != nil {
+			return nil, fmt.Errorf("drop_if: %w", err)
+		}
+		t.dropIf = prg
+	}
+	return t, nil
+}
+
+// compileCEL compiles expr and checks it evaluates to one of the allowed
+// types. CEL has no int/double arithmetic, so an expression that only
+// type-checks with its integer literals read as doubles, like
+// `100 - pIdle`, is compiled that way.
+func compileCEL(expr string, allowed ...*cel.Type) (cel.Program, error) {
+	ast, iss := celEnv.Compile(expr)
+	if iss.Err() != nil {
+		parsed, _ := celEnv.Parse(expr)
+		if parsed == nil {
+			return nil, iss.Err()
+		}
+		celIntLiteralsToDouble(parsed)
+		checked, retryIss := celEnv.Check(parsed)
+		if retryIss.Err() != nil {
+			return nil, iss.Err()
+		}
+		ast = checked
+	}
+	if !slices.ContainsFunc(allowed, func(t *cel.Type) bool { return ast.OutputType().IsExactType(t) }) {
+		return nil, fmt.Errorf("%q has type %s, want %v", expr, ast.OutputType(), allowed)
+	}
+	return celEnv.Program(ast)
+}
+
+func celIntLiteralsToDouble(a *cel.Ast) {
+	fac := celast.NewExprFactory()
+	celast.PostOrderVisit(a.NativeRep().Expr(), celast.NewExprVisitor(func(e celast.Expr) {
+		if e.Kind() != celast.LiteralKind {
+			return
+		}
+		if i, ok := e.AsLiteral().(types.Int); ok {
+			e.SetKindCase(fac.NewLiteral(e.ID(), types.Double(i)))
+		}
+	}))
+}
+
+func (c *celTransformer) Transform(r *Record) (bool, error) {
+	vars := celVars(r)
+
+	if c.dropIf != nil {
+		out, _, err := c.dropIf.Eval(vars)
+		if err != nil {
+			return false, fmt.Errorf("drop_if: %w", err)
+		}
+		if out == types.True {
+			return false, nil
+		}
+	}
+
+	for _, ind := range c.set {
+		out, _, err := ind.prg.Eval(vars)
+		if err != nil {
+			return false, fmt.Errorf("set.%s: %w", ind.name, err)
+		}
+		r.setIndicator(ind.name, celFloat(out))
+	}
+	return true, nil
+}
+
+func celVars(r *Record) map[string]any {
+	parse := func(s string) float64 {
+		v, _ := strconv.ParseFloat(s, 64)
+		return v
+	}
+	ind := make(map[string]float64, len(r.Data.Indicators))
+	for _, i := range r.Data.Indicators {
+		ind[i.Name] = i.Value
+	}
+	return map[string]any{
+		"pIdle":     parse(r.Raw.PIdle),
+		"pUser":     parse(r.Raw.PUser),
+		"pSys":      parse(r.Raw.PSys),
+		"pIRQ":      parse(r.Raw.PIRQ),
+		"pNice":     parse(r.Raw.PNice),
+		"name":      r.Data.Name,
+		"cpu":       r.Data.CPUNumber,
+		"timestamp": r.Data.Timestamp,
+		"host":      r.Appliance.HostName,
+		"ip":        r.Appliance.IP,
+		"ind":       ind,
+	}
+}
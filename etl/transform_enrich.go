@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+//////////////////////////////////////////////////
+// Enrichment Transformer
+//////////////////////////////////////////////////
+
+func init() {
+	registerTransformer("enrich", newEnrichTransformer)
+}
+
+// enrichTransformer attaches metadata such as site, rack, owner or
+// environment from a lookup table to each record as labels. The table is
+// keyed by appliance host name or IP and read once at startup:
+//
+//   - CSV: a header row naming the columns, one of which is the key column
+//     ("host" or "ip"); every other column is a label.
+//   - JSON: an object mapping each key to an object of label values.
+//
+// Records whose appliance isn't in the table pass through unchanged.
+type enrichTransformer struct {
+	byIP  bool
+	table map[string]map[string]string
+}
+
+func newEnrichTransformer(step TransformStep) (Transformer, error) {
+	key := step.Key
+	if key == "" {
+		key = "host"
+	}
+
+	var table map[string]map[string]string
+	var err error
+	if strings.EqualFold(filepath.Ext(step.Lookup), ".json") {
+		table, err = readJSONLookup(step.Lookup)
+	} else {
+		table, err = readCSVLookup(step.Lookup, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(step.Fields) > 0 {
+		for _, labels := range table {
+			maps.DeleteFunc(labels, func(name, _ string) bool { return !slices.Contains(step.Fields, name) })
+		}
+	}
+	return &enrichTransformer{byIP: key == "ip", table: table}, nil
+}
+
+func readCSVLookup(file, key string) (map[string]map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("%s: no header row", file)
+	}
+	header := rows[0]
+	keyCol := slices.Index(header, key)
+	if keyCol < 0 {
+		return nil, fmt.Errorf("%s: no %q column", file, key)
+	}
+
+	table := make(map[string]map[string]string, len(rows)-1)
+	for _, row := range rows[1:] {
+		labels := make(map[string]string, len(header)-1)
+		for i, v := range row {
+			if i != keyCol {
+				labels[header[i]] = v
+			}
+		}
+		table[row[keyCol]] = labels
+	}
+	return table, nil
+}
+
+func readJSONLookup(file string) (map[string]map[string]string, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var table map[string]map[string]string
+	if err := json.Unmarshal(b, &table); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return table, nil
+}
+
+func (e *enrichTransformer) Transform(r *Record) (bool, error) {
+	key := r.Appliance.HostName
+	if e.byIP {
+		key = r.Appliance.IP
+	}
+	labels, ok := e.table[key]
+	if !ok || len(labels) == 0 {
+		return true, nil
+	}
+	if r.Data.Labels == nil {
+		r.Data.Labels = make(map[string]string, len(labels))
+	}
+	maps.Copy(r.Data.Labels, labels)
+	return true, nil
+}
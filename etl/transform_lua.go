@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+//////////////////////////////////////////////////
+// Lua Transformer
+//////////////////////////////////////////////////
+
+func init() {
+	registerTransformer("lua", newLuaTransformer)
+}
+
+// luaTransformer calls a function from a user-supplied Lua script for every
+// record:
+//
+//	function transform(stats, record, appliance) ... end
+//
+// stats is the CpuStats map as extracted (JSON field names), record the
+// DeviceData built by earlier steps and appliance has host and ip. The
+// function returns the new record as a table, or nil to drop it. Scripts
+// run sandboxed, with only the base, table, string and math libraries.
+type luaTransformer struct {
+	function string
+	timeout  time.Duration
+	// states holds ready-to-call interpreters; an LState is not safe for
+	// concurrent use, so each record borrows one.
+	states sync.Pool
+}
+
+func newLuaTransformer(step TransformStep) (Transformer, error) {
+	src, err := os.ReadFile(step.Script)
+	if err != nil {
+		return nil, err
+	}
+	chunk, err := parse.Parse(strings.NewReader(string(src)), step.Script)
+	if err != nil {
+		return nil, err
+	}
+	proto, err := lua.Compile(chunk, step.Script)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &luaTransformer{function: step.Function, timeout: step.Timeout.Std()}
+	if t.function == "" {
+		t.function = "transform"
+	}
+	if t.timeout == 0 {
+		t.timeout = time.Second
+	}
+
+	// Load one interpreter now so script errors fail at startup.
+	L, err := t.newState(proto)
+	if err != nil {
+		return nil, err
+	}
+	t.states.Put(L)
+	t.states.New = func() any {
+		L, _ := t.newState(proto)
+		return L
+	}
+	return t, nil
+}
+
+func (t *luaTransformer) newState(proto *lua.FunctionProto) (*lua.LState, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	L.Push(L.NewFunctionFromProto(proto))
+	if err := L.PCall(0, lua.MultRet, nil); err != nil {
+		L.Close()
+		return nil, err
+	}
+	if _, ok := L.GetGlobal(t.function).(*lua.LFunction); !ok {
+		L.Close()
+		return nil, fmt.Errorf("script defines no function %q", t.function)
+	}
+	return L, nil
+}
+
+func (t *luaTransformer) Transform(r *Record) (bool, error) {
+	L := t.states.Get().(*lua.LState)
+	defer t.states.Put(L)
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+	defer cancel()
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+
+	err := L.CallByParam(lua.P{Fn: L.GetGlobal(t.function), NRet: 1, Protect: true},
+		luaStats(L, r.Raw), luaRecord(L, r.Data), luaAppliance(L, r.Appliance))
+	if err != nil {
+		return false, err
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+
+	switch ret := ret.(type) {
+	case *lua.LNilType:
+		return false, nil
+	case lua.LBool:
+		if !ret {
+			return false, nil
+		}
+		return false, errors.New("lua function returned true, want a record table or nil")
+	case *lua.LTable:
+		data, err := luaToDeviceData(ret, r.Data)
+		if err != nil {
+			return false, err
+		}
+		r.Data = data
+		return true, nil
+	default:
+		return false, fmt.Errorf("lua function returned %s, want a record table or nil", ret.Type())
+	}
+}
+
+func luaStats(L *lua.LState, cpu *CpuStats) *lua.LTable {
+	t := L.NewTable()
+	t.RawSetString("name", lua.LString(cpu.Name))
+	t.RawSetString("timestamp", lua.LNumber(cpu.Timestamp))
+	t.RawSetString("cpu_number", lua.LString(cpu.CPUNumber))
+	t.RawSetString("pIdle", lua.LString(cpu.PIdle))
+	t.RawSetString("pUser", lua.LString(cpu.PUser))
+	t.RawSetString("pSys", lua.LString(cpu.PSys))
+	t.RawSetString("pIRQ", lua.LString(cpu.PIRQ))
+	t.RawSetString("pNice", lua.LString(cpu.PNice))
+	return t
+}
+
+func luaRecord(L *lua.LState, d DeviceData) *lua.LTable {
+	t := L.NewTable()
+	t.RawSetString("name", lua.LString(d.Name))
+	t.RawSetString("cpu_number", lua.LString(d.CPUNumber))
+	t.RawSetString("timestamp", lua.LNumber(d.Timestamp))
+	inds := L.NewTable()
+	for _, ind := range d.Indicators {
+		it := L.NewTable()
+		it.RawSetString("name", lua.LString(ind.Name))
+		it.RawSetString("value", lua.LNumber(ind.Value))
+		inds.Append(it)
+	}
+	t.RawSetString("indicators", inds)
+	return t
+}
+
+func luaAppliance(L *lua.LState, ap Appliance) *lua.LTable {
+	t := L.NewTable()
+	t.RawSetString("host", lua.LString(ap.HostName))
+	t.RawSetString("ip", lua.LString(ap.IP))
+	return t
+}
+
+// luaToDeviceData reads a returned record table. Fields it leaves out keep
+// the values of prev. indicators is either a list of {name=, value=}
+// tables or a map of name to value, which is emitted sorted by name.
+func luaToDeviceData(t *lua.LTable, prev DeviceData) (DeviceData, error) {
+	d := prev
+	if v, ok := t.RawGetString("name").(lua.LString); ok {
+		d.Name = string(v)
+	}
+	switch v := t.RawGetString("cpu_number").(type) {
+	case lua.LString:
+		d.CPUNumber = string(v)
+	case lua.LNumber:
+		d.CPUNumber = v.String()
+	}
+	if v, ok := t.RawGetString("timestamp").(lua.LNumber); ok {
+		d.Timestamp = uint64(v)
+	}
+
+	inds, ok := t.RawGetString("indicators").(*lua.LTable)
+	if !ok {
+		return d, nil
+	}
+	d.Indicators = nil
+	if inds.Len() > 0 {
+		for i := 1; i <= inds.Len(); i++ {
+			it, ok := inds.RawGetInt(i).(*lua.LTable)
+			if !ok {
+				return DeviceData{}, fmt.Errorf("indicators[%d] is not a table", i)
+			}
+			name, ok := it.RawGetString("name").(lua.LString)
+			value, ok2 := it.RawGetString("value").(lua.LNumber)
+			if !ok || !ok2 {
+				return DeviceData{}, fmt.Errorf("indicators[%d] needs a string name and a number value", i)
+			}
+			d.Indicators = append(d.Indicators, Indicator{string(name), float64(value)})
+		}
+		return d, nil
+	}
+
+	var err error
+	inds.ForEach(func(k, v lua.LValue) {
+		value, ok := v.(lua.LNumber)
+		if !ok {
+			err = fmt.Errorf("indicator %s is not a number", k)
+			return
+		}
+		d.Indicators = append(d.Indicators, Indicator{k.String(), float64(value)})
+	})
+	if err != nil {
+		return DeviceData{}, err
+	}
+	sort.Slice(d.Indicators, func(i, j int) bool { return d.Indicators[i].Name < d.Indicators[j].Name })
+	return d, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata" // zones by name on hosts without a zoneinfo database
+)
+
+//////////////////////////////////////////////////
+// Timestamp Normalization Transformer
+//////////////////////////////////////////////////
+
+func init() {
+	registerTransformer("timestamp", newTimestampTransformer)
+}
+
+// Timestamp units, as scaled to seconds.
+var timestampUnits = map[string]uint64{
+	"s":  1,
+	"ms": 1_000,
+	"us": 1_000_000,
+	"ns": 1_000_000_000,
+}
+
+// timestampTransformer makes record timestamps Unix seconds in UTC, whatever
+// the appliance reported:
+//
+//   - unit auto tells seconds, milliseconds, microseconds and nanoseconds
+//     apart by magnitude; any other unit is taken as given.
+//   - an appliance with a timezone reports its local wall-clock time as if
+//     it were UTC; the zone's offset at that time is taken off.
+//   - a timestamp more than max_skew from the current time gets a
+//     clock_skew label with how far it is behind, negative if ahead, and
+//     the appliance a warning.
+type timestampTransformer struct {
+	unit    string
+	zones   map[string]*time.Location // by host name; "*" for the rest
+	maxSkew time.Duration
+	skewed  sync.Map // host names already warned about
+}
+
+func newTimestampTransformer(step TransformStep) (Transformer, error) {
+	t := &timestampTransformer{unit: step.Unit, maxSkew: step.MaxSkew.Std()}
+	if t.unit == "" {
+		t.unit = "auto"
+	}
+	if len(step.Timezones) > 0 {
+		t.zones = make(map[string]*time.Location, len(step.Timezones))
+		for host, zone := range step.Timezones {
+			loc, err := parseTimezone(zone)
+			if err != nil {
+				return nil, fmt.Errorf("timezones[%s]: %w", host, err)
+			}
+			t.zones[host] = loc
+		}
+	}
+	return t, nil
+}
+
+// parseTimezone takes an IANA zone name, such as Europe/Berlin, or a fixed
+// offset from UTC, such as +05:30 or -0800.
+func parseTimezone(zone string) (*time.Location, error) {
+	if strings.HasPrefix(zone, "+") || strings.HasPrefix(zone, "-") {
+		for _, layout := range []string{"-07:00", "-0700", "-07"} {
+			if t, err := time.Parse(layout, zone); err == nil {
+				_, offset := t.Zone()
+				return time.FixedZone(zone, offset), nil
+			}
+		}
+		return nil, fmt.Errorf("offset %q must be like +05:30, -0800 or +02", zone)
+	}
+	return time.LoadLocation(zone)
+}
+
+// timestampUnit guesses the unit of ts from its magnitude: in seconds, the
+// smallest value of each larger unit is a date past the year 5000.
+func timestampUnit(ts uint64) string {
+	switch {
+	case ts < 100_000_000_000:
+		return "s"
+	case ts < 100_000_000_000_000:
+		return "ms"
+	case ts < 100_000_000_000_000_000:
+		return "us"
+	default:
+		return "ns"
+	}
+}
+
+func (t *timestampTransformer) Transform(r *Record) (bool, error) {
+	unit := t.unit
+	if unit == "auto" {
+		unit = timestampUnit(r.Data.Timestamp)
+	}
+	ts := time.Unix(int64(r.Data.Timestamp/timestampUnits[unit]), 0).UTC()
+
+	loc, ok := t.zones[r.Appliance.HostName]
+	if !ok {
+		loc = t.zones["*"]
+	}
+	if loc != nil {
+		ts = time.Date(ts.Year(), ts.Month(), ts.Day(), ts.Hour(), ts.Minute(), ts.Second(), 0, loc)
+	}
+	r.Data.Timestamp = uint64(ts.Unix())
+
+	if t.maxSkew > 0 {
+		if skew := time.Since(ts); skew > t.maxSkew || skew < -t.maxSkew {
+			if r.Data.Labels == nil {
+				r.Data.Labels = make(map[string]string, 1)
+			}
+			r.Data.Labels["clock_skew"] = skew.Round(time.Second).String()
+			if _, warned := t.skewed.LoadOrStore(r.Appliance.HostName, true); !warned {
+				slog.Warn("Appliance clock looks skewed", "component", "transform", "appliance", r.Appliance.HostName,
+					"timestamp", ts.UTC().Format(time.RFC3339), "skew", skew.Round(time.Second).String())
+			}
+		}
+	}
+	return true, nil
+}
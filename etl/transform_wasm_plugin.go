@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+//////////////////////////////////////////////////
+// WASM Transformer
+//////////////////////////////////////////////////
+
+func init() {
+	registerTransformer("wasm", newWASMTransformer)
+}
+
+// wasmMemoryLimitPages caps plugin memory at 64 MiB.
+const wasmMemoryLimitPages = 1024
+
+// wasmIdleInstances is how many instantiated modules are kept for reuse.
+const wasmIdleInstances = 64
+
+// wasmInput is the JSON document passed to a plugin's transform export.
+type wasmInput struct {
+	Stats     *CpuStats     `json:"stats"`
+	Record    DeviceData    `json:"record"`
+	Appliance wasmAppliance `json:"appliance"`
+}
+
+type wasmAppliance struct {
+	Host string `json:"host"`
+	IP   string `json:"ip"`
+}
+
+// wasmOutput is the JSON document a plugin returns: the new record, drop,
+// or an error message.
+type wasmOutput struct {
+	Record *DeviceData `json:"record"`
+	Drop   bool        `json:"drop"`
+	Error  string      `json:"error"`
+}
+
+// wasmTransformer runs a transform plugin compiled to WebAssembly. The ABI:
+//
+//	alloc(size i32) -> ptr i32           reserve size bytes for the host to write into
+//	transform(ptr i32, len i32) -> i64   read the wasmInput JSON at ptr, return
+//	                                     (out_ptr << 32 | out_len) of the wasmOutput JSON
+//	free(ptr i32, len i32)               optional; called for the input and output buffers
+//
+// and the module must export its memory. Modules may import WASI, which
+// gets no filesystem, environment or network. Reactor modules' _initialize
+// is run when an instance is created.
+type wasmTransformer struct {
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	timeout  time.Duration
+	idle     chan api.Module
+}
+
+func newWASMTransformer(step TransformStep) (Transformer, error) {
+	code, err := os.ReadFile(step.Module)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithCloseOnContextDone(true).
+		WithMemoryLimitPages(wasmMemoryLimitPages))
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, runtime); err != nil {
+		runtime.Close(ctx)
+		return nil, err
+	}
+	compiled, err := runtime.CompileModule(ctx, code)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, err
+	}
+	for _, name := range []string{"alloc", "transform"} {
+		if _, ok := compiled.ExportedFunctions()[name]; !ok {
+			runtime.Close(ctx)
+			return nil, fmt.Errorf("module does not export %s", name)
+		}
+	}
+	if _, ok := compiled.ExportedMemories()["memory"]; !ok {
+		runtime.Close(ctx)
+		return nil, errors.New("module does not export memory")
+	}
+
+	t := &wasmTransformer{
+		runtime:  runtime,
+		compiled: compiled,
+		timeout:  step.Timeout.Std(),
+		idle:     make(chan api.Module, wasmIdleInstances),
+	}
+	if t.timeout == 0 {
+		t.timeout = time.Second
+	}
+
+	// Instantiate once now so start-up traps fail at startup.
+	mod, err := t.instantiate(ctx)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, err
+	}
+	t.release(mod)
+	return t, nil
+}
+
+func (t *wasmTransformer) instantiate(ctx context.Context) (api.Module, error) {
+	return t.runtime.InstantiateModule(ctx, t.compiled, wazero.NewModuleConfig().
+		WithName("").
+		WithStartFunctions("_initialize"))
+}
+
+// acquire returns an idle instance, or a new one if all are busy.
+func (t *wasmTransformer) acquire(ctx context.Context) (api.Module, error) {
+	select {
+	case mod := <-t.idle:
+		return mod, nil
+	default:
+		return t.instantiate(ctx)
+	}
+}
+
+func (t *wasmTransformer) release(mod api.Module) {
+	select {
+	case t.idle <- mod:
+	default:
+		mod.Close(context.Background())
+	}
+}
+
+func (t *wasmTransformer) Transform(r *Record) (bool, error) {
+	in, err := json.Marshal(wasmInput{
+		Stats:     r.Raw,
+		Record:    r.Data,
+		Appliance: wasmAppliance{Host: r.Appliance.HostName, IP: r.Appliance.IP},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+	defer cancel()
+	mod, err := t.acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+	out, err := t.call(ctx, mod, in)
+	if err != nil {
+		// A trapped or timed-out instance can't be trusted again.
+		mod.Close(context.Background())
+		return false, err
+	}
+	t.release(mod)
+
+	var res wasmOutput
+	if err := json.Unmarshal(out, &res); err != nil {
+		return false, fmt.Errorf("plugin output: %w", err)
+	}
+	switch {
+	case res.Error != "":
+		return false, errors.New(res.Error)
+	case res.Drop:
+		return false, nil
+	case res.Record == nil:
+		return false, errors.New("plugin returned neither record, drop nor error")
+	}
+	r.Data = *res.Record
+	return true, nil
+}
+
+func (t *wasmTransformer) call(ctx context.Context, mod api.Module, in []byte) ([]byte, error) {
+	res, err := mod.ExportedFunction("alloc").Call(ctx, uint64(len(in)))
+	if err != nil {
+		return nil, fmt.Errorf("alloc: %w", err)
+	}
+	inPtr := uint32(res[0])
+	if !mod.Memory().Write(inPtr, in) {
+		return nil, errors.New("alloc returned a buffer outside memory")
+	}
+
+	res, err = mod.ExportedFunction("transform").Call(ctx, uint64(inPtr), uint64(len(in)))
+	if err != nil {
+		return nil, fmt.Errorf("transform: %w", err)
+	}
+	outPtr, outLen := uint32(res[0]>>32), uint32(res[0])
+	view, ok := mod.Memory().Read(outPtr, outLen)
+	if !ok {
+		return nil, errors.New("transform returned a buffer outside memory")
+	}
+	out := append([]byte(nil), view...)
+
+	if free := mod.ExportedFunction("free"); free != nil {
+		if _, err := free.Call(ctx, uint64(inPtr), uint64(len(in))); err != nil {
+			return nil, fmt.Errorf("free: %w", err)
+		}
+		if _, err := free.Call(ctx, uint64(outPtr), uint64(outLen)); err != nil {
+			return nil, fmt.Errorf("free: %w", err)
+		}
+	}
+	return out, nil
+}
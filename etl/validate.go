@@ -0,0 +1,347 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//////////////////////////////////////////////////
+// Validate Config Command
+//////////////////////////////////////////////////
+
+const validateConfigUsage = `usage: etl [flags] validate-config [-check-endpoints] [-timeout 5s]
+
+Checks the configuration file for unknown keys and invalid values, the input
+CSV and the transform chain's lookup tables and scripts. With
+-check-endpoints it also connects to the load API and every other endpoint
+the configured sinks, spill store and tracing use. Exits non-zero if
+anything is wrong.`
+
+// runValidateConfigCommand reports every problem with the configuration:
+// loadErr, what loadConfig found, and the checks that need more than the
+// values themselves.
+func runValidateConfigCommand(loadErr error, args []string) error {
+	fs := flag.NewFlagSet("validate-config", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprintln(fs.Output(), validateConfigUsage) }
+	checkEndpoints := fs.Bool("check-endpoints", false, "connect to every configured endpoint")
+	timeout := fs.Duration("timeout", 5*time.Second, "connect timeout per endpoint")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return errors.New(validateConfigUsage)
+	}
+
+	problems := flattenErrors(loadErr)
+	var warnings []string
+	if cfg.Discovery.Type == "csv" {
+		csvProblems, csvWarnings := checkApplianceCSV(cfg.InputFile)
+		problems = append(problems, csvProblems...)
+		warnings = append(warnings, csvWarnings...)
+	}
+	if dir := filepath.Dir(cfg.LogFile); !isDir(dir) {
+		problems = append(problems, fmt.Errorf("log_file %s: directory %s does not exist", cfg.LogFile, dir))
+	}
+	// Resolving the secrets first lets the checks below use them.
+	if loadErr == nil {
+		if err := resolveSecrets(); err != nil {
+			problems = append(problems, flattenErrors(err)...)
+		}
+	}
+	if _, err := newSpillCrypter(cfg.Load.SpillKey, cfg.Load.SpillOldKey); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := cfg.Load.HTTPClient.TLS.build(); err != nil {
+		problems = append(problems, fmt.Errorf("load.http_client.tls: %w", err))
+	}
+	// Building the chain reads the enrichment lookups and compiles the
+	// expressions, scripts and plugins, as a run would at startup.
+	if loadErr == nil {
+		if _, err := newTransformChain(cfg.Transform); err != nil {
+			problems = append(problems, fmt.Errorf("transform.chain: %w", err))
+		}
+	}
+	if cfg.Validation.Enabled {
+		if _, _, err := compileSchemas(cfg.Validation); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	// Files other than the CSV, checked above, are read as a run would.
+	source := cfg.Discovery.Type
+	if loadErr == nil {
+		if src, err := newApplianceSource(cfg); err != nil {
+			problems = append(problems, fmt.Errorf("discovery: %w", err))
+		} else {
+			source = src.Name()
+			if _, file := src.(FileSource); file && cfg.Discovery.Type != "csv" {
+				if appliances, err := src.Appliances(context.Background()); err != nil {
+					problems = append(problems, fmt.Errorf("input_file %s: %w", src.Name(), err))
+				} else if len(appliances) == 0 {
+					problems = append(problems, fmt.Errorf("input_file %s lists no appliances", src.Name()))
+				}
+			}
+			closeSource(src)
+		}
+	}
+	if *checkEndpoints {
+		for _, ep := range configEndpoints(cfg) {
+			if err := dialEndpoint(ep.addr, *timeout); err != nil {
+				problems = append(problems, fmt.Errorf("%s %s is unreachable: %w", ep.key, ep.addr, err))
+			}
+		}
+	}
+
+	for _, w := range warnings {
+		fmt.Println("warning:", w)
+	}
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Println("error:", p)
+		}
+		return fmt.Errorf("configuration has %d problem(s)", len(problems))
+	}
+	fmt.Printf("Configuration OK: extract %s from %s, load into %s\n",
+		cfg.Extract.Type, source, strings.Join(cfg.Load.sinkList(), ", "))
+	return nil
+}
+
+// flattenErrors splits joined errors into the errors they are made of.
+func flattenErrors(err error) []error {
+	if err == nil {
+		return nil
+	}
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return []error{err}
+	}
+	var errs []error
+	for _, e := range joined.Unwrap() {
+		errs = append(errs, flattenErrors(e)...)
+	}
+	return errs
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// checkApplianceCSV reads the appliance CSV the way a run does. Lines a
+// run would skip, or that look wrong, are warnings; a file that can't be
+// read, lists no appliance or names unknown credentials is a problem.
+func checkApplianceCSV(path string) (problems []error, warnings []string) {
+	f, err := os.Open(path)
+	if err != nil {
+		return []error{fmt.Errorf("input_file: %w", err)}, nil
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	seen := map[string]int{}
+	appliances := 0
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return append(problems, fmt.Errorf("input_file %s: %w", path, err)), warnings
+		}
+		line, _ := r.FieldPos(0)
+		if len(rec) < 2 {
+			warnings = append(warnings, fmt.Sprintf("input_file %s:%d: want ip,hostname[,credentials[,priority]], got %d field(s); the line is skipped", path, line, len(rec)))
+			continue
+		}
+		appliances++
+		ip := strings.TrimSpace(rec[0])
+		if net.ParseIP(ip) == nil {
+			warnings = append(warnings, fmt.Sprintf("input_file %s:%d: %q is not an IP address", path, line, ip))
+		}
+		if len(rec) > 2 {
+			if _, err := applianceCredentials(strings.TrimSpace(rec[2])); err != nil {
+				problems = append(problems, fmt.Errorf("input_file %s:%d: %w", path, line, err))
+			}
+		}
+		if len(rec) > 3 {
+			if _, err := parsePriority(strings.TrimSpace(rec[3])); err != nil {
+				warnings = append(warnings, fmt.Sprintf("input_file %s:%d: %v; it is extracted as normal", path, line, err))
+			}
+		}
+		if first, ok := seen[ip]; ok {
+			warnings = append(warnings, fmt.Sprintf("input_file %s:%d: %s is already listed on line %d", path, line, ip, first))
+		} else {
+			seen[ip] = line
+		}
+	}
+	if appliances == 0 {
+		problems = append(problems, fmt.Errorf("input_file %s lists no appliances (want ip,hostname lines)", path))
+	}
+	return problems, warnings
+}
+
+// configEndpoint is a network address the configuration makes the ETL
+// connect to, with the key it is configured under.
+type configEndpoint struct {
+	key  string
+	addr string // host:port
+}
+
+// configEndpoints returns the endpoints of the selected sinks, the spill
+// store, tracing and discovery. Endpoints left unset are skipped.
+func configEndpoints(c *Config) []configEndpoint {
+	var eps []configEndpoint
+	addURL := func(key, raw string) {
+		if raw == "" {
+			return
+		}
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" {
+			return // Validate already reports malformed URLs
+		}
+		port := u.Port()
+		if port == "" {
+			port = "80"
+			if u.Scheme == "https" {
+				port = "443"
+			}
+		}
+		eps = append(eps, configEndpoint{key, net.JoinHostPort(u.Hostname(), port)})
+	}
+
+	for _, sink := range c.Load.sinkList() {
+		switch sink {
+		case "http":
+			addURL("api.endpoint", c.API.Endpoint)
+		case "kafka":
+			for i, b := range c.Sinks.Kafka.Brokers {
+				eps = append(eps, configEndpoint{fmt.Sprintf("sinks.kafka.brokers[%d]", i), b})
+			}
+			addURL("sinks.kafka.schema_registry.url", c.Sinks.Kafka.SchemaRegistry.URL)
+		case "elasticsearch":
+			addURL("sinks.elasticsearch.url", c.Sinks.Elasticsearch.URL)
+		case "prometheus":
+			addURL("sinks.prometheus.url", c.Sinks.Prometheus.URL)
+		case "otlp":
+			addURL("sinks.otlp.url", c.Sinks.OTLP.URL)
+		case "nats":
+			for i, raw := range c.Sinks.NATS.URLs {
+				if u, err := url.Parse(raw); err == nil && u.Hostname() != "" {
+					port := cmp.Or(u.Port(), "4222")
+					eps = append(eps, configEndpoint{fmt.Sprintf("sinks.nats.urls[%d]", i), net.JoinHostPort(u.Hostname(), port)})
+				}
+			}
+		case "mqtt":
+			for i, raw := range c.Sinks.MQTT.Brokers {
+				if u, err := url.Parse(raw); err == nil && u.Hostname() != "" {
+					port := u.Port()
+					if port == "" {
+						switch u.Scheme {
+						case "ssl", "tls", "mqtts":
+							port = "8883"
+						case "ws":
+							port = "80"
+						case "wss":
+							port = "443"
+						default:
+							port = "1883"
+						}
+					}
+					eps = append(eps, configEndpoint{fmt.Sprintf("sinks.mqtt.brokers[%d]", i), net.JoinHostPort(u.Hostname(), port)})
+				}
+			}
+		case "clickhouse":
+			for i, addr := range c.Sinks.ClickHouse.Addrs {
+				eps = append(eps, configEndpoint{fmt.Sprintf("sinks.clickhouse.addrs[%d]", i), addr})
+			}
+		case "s3":
+			scheme := "https://"
+			if c.Sinks.S3.Insecure {
+				scheme = "http://"
+			}
+			addURL("sinks.s3.endpoint", scheme+c.Sinks.S3.Endpoint)
+		case "kinesis":
+			// Without an endpoint the SDK resolves the region's, which
+			// may come from the environment.
+			if k := c.Sinks.Kinesis; k.Endpoint != "" {
+				addURL("sinks.kinesis.endpoint", k.Endpoint)
+			} else if k.Region != "" {
+				service := "kinesis"
+				if k.Service == "firehose" {
+					service = "firehose"
+				}
+				eps = append(eps, configEndpoint{"sinks.kinesis.region", service + "." + k.Region + ".amazonaws.com:443"})
+			}
+		case "pubsub":
+			switch {
+			case os.Getenv("PUBSUB_EMULATOR_HOST") != "":
+				eps = append(eps, configEndpoint{"PUBSUB_EMULATOR_HOST", os.Getenv("PUBSUB_EMULATOR_HOST")})
+			case c.Sinks.PubSub.Endpoint != "":
+				eps = append(eps, configEndpoint{"sinks.pubsub.endpoint", c.Sinks.PubSub.Endpoint})
+			default:
+				eps = append(eps, configEndpoint{"sinks.pubsub.endpoint", "pubsub.googleapis.com:443"})
+			}
+		case "grpc":
+			// Targets with a resolver scheme, like dns:///host:port, are
+			// left to gRPC.
+			if !strings.Contains(c.Sinks.GRPC.Target, "://") {
+				eps = append(eps, configEndpoint{"sinks.grpc.target", c.Sinks.GRPC.Target})
+			}
+		}
+	}
+	switch c.Load.SpillStore {
+	case "redis":
+		eps = append(eps, configEndpoint{"load.redis.addr", c.Load.Redis.Addr})
+	case "s3":
+		scheme := "https://"
+		if c.Load.S3.Insecure {
+			scheme = "http://"
+		}
+		addURL("load.s3.endpoint", scheme+c.Load.S3.Endpoint)
+	case "gcs":
+		if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+			if !strings.Contains(host, "://") {
+				host = "http://" + host
+			}
+			addURL("STORAGE_EMULATOR_HOST", host)
+		} else {
+			eps = append(eps, configEndpoint{"load.gcs.bucket", "storage.googleapis.com:443"})
+		}
+	}
+	if c.Cluster.Mode == "redis" {
+		eps = append(eps, configEndpoint{"cluster.redis.addr", c.Cluster.Redis.Addr})
+	}
+	if c.Tracing.Enabled {
+		eps = append(eps, configEndpoint{"tracing.endpoint", c.Tracing.Endpoint})
+	}
+	switch c.Discovery.Type {
+	case "http":
+		addURL("discovery.http.url", c.Discovery.HTTP.URL)
+	case "consul":
+		addURL("discovery.consul.address", c.Discovery.Consul.address())
+	case "kubernetes":
+		if server, err := c.Discovery.Kubernetes.apiServer(); err == nil {
+			addURL("discovery.kubernetes.api_server", server)
+		}
+	}
+	return eps
+}
+
+func dialEndpoint(addr string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
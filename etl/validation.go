@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+//////////////////////////////////////////////////
+// Schema Validation
+//////////////////////////////////////////////////
+
+// ValidationConfig checks records against JSON Schemas before they are
+// loaded. Invalid ones are written to the rejects file with the reasons,
+// instead of reaching the sinks.
+type ValidationConfig struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// StatsSchema is checked against the CPU stats of an appliance as
+	// extracted, before the transform chain, and RecordSchema against every
+	// record after it, CPU and other metrics alike. Empty uses the built-in
+	// schemas, which match what the load API accepts.
+	StatsSchema  string `yaml:"stats_schema" json:"stats_schema"`
+	RecordSchema string `yaml:"record_schema" json:"record_schema"`
+	// RejectsFile gets a JSON line per invalid record; it is appended to
+	// across runs.
+	RejectsFile string `yaml:"rejects_file" json:"rejects_file"`
+}
+
+func defaultValidationConfig() ValidationConfig {
+	return ValidationConfig{RejectsFile: "rejects.jsonl"}
+}
+
+func (v *ValidationConfig) validate() []error {
+	if v.Enabled && v.RejectsFile == "" {
+		return []error{errors.New("validation.rejects_file must be set when validation is enabled")}
+	}
+	return nil
+}
+
+//go:embed schemas/stats.schema.json
+var statsSchemaJSON []byte
+
+//go:embed schemas/record.schema.json
+var recordSchemaJSON []byte
+
+// Where a record was found invalid.
+const (
+	rejectStats  = "stats"  // as extracted
+	rejectRecord = "record" // after the transform chain
+)
+
+// Reject is a line of the rejects file, or of the quality quarantine file.
+type Reject struct {
+	Time      time.Time       `json:"time"`
+	RunID     string          `json:"run_id"`
+	Appliance string          `json:"appliance"`
+	IP        string          `json:"ip,omitempty"`
+	Stage     string          `json:"stage"`
+	Errors    []string        `json:"errors"`
+	Record    json.RawMessage `json:"record"`
+}
+
+// SchemaValidator checks CPU stats and records against their schemas. It is
+// safe for concurrent use by the extract workers.
+type SchemaValidator struct {
+	stats   *jsonschema.Schema
+	record  *jsonschema.Schema
+	rejects *rejectLog
+}
+
+// validator is nil unless validation is enabled.
+var validator *SchemaValidator
+
+// compileSchemas compiles the configured schemas, or the built-in ones.
+func compileSchemas(conf ValidationConfig) (stats, record *jsonschema.Schema, err error) {
+	compile := func(key, file string, builtin []byte) (*jsonschema.Schema, error) {
+		c := jsonschema.NewCompiler()
+		loc := file
+		if file == "" {
+			doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(builtin))
+			if err != nil {
+				return nil, err
+			}
+			loc = "builtin:" + key + ".schema.json"
+			if err := c.AddResource(loc, doc); err != nil {
+				return nil, err
+			}
+		}
+		sch, err := c.Compile(loc)
+		if err != nil {
+			return nil, fmt.Errorf("validation.%s_schema: %w", key, err)
+		}
+		return sch, nil
+	}
+	if stats, err = compile("stats", conf.StatsSchema, statsSchemaJSON); err != nil {
+		return nil, nil, err
+	}
+	if record, err = compile("record", conf.RecordSchema, recordSchemaJSON); err != nil {
+		return nil, nil, err
+	}
+	return stats, record, nil
+}
+
+func newSchemaValidator(conf ValidationConfig) (*SchemaValidator, error) {
+	stats, record, err := compileSchemas(conf)
+	if err != nil {
+		return nil, err
+	}
+	rejects, err := openRejectLog(conf.RejectsFile)
+	if err != nil {
+		return nil, err
+	}
+	return &SchemaValidator{stats: stats, record: record, rejects: rejects}, nil
+}
+
+func (v *SchemaValidator) Close() error {
+	if v == nil {
+		return nil
+	}
+	return v.rejects.Close()
+}
+
+// Stats reports whether the CPU stats of ap are valid, rejecting them if
+// not. A nil validator accepts everything.
+func (v *SchemaValidator) Stats(ap Appliance, stats *CpuStats) bool {
+	if v == nil {
+		return true
+	}
+	return v.check(ap, rejectStats, v.stats, stats)
+}
+
+// Record reports whether a record of ap is valid, rejecting it if not.
+func (v *SchemaValidator) Record(ap Appliance, d DeviceData) bool {
+	if v == nil {
+		return true
+	}
+	return v.check(ap, rejectRecord, v.record, d)
+}
+
+func (v *SchemaValidator) check(ap Appliance, stage string, sch *jsonschema.Schema, record any) bool {
+	body, err := json.Marshal(record)
+	if err == nil {
+		var doc any
+		if doc, err = jsonschema.UnmarshalJSON(bytes.NewReader(body)); err == nil {
+			err = sch.Validate(doc)
+		}
+	}
+	if err == nil {
+		return true
+	}
+
+	problems := []string{err.Error()}
+	var verr *jsonschema.ValidationError
+	if errors.As(err, &verr) {
+		problems = validationProblems(verr)
+	}
+	runStats.Rejected.Add(1)
+	slog.Debug("Record failed validation", "component", "validation", "appliance", ap.HostName,
+		"stage", stage, "errors", strings.Join(problems, "; "))
+	v.rejects.write("validation", Reject{Time: time.Now().UTC(), RunID: runStats.RunID, Appliance: ap.HostName, IP: ap.IP,
+		Stage: stage, Errors: problems, Record: body})
+	return false
+}
+
+// rejectLog appends Reject lines to a file, across runs.
+type rejectLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func openRejectLog(path string) (*rejectLog, error) {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &rejectLog{f: f}, nil
+}
+
+// write appends r as a single line, so concurrent writers never
+// interleave. component tags the log of a failed write.
+func (l *rejectLog) write(component string, r Reject) {
+	line, err := json.Marshal(r)
+	if err != nil {
+		slog.Error("Failed to encode rejected record", "component", component, "error", err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.f.Write(append(line, '\n')); err != nil {
+		slog.Error("Failed to write rejected record", "component", component, "appliance", r.Appliance, "file", l.f.Name(), "error", err)
+	}
+}
+
+func (l *rejectLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+var validationPrinter = message.NewPrinter(language.English)
+
+// validationProblems flattens a validation error into one message per
+// failed keyword, prefixed with the location of the offending value, e.g.
+// "/indicators/0/value: got string, want number".
+func validationProblems(err *jsonschema.ValidationError) []string {
+	var problems []string
+	var walk func(e *jsonschema.ValidationError)
+	walk = func(e *jsonschema.ValidationError) {
+		if len(e.Causes) == 0 {
+			problems = append(problems, "/"+strings.Join(e.InstanceLocation, "/")+": "+e.ErrorKind.LocalizedString(validationPrinter))
+			return
+		}
+		for _, c := range e.Causes {
+			walk(c)
+		}
+	}
+	walk(err)
+	slices.Sort(problems)
+	return slices.Compact(problems)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Config is the server's behaviour, from -config and the flags. Faults,
+// Latency and RateLimit can also be changed at runtime under /admin.
+type Config struct {
+	Faults    Faults    `json:"faults"`
+	Latency   Latency   `json:"latency"`
+	RateLimit RateLimit `json:"rate_limit"`
+	// Token, when set, is required in the Authorization header of /load,
+	// alone or after "Bearer ".
+	Token string `json:"token"`
+	// Validate checks every batch against Schema (the built-in batch
+	// schema if empty) and requires a Content-Type.
+	Validate bool   `json:"validate"`
+	Schema   string `json:"schema"`
+	Record   Record `json:"record"`
+	// IdempotencyTTL is how long the Idempotency-Key of an accepted batch
+	// is remembered; 0 ignores the header.
+	IdempotencyTTL jsonDuration `json:"idempotency_ttl"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Faults:         Faults{RetryAfter: 1, SlowDelay: jsonDuration(10 * time.Second)},
+		Latency:        defaultLatency(),
+		IdempotencyTTL: jsonDuration(24 * time.Hour),
+	}
+}
+
+// loadConfig reads the JSON config file at path into c. Flags set on the
+// command line win over the file.
+func loadConfig(path string, c *Config) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	set := map[string]string{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = f.Value.String() })
+	if err := json.Unmarshal(raw, c); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for name, value := range set {
+		flag.Set(name, value)
+	}
+	return nil
+}
+
+func (c Config) validate() error {
+	if err := c.Faults.validate(); err != nil {
+		return err
+	}
+	if err := c.Record.validate(); err != nil {
+		return err
+	}
+	if err := c.RateLimit.validate(); err != nil {
+		return err
+	}
+	if c.IdempotencyTTL < 0 {
+		return fmt.Errorf("idempotency_ttl must not be negative, got %s", c.IdempotencyTTL)
+	}
+	return c.Latency.validate()
+}
+
+// jsonDuration is a time.Duration written as a string such as "1.5s" in
+// JSON. It is also a flag.Value.
+type jsonDuration time.Duration
+
+func (d jsonDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *jsonDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
+
+func (d jsonDuration) String() string { return time.Duration(d).String() }
+
+func (d *jsonDuration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = jsonDuration(v)
+	return nil
+}
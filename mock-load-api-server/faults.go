@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Faults are the failures injected into POST /load, each as the fraction
+// of requests it hits, so the ETL's retries, backoff and spilling can be
+// exercised.
+type Faults struct {
+	ErrorRate    float64      `json:"error_rate"`    // answered 500
+	ThrottleRate float64      `json:"throttle_rate"` // answered 429 with Retry-After
+	RetryAfter   int          `json:"retry_after"`   // seconds, sent with the 429s
+	ResetRate    float64      `json:"reset_rate"`    // connection reset, no response
+	SlowRate     float64      `json:"slow_rate"`     // answered SlowDelay late
+	SlowDelay    jsonDuration `json:"slow_delay"`
+}
+
+func (f Faults) validate() error {
+	for name, rate := range map[string]float64{
+		"error_rate": f.ErrorRate, "throttle_rate": f.ThrottleRate,
+		"reset_rate": f.ResetRate, "slow_rate": f.SlowRate,
+	} {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("%s must be between 0 and 1, got %v", name, rate)
+		}
+	}
+	if f.ErrorRate+f.ThrottleRate+f.ResetRate > 1 {
+		return errors.New("error_rate, throttle_rate and reset_rate add up to more than 1")
+	}
+	if f.RetryAfter < 0 || f.SlowDelay < 0 {
+		return errors.New("retry_after and slow_delay must be >= 0")
+	}
+	return nil
+}
+
+// faults holds the current Faults; /admin/faults changes them at runtime.
+var faults struct {
+	sync.Mutex
+	f Faults
+}
+
+func currentFaults() Faults {
+	faults.Lock()
+	defer faults.Unlock()
+	return faults.f
+}
+
+func setFaults(f Faults) {
+	faults.Lock()
+	defer faults.Unlock()
+	faults.f = f
+}
+
+// injectFault applies the configured faults to a /load request. It returns
+// true if the request was failed and must not be handled further.
+func injectFault(ctx *fasthttp.RequestCtx) bool {
+	f := currentFaults()
+	if f.SlowRate > 0 && rand.Float64() < f.SlowRate {
+		log.Printf("Injected fault: delaying POST /load by %s", time.Duration(f.SlowDelay))
+		time.Sleep(time.Duration(f.SlowDelay))
+	}
+
+	r := rand.Float64()
+	switch {
+	case r < f.ResetRate:
+		log.Printf("Injected fault: resetting connection from %s", ctx.RemoteAddr())
+		if tcp, ok := ctx.Conn().(*net.TCPConn); ok {
+			tcp.SetLinger(0) // close with RST instead of FIN
+		}
+		ctx.Conn().Close()
+		ctx.SetUserValue(connResetKey, true)
+		return true
+	case r < f.ResetRate+f.ErrorRate:
+		log.Printf("Injected fault: 500 for POST /load")
+		jsonError(ctx, fasthttp.StatusInternalServerError, "injected_failure", "injected failure")
+		return true
+	case r < f.ResetRate+f.ErrorRate+f.ThrottleRate:
+		log.Printf("Injected fault: 429 for POST /load, Retry-After %d", f.RetryAfter)
+		jsonError(ctx, fasthttp.StatusTooManyRequests, "rate_limited", "injected throttling")
+		ctx.Response.Header.Set("Retry-After", strconv.Itoa(f.RetryAfter))
+		return true
+	}
+	return false
+}
+
+// handleFaults serves GET /admin/faults, the current faults, and PUT
+// /admin/faults, which changes the fields in the body and leaves the rest.
+func handleFaults(ctx *fasthttp.RequestCtx) {
+	f := currentFaults()
+	if ctx.IsPut() {
+		if err := json.Unmarshal(ctx.PostBody(), &f); err != nil {
+			ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+			return
+		}
+		if err := f.validate(); err != nil {
+			ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+			return
+		}
+		setFaults(f)
+		log.Printf("Faults changed: %+v", f)
+	}
+	body, _ := json.Marshal(f)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(body)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	_ "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// serveGRPC serves the Load service of proto/device_data.proto on addr, for
+// the ETL's grpc sink. Batches are handled like POST /load: the token,
+// error and throttle faults, latency, recording and idempotency apply, with
+// the batch_id as the Idempotency-Key.
+func serveGRPC(addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s := grpc.NewServer(grpc.ForceServerCodec(rawCodec{}))
+	s.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "concurrentetl.v1.Load",
+		HandlerType: (*any)(nil),
+		Streams:     []grpc.StreamDesc{{StreamName: "Load", Handler: handleGRPCLoad, ClientStreams: true}},
+	}, struct{}{})
+	return s.Serve(lis)
+}
+
+func handleGRPCLoad(_ any, stream grpc.ServerStream) (err error) {
+	start := time.Now()
+	var size int
+	defer func() { observe(status.Code(err).String(), size, time.Since(start)) }()
+	if err := grpcFault(); err != nil {
+		return err
+	}
+	if loadToken != "" {
+		md, _ := metadata.FromIncomingContext(stream.Context())
+		got := ""
+		if v := md.Get("authorization"); len(v) > 0 {
+			got = v[0]
+		}
+		if subtle.ConstantTimeCompare([]byte(got), []byte(loadToken)) != 1 &&
+			subtle.ConstantTimeCompare([]byte(got), []byte("Bearer "+loadToken)) != 1 {
+			log.Printf("Rejected gRPC Load: missing or wrong authorization")
+			return status.Error(codes.Unauthenticated, "missing or invalid authorization metadata")
+		}
+	}
+
+	var records []DeviceData
+	var batchID string
+	for {
+		var msg []byte
+		err := stream.RecvMsg(&msg)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		size += len(msg)
+		chunk, err := decodeBatchProto(msg)
+		if err != nil {
+			log.Printf("Rejected gRPC Load: %v", err)
+			return status.Errorf(codes.InvalidArgument, "cannot decode LoadRequest: %v", err)
+		}
+		records = append(records, chunk...)
+		walkProto(msg, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+			if num == 2 && typ == protowire.BytesType {
+				batchID = string(v)
+			}
+			return nil
+		})
+	}
+	log.Printf("Received gRPC Load of %d records, %d bytes, batch %s", len(records), size, batchID)
+
+	if first, ok := acceptedAt(batchID); ok {
+		log.Printf("Duplicate gRPC Load of batch %s, first accepted at %s", batchID, first.UTC().Format(time.RFC3339Nano))
+		countDuplicate()
+		return stream.SendMsg(loadResponse(len(records)))
+	}
+	time.Sleep(currentLatency().sample())
+
+	items := make([]json.RawMessage, len(records))
+	for i, d := range records {
+		items[i], _ = json.Marshal(d)
+	}
+	if err := recordBatch(items, "application/grpc"); err != nil {
+		log.Printf("Cannot record batch: %v", err)
+		return status.Errorf(codes.Internal, "record failed: %v", err)
+	}
+	rememberKey(batchID)
+	countRecords(len(records))
+	return stream.SendMsg(loadResponse(len(records)))
+}
+
+// loadResponse encodes a LoadResponse.
+func loadResponse(accepted int) []byte {
+	b := protowire.AppendTag(nil, 1, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(accepted))
+}
+
+// grpcFault applies the error and throttle faults to a gRPC Load, as
+// UNAVAILABLE and RESOURCE_EXHAUSTED.
+func grpcFault() error {
+	f := currentFaults()
+	r := rand.Float64()
+	switch {
+	case r < f.ErrorRate:
+		log.Printf("Injected fault: UNAVAILABLE for gRPC Load")
+		return status.Error(codes.Unavailable, "injected failure")
+	case r < f.ErrorRate+f.ThrottleRate:
+		log.Printf("Injected fault: RESOURCE_EXHAUSTED for gRPC Load")
+		return status.Error(codes.ResourceExhausted, "injected throttling")
+	}
+	return nil
+}
+
+// rawCodec passes messages through as bytes, decoded with protowire.
+type rawCodec struct{}
+
+func (rawCodec) Name() string {
+	return "proto"
+}
+
+func (rawCodec) Marshal(v any) ([]byte, error) {
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("cannot marshal %T", v)
+	}
+	return b, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v any) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("cannot unmarshal into %T", v)
+	}
+	*b = append((*b)[:0], data...)
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// idempotencyKeys are the Idempotency-Key headers of the accepted batches,
+// with when each was first accepted. A repeated key is answered like the
+// first request without the batch being counted or recorded again.
+var idempotencyKeys = struct {
+	sync.Mutex
+	ttl    time.Duration // how long keys are kept; 0 ignores the header
+	seen   map[string]time.Time
+	pruned time.Time
+}{seen: map[string]time.Time{}}
+
+func setIdempotencyTTL(ttl time.Duration) {
+	idempotencyKeys.Lock()
+	defer idempotencyKeys.Unlock()
+	idempotencyKeys.ttl = ttl
+}
+
+// duplicateBatch answers a request whose Idempotency-Key was accepted
+// within the TTL, and reports whether it did.
+func duplicateBatch(ctx *fasthttp.RequestCtx) bool {
+	key := string(ctx.Request.Header.Peek("Idempotency-Key"))
+	first, ok := acceptedAt(key)
+	if !ok {
+		return false
+	}
+
+	log.Printf("Duplicate POST /load with Idempotency-Key %s, first accepted at %s", key, first.UTC().Format(time.RFC3339Nano))
+	countDuplicate()
+	ctx.Response.Header.Set("Idempotent-Replayed", "true")
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.SetBody([]byte(`{"status":"success","duplicate":true}`))
+	return true
+}
+
+// acceptedAt returns when the batch with key was accepted, if within the
+// TTL.
+func acceptedAt(key string) (time.Time, bool) {
+	if key == "" {
+		return time.Time{}, false
+	}
+	idempotencyKeys.Lock()
+	defer idempotencyKeys.Unlock()
+	first, ok := idempotencyKeys.seen[key]
+	return first, ok && time.Since(first) < idempotencyKeys.ttl
+}
+
+// rememberBatch keeps the Idempotency-Key of an accepted batch.
+func rememberBatch(ctx *fasthttp.RequestCtx) {
+	rememberKey(string(ctx.Request.Header.Peek("Idempotency-Key")))
+}
+
+// rememberKey keeps the key of an accepted batch. Expired keys are dropped
+// at most once per TTL.
+func rememberKey(key string) {
+	if key == "" {
+		return
+	}
+	idempotencyKeys.Lock()
+	defer idempotencyKeys.Unlock()
+	if idempotencyKeys.ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	if now.Sub(idempotencyKeys.pruned) >= idempotencyKeys.ttl {
+		for k, at := range idempotencyKeys.seen {
+			if now.Sub(at) >= idempotencyKeys.ttl {
+				delete(idempotencyKeys.seen, k)
+			}
+		}
+		idempotencyKeys.pruned = now
+	}
+	idempotencyKeys.seen[key] = now
+}
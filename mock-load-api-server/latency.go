@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Latency is how long POST /load takes to answer, drawn per request from a
+// distribution:
+//
+//	fixed    always Delay
+//	uniform  between Min and Max
+//	normal   around Delay, with StdDev
+//	pareto   Min or more, a long tail whose weight Shape sets (lower is heavier)
+//
+// Max, if set, also caps normal and pareto draws.
+type Latency struct {
+	Distribution string       `json:"distribution"`
+	Delay        jsonDuration `json:"delay"`
+	Min          jsonDuration `json:"min"`
+	Max          jsonDuration `json:"max"`
+	StdDev       jsonDuration `json:"stddev"`
+	Shape        float64      `json:"shape"`
+}
+
+func defaultLatency() Latency {
+	return Latency{
+		Distribution: "fixed",
+		Delay:        jsonDuration(2 * time.Second),
+		Shape:        1.5,
+	}
+}
+
+func (l Latency) validate() error {
+	if l.Delay < 0 || l.Min < 0 || l.Max < 0 || l.StdDev < 0 {
+		return errors.New("latency durations must be >= 0")
+	}
+	switch l.Distribution {
+	case "fixed", "normal":
+	case "uniform":
+		if l.Max < l.Min {
+			return fmt.Errorf("uniform latency: max %s is below min %s", time.Duration(l.Max), time.Duration(l.Min))
+		}
+	case "pareto":
+		if l.Min <= 0 || l.Shape <= 0 {
+			return errors.New("pareto latency: min and shape must be > 0")
+		}
+	default:
+		return fmt.Errorf("latency distribution must be fixed, uniform, normal or pareto, got %q", l.Distribution)
+	}
+	return nil
+}
+
+// sample draws the delay of one request.
+func (l Latency) sample() time.Duration {
+	var d float64
+	switch l.Distribution {
+	case "fixed":
+		d = float64(l.Delay)
+	case "uniform":
+		d = float64(l.Min) + rand.Float64()*float64(l.Max-l.Min)
+	case "normal":
+		d = float64(l.Delay) + rand.NormFloat64()*float64(l.StdDev)
+	case "pareto":
+		// Inverse transform sampling; 1-U is in (0, 1].
+		d = float64(l.Min) / math.Pow(1-rand.Float64(), 1/l.Shape)
+	}
+	if l.Max > 0 && d > float64(l.Max) {
+		d = float64(l.Max)
+	}
+	return time.Duration(max(d, 0))
+}
+
+// latency holds the current Latency; /admin/latency changes it at runtime.
+var latency struct {
+	sync.Mutex
+	l Latency
+}
+
+func currentLatency() Latency {
+	latency.Lock()
+	defer latency.Unlock()
+	return latency.l
+}
+
+func setLatency(l Latency) {
+	latency.Lock()
+	defer latency.Unlock()
+	latency.l = l
+}
+
+// handleLatency serves GET /admin/latency, the current latency, and PUT
+// /admin/latency, which changes the fields in the body and leaves the rest.
+func handleLatency(ctx *fasthttp.RequestCtx) {
+	l := currentLatency()
+	if ctx.IsPut() {
+		if err := json.Unmarshal(ctx.PostBody(), &l); err != nil {
+			ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+			return
+		}
+		if err := l.validate(); err != nil {
+			ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+			return
+		}
+		setLatency(l)
+		log.Printf("Latency changed: %s", l)
+	}
+	body, _ := json.Marshal(l)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(body)
+}
+
+func (l Latency) String() string {
+	switch l.Distribution {
+	case "fixed":
+		return fmt.Sprintf("fixed %s", time.Duration(l.Delay))
+	case "uniform":
+		return fmt.Sprintf("uniform %s-%s", time.Duration(l.Min), time.Duration(l.Max))
+	case "normal":
+		return fmt.Sprintf("normal %s±%s", time.Duration(l.Delay), time.Duration(l.StdDev))
+	default:
+		return fmt.Sprintf("%s min %s shape %g", l.Distribution, time.Duration(l.Min), l.Shape)
+	}
+}
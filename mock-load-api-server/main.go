@@ -1,15 +1,71 @@
 package main
 
 import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
+	"mime"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/tinylib/msgp/msgp"
 	"github.com/valyala/fasthttp"
 )
 
 func main() {
+	cfg := defaultConfig()
+	addr := flag.String("addr", ":8080", "listen address")
+	grpcAddr := flag.String("grpc-addr", "", "also serve the gRPC Load service on this address")
+	configFile := flag.String("config", "", "JSON file with faults and latency; flags win over it")
+	f, l := &cfg.Faults, &cfg.Latency
+	flag.Float64Var(&f.ErrorRate, "error-rate", f.ErrorRate, "fraction of /load requests answered 500")
+	flag.Float64Var(&f.ThrottleRate, "throttle-rate", f.ThrottleRate, "fraction of /load requests answered 429")
+	flag.IntVar(&f.RetryAfter, "retry-after", f.RetryAfter, "Retry-After seconds sent with the 429s")
+	flag.Float64Var(&f.ResetRate, "reset-rate", f.ResetRate, "fraction of /load connections reset without a response")
+	flag.Float64Var(&f.SlowRate, "slow-rate", f.SlowRate, "fraction of /load requests answered -slow-delay late")
+	flag.Var(&f.SlowDelay, "slow-delay", "extra delay of the slow requests")
+	flag.StringVar(&l.Distribution, "latency", l.Distribution, "/load latency distribution: fixed, uniform, normal or pareto")
+	flag.Var(&l.Delay, "delay", "fixed latency, or the mean of normal")
+	flag.Var(&l.Min, "min-delay", "lower bound of uniform, scale of pareto")
+	flag.Var(&l.Max, "max-delay", "upper bound of uniform, cap of normal and pareto (0: none)")
+	flag.Var(&l.StdDev, "stddev", "standard deviation of normal")
+	flag.Float64Var(&l.Shape, "shape", l.Shape, "shape of pareto; lower has a heavier tail")
+	flag.StringVar(&cfg.Token, "token", "", "require this token in the Authorization header of /load")
+	flag.BoolVar(&cfg.Validate, "validate", false, "check batches against the JSON schema and require a Content-Type")
+	flag.StringVar(&cfg.Schema, "schema", "", "JSON schema file for -validate (default: built-in batch schema)")
+	flag.StringVar(&cfg.Record.Store, "record", "", "keep accepted batches for GET /received: ndjson or sqlite")
+	flag.StringVar(&cfg.Record.File, "record-file", "", "file of -record (default received.ndjson or received.db)")
+	flag.Float64Var(&cfg.RateLimit.Rate, "rate-limit", 0, "/load requests per second allowed per token, 0 for no limit")
+	flag.IntVar(&cfg.RateLimit.Burst, "burst", 0, "requests a token may send at once (default: -rate-limit rounded up)")
+	flag.Var(&cfg.IdempotencyTTL, "idempotency-ttl", "how long Idempotency-Key headers of accepted batches are remembered, 0 to ignore them")
+	flag.Parse()
+	if *configFile != "" {
+		if err := loadConfig(*configFile, &cfg); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		log.Fatal(err)
+	}
+	setFaults(cfg.Faults)
+	setLatency(cfg.Latency)
+	setRateLimit(cfg.RateLimit)
+	setIdempotencyTTL(time.Duration(cfg.IdempotencyTTL))
+	loadToken = cfg.Token
+	if cfg.Validate {
+		var err error
+		if batchSchema, err = loadSchema(cfg.Schema); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := openRecorder(cfg.Record); err != nil {
+		log.Fatal(err)
+	}
+
 	// Setup logging to file
 	logFile, err := os.OpenFile("mock_server.log", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
 	if err != nil {
@@ -25,19 +81,40 @@ func main() {
 
 		switch {
 		case path == "/load" && method == fasthttp.MethodPost:
+			start := time.Now()
 			handleLoad(ctx)
+			observeLoad(ctx, start)
 		case path == "/health" && method == fasthttp.MethodGet:
 			handleHealth(ctx)
+		case path == "/admin/faults" && (method == fasthttp.MethodGet || method == fasthttp.MethodPut):
+			handleFaults(ctx)
+		case path == "/admin/latency" && (method == fasthttp.MethodGet || method == fasthttp.MethodPut):
+			handleLatency(ctx)
+		case path == "/admin/ratelimit" && (method == fasthttp.MethodGet || method == fasthttp.MethodPut):
+			handleRateLimit(ctx)
+		case path == "/received" && (method == fasthttp.MethodGet || method == fasthttp.MethodDelete):
+			handleReceived(ctx)
+		case path == "/stats" && (method == fasthttp.MethodGet || method == fasthttp.MethodDelete):
+			handleStats(ctx)
 		default:
 			ctx.Error("Unsupported path", fasthttp.StatusNotFound)
 		}
 	}
 
-	fmt.Println("Mock API server started at http://localhost:8080")
-	log.Println("Mock API server started at http://localhost:8080")
+	if *grpcAddr != "" {
+		go func() {
+			if err := serveGRPC(*grpcAddr); err != nil {
+				log.Fatalf("Error starting gRPC server: %v", err)
+			}
+		}()
+		log.Printf("gRPC Load service listening at %s", *grpcAddr)
+	}
+
+	fmt.Printf("Mock API server started at %s\n", *addr)
+	log.Printf("Mock API server started at %s, latency %s, faults %+v", *addr, cfg.Latency, cfg.Faults)
 
 	// Start server
-	if err := fasthttp.ListenAndServe(":8080", requestHandler); err != nil {
+	if err := fasthttp.ListenAndServe(*addr, requestHandler); err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
 }
@@ -48,16 +125,127 @@ func handleHealth(ctx *fasthttp.RequestCtx) {
 	ctx.SetBody([]byte(`{"status":"ok"}`))
 }
 
+var (
+	loadToken   string  // required bearer token, "" for none
+	batchSchema *schema // nil unless -validate
+)
+
+// loadError is the body of the 4xx and 5xx answers of /load, which the
+// ETL reports in its dead-letter and spill records.
+type loadError struct {
+	Error   string   `json:"error"` // machine-readable code, e.g. invalid_batch
+	Message string   `json:"message"`
+	Details []string `json:"details,omitempty"`
+}
+
+func jsonError(ctx *fasthttp.RequestCtx, status int, code, message string, details ...string) {
+	body, _ := json.Marshal(loadError{Error: code, Message: message, Details: details})
+	ctx.Response.Reset()
+	ctx.SetStatusCode(status)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(body)
+}
+
+// authorized reports whether the request carries loadToken, alone or as a
+// bearer token.
+func authorized(ctx *fasthttp.RequestCtx) bool {
+	if loadToken == "" {
+		return true
+	}
+	got := string(ctx.Request.Header.Peek(fasthttp.HeaderAuthorization))
+	return subtle.ConstantTimeCompare([]byte(got), []byte(loadToken)) == 1 ||
+		subtle.ConstantTimeCompare([]byte(got), []byte("Bearer "+loadToken)) == 1
+}
+
 func handleLoad(ctx *fasthttp.RequestCtx) {
-	body := ctx.PostBody()
-	bodySize := len(body)
+	if injectFault(ctx) {
+		return
+	}
+	if !authorized(ctx) {
+		log.Printf("Rejected POST /load from %s: missing or wrong Authorization", ctx.RemoteAddr())
+		jsonError(ctx, fasthttp.StatusUnauthorized, "unauthorized", "missing or invalid Authorization header")
+		ctx.Response.Header.Set(fasthttp.HeaderWWWAuthenticate, `Bearer realm="load"`)
+		return
+	}
+	if rateLimited(ctx) {
+		return
+	}
+	if duplicateBatch(ctx) {
+		return
+	}
+	bodySize := len(ctx.PostBody())
+	encoding := string(ctx.Request.Header.ContentEncoding())
+
+	// Decompress gzip, deflate, br or zstd bodies per Content-Encoding
+	body, err := ctx.Request.BodyUncompressed()
+	if err != nil {
+		log.Printf("Rejected POST /load with Content-Encoding %q: %v", encoding, err)
+		jsonError(ctx, fasthttp.StatusUnsupportedMediaType, "unsupported_encoding", fmt.Sprintf("cannot decode %q body: %v", encoding, err))
+		return
+	}
+
+	if encoding != "" {
+		log.Printf("Received POST /load with size %d bytes (%s, %d bytes decompressed)", bodySize, encoding, len(body))
+	} else {
+		log.Printf("Received POST /load with size %d bytes", bodySize)
+	}
 
-	log.Printf("Received POST /load with size %d bytes", bodySize)
+	// Protobuf and msgpack batches are previewed as JSON
+	mediaType, _, _ := mime.ParseMediaType(string(ctx.Request.Header.ContentType()))
+	switch mediaType {
+	case "":
+		if batchSchema != nil {
+			log.Printf("Rejected POST /load without Content-Type")
+			jsonError(ctx, fasthttp.StatusUnsupportedMediaType, "unsupported_media_type", "Content-Type is required")
+			return
+		}
+	case "application/json":
+	case "application/x-protobuf":
+		records, err := decodeBatchProto(body)
+		if err != nil {
+			log.Printf("Rejected protobuf POST /load: %v", err)
+			jsonError(ctx, fasthttp.StatusBadRequest, "malformed_body", fmt.Sprintf("cannot decode protobuf body: %v", err))
+			return
+		}
+		log.Printf("Decoded %d protobuf records", len(records))
+		body, _ = json.Marshal(records)
+	case "application/msgpack", "application/x-msgpack":
+		var buf bytes.Buffer
+		if _, err := msgp.UnmarshalAsJSON(&buf, body); err != nil {
+			log.Printf("Rejected msgpack POST /load: %v", err)
+			jsonError(ctx, fasthttp.StatusBadRequest, "malformed_body", fmt.Sprintf("cannot decode msgpack body: %v", err))
+			return
+		}
+		body = buf.Bytes()
+	default:
+		log.Printf("Rejected POST /load with Content-Type %q", mediaType)
+		jsonError(ctx, fasthttp.StatusUnsupportedMediaType, "unsupported_media_type", fmt.Sprintf("unsupported Content-Type %q", mediaType))
+		return
+	}
+	if batchSchema != nil {
+		if problems := batchSchema.validateBatch(body); len(problems) > 0 {
+			log.Printf("Rejected invalid batch: %s", strings.Join(problems, "; "))
+			jsonError(ctx, fasthttp.StatusBadRequest, "invalid_batch", "batch does not match the schema", problems...)
+			return
+		}
+	}
 	log.Printf("Body Preview: %s", previewBody(body, 500))
 
-	// Optional: Simulate processing delay
-	time.Sleep(2 * time.Second)
+	// Simulate processing delay
+	time.Sleep(currentLatency().sample())
 
+	// A body that isn't a JSON array is one record.
+	var items []json.RawMessage
+	if err := json.Unmarshal(body, &items); err != nil {
+		items = []json.RawMessage{body}
+	}
+	if err := recordBatch(items, mediaType); err != nil {
+		log.Printf("Cannot record batch: %v", err)
+		jsonError(ctx, fasthttp.StatusInternalServerError, "record_failed", err.Error())
+		return
+	}
+	rememberBatch(ctx)
+	countRecords(len(items))
 	ctx.SetContentType("application/json")
 	ctx.SetStatusCode(fasthttp.StatusOK)
 	ctx.SetBody([]byte(`{"status":"success"}`))
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Indicator and DeviceData mirror the messages in proto/device_data.proto.
+type Indicator struct {
+	Name  string  `json:"name"`
+	Value float64 `json:"value"`
+}
+
+type DeviceData struct {
+	Name       string            `json:"name"`
+	CPUNumber  string            `json:"cpu_number"`
+	Timestamp  uint64            `json:"timestamp"`
+	Indicators []Indicator       `json:"indicators"`
+	Metric     string            `json:"metric,omitempty"`
+	Device     string            `json:"device,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+// decodeBatchProto decodes a DeviceDataBatch. Unknown fields are skipped.
+func decodeBatchProto(b []byte) ([]DeviceData, error) {
+	var records []DeviceData
+	err := walkProto(b, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		if num != 1 || typ != protowire.BytesType {
+			return nil
+		}
+		d, err := decodeDeviceData(v)
+		if err != nil {
+			return err
+		}
+		records = append(records, d)
+		return nil
+	})
+	return records, err
+}
+
+func decodeDeviceData(b []byte) (DeviceData, error) {
+	var d DeviceData
+	err := walkProto(b, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			d.Name = string(v)
+		case num == 2 && typ == protowire.BytesType:
+			d.CPUNumber = string(v)
+		case num == 3 && typ == protowire.VarintType:
+			d.Timestamp = n
+		case num == 4 && typ == protowire.BytesType:
+			var ind Indicator
+			err := walkProto(v, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+				switch {
+				case num == 1 && typ == protowire.BytesType:
+					ind.Name = string(v)
+				case num == 2 && typ == protowire.Fixed64Type:
+					ind.Value = math.Float64frombits(n)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			d.Indicators = append(d.Indicators, ind)
+		case num == 5 && typ == protowire.BytesType:
+			d.Metric = string(v)
+		case num == 6 && typ == protowire.BytesType:
+			d.Device = string(v)
+		case num == 7 && typ == protowire.BytesType:
+			var key, value string
+			err := walkProto(v, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+				switch {
+				case num == 1 && typ == protowire.BytesType:
+					key = string(v)
+				case num == 2 && typ == protowire.BytesType:
+					value = string(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if d.Labels == nil {
+				d.Labels = map[string]string{}
+			}
+			d.Labels[key] = value
+		}
+		return nil
+	})
+	return d, err
+}
+
+// walkProto calls fn for every field of a message, with the bytes of
+// length-delimited fields or the number of varint and fixed-size fields.
+func walkProto(b []byte, fn func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var v []byte
+		var x uint64
+		switch typ {
+		case protowire.BytesType:
+			v, n = protowire.ConsumeBytes(b)
+		case protowire.VarintType:
+			x, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			x, n = protowire.ConsumeFixed64(b)
+		case protowire.Fixed32Type:
+			var x32 uint32
+			x32, n = protowire.ConsumeFixed32(b)
+			x = uint64(x32)
+		default:
+			return errors.New("unsupported wire type")
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if err := fn(num, typ, v, x); err != nil {
+			return err
+		}
+	}
+	return nil
+}
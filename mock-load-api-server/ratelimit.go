@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// RateLimit caps POST /load per token, the Authorization header without
+// "Bearer ". Each token has a bucket of Burst requests refilled at Rate
+// per second; requests past it are answered 429 with the Retry-After of
+// the next free slot. Requests without a token share one bucket.
+type RateLimit struct {
+	Rate     float64            `json:"rate"`      // requests per second per token, 0 for no limit
+	Burst    int                `json:"burst"`     // default the rate rounded up
+	PerToken map[string]float64 `json:"per_token"` // rates of particular tokens
+}
+
+func (r RateLimit) validate() error {
+	if r.Rate < 0 || r.Burst < 0 {
+		return errors.New("rate limit rate and burst must be >= 0")
+	}
+	for token, rate := range r.PerToken {
+		if rate < 0 {
+			return fmt.Errorf("rate limit of token %q must be >= 0", token)
+		}
+	}
+	return nil
+}
+
+// limit is the rate and burst of a token; rate 0 means unlimited.
+func (r RateLimit) limit(token string) (rate, burst float64) {
+	rate = r.Rate
+	if perToken, ok := r.PerToken[token]; ok {
+		rate = perToken
+	}
+	burst = float64(r.Burst)
+	if burst == 0 {
+		burst = max(math.Ceil(rate), 1)
+	}
+	return rate, burst
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimit holds the current RateLimit and the buckets of the tokens
+// seen; /admin/ratelimit changes it at runtime, refilling every bucket.
+var rateLimit struct {
+	sync.Mutex
+	r       RateLimit
+	buckets map[string]*tokenBucket
+}
+
+func currentRateLimit() RateLimit {
+	rateLimit.Lock()
+	defer rateLimit.Unlock()
+	return rateLimit.r
+}
+
+func setRateLimit(r RateLimit) {
+	rateLimit.Lock()
+	defer rateLimit.Unlock()
+	rateLimit.r = r
+	rateLimit.buckets = map[string]*tokenBucket{}
+}
+
+// takeToken spends one request of token's bucket. If it is empty, it
+// returns false and how long until a request would be let through.
+func takeToken(token string) (bool, time.Duration) {
+	rateLimit.Lock()
+	defer rateLimit.Unlock()
+	rate, burst := rateLimit.r.limit(token)
+	if rate == 0 {
+		return true, 0
+	}
+	now := time.Now()
+	b, ok := rateLimit.buckets[token]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		rateLimit.buckets[token] = b
+	}
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// rateLimited answers 429 if the request's token is over its limit. It
+// returns true if so and the request must not be handled further.
+func rateLimited(ctx *fasthttp.RequestCtx) bool {
+	token := strings.TrimPrefix(string(ctx.Request.Header.Peek(fasthttp.HeaderAuthorization)), "Bearer ")
+	ok, wait := takeToken(token)
+	if ok {
+		return false
+	}
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	rate, _ := currentRateLimit().limit(token)
+	log.Printf("Rate limited POST /load from %s, Retry-After %d", ctx.RemoteAddr(), retryAfter)
+	jsonError(ctx, fasthttp.StatusTooManyRequests, "rate_limited", fmt.Sprintf("rate limit of %g requests/s exceeded", rate))
+	ctx.Response.Header.Set("Retry-After", strconv.Itoa(retryAfter))
+	return true
+}
+
+// handleRateLimit serves GET /admin/ratelimit, the current limit, and PUT
+// /admin/ratelimit, which changes the fields in the body and leaves the rest.
+func handleRateLimit(ctx *fasthttp.RequestCtx) {
+	r := currentRateLimit()
+	if ctx.IsPut() {
+		if err := json.Unmarshal(ctx.PostBody(), &r); err != nil {
+			ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+			return
+		}
+		if err := r.validate(); err != nil {
+			ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+			return
+		}
+		setRateLimit(r)
+		log.Printf("Rate limit changed: %+v", r)
+	}
+	body, _ := json.Marshal(r)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(body)
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	_ "modernc.org/sqlite"
+)
+
+// Record is where accepted batches are kept for GET /received, so
+// end-to-end tests can assert exactly what the ETL delivered.
+type Record struct {
+	Store string `json:"store"` // "" (off), ndjson or sqlite
+	File  string `json:"file"`  // default received.ndjson or received.db
+}
+
+func (r Record) validate() error {
+	switch r.Store {
+	case "", "ndjson", "sqlite":
+		return nil
+	default:
+		return fmt.Errorf("record store must be ndjson or sqlite, got %q", r.Store)
+	}
+}
+
+// receivedRecord is one record of an accepted batch.
+type receivedRecord struct {
+	Batch       int64           `json:"batch"` // sequence number of the batch, from 1
+	ReceivedAt  time.Time       `json:"received_at"`
+	Host        string          `json:"host"` // the record's name
+	ContentType string          `json:"content_type"`
+	Record      json.RawMessage `json:"record"`
+}
+
+// receivedQuery filters GET /received; zero fields match everything.
+type receivedQuery struct {
+	Host  string
+	Batch int64
+	Since time.Time
+}
+
+func (q receivedQuery) match(r *receivedRecord) bool {
+	return (q.Host == "" || r.Host == q.Host) && (q.Batch == 0 || r.Batch == q.Batch) &&
+		(q.Since.IsZero() || !r.ReceivedAt.Before(q.Since))
+}
+
+// recorder persists accepted batches. Records are appended in the order
+// they arrived and kept across restarts until DELETE /received.
+type recorder interface {
+	record(records []receivedRecord) error
+	query(q receivedQuery) ([]receivedRecord, error)
+	reset() error
+	// lastBatch is the highest batch number stored, 0 if none.
+	lastBatch() (int64, error)
+}
+
+// received is the recorder of -record, nil when recording is off.
+var received struct {
+	sync.Mutex
+	r     recorder
+	batch int64 // last batch number handed out
+}
+
+func openRecorder(r Record) error {
+	var (
+		rec recorder
+		err error
+	)
+	switch r.Store {
+	case "":
+		return nil
+	case "ndjson":
+		rec = &ndjsonRecorder{path: orDefault(r.File, "received.ndjson")}
+	case "sqlite":
+		rec, err = openSQLiteRecorder(orDefault(r.File, "received.db"))
+	}
+	if err != nil {
+		return err
+	}
+	last, err := rec.lastBatch()
+	if err != nil {
+		return err
+	}
+	received.r, received.batch = rec, last
+	return nil
+}
+
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+// recordBatch stores the records of an accepted batch.
+func recordBatch(items []json.RawMessage, contentType string) error {
+	received.Lock()
+	defer received.Unlock()
+	if received.r == nil {
+		return nil
+	}
+	received.batch++
+	now := time.Now().UTC()
+	records := make([]receivedRecord, len(items))
+	for i, item := range items {
+		var named struct {
+			Name string `json:"name"`
+		}
+		json.Unmarshal(item, &named)
+		records[i] = receivedRecord{Batch: received.batch, ReceivedAt: now, Host: named.Name,
+			ContentType: contentType, Record: item}
+	}
+	return received.r.record(records)
+}
+
+// handleReceived serves GET /received, the recorded records filtered by
+// ?host=, ?batch= and ?since= (RFC 3339), and DELETE /received, which
+// forgets them all.
+func handleReceived(ctx *fasthttp.RequestCtx) {
+	received.Lock()
+	defer received.Unlock()
+	if received.r == nil {
+		jsonError(ctx, fasthttp.StatusNotFound, "not_recording", "start the server with -record to keep received batches")
+		return
+	}
+	if ctx.IsDelete() {
+		if err := received.r.reset(); err != nil {
+			jsonError(ctx, fasthttp.StatusInternalServerError, "record_failed", err.Error())
+			return
+		}
+		received.batch = 0
+		log.Printf("Received records cleared")
+		ctx.SetStatusCode(fasthttp.StatusNoContent)
+		return
+	}
+
+	args := ctx.QueryArgs()
+	q := receivedQuery{Host: string(args.Peek("host"))}
+	if b := args.Peek("batch"); len(b) > 0 {
+		n, err := strconv.ParseInt(string(b), 10, 64)
+		if err != nil {
+			jsonError(ctx, fasthttp.StatusBadRequest, "bad_query", "batch must be a number")
+			return
+		}
+		q.Batch = n
+	}
+	if s := args.Peek("since"); len(s) > 0 {
+		t, err := time.Parse(time.RFC3339Nano, string(s))
+		if err != nil {
+			jsonError(ctx, fasthttp.StatusBadRequest, "bad_query", "since must be an RFC 3339 time")
+			return
+		}
+		q.Since = t
+	}
+	records, err := received.r.query(q)
+	if err != nil {
+		jsonError(ctx, fasthttp.StatusInternalServerError, "record_failed", err.Error())
+		return
+	}
+	if records == nil {
+		records = []receivedRecord{}
+	}
+	body, _ := json.Marshal(struct {
+		Count   int              `json:"count"`
+		Records []receivedRecord `json:"records"`
+	}{len(records), records})
+	ctx.SetContentType("application/json")
+	ctx.SetBody(body)
+}
+
+//////////////////////////////////////////////////
+// NDJSON
+//////////////////////////////////////////////////
+
+// ndjsonRecorder appends one JSON line per record to a file. Queries scan
+// the whole file, which is fine at test sizes.
+type ndjsonRecorder struct {
+	path string
+}
+
+func (n *ndjsonRecorder) record(records []receivedRecord) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i := range records {
+		if err := enc.Encode(&records[i]); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(n.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (n *ndjsonRecorder) scan(fn func(r *receivedRecord)) error {
+	f, err := os.Open(n.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 64<<20)
+	for line := 1; sc.Scan(); line++ {
+		var r receivedRecord
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			return fmt.Errorf("%s:%d: %w", n.path, line, err)
+		}
+		fn(&r)
+	}
+	return sc.Err()
+}
+
+func (n *ndjsonRecorder) query(q receivedQuery) ([]receivedRecord, error) {
+	var out []receivedRecord
+	err := n.scan(func(r *receivedRecord) {
+		if q.match(r) {
+			out = append(out, *r)
+		}
+	})
+	return out, err
+}
+
+func (n *ndjsonRecorder) lastBatch() (int64, error) {
+	var last int64
+	err := n.scan(func(r *receivedRecord) { last = max(last, r.Batch) })
+	return last, err
+}
+
+func (n *ndjsonRecorder) reset() error {
+	err := os.Remove(n.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+//////////////////////////////////////////////////
+// SQLite
+//////////////////////////////////////////////////
+
+// sqliteTimeFormat is fixed-width so stored timestamps compare as text.
+const sqliteTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+const sqliteReceivedSchema = `
+CREATE TABLE IF NOT EXISTS received (
+	id           INTEGER PRIMARY KEY AUTOINCREMENT,
+	batch        INTEGER NOT NULL,
+	received_at  TEXT    NOT NULL,
+	host         TEXT    NOT NULL,
+	content_type TEXT    NOT NULL,
+	record       TEXT    NOT NULL
+);
+CREATE INDEX IF NOT EXISTS received_host ON received (host);
+`
+
+// sqliteRecorder keeps one row per record, so what was received can also
+// be checked with plain SQL.
+type sqliteRecorder struct {
+	db *sql.DB
+}
+
+func openSQLiteRecorder(path string) (*sqliteRecorder, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteReceivedSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("record database %s: %w", path, err)
+	}
+	return &sqliteRecorder{db: db}, nil
+}
+
+func (s *sqliteRecorder) record(records []receivedRecord) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, r := range records {
+		if _, err := tx.Exec(`INSERT INTO received (batch, received_at, host, content_type, record) VALUES (?, ?, ?, ?, ?)`,
+			r.Batch, r.ReceivedAt.Format(sqliteTimeFormat), r.Host, r.ContentType, string(r.Record)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteRecorder) query(q receivedQuery) ([]receivedRecord, error) {
+	query := `SELECT batch, received_at, host, content_type, record FROM received WHERE 1=1`
+	var args []any
+	if q.Host != "" {
+		query += ` AND host = ?`
+		args = append(args, q.Host)
+	}
+	if q.Batch != 0 {
+		query += ` AND batch = ?`
+		args = append(args, q.Batch)
+	}
+	if !q.Since.IsZero() {
+		query += ` AND received_at >= ?`
+		args = append(args, q.Since.UTC().Format(sqliteTimeFormat))
+	}
+	rows, err := s.db.Query(query+` ORDER BY id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []receivedRecord
+	for rows.Next() {
+		var (
+			r          receivedRecord
+			receivedAt string
+			record     string
+		)
+		if err := rows.Scan(&r.Batch, &receivedAt, &r.Host, &r.ContentType, &record); err != nil {
+			return nil, err
+		}
+		r.ReceivedAt, _ = time.Parse(sqliteTimeFormat, receivedAt)
+		r.Record = json.RawMessage(record)
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqliteRecorder) lastBatch() (int64, error) {
+	var last sql.NullInt64
+	err := s.db.QueryRow(`SELECT MAX(batch) FROM received`).Scan(&last)
+	return last.Int64, err
+}
+
+func (s *sqliteRecorder) reset() error {
+	_, err := s.db.Exec(`DELETE FROM received`)
+	return err
+}
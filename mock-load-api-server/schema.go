@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// batchSchemaJSON is the schema batches are checked against with -validate,
+// unless -schema names another.
+//
+//go:embed batch.schema.json
+var batchSchemaJSON []byte
+
+// schema is the subset of JSON Schema the server checks batches with:
+// type, enum, required, properties, additionalProperties, items, minItems,
+// maxItems, minLength, minimum and maximum. Other keywords are ignored.
+type schema struct {
+	Type                 schemaTypes        `json:"type"`
+	Enum                 []any              `json:"enum"`
+	Required             []string           `json:"required"`
+	Properties           map[string]*schema `json:"properties"`
+	AdditionalProperties *additionalSchema  `json:"additionalProperties"`
+	Items                *schema            `json:"items"`
+	MinItems             *int               `json:"minItems"`
+	MaxItems             *int               `json:"maxItems"`
+	MinLength            *int               `json:"minLength"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+}
+
+// schemaTypes is "type", a single type name or a list of them.
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*t = schemaTypes{one}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(t))
+}
+
+// additionalSchema is "additionalProperties": false, or a schema the
+// properties not under "properties" must match.
+type additionalSchema struct {
+	forbidden bool
+	schema    *schema
+}
+
+func (a *additionalSchema) UnmarshalJSON(b []byte) error {
+	var allowed bool
+	if err := json.Unmarshal(b, &allowed); err == nil {
+		a.forbidden = !allowed
+		return nil
+	}
+	return json.Unmarshal(b, &a.schema)
+}
+
+// loadSchema reads the schema at path, or the built-in one if path is "".
+func loadSchema(path string) (*schema, error) {
+	raw := batchSchemaJSON
+	if path != "" {
+		var err error
+		if raw, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	var s schema
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, fmt.Errorf("schema %s: %w", path, err)
+	}
+	return &s, nil
+}
+
+// maxSchemaErrors bounds the details of a 400, so a batch of a thousand
+// bad records doesn't make a megabyte error.
+const maxSchemaErrors = 20
+
+// validateBatch checks a JSON body against s and returns what is wrong,
+// each problem prefixed with the JSON pointer of the value.
+func (s *schema) validateBatch(body []byte) []string {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return []string{"body is not JSON: " + err.Error()}
+	}
+	var errs []string
+	s.validate(v, "", &errs)
+	if len(errs) > maxSchemaErrors {
+		errs = append(errs[:maxSchemaErrors], fmt.Sprintf("... and %d more", len(errs)-maxSchemaErrors))
+	}
+	return errs
+}
+
+func (s *schema) validate(v any, ptr string, errs *[]string) {
+	fail := func(format string, args ...any) {
+		at := ptr
+		if at == "" {
+			at = "/"
+		}
+		*errs = append(*errs, at+": "+fmt.Sprintf(format, args...))
+	}
+
+	if len(s.Type) > 0 && !s.Type.match(v) {
+		fail("want %s, got %s", strings.Join(s.Type, " or "), jsonType(v))
+		return
+	}
+	if len(s.Enum) > 0 && !enumContains(s.Enum, v) {
+		fail("%v is not one of %v", v, s.Enum)
+	}
+
+	switch v := v.(type) {
+	case string:
+		if s.MinLength != nil && utf8.RuneCountInString(v) < *s.MinLength {
+			fail("shorter than %d characters", *s.MinLength)
+		}
+	case json.Number:
+		f, _ := v.Float64()
+		if s.Minimum != nil && f < *s.Minimum {
+			fail("%v is below the minimum %v", v, *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			fail("%v is above the maximum %v", v, *s.Maximum)
+		}
+	case []any:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			fail("want at least %d items, got %d", *s.MinItems, len(v))
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			fail("want at most %d items, got %d", *s.MaxItems, len(v))
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.validate(item, fmt.Sprintf("%s/%d", ptr, i), errs)
+			}
+		}
+	case map[string]any:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				fail("missing required property %q", name)
+			}
+		}
+		for _, name := range slices.Sorted(maps.Keys(v)) {
+			value := v[name]
+			child := ptr + "/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+			if ps, ok := s.Properties[name]; ok {
+				ps.validate(value, child, errs)
+				continue
+			}
+			switch a := s.AdditionalProperties; {
+			case a == nil:
+			case a.forbidden:
+				fail("unexpected property %q", name)
+			case a.schema != nil:
+				a.schema.validate(value, child, errs)
+			}
+		}
+	}
+}
+
+func (t schemaTypes) match(v any) bool {
+	got := jsonType(v)
+	for _, want := range t {
+		if want == got || want == "number" && got == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonType is the JSON Schema type of a value decoded with UseNumber.
+func jsonType(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if f, err := v.Float64(); err == nil && f == math.Trunc(f) {
+			return "integer"
+		}
+		return "number"
+	case []any:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func enumContains(enum []any, v any) bool {
+	if n, ok := v.(json.Number); ok {
+		f, _ := n.Float64()
+		v = f
+	}
+	for _, e := range enum {
+		if reflect.DeepEqual(e, v) {
+			return true
+		}
+	}
+	return false
+}
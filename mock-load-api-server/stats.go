@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// latencyWindow is how many of the latest /load requests the percentiles
+// of /stats are computed over.
+const latencyWindow = 10000
+
+// connResetKey marks a request whose connection injectFault reset, so it
+// is counted as such rather than by its unsent status.
+const connResetKey = "conn_reset"
+
+// stats are the counters of POST /load served by GET /stats.
+var stats = struct {
+	sync.Mutex
+	since     time.Time
+	requests  int64
+	bytes     int64 // request bodies as received, before decompression
+	records   int64 // records of accepted batches
+	dups      int64 // requests answered from their Idempotency-Key
+	responses map[string]int64
+	latencies []time.Duration // ring of the last latencyWindow
+	next      int
+}{since: time.Now(), responses: map[string]int64{}}
+
+// observeLoad counts a /load request handled since start.
+func observeLoad(ctx *fasthttp.RequestCtx, start time.Time) {
+	status := strconv.Itoa(ctx.Response.StatusCode())
+	if ctx.UserValue(connResetKey) != nil {
+		status = "reset"
+	}
+	observe(status, len(ctx.PostBody()), time.Since(start))
+}
+
+// observe counts a request of size bytes, answered with status after took.
+func observe(status string, size int, took time.Duration) {
+	stats.Lock()
+	defer stats.Unlock()
+	stats.requests++
+	stats.bytes += int64(size)
+	stats.responses[status]++
+	if len(stats.latencies) < latencyWindow {
+		stats.latencies = append(stats.latencies, took)
+	} else {
+		stats.latencies[stats.next] = took
+		stats.next = (stats.next + 1) % latencyWindow
+	}
+}
+
+func countDuplicate() {
+	stats.Lock()
+	defer stats.Unlock()
+	stats.dups++
+}
+
+func countRecords(n int) {
+	stats.Lock()
+	defer stats.Unlock()
+	stats.records += int64(n)
+}
+
+// statsReport is the body of GET /stats.
+type statsReport struct {
+	Since         time.Time        `json:"since"`
+	Requests      int64            `json:"requests"`
+	RequestsPerS  float64          `json:"requests_per_second"`
+	BytesReceived int64            `json:"bytes_received"`
+	Records       int64            `json:"records"`
+	Duplicates    int64            `json:"duplicates"` // already accepted under their Idempotency-Key
+	Responses     map[string]int64 `json:"responses"`  // by status code, "reset", or gRPC code name
+	LatencyMS     struct {
+		P50 float64 `json:"p50"`
+		P95 float64 `json:"p95"`
+		P99 float64 `json:"p99"`
+		Max float64 `json:"max"`
+	} `json:"latency_ms"` // over the last latencyWindow requests
+}
+
+// handleStats serves GET /stats, the counters since start or the last
+// DELETE /stats, which zeroes them.
+func handleStats(ctx *fasthttp.RequestCtx) {
+	stats.Lock()
+	defer stats.Unlock()
+	if ctx.IsDelete() {
+		stats.since = time.Now()
+		stats.requests, stats.bytes, stats.records, stats.dups = 0, 0, 0, 0
+		stats.responses = map[string]int64{}
+		stats.latencies, stats.next = stats.latencies[:0], 0
+		log.Printf("Stats reset")
+		ctx.SetStatusCode(fasthttp.StatusNoContent)
+		return
+	}
+
+	r := statsReport{
+		Since:         stats.since.UTC(),
+		Requests:      stats.requests,
+		BytesReceived: stats.bytes,
+		Records:       stats.records,
+		Duplicates:    stats.dups,
+		Responses:     stats.responses,
+	}
+	if elapsed := time.Since(stats.since).Seconds(); elapsed > 0 {
+		r.RequestsPerS = float64(stats.requests) / elapsed
+	}
+	if len(stats.latencies) > 0 {
+		sorted := slices.Sorted(slices.Values(stats.latencies))
+		ms := func(q float64) float64 {
+			return float64(sorted[int(q*float64(len(sorted)-1))]) / float64(time.Millisecond)
+		}
+		r.LatencyMS.P50, r.LatencyMS.P95, r.LatencyMS.P99, r.LatencyMS.Max = ms(0.5), ms(0.95), ms(0.99), ms(1)
+	}
+	body, _ := json.Marshal(r)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(body)
+}